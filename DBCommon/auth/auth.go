@@ -0,0 +1,281 @@
+// Package auth is the client authentication shared by the nodes and the controller. The controller issues
+// API tokens, each with the scopes it grants (read, write, admin) and optionally the namespaces and key
+// prefixes it is limited to, and ships them to the nodes. Requests carry a token either as a bearer
+// credential or as the token id along with an HMAC of the request made with the token's secret
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SCOPE_READ = "read"
+const SCOPE_WRITE = "write"
+const SCOPE_ADMIN = "admin" // implies the other scopes, and isn't limited by namespaces or prefixes
+
+const DEFAULT_NAMESPACE_NAME = "default" // how tokens refer to the default namespace
+const BEARER_SCHEME = "Bearer"
+const HMAC_SCHEME = "DB-HMAC-SHA256"
+const HMAC_MAX_SKEW = 5 * time.Minute // signed requests older (or newer) than this are rejected
+const HMAC_NONCE_BYTES = 16
+const HMAC_MAX_NONCE_LENGTH = 64
+const HMAC_MAX_NONCES = 1 << 18 // signed requests remembered to reject replays, see nonceCache
+const TOKEN_ID_BYTES = 8
+const TOKEN_SECRET_BYTES = 24
+const REALM = "go-distributed-db"
+
+type Token struct {
+	ID         string
+	Secret     string   `json:",omitempty"` // left out when tokens are listed
+	Scopes     []string // read, write or admin
+	Namespaces []string `json:",omitempty"` // namespaces the token may use, all if empty
+	Prefixes   []string `json:",omitempty"` // key prefixes the token may use, all if empty
+	CreatedAt  time.Time
+}
+
+// what the controller serves the nodes on /internal/auth
+type Config struct {
+	Enabled bool
+	Tokens  []Token
+}
+
+var ErrNoCredentials = errors.New("no credentials given")
+var ErrInvalidCredentials = errors.New("invalid credentials")
+var ErrExpiredSignature = errors.New("request signature is too old")
+var ErrReplayedSignature = errors.New("request signature was already used")
+
+func IsValidScope(scope string) bool {
+	return scope == SCOPE_READ || scope == SCOPE_WRITE || scope == SCOPE_ADMIN
+}
+
+// splits a comma separated list, dropping empty items
+func ParseList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func ParseScopes(value string) ([]string, error) {
+	scopes := ParseList(value)
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is needed")
+	}
+	for _, scope := range scopes {
+		if !IsValidScope(scope) {
+			return nil, fmt.Errorf("unknown scope '%s', should be %s, %s or %s", scope, SCOPE_READ, SCOPE_WRITE, SCOPE_ADMIN)
+		}
+	}
+	return scopes, nil
+}
+
+// a token with a random id and secret
+func NewToken(scopes []string, namespaces []string, prefixes []string) (Token, error) {
+	id := make([]byte, TOKEN_ID_BYTES)
+	secret := make([]byte, TOKEN_SECRET_BYTES)
+	if _, err := rand.Read(id); err != nil {
+		return Token{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return Token{}, err
+	}
+
+	return Token{
+		ID:         hex.EncodeToString(id),
+		Secret:     hex.EncodeToString(secret),
+		Scopes:     scopes,
+		Namespaces: namespaces,
+		Prefixes:   prefixes,
+		CreatedAt:  time.Now().UTC(),
+	}, nil
+}
+
+// the bearer credential of the token, <id>.<secret>
+func (token *Token) Credential() string {
+	return token.ID + "." + token.Secret
+}
+
+// the token without its secret
+func (token Token) Redacted() Token {
+	token.Secret = ""
+	return token
+}
+
+func (token *Token) HasScope(scope string) bool {
+	for _, granted := range token.Scopes {
+		if granted == scope || granted == SCOPE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+// namespace is the name the nodes use, empty for the default namespace
+func (token *Token) AllowsNamespace(namespace string) bool {
+	if len(token.Namespaces) == 0 || token.HasScope(SCOPE_ADMIN) {
+		return true
+	}
+
+	if len(namespace) == 0 {
+		namespace = DEFAULT_NAMESPACE_NAME
+	}
+	for _, allowed := range token.Namespaces {
+		if allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func (token *Token) AllowsKey(key string) bool {
+	if len(token.Prefixes) == 0 || token.HasScope(SCOPE_ADMIN) {
+		return true
+	}
+
+	for _, prefix := range token.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (token *Token) Allows(scope string, namespace string, key string) bool {
+	return token.HasScope(scope) && token.AllowsNamespace(namespace) && token.AllowsKey(key)
+}
+
+// checks an <id>.<secret> credential against the token lookup finds for the id
+func CheckCredential(credential string, lookup func(id string) (Token, bool)) (Token, error) {
+	id, secret, found := strings.Cut(credential, ".")
+	if !found {
+		return Token{}, ErrInvalidCredentials
+	}
+
+	token, found := lookup(id)
+	if !found || !hmac.Equal([]byte(secret), []byte(token.Secret)) {
+		return Token{}, ErrInvalidCredentials
+	}
+	return token, nil
+}
+
+// the token a request is authenticated with. signed requests have their body read (up to maxBodySize bytes)
+// to check the signature, it is put back for the handler
+func Authenticate(request *http.Request, lookup func(id string) (Token, bool), maxBodySize int64) (Token, error) {
+	header := request.Header.Get("Authorization")
+	if len(header) == 0 {
+		return Token{}, ErrNoCredentials
+	}
+
+	scheme, credentials, _ := strings.Cut(header, " ")
+	switch {
+	case strings.EqualFold(scheme, BEARER_SCHEME):
+		return CheckCredential(strings.TrimSpace(credentials), lookup)
+	case strings.EqualFold(scheme, HMAC_SCHEME):
+		return CheckSignature(request, credentials, lookup, maxBodySize)
+	default:
+		return Token{}, ErrInvalidCredentials
+	}
+}
+
+// checks an `id=<token id>,ts=<unix seconds>,nonce=<random>,sig=<hex>` credential, see Sign. every nonce is
+// accepted once per token
+func CheckSignature(request *http.Request, credentials string, lookup func(id string) (Token, bool), maxBodySize int64) (Token, error) {
+	params := make(map[string]string)
+	for _, param := range ParseList(credentials) {
+		name, value, _ := strings.Cut(param, "=")
+		params[name] = value
+	}
+
+	timestamp, err := strconv.ParseInt(params["ts"], 10, 64)
+	if err != nil {
+		return Token{}, ErrInvalidCredentials
+	}
+	skew := time.Since(time.Unix(timestamp, 0))
+	if skew > HMAC_MAX_SKEW || skew < -HMAC_MAX_SKEW {
+		return Token{}, ErrExpiredSignature
+	}
+
+	token, found := lookup(params["id"])
+	if !found {
+		return Token{}, ErrInvalidCredentials
+	}
+
+	nonce := params["nonce"]
+	if len(nonce) == 0 || len(nonce) > HMAC_MAX_NONCE_LENGTH {
+		return Token{}, ErrInvalidCredentials
+	}
+
+	body := []byte{}
+	if request.Body != nil {
+		body, err = io.ReadAll(io.LimitReader(request.Body, maxBodySize+1))
+		request.Body.Close()
+		if err != nil {
+			return Token{}, err
+		}
+		if int64(len(body)) > maxBodySize {
+			return Token{}, errors.New("request body is too large to check its signature")
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := Sign(token.Secret, request.Method, request.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(params["sig"]), []byte(expected)) {
+		return Token{}, ErrInvalidCredentials
+	}
+
+	// only requests with a valid signature are remembered, so others can't fill up the cache
+	if err := g_nonces.Add(token.ID, nonce, timestamp, time.Now().Unix()); err != nil {
+		return Token{}, err
+	}
+	return token, nil
+}
+
+// hex HMAC-SHA256 with the token's secret of "<method>\n<request uri>\n<timestamp>\n<nonce>\n<hex sha256 of the body>"
+func Sign(secret string, method string, requestURI string, timestamp int64, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n%s", method, requestURI, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// a random nonce for a signed request
+func NewNonce() (string, error) {
+	nonce := make([]byte, HMAC_NONCE_BYTES)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// the Authorization header of a signed request, for clients written in Go
+func SignatureHeader(token *Token, method string, requestURI string, body []byte) (string, error) {
+	nonce, err := NewNonce()
+	if err != nil {
+		return "", err
+	}
+
+	timestamp := time.Now().Unix()
+	signature := Sign(token.Secret, method, requestURI, timestamp, nonce, body)
+	return fmt.Sprintf("%s id=%s,ts=%d,nonce=%s,sig=%s", HMAC_SCHEME, token.ID, timestamp, nonce, signature), nil
+}
+
+// answers 401 for missing or invalid credentials, with the schemes that are accepted
+func WriteUnauthorized(response http.ResponseWriter, err error) {
+	response.Header().Add("WWW-Authenticate", fmt.Sprintf("%s realm=\"%s\"", BEARER_SCHEME, REALM))
+	response.Header().Add("WWW-Authenticate", fmt.Sprintf("%s realm=\"%s\"", HMAC_SCHEME, REALM))
+	http.Error(response, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+}
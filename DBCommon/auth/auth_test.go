@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const TEST_MAX_BODY_SIZE = 1024
+
+func testToken(t *testing.T, scopes ...string) (Token, func(id string) (Token, bool)) {
+	t.Helper()
+	token, err := NewToken(scopes, nil, nil)
+	if err != nil {
+		t.Fatalf("NewToken() = %v", err)
+	}
+	return token, func(id string) (Token, bool) { return token, id == token.ID }
+}
+
+// a request to target with a signature made at timestamp over signedMethod, signedURI and signedBody, with
+// a nonce of its own
+func signedRequest(token Token, method string, target string, body string, timestamp int64, signedMethod string, signedURI string, signedBody string) *http.Request {
+	nonce, _ := NewNonce()
+	request := httptest.NewRequest(method, target, strings.NewReader(body))
+	signature := Sign(token.Secret, signedMethod, signedURI, timestamp, nonce, []byte(signedBody))
+	request.Header.Set("Authorization", fmt.Sprintf("%s id=%s,ts=%d,nonce=%s,sig=%s", HMAC_SCHEME, token.ID, timestamp, nonce, signature))
+	return request
+}
+
+func TestCheckSignature(t *testing.T) {
+	token, lookup := testToken(t, SCOPE_WRITE)
+
+	header, err := SignatureHeader(&token, http.MethodPut, "/v1/kv/key?ttl=60", []byte("value"))
+	if err != nil {
+		t.Fatalf("SignatureHeader() = %v", err)
+	}
+	request := httptest.NewRequest(http.MethodPut, "/v1/kv/key?ttl=60", strings.NewReader("value"))
+	request.Header.Set("Authorization", header)
+	authenticated, err := Authenticate(request, lookup, TEST_MAX_BODY_SIZE)
+	if err != nil || authenticated.ID != token.ID {
+		t.Fatalf("Authenticate() = %q, %v, want token %q", authenticated.ID, err, token.ID)
+	}
+
+	// the body was read to check the signature, the handler still gets it
+	if body, _ := io.ReadAll(request.Body); string(body) != "value" {
+		t.Errorf("body after Authenticate() = %q, want \"value\"", body)
+	}
+
+	// within the allowed skew either way
+	for _, skew := range []time.Duration{-HMAC_MAX_SKEW + time.Minute, HMAC_MAX_SKEW - time.Minute} {
+		timestamp := time.Now().Add(skew).Unix()
+		request := signedRequest(token, http.MethodGet, "/get?key=a", "", timestamp, http.MethodGet, "/get?key=a", "")
+		if _, err := Authenticate(request, lookup, TEST_MAX_BODY_SIZE); err != nil {
+			t.Errorf("Authenticate() of a request signed %s from now = %v, want it accepted", skew, err)
+		}
+	}
+}
+
+func TestCheckSignatureRejects(t *testing.T) {
+	token, lookup := testToken(t, SCOPE_WRITE)
+	other, _ := testToken(t, SCOPE_WRITE)
+	now := time.Now().Unix()
+	stale := time.Now().Add(-HMAC_MAX_SKEW - time.Minute).Unix()
+	future := time.Now().Add(HMAC_MAX_SKEW + time.Minute).Unix()
+	uri := "/set?key=a&value=1"
+
+	tests := []struct {
+		name    string
+		request *http.Request
+		want    error
+	}{
+		{"Stale", signedRequest(token, http.MethodPost, uri, "", stale, http.MethodPost, uri, ""), ErrExpiredSignature},
+		{"Future", signedRequest(token, http.MethodPost, uri, "", future, http.MethodPost, uri, ""), ErrExpiredSignature},
+		{"OtherMethod", signedRequest(token, http.MethodDelete, uri, "", now, http.MethodPost, uri, ""), ErrInvalidCredentials},
+		{"OtherPath", signedRequest(token, http.MethodPost, "/ns/other/set?key=a&value=1", "", now, http.MethodPost, uri, ""), ErrInvalidCredentials},
+		{"OtherQuery", signedRequest(token, http.MethodPost, "/set?key=a&value=2", "", now, http.MethodPost, uri, ""), ErrInvalidCredentials},
+		{"OtherBody", signedRequest(token, http.MethodPut, "/v1/kv/a", "tampered", now, http.MethodPut, "/v1/kv/a", "value"), ErrInvalidCredentials},
+		{"OtherSecret", signedRequest(Token{ID: token.ID, Secret: other.Secret}, http.MethodPost, uri, "", now, http.MethodPost, uri, ""), ErrInvalidCredentials},
+		{"UnknownToken", signedRequest(other, http.MethodPost, uri, "", now, http.MethodPost, uri, ""), ErrInvalidCredentials},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Authenticate(test.request, lookup, TEST_MAX_BODY_SIZE); !errors.Is(err, test.want) {
+				t.Fatalf("Authenticate() = %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckSignatureReplayed(t *testing.T) {
+	token, lookup := testToken(t, SCOPE_WRITE)
+	header, err := SignatureHeader(&token, http.MethodPost, "/set?key=a&value=1", nil)
+	if err != nil {
+		t.Fatalf("SignatureHeader() = %v", err)
+	}
+
+	for i, want := range []error{nil, ErrReplayedSignature, ErrReplayedSignature} {
+		request := httptest.NewRequest(http.MethodPost, "/set?key=a&value=1", nil)
+		request.Header.Set("Authorization", header)
+		if _, err := Authenticate(request, lookup, TEST_MAX_BODY_SIZE); err != want {
+			t.Fatalf("Authenticate() of the same signed request, try %d = %v, want %v", i+1, err, want)
+		}
+	}
+
+	// the same request signed again gets a nonce of its own
+	request := signedRequest(token, http.MethodPost, "/set?key=a&value=1", "", time.Now().Unix(), http.MethodPost, "/set?key=a&value=1", "")
+	if _, err := Authenticate(request, lookup, TEST_MAX_BODY_SIZE); err != nil {
+		t.Fatalf("Authenticate() of a newly signed request = %v, want it accepted", err)
+	}
+}
+
+func TestNonceCacheBounded(t *testing.T) {
+	cache := newNonceCache(2)
+	now := time.Now().Unix()
+
+	tests := []struct {
+		nonce     string
+		timestamp int64
+		want      error
+	}{
+		{"a", now - 10, nil},
+		{"b", now - 5, nil},
+		{"a", now - 10, ErrReplayedSignature},
+		{"c", now, nil}, // full, the requests of now-10 are forgotten
+		{"a", now - 10, ErrExpiredSignature},
+		{"d", now - 8, ErrExpiredSignature}, // making room would forget the newer requests of now-5
+		{"b", now - 5, ErrReplayedSignature},
+		{"e", now - 5, ErrExpiredSignature}, // making room forgets now-5, which it can't be told apart from then
+		{"b", now - 5, ErrExpiredSignature},
+		{"c", now, ErrReplayedSignature},
+	}
+
+	for _, test := range tests {
+		if err := cache.Add("token", test.nonce, test.timestamp, now); err != test.want {
+			t.Errorf("Add(%q, %d) = %v, want %v", test.nonce, test.timestamp-now, err, test.want)
+		}
+	}
+
+	// requests too old for the skew check are dropped once time moves on
+	later := now + int64(HMAC_MAX_SKEW/time.Second) + 1
+	if err := cache.Add("token", "e", later, later); err != nil || cache.size != 1 {
+		t.Errorf("Add() after the skew window = %v with %d remembered, want nil with 1", err, cache.size)
+	}
+}
+
+func TestCheckSignatureMalformed(t *testing.T) {
+	token, lookup := testToken(t, SCOPE_READ)
+	now := time.Now().Unix()
+	signature := Sign(token.Secret, http.MethodGet, "/get?key=a", now, "nonce", nil)
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"MissingTimestamp", fmt.Sprintf("%s id=%s,nonce=nonce,sig=%s", HMAC_SCHEME, token.ID, signature)},
+		{"BadTimestamp", fmt.Sprintf("%s id=%s,ts=soon,nonce=nonce,sig=%s", HMAC_SCHEME, token.ID, signature)},
+		{"MissingSignature", fmt.Sprintf("%s id=%s,ts=%d,nonce=nonce", HMAC_SCHEME, token.ID, now)},
+		{"MissingID", fmt.Sprintf("%s ts=%d,nonce=nonce,sig=%s", HMAC_SCHEME, now, signature)},
+		{"MissingNonce", fmt.Sprintf("%s id=%s,ts=%d,sig=%s", HMAC_SCHEME, token.ID, now, Sign(token.Secret, http.MethodGet, "/get?key=a", now, "", nil))},
+		{"LongNonce", fmt.Sprintf("%s id=%s,ts=%d,nonce=%s,sig=%s", HMAC_SCHEME, token.ID, now, strings.Repeat("n", HMAC_MAX_NONCE_LENGTH+1), Sign(token.Secret, http.MethodGet, "/get?key=a", now, strings.Repeat("n", HMAC_MAX_NONCE_LENGTH+1), nil))},
+		{"UppercaseSignature", fmt.Sprintf("%s id=%s,ts=%d,nonce=nonce,sig=%s", HMAC_SCHEME, token.ID, now, strings.ToUpper(signature))},
+		{"UnknownScheme", fmt.Sprintf("Basic %s", token.Credential())},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/get?key=a", nil)
+			request.Header.Set("Authorization", test.header)
+			if _, err := Authenticate(request, lookup, TEST_MAX_BODY_SIZE); err == nil {
+				t.Fatal("Authenticate() succeeded, want an error")
+			}
+		})
+	}
+
+	body := strings.Repeat("b", TEST_MAX_BODY_SIZE+1)
+	request := signedRequest(token, http.MethodPut, "/v1/kv/a", body, now, http.MethodPut, "/v1/kv/a", body)
+	if _, err := Authenticate(request, lookup, TEST_MAX_BODY_SIZE); err == nil {
+		t.Error("Authenticate() of a body over the limit succeeded, want an error")
+	}
+
+	if _, err := Authenticate(httptest.NewRequest(http.MethodGet, "/get?key=a", nil), lookup, TEST_MAX_BODY_SIZE); err != ErrNoCredentials {
+		t.Errorf("Authenticate() without credentials = %v, want ErrNoCredentials", err)
+	}
+}
+
+func TestCheckCredential(t *testing.T) {
+	token, lookup := testToken(t, SCOPE_READ)
+
+	if authenticated, err := CheckCredential(token.Credential(), lookup); err != nil || authenticated.ID != token.ID {
+		t.Fatalf("CheckCredential() = %q, %v, want token %q", authenticated.ID, err, token.ID)
+	}
+	for _, credential := range []string{token.ID, token.ID + ".", token.ID + ".wrong", "unknown." + token.Secret, token.Secret} {
+		if _, err := CheckCredential(credential, lookup); err != ErrInvalidCredentials {
+			t.Errorf("CheckCredential(%q) = %v, want ErrInvalidCredentials", credential, err)
+		}
+	}
+}
+
+func TestTokenAllows(t *testing.T) {
+	limited := Token{Scopes: []string{SCOPE_READ}, Namespaces: []string{DEFAULT_NAMESPACE_NAME, "orders"}, Prefixes: []string{"user:"}}
+	admin := Token{Scopes: []string{SCOPE_ADMIN}, Namespaces: []string{"orders"}, Prefixes: []string{"user:"}}
+
+	tests := []struct {
+		token     Token
+		scope     string
+		namespace string
+		key       string
+		want      bool
+	}{
+		{limited, SCOPE_READ, "", "user:1", true},
+		{limited, SCOPE_READ, "orders", "user:1", true},
+		{limited, SCOPE_WRITE, "orders", "user:1", false},
+		{limited, SCOPE_ADMIN, "orders", "user:1", false},
+		{limited, SCOPE_READ, "billing", "user:1", false},
+		{limited, SCOPE_READ, "orders", "order:1", false},
+		{admin, SCOPE_WRITE, "billing", "order:1", true},
+		{admin, SCOPE_ADMIN, "", "", true},
+	}
+
+	for _, test := range tests {
+		if got := test.token.Allows(test.scope, test.namespace, test.key); got != test.want {
+			t.Errorf("Token%v.Allows(%q, %q, %q) = %v, want %v", test.token.Scopes, test.scope, test.namespace, test.key, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// signed requests are remembered by their token id and nonce until they are too old to be accepted anyway,
+// so one can't be replayed within HMAC_MAX_SKEW. once the cache is full the requests signed in the oldest
+// second are forgotten, and requests signed at or before it are rejected from then on
+type nonceCache struct {
+	lock      sync.Mutex
+	seconds   map[int64]map[string]bool // unix seconds -> token id and nonce of every request signed then
+	size      int
+	maxSize   int
+	watermark int64 // requests signed at or before this were forgotten to stay under maxSize
+	lastSweep int64
+}
+
+var g_nonces = newNonceCache(HMAC_MAX_NONCES)
+
+func newNonceCache(maxSize int) *nonceCache {
+	return &nonceCache{seconds: make(map[int64]map[string]bool), maxSize: maxSize}
+}
+
+// records a request signed at timestamp, fails if it was seen before or can't be told apart from one that was
+func (cache *nonceCache) Add(id string, nonce string, timestamp int64, now int64) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if now != cache.lastSweep {
+		oldest := now - int64(HMAC_MAX_SKEW/time.Second)
+		for second, seen := range cache.seconds {
+			if second < oldest {
+				cache.size -= len(seen)
+				delete(cache.seconds, second)
+			}
+		}
+		cache.lastSweep = now
+	}
+
+	key := id + "\n" + nonce
+	if timestamp <= cache.watermark {
+		return ErrExpiredSignature
+	}
+	if cache.seconds[timestamp][key] {
+		return ErrReplayedSignature
+	}
+
+	for cache.size >= cache.maxSize {
+		oldest := int64(math.MaxInt64)
+		for second := range cache.seconds {
+			if second < oldest {
+				oldest = second
+			}
+		}
+		if timestamp < oldest {
+			return ErrExpiredSignature // making room would forget requests signed after it
+		}
+
+		cache.size -= len(cache.seconds[oldest])
+		delete(cache.seconds, oldest)
+		cache.watermark = oldest
+		if timestamp <= cache.watermark {
+			return ErrExpiredSignature
+		}
+	}
+
+	if cache.seconds[timestamp] == nil {
+		cache.seconds[timestamp] = make(map[string]bool)
+	}
+	cache.seconds[timestamp][key] = true
+	cache.size++
+	return nil
+}
@@ -0,0 +1,255 @@
+// Package clustertls sets up TLS for the nodes and the controller. Every process of a cluster has a
+// certificate issued by the cluster CA that it serves with and presents as a client certificate when it
+// calls another one, so internal traffic is mutually authenticated. Clients of the public API only need
+// to trust the CA. The dev mode issues throwaway certificates from a CA generated on first use
+package clustertls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type Options struct {
+	CertFile string // certificate issued by the cluster CA, used as server and client certificate
+	KeyFile  string
+	CAFile   string // the cluster CA, peers have to present a certificate issued by it
+	Dev      bool   // issue a throwaway certificate from the dev CA in DevDir instead
+	DevDir   string
+}
+
+type Config struct {
+	Server *tls.Config // peers may present a certificate, handlers check IsClusterPeer where they need one
+	Client *tls.Config // trusts the cluster CA and presents this process' certificate
+}
+
+const DEV_CA_CERT_FILE = "ca.pem"
+const DEV_CA_KEY_FILE = "ca-key.pem"
+const DEV_CA_WAIT = 5 * time.Second // for the process that is generating the dev CA
+const DEV_CA_VALIDITY = 365 * 24 * time.Hour
+const DEV_CERT_VALIDITY = 30 * 24 * time.Hour
+
+func DefaultDevDir() string {
+	return filepath.Join(os.TempDir(), "go-distributed-db-dev-ca")
+}
+
+func (options Options) Enabled() bool {
+	return options.Dev || len(options.CertFile) > 0 || len(options.KeyFile) > 0 || len(options.CAFile) > 0
+}
+
+// builds the tls configs for the options, returns nil if TLS is off
+func Load(options Options) (*Config, error) {
+	if !options.Enabled() {
+		return nil, nil
+	}
+
+	var certificate tls.Certificate
+	var roots *x509.CertPool
+	var err error
+	if options.Dev {
+		certificate, roots, err = LoadDevCertificate(options.DevDir)
+	} else {
+		if len(options.CertFile) == 0 || len(options.KeyFile) == 0 || len(options.CAFile) == 0 {
+			return nil, errors.New("a certificate, its key and the cluster CA are all needed")
+		}
+
+		certificate, err = tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err == nil {
+			roots, err = LoadCertPool(options.CAFile)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Config{
+		Server: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{certificate},
+			ClientCAs:    roots,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		},
+		Client: &tls.Config{
+			MinVersion:   tls.VersionTLS12,
+			Certificates: []tls.Certificate{certificate},
+			RootCAs:      roots,
+		},
+	}, nil
+}
+
+// the server config for listeners only other processes of the cluster connect to
+func (config *Config) InternalServer() *tls.Config {
+	internal := config.Server.Clone()
+	internal.ClientAuth = tls.RequireAndVerifyClientCert
+	return internal
+}
+
+// true if the peer presented a certificate issued by the cluster CA
+func IsClusterPeer(state *tls.ConnectionState) bool {
+	return state != nil && len(state.VerifiedChains) > 0
+}
+
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(contents) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// issues a certificate for this host from the dev CA in dir, generating the CA if it isn't there yet.
+// every process on the host started in dev mode shares the CA, so they trust each other
+func LoadDevCertificate(dir string) (tls.Certificate, *x509.CertPool, error) {
+	if len(dir) == 0 {
+		dir = DefaultDevDir()
+	}
+
+	caCert, caKey, err := LoadOrCreateDevCA(dir)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: RandomSerial(),
+		Subject:      pkix.Name{CommonName: hostname, Organization: []string{"go-distributed-db dev"}},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(DEV_CERT_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost", hostname},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	return tls.Certificate{Certificate: [][]byte{der, caCert.Raw}, PrivateKey: key}, roots, nil
+}
+
+// the first process to create dir generates the CA, the others wait for it to be written
+func LoadOrCreateDevCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(dir, DEV_CA_CERT_FILE)
+	keyPath := filepath.Join(dir, DEV_CA_KEY_FILE)
+
+	err := os.Mkdir(dir, 0700)
+	if err == nil {
+		return CreateDevCA(certPath, keyPath)
+	}
+	if !errors.Is(err, os.ErrExist) {
+		return nil, nil, err
+	}
+
+	deadline := time.Now().Add(DEV_CA_WAIT)
+	for {
+		caCert, caKey, err := ReadDevCA(certPath, keyPath)
+		if err == nil || time.Now().After(deadline) {
+			return caCert, caKey, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func CreateDevCA(certPath string, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          RandomSerial(),
+		Subject:               pkix.Name{CommonName: "go-distributed-db dev CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(DEV_CA_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the certificate is written last, the other processes wait for it
+	err = WriteFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err == nil {
+		err = WriteFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	return caCert, key, err
+}
+
+func ReadDevCA(certPath string, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("dev CA files are corrupted")
+	}
+
+	caCert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	if time.Now().After(caCert.NotAfter) {
+		return nil, nil, fmt.Errorf("dev CA in %s expired, delete the directory to get a new one", filepath.Dir(certPath))
+	}
+
+	caKey, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	return caCert, caKey, err
+}
+
+func WriteFileAtomic(path string, contents []byte) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, contents, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func RandomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 126))
+	return serial
+}
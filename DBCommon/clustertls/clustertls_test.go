@@ -0,0 +1,127 @@
+package clustertls
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// a cluster with a dev CA of its own, processes of different clusters don't trust each other
+func testCluster(t *testing.T) *Config {
+	t.Helper()
+	config, err := Load(Options{Dev: true, DevDir: t.TempDir() + "/ca"})
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	return config
+}
+
+// serves with serverConfig and answers whether the caller is a cluster peer
+func testServer(t *testing.T, serverConfig *tls.Config) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if IsClusterPeer(request.TLS) {
+			io.WriteString(response, "peer")
+		} else {
+			io.WriteString(response, "client")
+		}
+	}))
+	server.TLS = serverConfig
+	server.Config.ErrorLog = log.New(io.Discard, "", 0) // rejected handshakes are expected
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// what the server made of the caller, or the error if the handshake failed
+func testCall(server *httptest.Server, clientConfig *tls.Config) (string, error) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+	defer client.CloseIdleConnections()
+
+	response, err := client.Get(server.URL)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	return string(body), err
+}
+
+func TestIsClusterPeer(t *testing.T) {
+	cluster, foreign := testCluster(t), testCluster(t)
+	server := testServer(t, cluster.Server)
+
+	if got, err := testCall(server, cluster.Client); err != nil || got != "peer" {
+		t.Errorf("call with the cluster's certificate = %q, %v, want peer", got, err)
+	}
+
+	anonymous := cluster.Client.Clone()
+	anonymous.Certificates = nil
+	if got, err := testCall(server, anonymous); err != nil || got != "client" {
+		t.Errorf("call without a certificate = %q, %v, want client", got, err)
+	}
+
+	// trusts the cluster CA but presents a certificate from another one
+	impostor := cluster.Client.Clone()
+	impostor.Certificates = foreign.Client.Certificates
+	if got, err := testCall(server, impostor); err == nil && got != "client" {
+		t.Errorf("call with a foreign certificate = %q, want it rejected or treated as a client", got)
+	}
+
+	if IsClusterPeer(nil) || IsClusterPeer(&tls.ConnectionState{}) {
+		t.Error("IsClusterPeer() without verified chains = true, want false")
+	}
+}
+
+func TestInternalServer(t *testing.T) {
+	cluster, foreign := testCluster(t), testCluster(t)
+	server := testServer(t, cluster.InternalServer())
+
+	if got, err := testCall(server, cluster.Client); err != nil || got != "peer" {
+		t.Errorf("call with the cluster's certificate = %q, %v, want peer", got, err)
+	}
+
+	anonymous := cluster.Client.Clone()
+	anonymous.Certificates = nil
+	if got, err := testCall(server, anonymous); err == nil {
+		t.Errorf("call without a certificate = %q, want the handshake to fail", got)
+	}
+
+	impostor := cluster.Client.Clone()
+	impostor.Certificates = foreign.Client.Certificates
+	if got, err := testCall(server, impostor); err == nil {
+		t.Errorf("call with a foreign certificate = %q, want the handshake to fail", got)
+	}
+
+	// the foreign cluster's client doesn't trust this cluster's server either
+	if got, err := testCall(server, foreign.Client); err == nil {
+		t.Errorf("call from another cluster = %q, want the handshake to fail", got)
+	}
+}
+
+func TestLoadOptions(t *testing.T) {
+	if config, err := Load(Options{}); config != nil || err != nil {
+		t.Errorf("Load() without options = %v, %v, want nil, nil", config, err)
+	}
+	if _, err := Load(Options{CertFile: "node.pem", KeyFile: "node-key.pem"}); err == nil {
+		t.Error("Load() without a CA succeeded")
+	}
+
+	// processes sharing a dev dir share the CA and trust each other
+	dir := t.TempDir() + "/ca"
+	first, err := Load(Options{Dev: true, DevDir: dir})
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	second, err := Load(Options{Dev: true, DevDir: dir})
+	if err != nil {
+		t.Fatalf("Load() with an existing dev CA = %v", err)
+	}
+	if got, err := testCall(testServer(t, first.InternalServer()), second.Client); err != nil || got != "peer" {
+		t.Errorf("call between processes sharing the dev CA = %q, %v, want peer", got, err)
+	}
+}
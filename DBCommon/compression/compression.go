@@ -0,0 +1,107 @@
+// Package compression is the zstd compression shared by the nodes and the controller. Nodes compress
+// large values before storing them and chunks before sending them to other nodes, a codec stored or sent
+// along with the data says whether it has to be decompressed. gzip is only used for http answers
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type Codec uint8
+
+const (
+	CODEC_NONE Codec = 0
+	CODEC_ZSTD Codec = 1
+	CODEC_GZIP Codec = 2
+)
+
+const MAX_DECOMPRESSED_BYTES = 1 << 30
+
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// both are safe for concurrent use through EncodeAll and DecodeAll
+var g_encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+var g_decoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MAX_DECOMPRESSED_BYTES))
+
+// how well the data that went through a Counter compressed
+type Stats struct {
+	Compressed   int64   // payloads that were stored or sent compressed
+	Uncompressed int64   // payloads left as they were, too small or they didn't get smaller
+	BytesIn      int64   // size of every payload before compression
+	BytesOut     int64   // size of every payload as it was stored or sent
+	Ratio        float64 // BytesIn / BytesOut, 0 until something was recorded
+}
+
+type Counter struct {
+	stats Stats
+	lock  sync.Mutex
+}
+
+func (codec Codec) String() string {
+	switch codec {
+	case CODEC_NONE:
+		return "none"
+	case CODEC_ZSTD:
+		return "zstd"
+	case CODEC_GZIP:
+		return "gzip"
+	default:
+		return "unknown"
+	}
+}
+
+// compresses data with zstd, returns data as it is if compressing doesn't make it smaller
+func Compress(data []byte) ([]byte, Codec) {
+	compressed := g_encoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	if len(compressed) >= len(data) {
+		return data, CODEC_NONE
+	}
+	return compressed, CODEC_ZSTD
+}
+
+func Decompress(data []byte, codec Codec) ([]byte, error) {
+	switch codec {
+	case CODEC_NONE:
+		return data, nil
+	case CODEC_ZSTD:
+		return g_decoder.DecodeAll(data, nil)
+	case CODEC_GZIP:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(io.LimitReader(reader, MAX_DECOMPRESSED_BYTES))
+	default:
+		return nil, ErrUnknownCodec
+	}
+}
+
+func (counter *Counter) Record(before int, after int, codec Codec) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	if codec == CODEC_NONE {
+		counter.stats.Uncompressed++
+	} else {
+		counter.stats.Compressed++
+	}
+	counter.stats.BytesIn += int64(before)
+	counter.stats.BytesOut += int64(after)
+}
+
+func (counter *Counter) Stats() Stats {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	stats := counter.stats
+	if stats.BytesOut > 0 {
+		stats.Ratio = float64(stats.BytesIn) / float64(stats.BytesOut)
+	}
+	return stats
+}
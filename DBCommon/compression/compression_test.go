@@ -0,0 +1,89 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("a value that repeats "), 1000)
+	compressed, codec := Compress(data)
+	if codec != CODEC_ZSTD || len(compressed) >= len(data) {
+		t.Fatalf("Compress() = %d bytes with %s, want fewer than %d with zstd", len(compressed), codec, len(data))
+	}
+
+	decompressed, err := Decompress(compressed, codec)
+	if err != nil || !bytes.Equal(decompressed, data) {
+		t.Fatalf("Decompress() = %d bytes, %v, want the %d compressed", len(decompressed), err, len(data))
+	}
+}
+
+func TestCompressIncompressible(t *testing.T) {
+	data := make([]byte, 4096)
+	rand.Read(data)
+
+	compressed, codec := Compress(data)
+	if codec != CODEC_NONE || !bytes.Equal(compressed, data) {
+		t.Fatalf("Compress() of random data = %d bytes with %s, want it unchanged", len(compressed), codec)
+	}
+	for _, empty := range [][]byte{nil, {}} {
+		if compressed, codec := Compress(empty); codec != CODEC_NONE || len(compressed) != 0 {
+			t.Errorf("Compress(%v) = %v, %s, want it unchanged", empty, compressed, codec)
+		}
+	}
+}
+
+func TestDecompressGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte("gzipped body"))
+	writer.Close()
+
+	decompressed, err := Decompress(compressed.Bytes(), CODEC_GZIP)
+	if err != nil || string(decompressed) != "gzipped body" {
+		t.Fatalf("Decompress() = %q, %v, want \"gzipped body\"", decompressed, err)
+	}
+}
+
+func TestDecompressMalformed(t *testing.T) {
+	compressed, _ := Compress(bytes.Repeat([]byte("abcd"), 1000))
+
+	tests := []struct {
+		name  string
+		data  []byte
+		codec Codec
+	}{
+		{"UnknownCodec", compressed, Codec(9)},
+		{"NotZstd", []byte("plain text"), CODEC_ZSTD},
+		{"TruncatedZstd", compressed[:len(compressed)/2], CODEC_ZSTD},
+		{"NotGzip", compressed, CODEC_GZIP},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if decompressed, err := Decompress(test.data, test.codec); err == nil {
+				t.Fatalf("Decompress() = %d bytes, want an error", len(decompressed))
+			}
+		})
+	}
+}
+
+func TestCounter(t *testing.T) {
+	var counter Counter
+	if stats := counter.Stats(); stats.Ratio != 0 {
+		t.Errorf("Stats().Ratio before anything was recorded = %f, want 0", stats.Ratio)
+	}
+
+	counter.Record(1000, 250, CODEC_ZSTD)
+	counter.Record(100, 100, CODEC_NONE)
+	counter.Record(900, 650, CODEC_GZIP)
+
+	stats := counter.Stats()
+	want := Stats{Compressed: 2, Uncompressed: 1, BytesIn: 2000, BytesOut: 1000, Ratio: 2}
+	if stats != want {
+		t.Fatalf("Stats() = %+v, want %+v", stats, want)
+	}
+}
@@ -0,0 +1,203 @@
+// Package encryption is the encryption at rest shared by the nodes and the controller. Values are sealed
+// with AES-256-GCM under one of the keys of a keyring, the id of the key is stored next to them (0 means
+// the value isn't encrypted) so keys can be rotated while older values are still around. Files the
+// controller writes to the backup target are sealed whole, with a header that names the key
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const KEYS_ENV_VAR = "DB_ENCRYPTION_KEYS" // used when no keyfile is given, same format as a keyfile
+const KEY_SIZE = 32                       // AES-256
+const NO_KEY = 0                          // key id of values that aren't encrypted
+
+var SEALED_FILE_MAGIC = []byte("DBENC1")
+
+var ErrUnknownKey = errors.New("value is encrypted with a key that isn't in the keyring")
+
+// the keys values can be decrypted with, new values are encrypted with the active one
+type Keyring struct {
+	source string // keyfile the keys were loaded from, empty if they came from KEYS_ENV_VAR
+	keys   map[uint32]cipher.AEAD
+	active uint32
+	lock   sync.RWMutex
+}
+
+// loads the keys from the keyfile, or from KEYS_ENV_VAR if path is empty. returns a nil keyring if neither
+// is set, encryption is off then
+func LoadKeyring(path string) (*Keyring, error) {
+	if len(path) == 0 && len(os.Getenv(KEYS_ENV_VAR)) == 0 {
+		return nil, nil
+	}
+
+	keyring := &Keyring{source: path}
+	return keyring, keyring.Reload()
+}
+
+// reads the keys again from where they were loaded from, the keyring is left as it was if that fails
+func (keyring *Keyring) Reload() error {
+	text := os.Getenv(KEYS_ENV_VAR)
+	if len(keyring.source) > 0 {
+		contents, err := os.ReadFile(keyring.source)
+		if err != nil {
+			return err
+		}
+		text = string(contents)
+	}
+
+	keys, active, err := ParseKeys(text)
+	if err != nil {
+		return err
+	}
+
+	keyring.lock.Lock()
+	defer keyring.lock.Unlock()
+
+	keyring.keys = keys
+	keyring.active = active
+	return nil
+}
+
+// one key per line (or separated by ';'), as "<id> <base64 of 32 random bytes>". ids are positive and the
+// last key listed is the active one. blank lines and lines starting with # are skipped
+func ParseKeys(text string) (map[uint32]cipher.AEAD, uint32, error) {
+	keys := make(map[uint32]cipher.AEAD)
+	active := uint32(NO_KEY)
+	for _, line := range strings.FieldsFunc(text, func(c rune) bool { return c == '\n' || c == ';' }) {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, NO_KEY, fmt.Errorf("invalid key line, expected '<id> <base64 key>'")
+		}
+
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || id == NO_KEY {
+			return nil, NO_KEY, fmt.Errorf("invalid key id '%s', ids are positive integers", fields[0])
+		}
+		if _, found := keys[uint32(id)]; found {
+			return nil, NO_KEY, fmt.Errorf("key id %d is listed twice", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != KEY_SIZE {
+			return nil, NO_KEY, fmt.Errorf("key %d should be %d bytes encoded as base64", id, KEY_SIZE)
+		}
+
+		block, _ := aes.NewCipher(key)
+		keys[uint32(id)], _ = cipher.NewGCM(block)
+		active = uint32(id)
+	}
+
+	if active == NO_KEY {
+		return nil, NO_KEY, errors.New("no keys found")
+	}
+	return keys, active, nil
+}
+
+func (keyring *Keyring) ActiveKey() uint32 {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	return keyring.active
+}
+
+func (keyring *Keyring) HasKey(id uint32) bool {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	_, found := keyring.keys[id]
+	return found || id == NO_KEY
+}
+
+// ids of every key in the keyring, in ascending order
+func (keyring *Keyring) KeyIDs() []uint32 {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	ids := make([]uint32, 0, len(keyring.keys))
+	for id := range keyring.keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// seals plaintext with the active key, returns the nonce followed by the ciphertext and the id of the key.
+// aad is authenticated but not stored, the same aad has to be passed to Decrypt
+func (keyring *Keyring) Encrypt(plaintext []byte, aad []byte) ([]byte, uint32) {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	aead := keyring.keys[keyring.active]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plaintext, aad), keyring.active
+}
+
+// opens data sealed by Encrypt with the key keyID, data is returned as it is for NO_KEY
+func (keyring *Keyring) Decrypt(data []byte, keyID uint32, aad []byte) ([]byte, error) {
+	if keyID == NO_KEY {
+		return data, nil
+	}
+
+	keyring.lock.RLock()
+	aead, found := keyring.keys[keyID]
+	keyring.lock.RUnlock()
+	if !found {
+		return nil, ErrUnknownKey
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+// seals a whole file with the active key, the header holds SEALED_FILE_MAGIC and the key id
+func (keyring *Keyring) SealFile(contents []byte) []byte {
+	sealed, keyID := keyring.Encrypt(contents, SEALED_FILE_MAGIC)
+
+	header := make([]byte, len(SEALED_FILE_MAGIC)+4)
+	copy(header, SEALED_FILE_MAGIC)
+	binary.BigEndian.PutUint32(header[len(SEALED_FILE_MAGIC):], keyID)
+	return append(header, sealed...)
+}
+
+func IsSealedFile(contents []byte) bool {
+	return bytes.HasPrefix(contents, SEALED_FILE_MAGIC)
+}
+
+// opens a file sealed by SealFile, files that aren't sealed are returned as they are. keyring can be nil
+// if the file isn't sealed
+func OpenFile(keyring *Keyring, contents []byte) ([]byte, error) {
+	if !IsSealedFile(contents) {
+		return contents, nil
+	}
+	if keyring == nil {
+		return nil, errors.New("file is encrypted but no encryption keys are loaded")
+	}
+
+	headerSize := len(SEALED_FILE_MAGIC) + 4
+	if len(contents) < headerSize {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	keyID := binary.BigEndian.Uint32(contents[len(SEALED_FILE_MAGIC):headerSize])
+	return keyring.Decrypt(contents[headerSize:], keyID, SEALED_FILE_MAGIC)
+}
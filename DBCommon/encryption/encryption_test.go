@@ -0,0 +1,219 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(fill byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, KEY_SIZE))
+}
+
+func testKeyring(t *testing.T, text string) *Keyring {
+	t.Helper()
+	keys, active, err := ParseKeys(text)
+	if err != nil {
+		t.Fatalf("ParseKeys() = %v", err)
+	}
+	return &Keyring{keys: keys, active: active}
+}
+
+func TestParseKeys(t *testing.T) {
+	text := fmt.Sprintf("# rotated on the 1st\n1 %s\n\n  2 %s  ;3 %s\n", testKey(1), testKey(2), testKey(3))
+	keys, active, err := ParseKeys(text)
+	if err != nil {
+		t.Fatalf("ParseKeys() = %v", err)
+	}
+	if len(keys) != 3 || active != 3 {
+		t.Fatalf("ParseKeys() = %d keys, active %d, want 3 keys, active 3", len(keys), active)
+	}
+}
+
+func TestParseKeysMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"Empty", ""},
+		{"OnlyComments", "# no keys yet\n"},
+		{"MissingKey", "1"},
+		{"ExtraField", "1 " + testKey(1) + " active"},
+		{"ZeroID", "0 " + testKey(1)},
+		{"NegativeID", "-1 " + testKey(1)},
+		{"NamedID", "first " + testKey(1)},
+		{"DuplicateID", "1 " + testKey(1) + "\n1 " + testKey(2)},
+		{"NotBase64", "1 not-base64!"},
+		{"ShortKey", "1 " + base64.StdEncoding.EncodeToString(make([]byte, 16))},
+		{"LongKey", "1 " + base64.StdEncoding.EncodeToString(make([]byte, KEY_SIZE+1))},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if keys, _, err := ParseKeys(test.text); err == nil {
+				t.Fatalf("ParseKeys() = %d keys, want an error", len(keys))
+			}
+		})
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	keyring := testKeyring(t, "1 "+testKey(1))
+	aad := []byte("namespace/key")
+
+	sealed, keyID := keyring.Encrypt([]byte("secret value"), aad)
+	if keyID != 1 || bytes.Contains(sealed, []byte("secret value")) {
+		t.Fatalf("Encrypt() = %q with key %d, want it sealed with key 1", sealed, keyID)
+	}
+	if again, _ := keyring.Encrypt([]byte("secret value"), aad); bytes.Equal(again, sealed) {
+		t.Error("Encrypt() of the same value twice gave the same output, the nonce should differ")
+	}
+
+	plaintext, err := keyring.Decrypt(sealed, keyID, aad)
+	if err != nil || string(plaintext) != "secret value" {
+		t.Fatalf("Decrypt() = %q, %v, want \"secret value\"", plaintext, err)
+	}
+
+	if plaintext, err := keyring.Decrypt([]byte("stored before encryption"), NO_KEY, aad); err != nil || string(plaintext) != "stored before encryption" {
+		t.Errorf("Decrypt() with NO_KEY = %q, %v, want the data as it is", plaintext, err)
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	keyring := testKeyring(t, "1 "+testKey(1))
+	aad := []byte("namespace/key")
+	sealed, keyID := keyring.Encrypt([]byte("secret value"), aad)
+
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		data    []byte
+		keyID   uint32
+		aad     []byte
+	}{
+		{"WrongAAD", keyring, sealed, keyID, []byte("namespace/other")},
+		{"MissingAAD", keyring, sealed, keyID, nil},
+		{"WrongKey", testKeyring(t, "1 "+testKey(9)), sealed, keyID, aad},
+		{"UnknownKey", keyring, sealed, 2, aad},
+		{"Tampered", keyring, tampered, keyID, aad},
+		{"Truncated", keyring, sealed[:len(sealed)-1], keyID, aad},
+		{"ShorterThanNonce", keyring, sealed[:4], keyID, aad},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if plaintext, err := test.keyring.Decrypt(test.data, test.keyID, test.aad); err == nil {
+				t.Fatalf("Decrypt() = %q, want an error", plaintext)
+			}
+		})
+	}
+
+	if _, err := keyring.Decrypt(sealed, 2, aad); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt() with a key that isn't loaded = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := filepath.Join(dir, "keys")
+	os.WriteFile(keyfile, []byte("1 "+testKey(1)), 0600)
+
+	keyring, err := LoadKeyring(keyfile)
+	if err != nil {
+		t.Fatalf("LoadKeyring() = %v", err)
+	}
+	old, oldID := keyring.Encrypt([]byte("old value"), nil)
+
+	os.WriteFile(keyfile, []byte("1 "+testKey(1)+"\n2 "+testKey(2)), 0600)
+	if err := keyring.Reload(); err != nil {
+		t.Fatalf("Reload() = %v", err)
+	}
+	if keyring.ActiveKey() != 2 || !keyring.HasKey(1) {
+		t.Fatalf("after Reload() the active key is %d with keys %v, want 2 with key 1 still there", keyring.ActiveKey(), keyring.KeyIDs())
+	}
+	if _, keyID := keyring.Encrypt([]byte("new value"), nil); keyID != 2 {
+		t.Errorf("Encrypt() after rotating used key %d, want 2", keyID)
+	}
+	if plaintext, err := keyring.Decrypt(old, oldID, nil); err != nil || string(plaintext) != "old value" {
+		t.Errorf("Decrypt() of a value sealed before rotating = %q, %v, want \"old value\"", plaintext, err)
+	}
+
+	// a broken keyfile leaves the loaded keys alone
+	os.WriteFile(keyfile, []byte("2 "+testKey(2)+"\n2 "+testKey(3)), 0600)
+	if err := keyring.Reload(); err == nil {
+		t.Fatal("Reload() of a keyfile listing a key twice succeeded")
+	}
+	if ids := keyring.KeyIDs(); len(ids) != 2 || keyring.ActiveKey() != 2 {
+		t.Fatalf("after a failed Reload() the keys are %v with %d active, want [1 2] with 2 active", ids, keyring.ActiveKey())
+	}
+}
+
+func TestLoadKeyringFromEnv(t *testing.T) {
+	t.Setenv(KEYS_ENV_VAR, "")
+	if keyring, err := LoadKeyring(""); keyring != nil || err != nil {
+		t.Fatalf("LoadKeyring() without keys = %v, %v, want nil, nil", keyring, err)
+	}
+
+	t.Setenv(KEYS_ENV_VAR, "4 "+testKey(4)+";5 "+testKey(5))
+	keyring, err := LoadKeyring("")
+	if err != nil || keyring.ActiveKey() != 5 {
+		t.Fatalf("LoadKeyring() from %s = %v, want key 5 active", KEYS_ENV_VAR, err)
+	}
+}
+
+func TestSealedFiles(t *testing.T) {
+	keyring := testKeyring(t, "1 "+testKey(1)+"\n2 "+testKey(2))
+	contents := []byte(`{"ID":"backup"}`)
+
+	sealed := keyring.SealFile(contents)
+	if !IsSealedFile(sealed) || bytes.Contains(sealed, contents) {
+		t.Fatalf("SealFile() = %q, want it sealed behind %q", sealed, SEALED_FILE_MAGIC)
+	}
+	if opened, err := OpenFile(keyring, sealed); err != nil || !bytes.Equal(opened, contents) {
+		t.Fatalf("OpenFile() = %q, %v, want %q", opened, err, contents)
+	}
+	if opened, err := OpenFile(nil, contents); err != nil || !bytes.Equal(opened, contents) {
+		t.Errorf("OpenFile() of a file that isn't sealed = %q, %v, want it as it is", opened, err)
+	}
+
+	// sealed with key 2, a keyring holding a different key 2 can't open it
+	otherKeyring := testKeyring(t, "2 "+testKey(7))
+	wrongKeyID := append(append([]byte{}, SEALED_FILE_MAGIC...), 0, 0, 0, 9)
+
+	tests := []struct {
+		name     string
+		keyring  *Keyring
+		contents []byte
+	}{
+		{"NoKeyring", nil, sealed},
+		{"WrongKey", otherKeyring, sealed},
+		{"UnknownKey", keyring, append(wrongKeyID, sealed[len(wrongKeyID):]...)},
+		{"TruncatedHeader", keyring, sealed[:len(SEALED_FILE_MAGIC)+2]},
+		{"Tampered", keyring, append(append([]byte{}, sealed[:len(sealed)-1]...), sealed[len(sealed)-1]^1)},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if opened, err := OpenFile(test.keyring, test.contents); err == nil {
+				t.Fatalf("OpenFile() = %q, want an error", opened)
+			}
+		})
+	}
+
+	// the magic is the aad, a value sealed for something else doesn't open as a file
+	value, keyID := keyring.Encrypt(contents, []byte("namespace/key"))
+	header := append(append([]byte{}, SEALED_FILE_MAGIC...), 0, 0, 0, byte(keyID))
+	if opened, err := OpenFile(keyring, append(header, value...)); err == nil {
+		t.Errorf("OpenFile() of a value sealed with another aad = %q, want an error", opened)
+	}
+}
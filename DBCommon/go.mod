@@ -0,0 +1,5 @@
+module DBCommon
+
+go 1.19
+
+require github.com/klauspost/compress v1.17.0
@@ -0,0 +1,160 @@
+// Package placement decides which nodes hold a key. The nodes place the keys they store with it and the
+// controller places the keys it backs up, restores and imports with it, so both agree on where every key
+// lives. Keys are placed with weighted rendezvous hashing: every node scores the key and the highest
+// scoring nodes hold it, spread over as many zones as possible
+package placement
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+)
+
+const DEFAULT_NODE_WEIGHT = 1.0
+const VERSION = 1 // weighted rendezvous hashing, 0 is the hash ring that came before it
+
+// parts of split values are stored under keys made of the key of the value, this and a suffix. clients
+// can't write keys containing it
+const VALUE_PART_SEPARATOR = "\x1fpart\x1f"
+
+// what placement needs to know about a node
+type Node struct {
+	ID     int32  // index of the node
+	Addr   string // nodes are scored by their address, ids shift around when nodes are removed
+	Zone   string
+	Weight float64 // 0 means DEFAULT_NODE_WEIGHT
+}
+
+// overrides the replication factor of every key in the namespace starting with Prefix, the longest
+// matching prefix wins
+type Rule struct {
+	Namespace         string `json:",omitempty"`
+	Prefix            string
+	ReplicationFactor uint32
+}
+
+func GetWeight(weight float64) float64 {
+	if weight <= 0 {
+		return DEFAULT_NODE_WEIGHT
+	}
+	return weight
+}
+
+func (node *Node) Hash() uint64 {
+	hash := fnv.New64()
+	hash.Write([]byte(node.Addr))
+	return hash.Sum64()
+}
+
+// the key that decides where an entry is stored, the key of the value for parts and the key itself otherwise
+func GetPlacementKey(key string) string {
+	placementKey, _, _ := strings.Cut(key, VALUE_PART_SEPARATOR)
+	return placementKey
+}
+
+func HashKey(key string) uint64 {
+	hash := fnv.New64()
+	hash.Write([]byte(GetPlacementKey(key)))
+	return hash.Sum64()
+}
+
+// splitmix64 finalizer, spreads the combined key and node hashes over the whole range
+func MixHash(hash uint64) uint64 {
+	hash ^= hash >> 30
+	hash *= 0xbf58476d1ce4e5b9
+	hash ^= hash >> 27
+	hash *= 0x94d049bb133111eb
+	hash ^= hash >> 31
+	return hash
+}
+
+// replication factor of the key, from the longest matching prefix rule or replicationFactor, the one of
+// its namespace. capped at the number of nodes
+func GetReplicationFactor(rules []Rule, namespace string, key string, replicationFactor uint32, numNodes uint32) uint32 {
+	longestPrefix := -1
+	for _, rule := range rules {
+		if rule.Namespace == namespace && strings.HasPrefix(key, rule.Prefix) && len(rule.Prefix) > longestPrefix {
+			replicationFactor = rule.ReplicationFactor
+			longestPrefix = len(rule.Prefix)
+		}
+	}
+
+	if replicationFactor > numNodes {
+		return numNodes
+	}
+	return replicationFactor
+}
+
+// every node scores the key and nodes are ranked by their score. a node's share of the keyspace is
+// proportional to its weight, and a change in weights or nodes only moves the keys whose ranking changes.
+// nodes with an id outside [0, numNodes) are left out
+func RankNodes(nodes []Node, numNodes uint32, keyHash uint64) []uint32 {
+	scores := make([]float64, numNodes)
+	ranked := make([]uint32, 0, numNodes)
+	for i := range nodes {
+		node := &nodes[i]
+		if node.ID < 0 || uint32(node.ID) >= numNodes {
+			continue
+		}
+
+		uniform := (float64(MixHash(keyHash^node.Hash())>>11) + 0.5) / (1 << 53) // in (0, 1)
+		scores[node.ID] = -GetWeight(node.Weight) / math.Log(uniform)
+		ranked = append(ranked, uint32(node.ID))
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if scores[ranked[i]] != scores[ranked[j]] {
+			return scores[ranked[i]] > scores[ranked[j]]
+		}
+		return ranked[i] < ranked[j]
+	})
+
+	return ranked
+}
+
+// goes through the nodes in rank order and takes the first node of every zone it hasn't used yet, then
+// fills up with the nodes it skipped. without zones this is just the highest ranked nodes
+func PlaceReplicas(nodes []Node, numNodes uint32, ranked []uint32, replicationFactor uint32) []uint32 {
+	zones := make([]string, numNodes)
+	for _, node := range nodes {
+		if node.ID >= 0 && uint32(node.ID) < numNodes {
+			zones[node.ID] = node.Zone
+		}
+	}
+
+	targetNodes := make([]uint32, 0, replicationFactor)
+	chosen := make([]bool, numNodes)
+	usedZones := make(map[string]bool)
+	for _, nodeID := range ranked {
+		if uint32(len(targetNodes)) == replicationFactor {
+			break
+		}
+		if usedZones[zones[nodeID]] {
+			continue
+		}
+
+		usedZones[zones[nodeID]] = true
+		chosen[nodeID] = true
+		targetNodes = append(targetNodes, nodeID)
+	}
+
+	for _, nodeID := range ranked {
+		if uint32(len(targetNodes)) == replicationFactor {
+			break
+		}
+		if !chosen[nodeID] {
+			targetNodes = append(targetNodes, nodeID)
+		}
+	}
+
+	return targetNodes
+}
+
+// the nodes that hold key, the first one is its primary and the rest are its replicas
+func GetTargetNodes(nodes []Node, numNodes uint32, key string, replicationFactor uint32) []uint32 {
+	if numNodes == 0 {
+		return []uint32{}
+	}
+	return PlaceReplicas(nodes, numNodes, RankNodes(nodes, numNodes, HashKey(key)), replicationFactor)
+}
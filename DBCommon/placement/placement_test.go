@@ -0,0 +1,91 @@
+package placement
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// the network and the targets in testdata are shared with the controller and node tests, which check that
+// they place the keys of the same network on the same nodes as this package
+type testNetwork struct {
+	Nodes             []Node
+	NumNodes          uint32
+	ReplicationFactor uint32
+	Namespaces        map[string]struct{ ReplicationFactor uint32 }
+	ReplicationRules  []Rule
+}
+
+type testTarget struct {
+	Namespace string
+	Key       string
+	Nodes     []uint32
+}
+
+func (network *testNetwork) GetTargetNodes(namespace string, key string) []uint32 {
+	replicationFactor := network.ReplicationFactor
+	if settings, found := network.Namespaces[namespace]; found && namespace != "" {
+		replicationFactor = settings.ReplicationFactor
+	}
+	replicationFactor = GetReplicationFactor(network.ReplicationRules, namespace, GetPlacementKey(key), replicationFactor, network.NumNodes)
+	return GetTargetNodes(network.Nodes, network.NumNodes, key, replicationFactor)
+}
+
+func readTestData(t *testing.T, name string, v interface{}) {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("os.ReadFile() = %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("json.Unmarshal() of %s = %v", name, err)
+	}
+}
+
+func TestGetTargetNodes(t *testing.T) {
+	var network testNetwork
+	var targets []testTarget
+	readTestData(t, "network.json", &network)
+	readTestData(t, "targets.json", &targets)
+
+	for _, target := range targets {
+		if nodes := network.GetTargetNodes(target.Namespace, target.Key); !reflect.DeepEqual(nodes, target.Nodes) {
+			t.Errorf("GetTargetNodes(%q, %q) = %v, want %v", target.Namespace, target.Key, nodes, target.Nodes)
+		}
+	}
+}
+
+func TestGetReplicationFactor(t *testing.T) {
+	rules := []Rule{{Prefix: "tmp:", ReplicationFactor: 1}, {Prefix: "tmp:long:", ReplicationFactor: 3}, {Namespace: "orders", Prefix: "vip:", ReplicationFactor: 5}}
+	tests := []struct {
+		namespace string
+		key       string
+		numNodes  uint32
+		want      uint32
+	}{
+		{"", "user:1", 5, 2},
+		{"", "tmp:a", 5, 1},
+		{"", "tmp:long:a", 5, 3},
+		{"", "vip:a", 5, 2},
+		{"orders", "vip:a", 5, 5},
+		{"orders", "vip:a", 4, 4},
+		{"orders", "tmp:a", 5, 2},
+	}
+
+	for _, test := range tests {
+		if got := GetReplicationFactor(rules, test.namespace, test.key, 2, test.numNodes); got != test.want {
+			t.Errorf("GetReplicationFactor(%q, %q, %d nodes) = %d, want %d", test.namespace, test.key, test.numNodes, got, test.want)
+		}
+	}
+}
+
+func TestPlaceReplicasSpreadsZones(t *testing.T) {
+	nodes := []Node{{ID: 0, Zone: "a"}, {ID: 1, Zone: "a"}, {ID: 2, Zone: "b"}}
+	if got := PlaceReplicas(nodes, 3, []uint32{0, 1, 2}, 2); !reflect.DeepEqual(got, []uint32{0, 2}) {
+		t.Errorf("PlaceReplicas() = %v, want [0 2]", got)
+	}
+	if got := PlaceReplicas(nodes, 3, []uint32{0, 1, 2}, 3); !reflect.DeepEqual(got, []uint32{0, 2, 1}) {
+		t.Errorf("PlaceReplicas() = %v, want [0 2 1]", got)
+	}
+}
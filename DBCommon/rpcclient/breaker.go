@@ -0,0 +1,124 @@
+package rpcclient
+
+import (
+	"sync"
+	"time"
+)
+
+type BreakerState string
+
+const (
+	BREAKER_CLOSED    BreakerState = "closed"    // requests go through
+	BREAKER_OPEN      BreakerState = "open"      // the peer keeps failing, requests fail right away
+	BREAKER_HALF_OPEN BreakerState = "half-open" // the cooldown passed, a single probe request is let through
+)
+
+// what the client knows about one peer, served as metrics by both binaries
+type PeerStats struct {
+	State               BreakerState
+	LatencyMs           float64 // moving average, failed requests count as FAILURE_PENALTY_MS
+	Requests            int64
+	Failures            int64
+	ShortCircuited      int64 // requests failed right away because the breaker was open
+	ConsecutiveFailures int
+	LastError           string    `json:",omitempty"`
+	LastSeen            time.Time // last response of any kind
+	OpenedAt            time.Time // when the breaker last opened
+}
+
+const LATENCY_SMOOTHING = 0.2   // weight of the newest sample in the moving average
+const FAILURE_PENALTY_MS = 1000 // latency a failed request counts as, so failing peers sort behind healthy ones
+
+type breaker struct {
+	lock          sync.Mutex
+	stats         PeerStats
+	probeInFlight bool
+}
+
+func (b *breaker) Allow(threshold int, cooldown time.Duration) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.stats.State {
+	case BREAKER_OPEN:
+		if time.Since(b.stats.OpenedAt) < cooldown {
+			b.stats.ShortCircuited++
+			return false
+		}
+		b.stats.State = BREAKER_HALF_OPEN
+		b.probeInFlight = true
+		return true
+	case BREAKER_HALF_OPEN:
+		if b.probeInFlight {
+			b.stats.ShortCircuited++
+			return false
+		}
+		b.probeInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) RecordSuccess(latency time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	sample := float64(latency) / float64(time.Millisecond)
+	if b.stats.Requests == 0 {
+		b.stats.LatencyMs = sample
+	} else {
+		b.stats.LatencyMs += LATENCY_SMOOTHING * (sample - b.stats.LatencyMs)
+	}
+
+	b.stats.Requests++
+	b.stats.ConsecutiveFailures = 0
+	b.stats.LastSeen = time.Now()
+	b.stats.State = BREAKER_CLOSED
+	b.probeInFlight = false
+}
+
+func (b *breaker) RecordFailure(err error, threshold int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.stats.LatencyMs += LATENCY_SMOOTHING * (FAILURE_PENALTY_MS - b.stats.LatencyMs)
+	b.stats.Requests++
+	b.stats.Failures++
+	b.stats.ConsecutiveFailures++
+	b.stats.LastError = err.Error()
+
+	if b.stats.State == BREAKER_HALF_OPEN || b.stats.ConsecutiveFailures >= threshold {
+		if b.stats.State != BREAKER_OPEN {
+			b.stats.OpenedAt = time.Now()
+		}
+		b.stats.State = BREAKER_OPEN
+	}
+	b.probeInFlight = false
+}
+
+// the caller stopped waiting after elapsed, the peer took at least that long. it isn't a failure, but a
+// peer that is always abandoned should stop looking fast
+func (b *breaker) RecordAbandoned(elapsed time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	sample := float64(elapsed) / float64(time.Millisecond)
+	if sample > b.stats.LatencyMs {
+		b.stats.LatencyMs += LATENCY_SMOOTHING * (sample - b.stats.LatencyMs)
+	}
+	b.probeInFlight = false
+}
+
+// the probe was given up before it could tell anything about the peer
+func (b *breaker) ReleaseProbe() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probeInFlight = false
+}
+
+func (b *breaker) Stats() PeerStats {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.stats
+}
@@ -0,0 +1,381 @@
+// Package rpcclient is the http client every internal call between the controller and the nodes goes
+// through. It gives every attempt a deadline, reuses connections, retries with jittered exponential
+// backoff and keeps a circuit breaker per peer
+package rpcclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	BreakerThreshold int           // consecutive failures that open a peer's breaker
+	BreakerCooldown  time.Duration // how long an open breaker fails requests before letting a probe through
+	MaxIdleConns     int           // idle connections kept per peer
+}
+
+// options of a single call, the zero value makes one attempt without a deadline
+type CallOptions struct {
+	Timeout       time.Duration // deadline of every attempt, 0 means none
+	Attempts      int           // attempts on network errors and 500/502/504 responses, at least 1
+	BusyRetries   int           // extra attempts when the peer answers 429/503, these don't count against Attempts
+	BaseBackoff   time.Duration // first backoff, doubled after every attempt
+	MaxBackoff    time.Duration
+	IgnoreBreaker bool // health checks go through an open breaker, their result still counts
+}
+
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+type Client struct {
+	config    Config
+	transport *http.Transport
+	http      *http.Client
+	breakers  map[string]*breaker
+	lock      sync.Mutex
+}
+
+const DEFAULT_BREAKER_THRESHOLD = 5
+const DEFAULT_BREAKER_COOLDOWN = 10 * time.Second
+const DEFAULT_MAX_IDLE_CONNS = 32
+const DEFAULT_BASE_BACKOFF = 200 * time.Millisecond
+const DEFAULT_MAX_BACKOFF = 30 * time.Second
+
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+
+func init() {
+	rand.Seed(time.Now().UnixNano()) // otherwise every process jitters the same way
+}
+
+func New(config Config) *Client {
+	if config.BreakerThreshold <= 0 {
+		config.BreakerThreshold = DEFAULT_BREAKER_THRESHOLD
+	}
+	if config.BreakerCooldown <= 0 {
+		config.BreakerCooldown = DEFAULT_BREAKER_COOLDOWN
+	}
+	if config.MaxIdleConns <= 0 {
+		config.MaxIdleConns = DEFAULT_MAX_IDLE_CONNS
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:        config.MaxIdleConns * 8,
+		MaxIdleConnsPerHost: config.MaxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &Client{config: config, transport: transport, http: &http.Client{Transport: transport}, breakers: make(map[string]*breaker)}
+}
+
+// https peers are verified with (and presented the client certificate of) config, has to be set before
+// the first call
+func (client *Client) SetTLSConfig(config *tls.Config) {
+	client.transport.TLSClientConfig = config
+}
+
+// peers are keyed by scheme and host, so every path of a node shares one breaker
+func GetPeer(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+func (client *Client) getBreaker(peer string) *breaker {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	b, found := client.breakers[peer]
+	if !found {
+		b = &breaker{stats: PeerStats{State: BREAKER_CLOSED}}
+		client.breakers[peer] = b
+	}
+	return b
+}
+
+// true if the peer failed for a reason that says something about its health, 503 is backpressure and
+// 501 just means the peer doesn't support the call
+func isPeerFailure(statusCode int) bool {
+	return statusCode == http.StatusInternalServerError || statusCode == http.StatusBadGateway || statusCode == http.StatusGatewayTimeout
+}
+
+func isBusy(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// full jitter: a random wait between 0 and the current backoff
+func jitter(backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+func sleep(ctx context.Context, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// makes the request and reads the whole body. the response is returned with a nil error whenever the
+// peer answered, whatever the status code, except for a peer that stayed busy through every busy retry
+func (client *Client) Do(ctx context.Context, method string, rawURL string, body []byte, options CallOptions) (*Response, error) {
+	var result *Response
+	err := client.do(ctx, method, rawURL, body, options, func(res *http.Response) error {
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+
+		result = &Response{StatusCode: res.StatusCode, Header: res.Header, Body: data}
+		return nil
+	})
+
+	return result, err
+}
+
+// like Do but hands the response to handle while the body is still being streamed, the body is closed
+// once handle returns. handle isn't called for responses that get retried
+func (client *Client) Stream(ctx context.Context, method string, rawURL string, body []byte, options CallOptions, handle func(*http.Response) error) error {
+	return client.do(ctx, method, rawURL, body, options, handle)
+}
+
+func (client *Client) Get(ctx context.Context, rawURL string, options CallOptions) (*Response, error) {
+	return client.Do(ctx, http.MethodGet, rawURL, nil, options)
+}
+
+func (client *Client) Post(ctx context.Context, rawURL string, body []byte, options CallOptions) (*Response, error) {
+	return client.Do(ctx, http.MethodPost, rawURL, body, options)
+}
+
+func (client *Client) do(ctx context.Context, method string, rawURL string, body []byte, options CallOptions, handle func(*http.Response) error) error {
+	if _, err := url.Parse(rawURL); err != nil {
+		return err
+	}
+
+	return client.call(ctx, GetPeer(rawURL), options, func(ctx context.Context) (*answer, error) {
+		var reader io.Reader = http.NoBody
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+
+		request, err := http.NewRequestWithContext(ctx, method, rawURL, reader)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			request.Header.Set("Content-Type", "application/json")
+		}
+
+		res, err := client.http.Do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		return &answer{
+			StatusCode: res.StatusCode,
+			Header:     res.Header,
+			Describe:   method + " " + request.URL.Path,
+			Finish: func() error {
+				defer res.Body.Close()
+				return handle(res)
+			},
+			Discard: func() {
+				io.Copy(io.Discard, res.Body) // lets the connection be reused
+				res.Body.Close()
+			},
+		}, nil
+	})
+}
+
+// one attempt over a transport other than http, see Invoke. the status codes mean the same as in http and
+// a busy peer's Retry-After goes in the header
+type RoundTrip func(ctx context.Context) (*Response, error)
+
+// makes a call over another transport with the same deadlines, retries and breaker as Do. peer is the
+// peer's http address, so both transports share its breaker and latency
+func (client *Client) Invoke(ctx context.Context, peer string, options CallOptions, roundTrip RoundTrip) (*Response, error) {
+	var result *Response
+	err := client.call(ctx, GetPeer(peer), options, func(ctx context.Context) (*answer, error) {
+		res, err := roundTrip(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return &answer{
+			StatusCode: res.StatusCode,
+			Header:     res.Header,
+			Describe:   peer,
+			Finish: func() error {
+				result = res
+				return nil
+			},
+			Discard: func() {},
+		}, nil
+	})
+
+	return result, err
+}
+
+// the peer's answer to one attempt, Finish hands it to the caller and Discard drops it when it gets retried
+type answer struct {
+	StatusCode int
+	Header     http.Header
+	Describe   string // what was called, for errors
+	Finish     func() error
+	Discard    func()
+}
+
+func (client *Client) call(ctx context.Context, peer string, options CallOptions, send func(context.Context) (*answer, error)) error {
+	peerBreaker := client.getBreaker(peer)
+
+	backoff := options.BaseBackoff
+	if backoff <= 0 {
+		backoff = DEFAULT_BASE_BACKOFF
+	}
+	maxBackoff := options.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DEFAULT_MAX_BACKOFF
+	}
+
+	attempts, busyRetries := 0, 0
+	var lastErr error
+	for {
+		if !options.IgnoreBreaker && !peerBreaker.Allow(client.config.BreakerThreshold, client.config.BreakerCooldown) {
+			return fmt.Errorf("%s: %w", peer, ErrBreakerOpen)
+		}
+
+		wait, retry, err := client.attempt(ctx, peerBreaker, options.Timeout, send)
+		if !retry {
+			return err
+		}
+		lastErr = err
+
+		if wait > 0 {
+			busyRetries++
+			if busyRetries > options.BusyRetries {
+				return lastErr
+			}
+		} else {
+			attempts++
+			if attempts >= options.Attempts {
+				return lastErr
+			}
+		}
+
+		// the peer's Retry-After wins if it asks for longer than our backoff
+		delay := jitter(backoff)
+		if wait > delay {
+			delay = wait
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// makes one request. returns whether it is worth retrying, and for busy peers how long they asked us to wait
+func (client *Client) attempt(ctx context.Context, peerBreaker *breaker, timeout time.Duration, send func(context.Context) (*answer, error)) (time.Duration, bool, error) {
+	attemptCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	sentAt := time.Now()
+	res, err := send(attemptCtx)
+	if err != nil {
+		if ctx.Err() != nil {
+			peerBreaker.RecordAbandoned(time.Since(sentAt)) // the caller gave up, that says nothing about the peer's health
+			return 0, false, ctx.Err()
+		}
+
+		peerBreaker.RecordFailure(err, client.config.BreakerThreshold)
+		return 0, true, err
+	}
+
+	if isPeerFailure(res.StatusCode) {
+		err = fmt.Errorf("%s failed with status %d", res.Describe, res.StatusCode)
+		peerBreaker.RecordFailure(err, client.config.BreakerThreshold)
+		res.Discard()
+		return 0, true, err
+	}
+
+	peerBreaker.RecordSuccess(time.Since(sentAt))
+
+	if isBusy(res.StatusCode) {
+		wait := time.Millisecond // retried as busy even without a Retry-After
+		if retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && retryAfter > 0 {
+			wait = time.Duration(retryAfter) * time.Second
+		}
+
+		err = fmt.Errorf("%s: peer is busy (status %d)", res.Describe, res.StatusCode)
+		res.Discard()
+		return wait, true, &BusyError{StatusCode: res.StatusCode, err: err}
+	}
+
+	return 0, false, res.Finish()
+}
+
+// returned once a peer is still busy after every busy retry
+type BusyError struct {
+	StatusCode int
+	err        error
+}
+
+func (err *BusyError) Error() string {
+	return err.err.Error()
+}
+
+// expected latency of the peer in ms, peers we haven't talked to yet count as fast so they get tried
+func (client *Client) GetLatency(peer string) float64 {
+	client.lock.Lock()
+	b, found := client.breakers[GetPeer(peer)]
+	client.lock.Unlock()
+
+	if !found {
+		return 0
+	}
+	return b.Stats().LatencyMs
+}
+
+// breaker state and latency of every peer the client talked to
+func (client *Client) Stats() map[string]PeerStats {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	stats := make(map[string]PeerStats, len(client.breakers))
+	for peer, b := range client.breakers {
+		stats[peer] = b.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,215 @@
+package wire
+
+import (
+	"DBCommon/rpcclient"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const DIAL_TIMEOUT = 5 * time.Second
+const DEFAULT_MAX_IDLE_CONNS = 16
+
+// the connection to the peer failed, as opposed to the peer answering with an error status. the caller
+// might want to renegotiate, the peer could have been replaced by a version without the protocol
+type ConnError struct {
+	err error
+}
+
+func (err *ConnError) Error() string {
+	return "wire: " + err.err.Error()
+}
+
+func (err *ConnError) Unwrap() error {
+	return err.err
+}
+
+func IsConnError(err error) bool {
+	var connErr *ConnError
+	return errors.As(err, &connErr)
+}
+
+// keeps a pool of handshaked connections to one peer
+type Client struct {
+	addr      string
+	idle      chan net.Conn
+	tlsConfig *tls.Config // nil if the peer is talked to in plaintext
+}
+
+func NewClient(addr string, maxIdleConns int, tlsConfig *tls.Config) *Client {
+	if maxIdleConns <= 0 {
+		maxIdleConns = DEFAULT_MAX_IDLE_CONNS
+	}
+	return &Client{addr: addr, idle: make(chan net.Conn, maxIdleConns), tlsConfig: tlsConfig}
+}
+
+func (client *Client) Addr() string {
+	return client.addr
+}
+
+func (client *Client) getConn(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-client.idle:
+		return conn, nil
+	default:
+	}
+
+	var conn net.Conn
+	var err error
+	dialer := net.Dialer{Timeout: DIAL_TIMEOUT, KeepAlive: 30 * time.Second}
+	if client.tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: &dialer, Config: client.tlsConfig}).DialContext(ctx, "tcp", client.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", client.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := handshake(ctx, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (client *Client) putConn(conn net.Conn) {
+	select {
+	case client.idle <- conn:
+	default:
+		conn.Close() // pool is full
+	}
+}
+
+// closes the idle connections, the ones in use are closed when their call finishes
+func (client *Client) Close() {
+	for {
+		select {
+		case conn := <-client.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func handshake(ctx context.Context, conn net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	encoder := Encoder{}
+	encoder.Uvarint(PROTOCOL_VERSION)
+	if err := WriteFrame(conn, []byte{byte(OP_HEALTH)}, encoder.Data()); err != nil {
+		return err
+	}
+
+	status, _, body, err := readResponse(conn)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("handshake failed with status %d", status)
+	}
+
+	decoder := NewDecoder(body)
+	version := decoder.Uvarint()
+	if decoder.Err() != nil || version < PROTOCOL_VERSION {
+		return fmt.Errorf("peer speaks protocol version %d, we need %d", version, PROTOCOL_VERSION)
+	}
+	return nil
+}
+
+func readResponse(conn net.Conn) (uint16, uint32, []byte, error) {
+	frame, err := ReadFrame(conn)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(frame) < 6 {
+		return 0, 0, nil, ErrMalformed
+	}
+
+	return binary.BigEndian.Uint16(frame[0:2]), binary.BigEndian.Uint32(frame[2:6]), frame[6:], nil
+}
+
+// sends one request and waits for the final response, pieces of a streamed answer are handed to onPiece
+// as they arrive. meant to be used as an rpcclient.RoundTrip so the call gets the client's retries and
+// breaker, a busy peer's retry after is put in the Retry-After header for that reason
+func (client *Client) RoundTrip(ctx context.Context, op Op, body []byte, onPiece func([]byte) error) (*rpcclient.Response, error) {
+	conn, err := client.getConn(ctx)
+	if err != nil {
+		return nil, &ConnError{err}
+	}
+
+	healthy := false
+	defer func() {
+		if healthy {
+			client.putConn(conn)
+		} else {
+			conn.Close()
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Time{})
+	}
+
+	// cancelling ctx interrupts the call, the connection isn't reused after that
+	if ctx.Done() != nil {
+		done, watcherExited := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(watcherExited)
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(time.Unix(1, 0))
+			case <-done:
+			}
+		}()
+		defer func() {
+			close(done)
+			<-watcherExited
+			if ctx.Err() != nil {
+				healthy = false
+			}
+		}()
+	}
+
+	if err := WriteFrame(conn, []byte{byte(op)}, body); err != nil {
+		if errors.Is(err, ErrFrameTooLarge) {
+			return nil, err
+		}
+		return nil, &ConnError{err}
+	}
+
+	for {
+		status, retryAfterS, payload, err := readResponse(conn)
+		if err != nil {
+			return nil, &ConnError{err}
+		}
+
+		if status == STATUS_PIECE {
+			if onPiece != nil {
+				if err := onPiece(payload); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		healthy = true
+		header := http.Header{}
+		if retryAfterS > 0 {
+			header.Set("Retry-After", strconv.Itoa(int(retryAfterS)))
+		}
+		return &rpcclient.Response{StatusCode: int(status), Header: header, Body: payload}, nil
+	}
+}
@@ -0,0 +1,185 @@
+// Package wire is the length-prefixed binary protocol the nodes use between each other, it replaces
+// query strings and JSON for internal traffic with peers that support it. Every request is one frame
+// and is answered with one or more frames on the same connection, requests on a connection don't overlap
+//
+// request frame:  u32 length | u8 op | body
+// response frame: u32 length | u16 status | u32 retry after (s) | body
+//
+// statuses are http status codes and mean the same thing, 206 marks one piece of a streamed answer that
+// more frames follow
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type Op uint8
+
+const (
+	OP_HEALTH   Op = 1 // handshake on every new connection, carries the protocol version
+	OP_SET      Op = 2 // replicate a single entry
+	OP_GET      Op = 3 // fetch a single entry
+	OP_SETCHUNK Op = 4 // write a chunk of entries, the body is prefixed with the compression codec of the rest
+	OP_GETALL   Op = 5 // stream every entry of a namespace, every piece and the answer are prefixed with their codec
+	OP_TOPOLOGY Op = 6 // the network the peer placed its data with
+	OP_DELETE   Op = 7 // delete a single entry
+	OP_SCAN     Op = 8 // one page of the keys the peer is the first replica of
+)
+
+// bumped whenever a message changes shape, peers on different versions talk over http instead
+const PROTOCOL_VERSION = 5
+const PROTOCOL_NAME = "binary/5" // advertised by /internal/hello
+const MAX_FRAME_BYTES = 64 << 20
+const STATUS_PIECE = 206
+
+var ErrFrameTooLarge = errors.New("frame is larger than MAX_FRAME_BYTES")
+var ErrMalformed = errors.New("malformed message")
+
+func WriteFrame(writer io.Writer, header []byte, body []byte) error {
+	size := len(header) + len(body)
+	if size > MAX_FRAME_BYTES {
+		return ErrFrameTooLarge
+	}
+
+	frame := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(frame, uint32(size))
+	frame = append(frame, header...)
+	frame = append(frame, body...)
+	_, err := writer.Write(frame)
+	return err
+}
+
+func ReadFrame(reader io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(reader, size[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(size[:])
+	if length > MAX_FRAME_BYTES {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// builds message bodies, strings and byte slices are prefixed with their length as a uvarint
+type Encoder struct {
+	buf []byte
+}
+
+func (encoder *Encoder) Uvarint(value uint64) {
+	encoder.buf = binary.AppendUvarint(encoder.buf, value)
+}
+
+func (encoder *Encoder) Varint(value int64) {
+	encoder.buf = binary.AppendVarint(encoder.buf, value)
+}
+
+func (encoder *Encoder) Bool(value bool) {
+	if value {
+		encoder.buf = append(encoder.buf, 1)
+	} else {
+		encoder.buf = append(encoder.buf, 0)
+	}
+}
+
+func (encoder *Encoder) String(value string) {
+	encoder.Uvarint(uint64(len(value)))
+	encoder.buf = append(encoder.buf, value...)
+}
+
+func (encoder *Encoder) Bytes(value []byte) {
+	encoder.Uvarint(uint64(len(value)))
+	encoder.buf = append(encoder.buf, value...)
+}
+
+func (encoder *Encoder) Data() []byte {
+	return encoder.buf
+}
+
+// reads what Encoder wrote. the first error sticks, reads after it return zero values, so a message can
+// be decoded field by field and checked once with Err
+type Decoder struct {
+	buf []byte
+	err error
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{buf: data}
+}
+
+func (decoder *Decoder) Uvarint() uint64 {
+	if decoder.err != nil {
+		return 0
+	}
+
+	value, n := binary.Uvarint(decoder.buf)
+	if n <= 0 {
+		decoder.err = ErrMalformed
+		return 0
+	}
+	decoder.buf = decoder.buf[n:]
+	return value
+}
+
+func (decoder *Decoder) Varint() int64 {
+	if decoder.err != nil {
+		return 0
+	}
+
+	value, n := binary.Varint(decoder.buf)
+	if n <= 0 {
+		decoder.err = ErrMalformed
+		return 0
+	}
+	decoder.buf = decoder.buf[n:]
+	return value
+}
+
+func (decoder *Decoder) Bool() bool {
+	if decoder.err != nil {
+		return false
+	}
+	if len(decoder.buf) == 0 {
+		decoder.err = ErrMalformed
+		return false
+	}
+
+	value := decoder.buf[0] != 0
+	decoder.buf = decoder.buf[1:]
+	return value
+}
+
+func (decoder *Decoder) Bytes() []byte {
+	length := decoder.Uvarint()
+	if decoder.err != nil {
+		return nil
+	}
+	if length > uint64(len(decoder.buf)) {
+		decoder.err = ErrMalformed
+		return nil
+	}
+
+	value := decoder.buf[:length]
+	decoder.buf = decoder.buf[length:]
+	return value
+}
+
+func (decoder *Decoder) String() string {
+	return string(decoder.Bytes())
+}
+
+func (decoder *Decoder) Err() error {
+	if decoder.err != nil {
+		return fmt.Errorf("wire: %w", decoder.err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	encoder := Encoder{}
+	encoder.Uvarint(0)
+	encoder.Uvarint(math.MaxUint64)
+	encoder.Varint(math.MinInt64)
+	encoder.Varint(-1)
+	encoder.Bool(true)
+	encoder.Bool(false)
+	encoder.String("")
+	encoder.String("key\x00with\xffbytes")
+	encoder.Bytes(bytes.Repeat([]byte{0xab}, 300)) // a length that takes two uvarint bytes
+	encoder.Bytes(nil)
+
+	decoder := NewDecoder(encoder.Data())
+	if got := decoder.Uvarint(); got != 0 {
+		t.Errorf("Uvarint() = %d, want 0", got)
+	}
+	if got := decoder.Uvarint(); got != math.MaxUint64 {
+		t.Errorf("Uvarint() = %d, want %d", got, uint64(math.MaxUint64))
+	}
+	if got := decoder.Varint(); got != math.MinInt64 {
+		t.Errorf("Varint() = %d, want %d", got, int64(math.MinInt64))
+	}
+	if got := decoder.Varint(); got != -1 {
+		t.Errorf("Varint() = %d, want -1", got)
+	}
+	if got := decoder.Bool(); !got {
+		t.Error("Bool() = false, want true")
+	}
+	if got := decoder.Bool(); got {
+		t.Error("Bool() = true, want false")
+	}
+	if got := decoder.String(); got != "" {
+		t.Errorf("String() = %q, want \"\"", got)
+	}
+	if got := decoder.String(); got != "key\x00with\xffbytes" {
+		t.Errorf("String() = %q, want %q", got, "key\x00with\xffbytes")
+	}
+	if got := decoder.Bytes(); !bytes.Equal(got, bytes.Repeat([]byte{0xab}, 300)) {
+		t.Errorf("Bytes() returned %d bytes, want the 300 written", len(got))
+	}
+	if got := decoder.Bytes(); len(got) != 0 {
+		t.Errorf("Bytes() = %v, want empty", got)
+	}
+	if err := decoder.Err(); err != nil {
+		t.Fatalf("Err() = %v after decoding everything that was encoded", err)
+	}
+}
+
+func TestDecoderMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		decode func(decoder *Decoder)
+	}{
+		{"EmptyUvarint", nil, func(decoder *Decoder) { decoder.Uvarint() }},
+		{"TruncatedUvarint", []byte{0x80}, func(decoder *Decoder) { decoder.Uvarint() }},
+		{"OverflowingUvarint", bytes.Repeat([]byte{0xff}, 11), func(decoder *Decoder) { decoder.Uvarint() }},
+		{"TruncatedVarint", []byte{0xff}, func(decoder *Decoder) { decoder.Varint() }},
+		{"EmptyBool", nil, func(decoder *Decoder) { decoder.Bool() }},
+		{"LengthPastEnd", []byte{5, 'a', 'b'}, func(decoder *Decoder) { _ = decoder.String() }},
+		{"HugeLength", binary.AppendUvarint(nil, math.MaxUint64), func(decoder *Decoder) { decoder.Bytes() }},
+		{"MissingSecondField", []byte{1, 'a'}, func(decoder *Decoder) { _, _ = decoder.String(), decoder.String() }},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			decoder := NewDecoder(test.data)
+			test.decode(decoder)
+			if err := decoder.Err(); !errors.Is(err, ErrMalformed) {
+				t.Fatalf("Err() = %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+func TestDecoderErrorSticks(t *testing.T) {
+	encoder := Encoder{}
+	encoder.Uvarint(7)
+
+	// the failed read leaves the buffer alone, the error has to keep the valid uvarint after it from being read
+	decoder := NewDecoder(append([]byte{9}, encoder.Data()...))
+	_ = decoder.Bytes()
+	if got := decoder.Uvarint(); got != 0 {
+		t.Errorf("Uvarint() after an error = %d, want 0", got)
+	}
+	if got := decoder.String(); got != "" {
+		t.Errorf("String() after an error = %q, want \"\"", got)
+	}
+	if !errors.Is(decoder.Err(), ErrMalformed) {
+		t.Fatalf("Err() = %v, want ErrMalformed", decoder.Err())
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, []byte{byte(OP_GET)}, []byte("body")); err != nil {
+		t.Fatalf("WriteFrame() = %v", err)
+	}
+	if err := WriteFrame(&buf, nil, nil); err != nil {
+		t.Fatalf("WriteFrame() of an empty frame = %v", err)
+	}
+
+	frame, err := ReadFrame(&buf)
+	if err != nil || !bytes.Equal(frame, []byte("\x03body")) {
+		t.Fatalf("ReadFrame() = %q, %v, want \"\\x03body\"", frame, err)
+	}
+	frame, err = ReadFrame(&buf)
+	if err != nil || len(frame) != 0 {
+		t.Fatalf("ReadFrame() = %q, %v, want an empty frame", frame, err)
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Fatalf("ReadFrame() past the last frame = %v, want io.EOF", err)
+	}
+}
+
+func TestFrameMalformed(t *testing.T) {
+	if err := WriteFrame(io.Discard, []byte{byte(OP_SET)}, make([]byte, MAX_FRAME_BYTES)); err != ErrFrameTooLarge {
+		t.Errorf("WriteFrame() of an oversized frame = %v, want ErrFrameTooLarge", err)
+	}
+
+	tooLarge := binary.BigEndian.AppendUint32(nil, MAX_FRAME_BYTES+1)
+	if _, err := ReadFrame(bytes.NewReader(tooLarge)); err != ErrFrameTooLarge {
+		t.Errorf("ReadFrame() with an oversized length = %v, want ErrFrameTooLarge", err)
+	}
+
+	if _, err := ReadFrame(bytes.NewReader([]byte{0, 0})); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadFrame() with a truncated length = %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	truncated := append(binary.BigEndian.AppendUint32(nil, 10), "short"...)
+	if _, err := ReadFrame(bytes.NewReader(truncated)); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadFrame() with a truncated body = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
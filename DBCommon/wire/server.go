@@ -0,0 +1,119 @@
+package wire
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// answers one request, the handler sends any number of pieces and then exactly one final response
+type ResponseWriter struct {
+	conn    net.Conn
+	written bool
+	err     error
+}
+
+func (writer *ResponseWriter) write(status uint16, retryAfterS uint32, body []byte) {
+	if writer.err != nil {
+		return
+	}
+
+	var header [6]byte
+	binary.BigEndian.PutUint16(header[0:2], status)
+	binary.BigEndian.PutUint32(header[2:6], retryAfterS)
+	writer.err = WriteFrame(writer.conn, header[:], body)
+}
+
+// sends one piece of a streamed answer, the caller gets the pieces in order before the final response
+func (writer *ResponseWriter) WritePiece(body []byte) error {
+	writer.write(STATUS_PIECE, 0, body)
+	return writer.err
+}
+
+func (writer *ResponseWriter) Write(status int, body []byte) {
+	writer.WriteBusy(status, 0, body)
+}
+
+// like Write but tells the caller how long to back off, the equivalent of Retry-After
+func (writer *ResponseWriter) WriteBusy(status int, retryAfterS int, body []byte) {
+	if writer.written {
+		return
+	}
+	writer.written = true
+	writer.write(uint16(status), uint32(retryAfterS), body)
+}
+
+type Handler func(remoteAddr string, op Op, body []byte, response *ResponseWriter)
+
+const CONN_IDLE_TIMEOUT = 5 * time.Minute // pooled connections that see no request for this long get closed
+
+// accepts connections until the listener is closed. the health handshake is answered here, every other
+// op goes to handler
+func Serve(listener net.Listener, handler Handler) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go ServeConn(conn, handler)
+	}
+}
+
+func ServeConn(conn net.Conn, handler Handler) {
+	defer conn.Close()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(CONN_IDLE_TIMEOUT))
+		frame, err := ReadFrame(conn)
+		if err != nil {
+			return // closed by the peer, or it sent garbage
+		}
+		if len(frame) == 0 {
+			log.Printf("wire.ServeConn: [%s] sent an empty frame, closing connection\n", conn.RemoteAddr())
+			return
+		}
+
+		response := &ResponseWriter{conn: conn}
+		op, body := Op(frame[0]), frame[1:]
+		if op == OP_HEALTH {
+			if version := NewDecoder(body).Uvarint(); version < PROTOCOL_VERSION {
+				log.Printf("wire.ServeConn: [%s] speaks protocol version %d, we need %d\n", conn.RemoteAddr(), version, PROTOCOL_VERSION)
+				response.Write(http.StatusHTTPVersionNotSupported, nil)
+				return
+			}
+
+			encoder := Encoder{}
+			encoder.Uvarint(PROTOCOL_VERSION)
+			response.Write(http.StatusOK, encoder.Data())
+		} else {
+			if !serveRequest(conn, handler, op, body, response) {
+				return
+			}
+			if !response.written {
+				response.Write(http.StatusInternalServerError, nil)
+			}
+		}
+
+		if response.err != nil {
+			return
+		}
+	}
+}
+
+// runs the handler for one request. a handler that panics only takes its connection down, what it already
+// wrote of the answer can't be taken back, so the connection is closed instead of answering 500
+func serveRequest(conn net.Conn, handler Handler, op Op, body []byte, response *ResponseWriter) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("wire.ServeConn: [%s] op %d panicked, closing connection: %v\n%s", conn.RemoteAddr(), op, err, debug.Stack())
+			ok = false
+		}
+	}()
+
+	handler(conn.RemoteAddr().String(), op, body, response)
+	return true
+}
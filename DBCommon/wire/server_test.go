@@ -0,0 +1,45 @@
+package wire
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestServeConnRecoversFromPanics(t *testing.T) {
+	handler := func(remoteAddr string, op Op, body []byte, response *ResponseWriter) {
+		if op == OP_DELETE {
+			panic("handler bug")
+		}
+		response.Write(http.StatusOK, body)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() = %v", err)
+	}
+	defer listener.Close()
+	go Serve(listener, handler)
+
+	panicking, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() = %v", err)
+	}
+	defer panicking.Close()
+
+	if err := WriteFrame(panicking, []byte{byte(OP_DELETE)}, nil); err != nil {
+		t.Fatalf("WriteFrame() = %v", err)
+	}
+	if frame, err := ReadFrame(panicking); err == nil {
+		t.Fatalf("ReadFrame() after the handler panicked = %q, want the connection closed", frame)
+	}
+
+	// the server and its other connections keep going
+	client := NewClient(listener.Addr().String(), 1, nil)
+	defer client.Close()
+	res, err := client.RoundTrip(context.Background(), OP_GET, []byte("still serving"), nil)
+	if err != nil || res.StatusCode != http.StatusOK || string(res.Body) != "still serving" {
+		t.Fatalf("RoundTrip() after another connection panicked = %+v, %v, want 200 with the body echoed", res, err)
+	}
+}
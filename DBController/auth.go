@@ -0,0 +1,350 @@
+package main
+
+import (
+	"DBCommon/auth"
+	"DBCommon/clustertls"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// with -auth the controller issues API tokens and every client of the controller and the nodes has to
+// present one. tokens are kept in -tokenfile and pushed to the nodes whenever they change, the nodes
+// download them on /internal/auth too. the admin scope is needed for every route that changes the
+// cluster, read is enough for the network, peers, namespaces and replication rules. processes of the
+// cluster authenticate with their certificates, which is why auth needs TLS
+
+const TOKEN_FILENAME = "tokens.json"
+const ADMIN_TOKEN_FILENAME = "admin.token"        // the bootstrap admin token is written here, next to the token file
+const AUTH_MAX_SIGNED_BODY_SIZE = int64(64 << 20) // signed requests with larger bodies have to use a bearer token
+const AUTH_PUSH_TRIES = 3
+
+var g_authEnabled bool
+var g_tokenFile string
+var g_tokens map[string]auth.Token
+var g_tokensLock sync.RWMutex
+
+func Auth_Setup() {
+	if !g_authEnabled {
+		return
+	}
+	if g_tls == nil {
+		log.Fatalln("-auth needs TLS, start the controller with -tlscert/-tlskey/-tlsca or -tlsdev")
+	}
+
+	if len(g_tokenFile) == 0 {
+		g_tokenFile = path.Join(g_currDir, TOKEN_FILENAME)
+	}
+
+	g_tokens = make(map[string]auth.Token)
+	contents, err := os.ReadFile(g_tokenFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatalf("Failed to read token file %s: %s\n", g_tokenFile, err.Error())
+	}
+	if err == nil {
+		tokens := make([]auth.Token, 0)
+		if err := json.Unmarshal(contents, &tokens); err != nil {
+			log.Fatalf("Failed to parse token file %s: %s\n", g_tokenFile, err.Error())
+		}
+		for _, token := range tokens {
+			g_tokens[token.ID] = token
+		}
+	}
+
+	if Auth_CountAdminTokens() == 0 {
+		Auth_CreateBootstrapToken()
+	}
+	log.Printf("Auth_Setup: clients need API tokens, %d tokens loaded from %s\n", len(g_tokens), g_tokenFile)
+}
+
+// without an admin token nobody could create tokens, so the first start writes one to a file only the
+// controller's user can read
+func Auth_CreateBootstrapToken() {
+	token, err := auth.NewToken([]string{auth.SCOPE_ADMIN}, nil, nil)
+	if err != nil {
+		log.Fatalf("Failed to create the admin token: %s\n", err.Error())
+	}
+
+	g_tokens[token.ID] = token
+	if err := Auth_SaveTokens(); err != nil {
+		log.Fatalf("Failed to save tokens to %s: %s\n", g_tokenFile, err.Error())
+	}
+
+	adminTokenFile := filepath.Join(filepath.Dir(g_tokenFile), ADMIN_TOKEN_FILENAME)
+	if err := clustertls.WriteFileAtomic(adminTokenFile, []byte(token.Credential()+"\n")); err != nil {
+		log.Fatalf("Failed to write the admin token to %s: %s\n", adminTokenFile, err.Error())
+	}
+	log.Printf("Auth_CreateBootstrapToken: wrote admin token %s to %s\n", token.ID, adminTokenFile)
+}
+
+func Auth_CountAdminTokens() int {
+	count := 0
+	for _, token := range g_tokens {
+		if token.HasScope(auth.SCOPE_ADMIN) {
+			count++
+		}
+	}
+	return count
+}
+
+// writes every token to the token file, callers hold g_tokensLock
+func Auth_SaveTokens() error {
+	tokens := make([]auth.Token, 0, len(g_tokens))
+	for _, token := range g_tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+
+	contents, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return clustertls.WriteFileAtomic(g_tokenFile, contents)
+}
+
+func Auth_Lookup(id string) (auth.Token, bool) {
+	g_tokensLock.RLock()
+	defer g_tokensLock.RUnlock()
+
+	token, found := g_tokens[id]
+	return token, found
+}
+
+func Auth_GetConfig() auth.Config {
+	config := auth.Config{Enabled: g_authEnabled, Tokens: make([]auth.Token, 0)}
+
+	g_tokensLock.RLock()
+	defer g_tokensLock.RUnlock()
+
+	for _, token := range g_tokens {
+		config.Tokens = append(config.Tokens, token)
+	}
+	return config
+}
+
+// sends the tokens to every node that isn't dead, nodes that miss it pick them up on their next refresh
+func Auth_PushToNodes() {
+	body, err := json.Marshal(Auth_GetConfig())
+	if err != nil {
+		log.Println("Auth_PushToNodes: Failed to serialize tokens", err.Error())
+		return
+	}
+
+	g_networkLock.Lock()
+	nodes := make([]DBNode, 0, len(g_network.Nodes))
+	for _, node := range g_network.Nodes {
+		if node.State != NODESTATE_DEAD {
+			nodes = append(nodes, node)
+		}
+	}
+	g_networkLock.Unlock()
+
+	for _, node := range nodes {
+		go func(node DBNode) {
+			res, err := g_rpc.Do(context.Background(), http.MethodPut, node.Addr+"/internal/auth", body, NodeCall(AUTH_PUSH_TRIES))
+			if err == nil && res.StatusCode != http.StatusOK {
+				err = errors.New(http.StatusText(res.StatusCode))
+			}
+			if err != nil {
+				log.Printf("Auth_PushToNodes: Failed to send tokens to node %d: %s\n", node.ID, err.Error())
+			}
+		}(node)
+	}
+}
+
+// the scope a route needs, reading the cluster's layout only needs read
+func Auth_GetRouteScope(request *http.Request) string {
+	switch request.URL.Path {
+	case "/network", "/peers":
+		return auth.SCOPE_READ
+	case "/namespaces", "/rfrules":
+		if request.Method == http.MethodGet {
+			return auth.SCOPE_READ
+		}
+	}
+	return auth.SCOPE_ADMIN
+}
+
+// checks the token of every request with -auth on. preflight requests carry no credentials and processes
+// of the cluster are let through on their certificates
+func Auth_RequireToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !g_authEnabled || request.Method == http.MethodOptions || clustertls.IsClusterPeer(request.TLS) {
+			handler.ServeHTTP(response, request)
+			return
+		}
+
+		EnableCors(response)
+		token, err := auth.Authenticate(request, Auth_Lookup, AUTH_MAX_SIGNED_BODY_SIZE)
+		if err != nil {
+			log.Printf("[%s]: Rejected a request for %s: %s\n", request.RemoteAddr, request.URL.Path, err.Error())
+			auth.WriteUnauthorized(response, err)
+			return
+		}
+
+		scope := Auth_GetRouteScope(request)
+		if !token.HasScope(scope) {
+			log.Printf("[%s]: Token %s doesn't have the %s scope needed for %s\n", request.RemoteAddr, token.ID, scope, request.URL.Path)
+			http.Error(response, "Route needs a token with the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(response, request)
+	})
+}
+
+// GET lists the tokens without their secrets, POST creates one with the given scopes (and namespaces and
+// key prefixes, comma separated) and answers it with its secret, which isn't shown again. DELETE revokes id
+func HandleTokens(response http.ResponseWriter, request *http.Request) {
+	EnableCors(response)
+	if HandlePreflightRequests(response, request) {
+		return
+	}
+
+	if !g_authEnabled {
+		http.Error(response, "Authentication is off, start the controller with -auth to use tokens", http.StatusConflict)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		config := Auth_GetConfig()
+		tokens := make([]auth.Token, 0, len(config.Tokens))
+		for _, token := range config.Tokens {
+			tokens = append(tokens, token.Redacted())
+		}
+		sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+
+		serialized, err := json.Marshal(tokens)
+		if err != nil {
+			log.Println("HandleTokens: Failed to serialize tokens", err.Error())
+			http.Error(response, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		response.Write(serialized)
+	case http.MethodPost:
+		HandleCreateToken(response, request)
+	case http.MethodDelete:
+		HandleRevokeToken(response, request)
+	default:
+		log.Printf("[%s]: Got a request for /tokens route with unsupported method %s\n", request.RemoteAddr, request.Method)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+	}
+}
+
+func HandleCreateToken(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	scopes, err := auth.ParseScopes(query.Get("scopes"))
+	if err != nil {
+		http.Error(response, "Invalid params, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	namespaces := auth.ParseList(query.Get("namespaces"))
+	for _, namespace := range namespaces {
+		if namespace != auth.DEFAULT_NAMESPACE_NAME && !g_namespaceNameRegex.MatchString(namespace) {
+			http.Error(response, "Invalid params, '"+namespace+"' isn't a namespace name", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, err := auth.NewToken(scopes, namespaces, auth.ParseList(query.Get("prefixes")))
+	if err != nil {
+		log.Println("HandleCreateToken: Failed to create token", err.Error())
+		http.Error(response, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	g_tokensLock.Lock()
+	g_tokens[token.ID] = token
+	err = Auth_SaveTokens()
+	if err != nil {
+		delete(g_tokens, token.ID)
+	}
+	g_tokensLock.Unlock()
+
+	if err != nil {
+		log.Println("HandleCreateToken: Failed to save tokens", err.Error())
+		http.Error(response, "Error saving token", http.StatusInternalServerError)
+		return
+	}
+
+	serialized, err := json.Marshal(token)
+	if err != nil {
+		log.Println("HandleCreateToken: Failed to serialize token", err.Error())
+		http.Error(response, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	Auth_PushToNodes()
+	log.Printf("Created token %s with scopes %v, namespaces %v and prefixes %v\n", token.ID, token.Scopes, token.Namespaces, token.Prefixes)
+	response.WriteHeader(http.StatusCreated)
+	response.Write(serialized)
+}
+
+func HandleRevokeToken(response http.ResponseWriter, request *http.Request) {
+	id := request.URL.Query().Get("id")
+	if !Auth_RevokeToken(response, id) {
+		return
+	}
+
+	Auth_PushToNodes()
+	log.Printf("Revoked token %s\n", id)
+}
+
+// answers the error and returns false if the token can't be revoked
+func Auth_RevokeToken(response http.ResponseWriter, id string) bool {
+	g_tokensLock.Lock()
+	defer g_tokensLock.Unlock()
+
+	token, found := g_tokens[id]
+	if !found {
+		http.Error(response, "Token not found", http.StatusNotFound)
+		return false
+	}
+	if token.HasScope(auth.SCOPE_ADMIN) && Auth_CountAdminTokens() == 1 {
+		http.Error(response, "Can't revoke the last admin token", http.StatusConflict)
+		return false
+	}
+
+	delete(g_tokens, id)
+	if err := Auth_SaveTokens(); err != nil {
+		g_tokens[id] = token
+		log.Println("Auth_RevokeToken: Failed to save tokens", err.Error())
+		http.Error(response, "Error saving tokens", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// the tokens the nodes check clients with, only processes of the cluster get them
+func HandleInternalAuth(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		log.Printf("[%s]: Got a request for /internal/auth route with unsupported method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if g_tls != nil && !clustertls.IsClusterPeer(request.TLS) {
+		log.Printf("[%s]: Rejected a request for %s without a cluster certificate\n", request.RemoteAddr, request.URL.Path)
+		http.Error(response, "Internal routes need a certificate issued by the cluster CA", http.StatusForbidden)
+		return
+	}
+
+	serialized, err := json.Marshal(Auth_GetConfig())
+	if err != nil {
+		log.Println("HandleInternalAuth: Failed to serialize tokens", err.Error())
+		http.Error(response, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	response.Write(serialized)
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackupTarget is where backups are shipped to, names are slash separated paths relative to the target root
+type BackupTarget interface {
+	Put(name string, body io.Reader, size int64) error
+	Get(name string) (io.ReadCloser, error)
+	List(prefix string) ([]string, error)
+	String() string
+}
+
+type DirBackupTarget struct {
+	root string
+}
+
+// talks to an S3-compatible object store using path-style urls (endpoint/bucket/key)
+type S3BackupTarget struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+type BackupNodeFile struct {
+	NodeID    int32
+	Addr      string
+	File      string // name of the snapshot inside the backup target
+	Format    string // sqlite or ndjson, depending on the storage engine of the node
+	SizeBytes int64
+	SHA256    string
+	ChangeSeq int64  `json:",omitempty"` // every change of the node up to this archive seq is in the snapshot, archived changes after it are replayed on top
+	Error     string `json:",omitempty"` // set if the snapshot of this node couldn't be taken
+
+	NamespaceChangeSeqs map[string]int64 `json:",omitempty"` // ChangeSeq of the other namespaces
+}
+
+type BackupManifest struct {
+	ID                string
+	CreatedAt         time.Time
+	NetworkEpoch      uint64
+	ReplicationFactor uint32
+	NumNodes          uint32
+	Nodes             []BackupNodeFile
+	Complete          bool                   // false if any node failed to snapshot
+	Namespaces        map[string]DBNamespace `json:",omitempty"` // every namespace but the default one, restores create the missing ones
+}
+
+const BACKUP_MANIFEST_FILE = "manifest.json"
+const SNAPSHOT_FORMAT_SQLITE = "sqlite"
+const SNAPSHOT_FORMAT_NDJSON = "ndjson"
+const BACKUP_ID_FORMAT = "20060102T150405.000Z"
+const LEGACY_BACKUP_ID_FORMAT = "20060102T150405Z" // ids of backups taken before they had ms precision
+const S3_REQUEST_TIMEOUT = NODE_SNAPSHOT_TIMEOUT   // a request carries at most one snapshot
+const S3_CONNECT_TIMEOUT = 10 * time.Second
+const S3_RESPONSE_HEADER_TIMEOUT = time.Minute // after the request body was sent
+const S3_UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+
+var g_backupTarget BackupTarget
+var g_backupLock sync.Mutex // only one backup runs at a time
+
+func MakeBackupTarget() BackupTarget {
+	if len(g_backupEndpoint) > 0 {
+		if len(g_backupBucket) == 0 {
+			log.Fatalln("MakeBackupTarget: -backupbucket is required when -backupendpoint is set")
+		}
+
+		return &S3BackupTarget{
+			endpoint:  strings.TrimSuffix(g_backupEndpoint, "/"),
+			bucket:    g_backupBucket,
+			region:    g_backupRegion,
+			accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			client: &http.Client{
+				Timeout: S3_REQUEST_TIMEOUT,
+				Transport: &http.Transport{
+					Proxy:                 http.ProxyFromEnvironment,
+					DialContext:           (&net.Dialer{Timeout: S3_CONNECT_TIMEOUT}).DialContext,
+					TLSHandshakeTimeout:   S3_CONNECT_TIMEOUT,
+					ResponseHeaderTimeout: S3_RESPONSE_HEADER_TIMEOUT,
+				},
+			},
+		}
+	}
+
+	root := g_backupDir
+	if len(root) == 0 {
+		root = path.Join(g_currDir, "backups")
+	}
+
+	return &DirBackupTarget{root: root}
+}
+
+func (target *DirBackupTarget) Put(name string, body io.Reader, size int64) error {
+	fullPath := filepath.Join(target.root, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(fullPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file first so a failed backup never leaves a truncated file under the real name
+	tmpPath := fullPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, body)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, fullPath)
+}
+
+func (target *DirBackupTarget) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(target.root, filepath.FromSlash(name)))
+}
+
+func (target *DirBackupTarget) List(prefix string) ([]string, error) {
+	names := make([]string, 0)
+	err := filepath.Walk(target.root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // nothing backed up yet
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(fullPath, ".tmp") {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(target.root, fullPath)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(relPath)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+
+	sort.Strings(names)
+	return names, err
+}
+
+func (target *DirBackupTarget) String() string {
+	return "dir:" + target.root
+}
+
+func (target *S3BackupTarget) ObjectURL(name string) string {
+	return fmt.Sprintf("%s/%s/%s", target.endpoint, target.bucket, name)
+}
+
+func (target *S3BackupTarget) Do(method string, rawURL string, body io.Reader, size int64) (*http.Response, error) {
+	request, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		request.ContentLength = size
+	}
+	target.Sign(request)
+
+	response, err := target.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("%s %s failed with status %d: %s", method, rawURL, response.StatusCode, string(message))
+	}
+
+	return response, nil
+}
+
+func (target *S3BackupTarget) Put(name string, body io.Reader, size int64) error {
+	if size < 0 {
+		return errors.New("S3BackupTarget: size of object must be known up front")
+	}
+
+	response, err := target.Do(http.MethodPut, target.ObjectURL(name), body, size)
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+	return nil
+}
+
+func (target *S3BackupTarget) Get(name string) (io.ReadCloser, error) {
+	response, err := target.Do(http.MethodGet, target.ObjectURL(name), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Body, nil
+}
+
+func (target *S3BackupTarget) List(prefix string) ([]string, error) {
+	type listBucketResult struct {
+		Contents []struct {
+			Key string
+		}
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+
+	names := make([]string, 0)
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if len(continuationToken) > 0 {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		response, err := target.Do(http.MethodGet, fmt.Sprintf("%s/%s?%s", target.endpoint, target.bucket, query.Encode()), nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var result listBucketResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			names = append(names, object.Key)
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (target *S3BackupTarget) String() string {
+	return fmt.Sprintf("s3:%s/%s", target.endpoint, target.bucket)
+}
+
+// signs the request with AWS signature v4, requests go out unsigned if no credentials are configured
+func (target *S3BackupTarget) Sign(request *http.Request) {
+	if len(target.accessKey) == 0 || len(target.secretKey) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", S3_UNSIGNED_PAYLOAD)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", request.URL.Host, S3_UNSIGNED_PAYLOAD, amzDate)
+
+	query := request.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+
+	canonicalQuery := make([]string, 0, len(queryKeys))
+	for _, key := range queryKeys {
+		canonicalQuery = append(canonicalQuery, S3URIEncode(key, true)+"="+S3URIEncode(query.Get(key), true))
+	}
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		S3URIEncode(request.URL.Path, false),
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		S3_UNSIGNED_PAYLOAD,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, target.region)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", amzDate, scope, hex.EncodeToString(requestHash[:]))
+
+	signingKey := HMACSHA256([]byte("AWS4"+target.secretKey), date)
+	signingKey = HMACSHA256(signingKey, target.region)
+	signingKey = HMACSHA256(signingKey, "s3")
+	signingKey = HMACSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(HMACSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", target.accessKey, scope, signedHeaders, signature))
+}
+
+func HMACSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// percent-encodes everything but the unreserved characters, as sigv4 expects
+func S3URIEncode(value string, encodeSlash bool) string {
+	var builder strings.Builder
+	for _, c := range []byte(value) {
+		isUnreserved := (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~'
+		if isUnreserved || (c == '/' && !encodeSlash) {
+			builder.WriteByte(c)
+		} else {
+			builder.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+
+	return builder.String()
+}
+
+func GetSnapshotExtension(format string) string {
+	if format == SNAPSHOT_FORMAT_SQLITE {
+		return "db"
+	}
+
+	return format
+}
+
+// asks the node for a snapshot of its store and ships it to the backup target under backupID
+func (node *DBNode) BackupSnapshot(backupID string) BackupNodeFile {
+	result := BackupNodeFile{NodeID: node.ID, Addr: node.Addr}
+
+	options := BulkCall(1)
+	options.Timeout = NODE_SNAPSHOT_TIMEOUT
+	err := g_rpc.Stream(context.Background(), http.MethodGet, node.Addr+"/internal/snapshot", nil, options, func(res *http.Response) error {
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("snapshot request failed with status %d", res.StatusCode)
+		}
+
+		result.Format = res.Header.Get("X-Snapshot-Format")
+		changeSeq, _ := strconv.ParseInt(res.Header.Get("X-Snapshot-Change-Seq"), 10, 64) // missing if the node keeps no change log
+		result.ChangeSeq = GetArchivedChangeSeq(node.Addr, DEFAULT_NAMESPACE, changeSeq)
+
+		namespaceSeqs := make(map[string]int64)
+		json.Unmarshal([]byte(res.Header.Get("X-Snapshot-Namespace-Change-Seqs")), &namespaceSeqs) // missing from nodes without namespaces
+		for namespace, seq := range namespaceSeqs {
+			if result.NamespaceChangeSeqs == nil {
+				result.NamespaceChangeSeqs = make(map[string]int64)
+			}
+			result.NamespaceChangeSeqs[namespace] = GetArchivedChangeSeq(node.Addr, namespace, seq)
+		}
+		result.File = fmt.Sprintf("%s/node-%d.%s", backupID, node.ID, GetSnapshotExtension(result.Format))
+
+		hash := sha256.New()
+		counter := &CountingReader{reader: io.TeeReader(res.Body, hash)}
+		err := g_backupTarget.Put(result.File, counter, res.ContentLength)
+		if err != nil {
+			return err
+		}
+
+		result.SizeBytes = counter.count
+		result.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+type CountingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (counter *CountingReader) Read(buffer []byte) (int, error) {
+	n, err := counter.reader.Read(buffer)
+	counter.count += int64(n)
+	return n, err
+}
+
+// snapshots every node in parallel, the manifest is written last so its presence marks a finished backup
+func RunBackup() (*BackupManifest, error) {
+	g_backupLock.Lock()
+	defer g_backupLock.Unlock()
+
+	now := time.Now().UTC()
+	g_networkLock.Lock()
+	manifest := BackupManifest{
+		ID:                now.Format(BACKUP_ID_FORMAT),
+		CreatedAt:         now,
+		NetworkEpoch:      g_network.Epoch,
+		ReplicationFactor: g_network.ReplicationFactor,
+		NumNodes:          g_network.NumNodes,
+		Namespaces:        make(map[string]DBNamespace, len(g_network.Namespaces)),
+	}
+	for name, namespace := range g_network.Namespaces {
+		manifest.Namespaces[name] = namespace
+	}
+	nodes := make([]DBNode, len(g_network.Nodes))
+	copy(nodes, g_network.Nodes)
+	g_networkLock.Unlock()
+
+	// the id names the backup's directory, a second backup under it would mix up the snapshots of both
+	existing, err := g_backupTarget.List(manifest.ID + "/")
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("a backup with id %s already exists", manifest.ID)
+	}
+
+	log.Printf("RunBackup: starting backup %s of %d nodes to %s\n", manifest.ID, len(nodes), g_backupTarget)
+
+	if g_changeArchiveInterval > 0 {
+		// notices nodes whose change log started over, so their snapshot seqs are recorded with the new offset
+		ArchiveAllChanges()
+	}
+
+	manifest.Nodes = make([]BackupNodeFile, len(nodes))
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			manifest.Nodes[i] = nodes[i].BackupSnapshot(manifest.ID)
+		}(i)
+	}
+	wg.Wait()
+
+	manifest.Complete = true
+	for _, file := range manifest.Nodes {
+		if len(file.Error) > 0 {
+			log.Printf("RunBackup: failed to back up node %d (%s): %s\n", file.NodeID, file.Addr, file.Error)
+			manifest.Complete = false
+		}
+	}
+
+	serializedManifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return &manifest, err
+	}
+
+	err = g_backupTarget.Put(manifest.ID+"/"+BACKUP_MANIFEST_FILE, strings.NewReader(string(serializedManifest)), int64(len(serializedManifest)))
+	if err != nil {
+		return &manifest, err
+	}
+
+	log.Printf("RunBackup: finished backup %s, complete: %t\n", manifest.ID, manifest.Complete)
+	return &manifest, nil
+}
+
+// returns the ids of every backup that has a manifest, oldest first
+// when the backup with the given id was taken
+func ParseBackupID(id string) (time.Time, error) {
+	createdAt, err := time.Parse(BACKUP_ID_FORMAT, id)
+	if err != nil {
+		createdAt, err = time.Parse(LEGACY_BACKUP_ID_FORMAT, id)
+	}
+	return createdAt, err
+}
+
+func ListBackups() ([]string, error) {
+	names, err := g_backupTarget.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0)
+	for _, name := range names {
+		if path.Base(name) == BACKUP_MANIFEST_FILE {
+			ids = append(ids, path.Dir(name))
+		}
+	}
+
+	return ids, nil
+}
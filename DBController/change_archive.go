@@ -0,0 +1,396 @@
+package main
+
+import (
+	"DBCommon/encryption"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type DBChangeOp uint8
+
+const (
+	CHANGE_OP_WRITE  DBChangeOp = iota
+	CHANGE_OP_DELETE DBChangeOp = iota
+	CHANGE_OP_DROP   DBChangeOp = iota // the key moved to other replicas and this node dropped its copy, it wasn't deleted
+)
+
+// mirrors the change log records served by the nodes on /internal/changes
+type DBChange struct {
+	Seq         int64
+	Op          DBChangeOp
+	Key         string
+	Value       string
+	Timestamp   int64  // unix timestamp (in ms) when the change was committed on the node
+	Parts       uint32 `json:",omitempty"`
+	ExpiresAt   int64  `json:",omitempty"`
+	Flags       uint32 `json:",omitempty"`
+	ContentType string `json:",omitempty"`
+}
+
+type dbChangeJSON DBChange
+
+// mirrors the json of DBChange on the nodes, binary values are base64 encoded in ValueBase64. archived
+// changes are written the same way
+func (change DBChange) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(change.Value) {
+		return json.Marshal(dbChangeJSON(change))
+	}
+
+	raw := dbChangeJSON(change)
+	raw.Value = ""
+	return json.Marshal(struct {
+		dbChangeJSON
+		ValueBase64 string
+	}{raw, base64.StdEncoding.EncodeToString([]byte(change.Value))})
+}
+
+func (change *DBChange) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		dbChangeJSON
+		ValueBase64 string
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*change = DBChange(raw.dbChangeJSON)
+	if len(raw.ValueBase64) > 0 {
+		value, err := base64.StdEncoding.DecodeString(raw.ValueBase64)
+		if err != nil {
+			return err
+		}
+		change.Value = string(value)
+	}
+	return nil
+}
+
+type DBChangeBatch struct {
+	Changes   []DBChange
+	OldestSeq int64
+	LatestSeq int64 // 0 from nodes that don't report it
+}
+
+// an archived run of changes of one node, covering every change in (Since, Last]
+type ChangeSegment struct {
+	Name  string
+	Since int64
+	Last  int64
+}
+
+const CHANGE_ARCHIVE_PREFIX = "changes"
+const CHANGE_ARCHIVE_FETCH_LIMIT = 10000 // max the nodes hand out per request
+const CHANGE_OFFSET_PREFIX = "offset-"   // empty marker objects next to the segments, named after the node's seq offset
+
+var ErrNoChangeLog = errors.New("node doesn't keep a change log")
+
+var g_archivedSeqs = make(map[string]int64)   // last archived seq per node, keyed by GetChangeArchiveDir
+var g_archiveOffsets = make(map[string]int64) // added to the node's seqs in the archive, see ArchiveChanges
+var g_archiveLock sync.Mutex                  // only one archive pass runs at a time
+
+// nodes are identified by their address in the archive, ids get reassigned when nodes are removed. every
+// namespace of a node has its own dir next to the one of the default namespace, <dir>@<namespace>
+func GetChangeArchiveDir(addr string, namespace string) string {
+	name := strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://")
+	name = strings.NewReplacer(":", "_", "/", "_").Replace(name)
+	if namespace != DEFAULT_NAMESPACE {
+		name += "@" + namespace
+	}
+	return CHANGE_ARCHIVE_PREFIX + "/" + name
+}
+
+func GetChangeSegmentName(dir string, since int64, last int64) string {
+	return fmt.Sprintf("%s/%020d-%020d.ndjson", dir, since, last)
+}
+
+func GetChangeOffsetName(dir string, offset int64) string {
+	return fmt.Sprintf("%s/%s%020d", dir, CHANGE_OFFSET_PREFIX, offset)
+}
+
+func ParseChangeSegmentName(name string) (ChangeSegment, bool) {
+	segment := ChangeSegment{Name: name}
+	bounds := strings.SplitN(strings.TrimSuffix(path.Base(name), ".ndjson"), "-", 2)
+	if len(bounds) != 2 {
+		return segment, false
+	}
+
+	var err1, err2 error
+	segment.Since, err1 = strconv.ParseInt(bounds[0], 10, 64)
+	segment.Last, err2 = strconv.ParseInt(bounds[1], 10, 64)
+	return segment, err1 == nil && err2 == nil
+}
+
+// every archived segment of the node, oldest first
+func ListChangeSegments(dir string) ([]ChangeSegment, error) {
+	segments, _, err := ListChangeArchive(dir)
+	return segments, err
+}
+
+// the segments of the node, oldest first, and the offset its seqs are archived with
+func ListChangeArchive(dir string) ([]ChangeSegment, int64, error) {
+	names, err := g_backupTarget.List(dir + "/")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var offset int64
+	segments := make([]ChangeSegment, 0, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(path.Base(name), CHANGE_OFFSET_PREFIX) {
+			if parsed, err := strconv.ParseInt(strings.TrimPrefix(path.Base(name), CHANGE_OFFSET_PREFIX), 10, 64); err == nil && parsed > offset {
+				offset = parsed
+			}
+		} else if segment, ok := ParseChangeSegmentName(name); ok {
+			segments = append(segments, segment)
+		}
+	}
+
+	return segments, offset, nil
+}
+
+// the archive seq of a seq the node handed out, backups record their snapshot's seq with it
+func GetArchivedChangeSeq(addr string, namespace string, seq int64) int64 {
+	if seq == 0 {
+		return 0 // the node keeps no change log
+	}
+
+	g_archiveLock.Lock()
+	defer g_archiveLock.Unlock()
+	return seq + g_archiveOffsets[GetChangeArchiveDir(addr, namespace)]
+}
+
+func (node *DBNode) FetchChanges(namespace string, since int64, limit int) (*DBChangeBatch, error) {
+	res, err := g_rpc.Get(context.Background(), fmt.Sprintf("%s/internal/changes?namespace=%s&since=%d&limit=%d", node.Addr, url.QueryEscape(namespace), since, limit), BulkCall(1))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNotImplemented {
+		return nil, ErrNoChangeLog
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("change log request failed with status %d", res.StatusCode)
+	}
+
+	var batch DBChangeBatch
+	err = json.Unmarshal(res.Body, &batch)
+	if err != nil {
+		return nil, err
+	}
+
+	return &batch, nil
+}
+
+// copies every change the node committed since the last pass into the backup target. seqs are archived
+// plus an offset: a node whose change log started over (a replacement at the same address with a fresh data
+// dir) hands out seqs the archive already has, its changes are archived past everything archived before
+func (node *DBNode) ArchiveChanges(namespace string) error {
+	dir := GetChangeArchiveDir(node.Addr, namespace)
+
+	since, found := g_archivedSeqs[dir]
+	offset := g_archiveOffsets[dir]
+	if !found {
+		// first pass since the controller started, pick up where the archive left off
+		segments, archivedOffset, err := ListChangeArchive(dir)
+		if err != nil {
+			return err
+		}
+		if len(segments) > 0 {
+			since = segments[len(segments)-1].Last
+		}
+		offset = archivedOffset
+		g_archiveOffsets[dir] = offset
+	}
+
+	for {
+		batch, err := node.FetchChanges(namespace, since-offset, CHANGE_ARCHIVE_FETCH_LIMIT)
+		if err != nil {
+			return err
+		}
+
+		if batch.LatestSeq > 0 && batch.LatestSeq < since-offset {
+			// the seq after since is skipped, the hole tells restores that changes the old log made after the
+			// last pass are lost
+			log.Printf("ArchiveChanges: change log of node %d (%s) namespace '%s' started over at seq %d, archived up to %d, changes in between are lost\n", node.ID, node.Addr, namespace, batch.LatestSeq, since-offset)
+			offset = since + 1
+			err = g_backupTarget.Put(GetChangeOffsetName(dir, offset), bytes.NewReader(nil), 0)
+			if err != nil {
+				return err
+			}
+			since = offset
+			g_archivedSeqs[dir], g_archiveOffsets[dir] = since, offset
+			continue
+		}
+		if len(batch.Changes) == 0 {
+			break
+		}
+
+		// the segment name always says where it starts, so changes the node trimmed before
+		// they could be archived show up as a hole between segments at restore time
+		segmentSince := since
+		if batch.OldestSeq-1 > since-offset {
+			log.Printf("ArchiveChanges: node %d (%s) trimmed changes (%d, %d) before they were archived\n", node.ID, node.Addr, since-offset, batch.OldestSeq)
+			segmentSince = batch.OldestSeq - 1 + offset
+		}
+
+		var buffer bytes.Buffer
+		encoder := json.NewEncoder(&buffer)
+		for _, change := range batch.Changes {
+			change.Seq += offset
+			encoder.Encode(change)
+		}
+
+		segment := buffer.Bytes()
+		if g_keyring != nil {
+			segment = g_keyring.SealFile(segment) // the nodes keep these values encrypted, so does the archive
+		}
+
+		last := batch.Changes[len(batch.Changes)-1].Seq + offset
+		err = g_backupTarget.Put(GetChangeSegmentName(dir, segmentSince, last), bytes.NewReader(segment), int64(len(segment)))
+		if err != nil {
+			return err
+		}
+
+		since = last
+		g_archivedSeqs[dir] = since
+
+		if len(batch.Changes) < CHANGE_ARCHIVE_FETCH_LIMIT {
+			break
+		}
+	}
+
+	g_archivedSeqs[dir] = since
+	return nil
+}
+
+func ArchiveAllChanges() {
+	g_archiveLock.Lock()
+	defer g_archiveLock.Unlock()
+
+	g_networkLock.Lock()
+	nodes := make([]DBNode, len(g_network.Nodes))
+	copy(nodes, g_network.Nodes)
+	namespaces := g_network.GetNamespaceNames()
+	g_networkLock.Unlock()
+
+	for _, node := range nodes {
+		if node.State == NODESTATE_DEAD {
+			continue
+		}
+
+		for _, namespace := range namespaces {
+			err := node.ArchiveChanges(namespace)
+			if err == ErrNoChangeLog {
+				break
+			}
+			if err != nil {
+				log.Printf("ArchiveAllChanges: Failed to archive changes of node %d (%s) namespace '%s': %s\n", node.ID, node.Addr, namespace, err.Error())
+			}
+		}
+	}
+}
+
+// keeps shipping every node's change log to the backup target so it can be replayed on top of a snapshot
+func RunChangeArchiver() {
+	log.Printf("RunChangeArchiver: archiving change logs to %s every %s\n", g_backupTarget, g_changeArchiveInterval)
+	for {
+		time.Sleep(g_changeArchiveInterval)
+		ArchiveAllChanges()
+	}
+}
+
+// takes a fresh backup every interval, restores pick the newest one before the requested time
+func RunScheduledBackups() {
+	log.Printf("RunScheduledBackups: backing up to %s every %s\n", g_backupTarget, g_backupInterval)
+	for {
+		time.Sleep(g_backupInterval)
+		_, err := RunBackup()
+		if err != nil {
+			log.Printf("RunScheduledBackups: backup failed: %s\n", err.Error())
+		}
+	}
+}
+
+// calls visit with every archived change of the node in (since, until], in commit order.
+// returns false if the archive has a hole in that range
+func ReplayArchivedChanges(addr string, namespace string, since int64, until time.Time, visit func(DBChange)) (bool, error) {
+	segments, err := ListChangeSegments(GetChangeArchiveDir(addr, namespace))
+	if err != nil {
+		return false, err
+	}
+
+	complete := true
+	covered := since // every change up to this seq has been replayed
+	for _, segment := range segments {
+		if segment.Last <= covered {
+			continue
+		}
+		if segment.Since > covered {
+			complete = false
+		}
+
+		contents, err := ReadChangeSegment(segment.Name)
+		if err != nil {
+			return false, err
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(contents))
+		for {
+			var change DBChange
+			err = decoder.Decode(&change)
+			if err != nil {
+				break
+			}
+
+			if change.Seq <= covered {
+				continue
+			}
+			if change.Timestamp > until.UnixMilli() {
+				return complete, nil // the log is in commit order, nothing after this is wanted
+			}
+
+			visit(change)
+			covered = change.Seq
+		}
+
+		if err != io.EOF {
+			return false, fmt.Errorf("failed to read %s: %s", segment.Name, err.Error())
+		}
+		covered = segment.Last
+	}
+
+	return complete, nil
+}
+
+// reads an archived segment, decrypting it if it was archived with encryption on
+func ReadChangeSegment(name string) ([]byte, error) {
+	reader, err := g_backupTarget.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err = encryption.OpenFile(g_keyring, contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %s", name, err.Error())
+	}
+	return contents, nil
+}
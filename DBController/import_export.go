@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type ImportRejectedRow struct {
+	Line   int
+	Reason string
+}
+
+type ImportResult struct {
+	RowsRead     int
+	RowsImported int
+	RowsRejected int
+	Rejected     []ImportRejectedRow // capped at IMPORT_MAX_REPORTED_REJECTIONS, RowsRejected has the full count
+}
+
+type ImportRow struct {
+	Line  int
+	Entry DBEntry
+}
+
+// reads one row at a time, returns io.EOF once the input is exhausted
+type ImportRowReader interface {
+	Next() (ImportRow, error)
+}
+
+// a row that couldn't be parsed, the reader can carry on past it
+type ImportRowError struct {
+	Line   int
+	Reason string
+}
+
+type NDJSONRowReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+type CSVRowReader struct {
+	reader *csv.Reader
+	line   int
+}
+
+const EXPORT_FORMAT_NDJSON = "ndjson"
+const EXPORT_FORMAT_CSV = "csv"
+const IMPORT_DEFAULT_BATCH_SIZE = 500
+const IMPORT_MAX_REPORTED_REJECTIONS = 1000
+const IMPORT_MAX_LINE_BYTES = 16 * 1024 * 1024
+
+var ErrUnknownFormat = errors.New("unknown format, expected ndjson or csv")
+
+func (err *ImportRowError) Error() string {
+	return fmt.Sprintf("line %d: %s", err.Line, err.Reason)
+}
+
+func MakeImportRowReader(format string, body io.Reader) (ImportRowReader, error) {
+	switch format {
+	case EXPORT_FORMAT_NDJSON:
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), IMPORT_MAX_LINE_BYTES)
+		return &NDJSONRowReader{scanner: scanner}, nil
+	case EXPORT_FORMAT_CSV:
+		reader := csv.NewReader(body)
+		reader.FieldsPerRecord = -1 // checked per row so one bad row doesn't end the import
+		return &CSVRowReader{reader: reader}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+func (reader *NDJSONRowReader) Next() (ImportRow, error) {
+	for reader.scanner.Scan() {
+		reader.line++
+		line := strings.TrimSpace(reader.scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		row := ImportRow{Line: reader.line}
+		if err := json.Unmarshal([]byte(line), &row.Entry); err != nil {
+			return row, &ImportRowError{Line: reader.line, Reason: "invalid json: " + err.Error()}
+		}
+		return row, nil
+	}
+
+	if err := reader.scanner.Err(); err != nil {
+		return ImportRow{}, err
+	}
+	return ImportRow{}, io.EOF
+}
+
+// rows are key,value, a key,value header on the first line is skipped
+func (reader *CSVRowReader) Next() (ImportRow, error) {
+	for {
+		record, err := reader.reader.Read()
+		if err == io.EOF {
+			return ImportRow{}, io.EOF
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			return ImportRow{Line: parseErr.Line}, &ImportRowError{Line: parseErr.Line, Reason: parseErr.Err.Error()}
+		}
+		if err != nil {
+			return ImportRow{}, err
+		}
+
+		reader.line, _ = reader.reader.FieldPos(0)
+		if reader.line == 1 && len(record) == 2 && strings.EqualFold(record[0], "key") && strings.EqualFold(record[1], "value") {
+			continue
+		}
+
+		row := ImportRow{Line: reader.line}
+		if len(record) != 2 {
+			return row, &ImportRowError{Line: reader.line, Reason: fmt.Sprintf("expected 2 fields, got %d", len(record))}
+		}
+
+		row.Entry = DBEntry{Key: record[0], Value: record[1]}
+		return row, nil
+	}
+}
+
+func (result *ImportResult) Reject(line int, reason string) {
+	result.RowsRejected++
+	if len(result.Rejected) < IMPORT_MAX_REPORTED_REJECTIONS {
+		result.Rejected = append(result.Rejected, ImportRejectedRow{Line: line, Reason: reason})
+	}
+}
+
+// streams rows from reader into the namespace, rows are grouped per owner node and sent in chunks of batchSize
+func ImportRows(reader ImportRowReader, batchSize int, namespace string) (*ImportResult, error) {
+	g_networkLock.Lock()
+	network := g_network
+	network.Nodes = make([]DBNode, len(g_network.Nodes))
+	copy(network.Nodes, g_network.Nodes)
+	g_networkLock.Unlock()
+
+	if network.NumNodes == 0 {
+		return nil, errors.New("network has no nodes")
+	}
+
+	nodesByID := make(map[uint32]DBNode)
+	for _, node := range network.Nodes {
+		nodesByID[uint32(node.ID)] = node
+	}
+
+	result := &ImportResult{Rejected: make([]ImportRejectedRow, 0)}
+	pending := make(map[uint32][]ImportRow)
+	failedLines := make(map[int]string) // rows at least one replica didn't accept
+
+	flush := func(nodeID uint32) {
+		rows := pending[nodeID]
+		if len(rows) == 0 {
+			return
+		}
+
+		chunk := DBChunk{Entries: make([]DBEntry, len(rows)), Owner: nodeID}
+		for i, row := range rows {
+			chunk.Entries[i] = row.Entry
+		}
+
+		node := nodesByID[nodeID]
+		if !node.SendChunk(&chunk) {
+			for _, row := range rows {
+				failedLines[row.Line] = fmt.Sprintf("node %d didn't accept the write", nodeID)
+			}
+		}
+		pending[nodeID] = rows[:0]
+	}
+
+	var readErr error
+	for {
+		row, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if rowErr, ok := err.(*ImportRowError); ok {
+			result.RowsRead++
+			result.Reject(rowErr.Line, rowErr.Reason)
+			continue
+		}
+		if err != nil {
+			readErr = err // the body itself couldn't be read, nothing after this point is imported
+			break
+		}
+
+		result.RowsRead++
+		if len(row.Entry.Key) == 0 {
+			result.Reject(row.Line, "key must not be empty")
+			continue
+		}
+		if IsValuePartKey(row.Entry.Key) || row.Entry.Parts != 0 {
+			result.Reject(row.Line, "key contains a reserved sequence or the row is a manifest of a split value")
+			continue
+		}
+
+		row.Entry.Namespace = namespace
+		for _, nodeID := range network.GetTargetNodes(namespace, row.Entry.Key) {
+			pending[nodeID] = append(pending[nodeID], row)
+			if len(pending[nodeID]) >= batchSize {
+				flush(nodeID)
+			}
+		}
+		result.RowsImported++
+	}
+
+	for nodeID := range pending {
+		flush(nodeID)
+	}
+
+	failed := make([]int, 0, len(failedLines))
+	for line := range failedLines {
+		failed = append(failed, line)
+	}
+	sort.Ints(failed)
+	for _, line := range failed {
+		result.RowsImported--
+		result.Reject(line, failedLines[line])
+	}
+
+	return result, readErr
+}
+
+// writes every key of the namespace once. nodes are read one after the other so only one node's data is held
+// at a time, a key is written from the first node that has a complete copy of it and keys are sorted within
+// each node. returns the number of entries written and the number of nodes that couldn't be read
+func ExportEntries(writer *ExportWriter, namespace string) (int, int, error) {
+	g_networkLock.Lock()
+	nodes := make([]DBNode, len(g_network.Nodes))
+	copy(nodes, g_network.Nodes)
+	g_networkLock.Unlock()
+
+	exported := make(map[string]bool)
+	numEntries, missingNodes := 0, 0
+	for _, node := range nodes {
+		chunk := node.GetAllData(namespace)
+		if chunk == nil {
+			missingNodes++
+			continue
+		}
+
+		entryInfoTable := ProcessDBChunks([]*DBChunk{chunk})
+		AssembleSplitValues(entryInfoTable)
+
+		keys := make([]string, 0, len(entryInfoTable))
+		for key := range entryInfoTable {
+			if !exported[key] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if err := writer.Write(entryInfoTable[key].Entry); err != nil {
+				return numEntries, missingNodes, err
+			}
+			exported[key] = true
+			numEntries++
+		}
+		if err := writer.Flush(); err != nil {
+			return numEntries, missingNodes, err
+		}
+	}
+
+	return numEntries, missingNodes, nil
+}
+
+// writes entries as ndjson or csv
+type ExportWriter struct {
+	encoder   *json.Encoder
+	csvWriter *csv.Writer
+}
+
+func MakeExportWriter(writer io.Writer, format string) (*ExportWriter, error) {
+	switch format {
+	case EXPORT_FORMAT_NDJSON:
+		return &ExportWriter{encoder: json.NewEncoder(writer)}, nil
+	case EXPORT_FORMAT_CSV:
+		csvWriter := csv.NewWriter(writer)
+		csvWriter.Write([]string{"key", "value"})
+		return &ExportWriter{csvWriter: csvWriter}, nil
+	default:
+		return nil, ErrUnknownFormat
+	}
+}
+
+func (writer *ExportWriter) Write(entry DBEntry) error {
+	if writer.csvWriter != nil {
+		return writer.csvWriter.Write([]string{entry.Key, entry.Value})
+	}
+	return writer.encoder.Encode(entry)
+}
+
+func (writer *ExportWriter) Flush() error {
+	if writer.csvWriter != nil {
+		writer.csvWriter.Flush()
+		return writer.csvWriter.Error()
+	}
+	return nil
+}
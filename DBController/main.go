@@ -1,14 +1,20 @@
 package main
 
 import (
+	"DBCommon/clustertls"
+	"DBCommon/encryption"
+	"DBCommon/placement"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -27,15 +33,21 @@ const NODE_HEALTH_CHECK_INTERVAL_S = 5
 const NEWNODE_HEALTHCHECK_TRIES = 3
 
 type DBNode struct {
-	Addr  string      // http addr
-	ID    int32       // index of the node
-	State DBNodeState // last known state of this node (updates periodically)
+	Addr   string      // http addr
+	ID     int32       // index of the node
+	State  DBNodeState // last known state of this node (updates periodically)
+	Zone   string      `json:",omitempty"` // replicas of a key are spread over as many zones as possible
+	Weight float64     `json:",omitempty"` // share of the keyspace relative to the other nodes, 0 means 1
 }
 
 type DBNetwork struct {
 	Nodes             []DBNode // list of nodes
 	NumNodes          uint32
 	ReplicationFactor uint32
+	Epoch             uint64                 // bumped every time the network changes
+	Namespaces        map[string]DBNamespace `json:",omitempty"`
+	ReplicationRules  []DBReplicationRule    `json:",omitempty"`
+	PlacementVersion  uint32                 // strategy keys are placed with, nodes move data laid out by an older one
 }
 
 var g_network DBNetwork
@@ -44,12 +56,34 @@ var g_replicationFactor uint
 var g_minNumNodes uint
 var g_listenPort uint
 var g_debugLocal bool
+var g_backupDir string
+var g_backupEndpoint string
+var g_backupBucket string
+var g_backupRegion string
+var g_backupInterval time.Duration
+var g_changeArchiveInterval time.Duration
+var g_keyFile string
+var g_keyring *encryption.Keyring // nil if backups aren't encrypted
 
 func init() {
 	flag.UintVar(&g_replicationFactor, "rf", 1, "Number of nodes that should replicate a piece of data")
 	flag.UintVar(&g_minNumNodes, "n", 1, "Number of nodes to deploy in the network, replication factor should be <= than this number")
 	flag.UintVar(&g_listenPort, "port", 8080, "Port that this node will bind to and listen")
 	flag.BoolVar(&g_debugLocal, "debuglocal", false, "Set this flag to when running all nodes and controller locally")
+	flag.StringVar(&g_backupDir, "backupdir", "", "Directory backups are written to, defaults to a backups directory next to the controller")
+	flag.StringVar(&g_backupEndpoint, "backupendpoint", "", "URL of an S3-compatible object store to write backups to instead of -backupdir")
+	flag.StringVar(&g_backupBucket, "backupbucket", "", "Bucket used for backups when -backupendpoint is set")
+	flag.StringVar(&g_backupRegion, "backupregion", "us-east-1", "Region used to sign requests to the backup object store")
+	flag.DurationVar(&g_backupInterval, "backupinterval", 0, "Take a backup this often, 0 disables scheduled backups")
+	flag.DurationVar(&g_changeArchiveInterval, "changearchiveinterval", 0, "Copy every node's change log to the backup target this often so restores can target any point in time, 0 disables archiving")
+	flag.StringVar(&g_tlsOptions.CertFile, "tlscert", "", "Certificate issued by the cluster CA, turns on TLS for the api and calls to the nodes, deployed nodes get the same TLS flags")
+	flag.StringVar(&g_tlsOptions.KeyFile, "tlskey", "", "Private key of -tlscert")
+	flag.StringVar(&g_tlsOptions.CAFile, "tlsca", "", "Cluster CA, nodes have to present a certificate issued by it")
+	flag.BoolVar(&g_tlsOptions.Dev, "tlsdev", false, "Turn on TLS with a throwaway certificate issued by a dev CA that is generated on first use, for local clusters")
+	flag.StringVar(&g_tlsOptions.DevDir, "tlsdevdir", clustertls.DefaultDevDir(), "Directory the dev CA is kept in, shared by every process on the host")
+	flag.BoolVar(&g_authEnabled, "auth", false, "Require API tokens from clients of the controller and the nodes, needs TLS. An admin token is written to "+ADMIN_TOKEN_FILENAME+" next to -tokenfile on first start")
+	flag.StringVar(&g_tokenFile, "tokenfile", "", "File API tokens are kept in, defaults to "+TOKEN_FILENAME+" next to the controller")
+	flag.StringVar(&g_keyFile, "keyfile", "", "File with the keys the nodes encrypt values with, archived changes are encrypted with it and restores decrypt snapshots with it. "+encryption.KEYS_ENV_VAR+" is used if it isn't set")
 }
 
 func SetupLogger() {
@@ -65,7 +99,7 @@ func EnableCors(response http.ResponseWriter) {
 	response.Header().Set("Access-Control-Allow-Origin", "*")
 	response.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
 	response.Header().Set("Access-Control-Allow-Credentials", "true")
-	response.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH")
+	response.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE")
 }
 
 func HandlePreflightRequests(response http.ResponseWriter, request *http.Request) bool {
@@ -148,7 +182,7 @@ func FetchDataFromAllNodes(writeChannel chan<- *DBChunk) {
 	for _, node := range g_network.Nodes {
 
 		go func(node DBNode) {
-			data := node.GetAllData()
+			data := node.GetAllData(DEFAULT_NAMESPACE)
 			writeChannel <- data
 		}(node)
 
@@ -190,8 +224,27 @@ func HandleAddNode(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if g_tls != nil && !strings.HasPrefix(nodeURL, "https://") {
+		log.Printf("[%s]: /addnode got a non-https node url while TLS is on", request.RemoteAddr)
+		http.Error(response, "Invalid params, node urls should be https while TLS is on", http.StatusBadRequest)
+		return
+	}
+
 	node := DBNode{ID: int32(g_network.NumNodes), Addr: nodeURL}
 	addr, port := node.SplitAddrAndPort()
+	node.Zone = query.Get("zone")
+	if len(node.Zone) == 0 {
+		node.Zone = g_hostPool.GetZone(addr, port)
+	}
+	if query.Has("weight") {
+		weight, err := strconv.ParseFloat(query.Get("weight"), 64)
+		if err != nil || weight <= 0 {
+			log.Printf("[%s]: invalid weight param for /addnode", request.RemoteAddr)
+			http.Error(response, "Invalid params, weight should be a positive number", http.StatusBadRequest)
+			return
+		}
+		node.Weight = weight
+	}
 	spawned := DeployNode(addr, port, int(node.ID))
 
 	if spawned {
@@ -228,11 +281,15 @@ func HandleRFUpdate(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	g_networkLock.Lock()
+	defer g_networkLock.Unlock()
+
 	if newRF != int(g_network.ReplicationFactor) && newRF > 0 && newRF <= int(g_network.NumNodes) {
 		log.Printf("Changing replication factor from %d to %d\n", g_network.ReplicationFactor, newRF)
 
 		g_network.ReplicationFactor = uint32(newRF)
 		g_network.OnUpdated()
+		SetZoneWarningHeader(response, uint32(newRF))
 
 		response.WriteHeader(http.StatusNoContent)
 		return
@@ -271,21 +328,302 @@ func HandleKillNode(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// RemoveNode takes the lock itself, it gets a copy of the node since the slice can change until then
+	g_networkLock.Lock()
+	var node *DBNode
 	for i := 0; i < len(g_network.Nodes); i++ {
-		node := &g_network.Nodes[i]
-		if node.ID == int32(nodeID) {
-			go g_network.RemoveNode(node)
+		if g_network.Nodes[i].ID == int32(nodeID) {
+			found := g_network.Nodes[i]
+			node = &found
 			break
 		}
 	}
+	g_networkLock.Unlock()
+
+	if node != nil {
+		go g_network.RemoveNode(node)
+	}
 
 	response.WriteHeader(http.StatusNoContent)
 }
 
+func HandleBackup(response http.ResponseWriter, request *http.Request) {
+	EnableCors(response)
+	if HandlePreflightRequests(response, request) {
+		return
+	}
+
+	var body interface{}
+	status := http.StatusOK
+
+	switch request.Method {
+	case http.MethodGet:
+		ids, err := ListBackups()
+		if err != nil {
+			log.Printf("[%s]: Failed to list backups: %s\n", request.RemoteAddr, err.Error())
+			http.Error(response, "Failed to list backups", http.StatusInternalServerError)
+			return
+		}
+		body = ids
+	case http.MethodPost:
+		manifest, err := RunBackup()
+		if err != nil {
+			log.Printf("[%s]: Backup failed: %s\n", request.RemoteAddr, err.Error())
+			http.Error(response, "Backup failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		body = manifest
+		status = http.StatusCreated
+		if !manifest.Complete {
+			status = http.StatusBadGateway // some nodes didn't make it into the backup
+		}
+	default:
+		log.Printf("[%s]: Got a request for /backup route with unsupported method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	serialized, err := json.Marshal(body)
+	if err != nil {
+		log.Println("HandleBackup: Failed to serialize response", err.Error())
+		http.Error(response, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	response.WriteHeader(status)
+	response.Write(serialized)
+}
+
+func ParseIntParam(query url.Values, name string, defaultValue int) (int, error) {
+	if !query.Has(name) {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.Atoi(query.Get(name))
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid %s param", name)
+	}
+
+	return value, nil
+}
+
+func ParseRestoreOptions(query url.Values) (RestoreOptions, error) {
+	options := RestoreOptions{Verify: query.Get("verify") != "false"}
+
+	var err error
+	if options.BatchSize, err = ParseIntParam(query, "batch", RESTORE_DEFAULT_BATCH_SIZE); err != nil {
+		return options, err
+	}
+	if options.BatchSize == 0 {
+		return options, errors.New("invalid batch param")
+	}
+	if options.Rate, err = ParseIntParam(query, "rate", RESTORE_DEFAULT_RATE); err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
+
+// accepts RFC 3339 times, with or without seconds
+func ParseRestorePoint(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04Z07:00"} {
+		if at, err := time.Parse(layout, value); err == nil {
+			return at, nil
+		}
+	}
+
+	return time.Time{}, errors.New("invalid at param, expected a time like 2026-10-15T13:00Z")
+}
+
+func HandleRestore(response http.ResponseWriter, request *http.Request) {
+	EnableCors(response)
+	if HandlePreflightRequests(response, request) {
+		return
+	}
+
+	var status *RestoreStatus
+	switch request.Method {
+	case http.MethodGet:
+		status = GetRestoreStatus()
+		if status == nil {
+			http.Error(response, "No restore has been started", http.StatusNotFound)
+			return
+		}
+	case http.MethodPost:
+		query := request.URL.Query()
+		backupID := query.Get("backup")
+		if len(backupID) == 0 && !query.Has("at") {
+			log.Printf("[%s]: invalid query params for /restore", request.RemoteAddr)
+			http.Error(response, "Invalid params", http.StatusBadRequest)
+			return
+		}
+
+		options, err := ParseRestoreOptions(query)
+		if err != nil {
+			log.Printf("[%s]: invalid query params for /restore: %s", request.RemoteAddr, err.Error())
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if query.Has("at") {
+			at, err := ParseRestorePoint(query.Get("at"))
+			if err != nil {
+				log.Printf("[%s]: invalid query params for /restore: %s", request.RemoteAddr, err.Error())
+				http.Error(response, err.Error(), http.StatusBadRequest)
+				return
+			}
+			status, err = StartPointInTimeRestore(backupID, at, options)
+		} else {
+			status, err = StartRestore(backupID, options)
+		}
+		if err == ErrRestoreRunning {
+			http.Error(response, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("[%s]: Failed to start restore: %s\n", request.RemoteAddr, err.Error())
+			http.Error(response, "Failed to find a backup to restore: "+err.Error(), http.StatusNotFound)
+			return
+		}
+
+		log.Printf("[%s]: Started restore of backup %s (point in time: '%s') with %+v\n", request.RemoteAddr, status.BackupID, status.PointInTime, options)
+		response.WriteHeader(http.StatusAccepted)
+	default:
+		log.Printf("[%s]: Got a request for /restore route with unsupported method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	serialized, err := json.Marshal(status)
+	if err != nil {
+		log.Println("HandleRestore: Failed to serialize restore status", err.Error())
+		return
+	}
+
+	response.Write(serialized)
+}
+
+func HandleExport(response http.ResponseWriter, request *http.Request) {
+	EnableCors(response)
+
+	if request.Method != http.MethodGet {
+		log.Printf("[%s]: Got a request for /export route with non-get method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := request.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = EXPORT_FORMAT_NDJSON
+	}
+	if format != EXPORT_FORMAT_NDJSON && format != EXPORT_FORMAT_CSV {
+		http.Error(response, ErrUnknownFormat.Error(), http.StatusBadRequest)
+		return
+	}
+
+	namespace := request.URL.Query().Get("namespace")
+	if !NamespaceExists(namespace) {
+		http.Error(response, "Namespace not found", http.StatusNotFound)
+		return
+	}
+
+	if format == EXPORT_FORMAT_CSV {
+		response.Header().Set("Content-Type", "text/csv")
+	} else {
+		response.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=export.%s", format))
+	// entries are streamed as the nodes are read, so nodes that couldn't be read are only known at the end
+	response.Header().Set("Trailer", "X-Export-Missing-Nodes")
+
+	writer, err := MakeExportWriter(response, format)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	numEntries, missingNodes, err := ExportEntries(writer, namespace)
+	if missingNodes > 0 {
+		// with replication the other replicas usually cover for them, so still hand out what we have
+		log.Printf("[%s]: Export is missing data from %d nodes\n", request.RemoteAddr, missingNodes)
+		response.Header().Set("X-Export-Missing-Nodes", strconv.Itoa(missingNodes))
+	}
+	if err != nil {
+		log.Printf("[%s]: Failed to write export: %s\n", request.RemoteAddr, err.Error())
+		return
+	}
+
+	log.Printf("[%s]: Exported %d entries of namespace '%s' as %s\n", request.RemoteAddr, numEntries, namespace, format)
+}
+
+func HandleImport(response http.ResponseWriter, request *http.Request) {
+	EnableCors(response)
+	if HandlePreflightRequests(response, request) {
+		return
+	}
+
+	if request.Method != http.MethodPost {
+		log.Printf("[%s]: Got a request for /import route with non-post method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+	format := query.Get("format")
+	if len(format) == 0 {
+		format = EXPORT_FORMAT_NDJSON
+	}
+
+	batchSize, err := ParseIntParam(query, "batch", IMPORT_DEFAULT_BATCH_SIZE)
+	if err != nil || batchSize == 0 {
+		log.Printf("[%s]: invalid query params for /import\n", request.RemoteAddr)
+		http.Error(response, "Invalid params", http.StatusBadRequest)
+		return
+	}
+
+	namespace := query.Get("namespace")
+	if !NamespaceExists(namespace) {
+		http.Error(response, "Namespace not found", http.StatusNotFound)
+		return
+	}
+
+	reader, err := MakeImportRowReader(format, request.Body)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := ImportRows(reader, batchSize, namespace)
+	if result == nil {
+		log.Printf("[%s]: Import failed: %s\n", request.RemoteAddr, err.Error())
+		http.Error(response, "Import failed: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		log.Printf("[%s]: Import stopped after %d rows: %s\n", request.RemoteAddr, result.RowsRead, err.Error())
+		status = http.StatusBadRequest
+	}
+
+	log.Printf("[%s]: Imported %d of %d rows, %d rejected\n", request.RemoteAddr, result.RowsImported, result.RowsRead, result.RowsRejected)
+
+	serialized, err := json.Marshal(result)
+	if err != nil {
+		log.Println("HandleImport: Failed to serialize import result", err.Error())
+		http.Error(response, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	response.WriteHeader(status)
+	response.Write(serialized)
+}
+
 func Debug_SetupNodes() {
 	nodePort := 5000
 	for i := 0; i < int(g_minNumNodes); i++ {
-		node := DBNode{ID: int32(i), Addr: fmt.Sprintf("http://localhost:%d", nodePort)}
+		node := DBNode{ID: int32(i), Addr: GetNodeURL("localhost", nodePort), Zone: g_hostPool.GetZone("localhost", nodePort)}
 		g_network.Nodes = append(g_network.Nodes, node)
 		nodePort++
 	}
@@ -297,12 +635,30 @@ func StartServer(serverExitNotifier chan<- bool) {
 	http.HandleFunc("/addnode", HandleAddNode)            // POST
 	http.HandleFunc("/killnode", HandleKillNode)          // PATCH
 	http.HandleFunc("/rfupdate", HandleRFUpdate)          // PATCH
-	http.ListenAndServe(fmt.Sprintf(":%d", g_listenPort), nil)
+	http.HandleFunc("/backup", HandleBackup)              // GET, POST
+	http.HandleFunc("/restore", HandleRestore)            // GET, POST
+	http.HandleFunc("/export", HandleExport)              // GET
+	http.HandleFunc("/import", HandleImport)              // POST
+	http.HandleFunc("/namespaces", HandleNamespaces)      // GET, POST, PATCH
+	http.HandleFunc("/rfrules", HandleReplicationRules)   // GET, POST, DELETE
+	http.HandleFunc("/nodeweight", HandleNodeWeight)      // PATCH
+	http.HandleFunc("/peers", HandlePeers)                // GET
+	http.HandleFunc("/tokens", HandleTokens)              // GET, POST, DELETE
+	http.HandleFunc("/internal/auth", HandleInternalAuth) // GET
+	err := TLS_ListenAndServe()
+	log.Printf("StartServer: Stopped serving: %s\n", err.Error())
 	serverExitNotifier <- true
 }
 
 func main() {
 	flag.Parse()
+
+	var err error
+	g_keyring, err = encryption.LoadKeyring(g_keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %s\n", err.Error())
+	}
+
 	SetWorkingDirectory()
 
 	if g_replicationFactor > g_minNumNodes {
@@ -315,6 +671,12 @@ func main() {
 	}
 
 	SetupLogger()
+	TLS_Setup()
+	Auth_Setup()
+	g_backupTarget = MakeBackupTarget()
+	if g_keyring != nil {
+		log.Printf("Encrypting archived changes with key %d\n", g_keyring.ActiveKey())
+	}
 	serverExitNotifier := make(chan bool)
 
 	if g_debugLocal {
@@ -324,7 +686,7 @@ func main() {
 		const nodePort = 5000
 		hostAddresses := make([]string, 0)
 		for i := 0; i < int(g_minNumNodes); i++ {
-			node := DBNode{ID: int32(i), Addr: fmt.Sprintf("http://%s:%d", g_hostPool.Hosts[i], nodePort)}
+			node := DBNode{ID: int32(i), Addr: GetNodeURL(g_hostPool.Hosts[i], nodePort), Zone: g_hostPool.GetZone(g_hostPool.Hosts[i], nodePort)}
 			hostAddresses = append(hostAddresses, g_hostPool.Hosts[i])
 			g_network.Nodes = append(g_network.Nodes, node)
 		}
@@ -342,9 +704,18 @@ func main() {
 
 	g_network.NumNodes = uint32(len(g_network.Nodes))
 	g_network.ReplicationFactor = uint32(g_replicationFactor)
+	g_network.PlacementVersion = placement.VERSION
 	log.Printf("Network:\n%+v\n", g_network)
+	g_network.WarnIfZonesTooFew()
 
 	go MonitorNodes()
+	go Namespace_MonitorQuotas()
+	if g_backupInterval > 0 {
+		go RunScheduledBackups()
+	}
+	if g_changeArchiveInterval > 0 {
+		go RunChangeArchiver()
+	}
 
 	<-serverExitNotifier
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"DBCommon/auth"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// mirrors DBNamespace on the nodes, shipped to them as part of the network
+type DBNamespace struct {
+	Name              string
+	ReplicationFactor uint32
+	TTLSeconds        int64  // default time to live of entries, 0 means they never expire
+	Consistency       string // default number of replicas reads and writes wait for (one, quorum or all)
+	QuotaBytes        int64  // 0 means unlimited
+	OverQuota         bool   // writes are rejected while this is set
+}
+
+// the part of a node's /internal/stats response the quota monitor cares about
+type NamespaceStats struct {
+	NumKeys   int64
+	SizeBytes int64
+}
+
+const DEFAULT_NAMESPACE = ""
+const CONSISTENCY_ONE = "one"
+const CONSISTENCY_QUORUM = "quorum"
+const CONSISTENCY_ALL = "all"
+const NAMESPACE_QUOTA_CHECK_INTERVAL_S = 30
+
+var g_namespaceNameRegex = regexp.MustCompile(`^[a-z0-9_]{1,48}$`) // names end up in table and file names on the nodes
+
+func IsValidConsistency(consistency string) bool {
+	return consistency == CONSISTENCY_ONE || consistency == CONSISTENCY_QUORUM || consistency == CONSISTENCY_ALL
+}
+
+// the default namespace followed by every namespace the network knows about
+func (network *DBNetwork) GetNamespaceNames() []string {
+	names := []string{DEFAULT_NAMESPACE}
+	for name := range network.Namespaces {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// whether name is the default namespace or one the network knows about
+func NamespaceExists(name string) bool {
+	g_networkLock.Lock()
+	defer g_networkLock.Unlock()
+
+	_, found := g_network.Namespaces[name]
+	return found || name == DEFAULT_NAMESPACE
+}
+
+// applies the ttl, consistency and quota params that are set on the request to namespace
+func ParseNamespaceSettings(query url.Values, namespace *DBNamespace) error {
+	if query.Has("ttl") {
+		ttl, err := time.ParseDuration(query.Get("ttl"))
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("ttl should be a duration like 30s or 12h")
+		}
+		namespace.TTLSeconds = int64(ttl / time.Second)
+	}
+
+	if query.Has("consistency") {
+		consistency := query.Get("consistency")
+		if !IsValidConsistency(consistency) {
+			return fmt.Errorf("consistency should be one, quorum or all")
+		}
+		namespace.Consistency = consistency
+	}
+
+	if query.Has("quota") {
+		quota, err := strconv.ParseInt(query.Get("quota"), 10, 64)
+		if err != nil || quota < 0 {
+			return fmt.Errorf("quota should be a number of bytes")
+		}
+		namespace.QuotaBytes = quota
+	}
+
+	return nil
+}
+
+// GET lists the namespaces, POST creates one (name, rf, ttl, consistency, quota) and PATCH changes the
+// settings of an existing one
+func HandleNamespaces(response http.ResponseWriter, request *http.Request) {
+	EnableCors(response)
+	if HandlePreflightRequests(response, request) {
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		g_networkLock.Lock()
+		namespaces := make([]DBNamespace, 0, len(g_network.Namespaces))
+		for _, namespace := range g_network.Namespaces {
+			namespaces = append(namespaces, namespace)
+		}
+		g_networkLock.Unlock()
+
+		sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+		serialized, err := json.Marshal(namespaces)
+		if err != nil {
+			log.Println("HandleNamespaces: Failed to serialize namespaces", err.Error())
+			http.Error(response, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		response.Write(serialized)
+	case http.MethodPost:
+		HandleCreateNamespace(response, request)
+	case http.MethodPatch:
+		HandleUpdateNamespace(response, request)
+	default:
+		log.Printf("[%s]: Got a request for /namespaces route with unsupported method %s\n", request.RemoteAddr, request.Method)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+	}
+}
+
+func HandleCreateNamespace(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	name := query.Get("name")
+	if !g_namespaceNameRegex.MatchString(name) {
+		log.Printf("[%s]: invalid namespace name '%s' for /namespaces\n", request.RemoteAddr, name)
+		http.Error(response, "Invalid params, name should be 1-48 lowercase letters, digits or underscores", http.StatusBadRequest)
+		return
+	}
+	if name == auth.DEFAULT_NAMESPACE_NAME {
+		http.Error(response, "Invalid params, "+name+" is how API tokens refer to the default namespace", http.StatusBadRequest)
+		return
+	}
+
+	g_networkLock.Lock()
+	defer g_networkLock.Unlock()
+
+	if _, found := g_network.Namespaces[name]; found {
+		http.Error(response, "Namespace already exists", http.StatusConflict)
+		return
+	}
+
+	namespace := DBNamespace{Name: name, ReplicationFactor: g_network.ReplicationFactor, Consistency: CONSISTENCY_ONE}
+	if query.Has("rf") {
+		rf, err := strconv.Atoi(query.Get("rf"))
+		if err != nil || rf <= 0 || rf > int(g_network.NumNodes) {
+			http.Error(response, fmt.Sprintf("Invalid params, rf should be between 1 and %d", g_network.NumNodes), http.StatusBadRequest)
+			return
+		}
+		namespace.ReplicationFactor = uint32(rf)
+	}
+
+	if err := ParseNamespaceSettings(query, &namespace); err != nil {
+		http.Error(response, "Invalid params, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if g_network.Namespaces == nil {
+		g_network.Namespaces = make(map[string]DBNamespace)
+	}
+	g_network.Namespaces[name] = namespace
+	g_network.OnUpdated()
+	SetZoneWarningHeader(response, namespace.ReplicationFactor)
+
+	log.Printf("Created namespace %+v\n", namespace)
+	response.WriteHeader(http.StatusCreated)
+}
+
+func HandleUpdateNamespace(response http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	name := query.Get("name")
+
+	g_networkLock.Lock()
+	defer g_networkLock.Unlock()
+
+	namespace, found := g_network.Namespaces[name]
+	if !found {
+		http.Error(response, "Namespace not found", http.StatusNotFound)
+		return
+	}
+
+	if query.Has("rf") {
+		rf, err := strconv.Atoi(query.Get("rf"))
+		if err != nil || rf <= 0 || rf > int(g_network.NumNodes) {
+			http.Error(response, fmt.Sprintf("Invalid params, rf should be between 1 and %d", g_network.NumNodes), http.StatusBadRequest)
+			return
+		}
+		namespace.ReplicationFactor = uint32(rf) // the nodes only move this namespace's keys
+	}
+
+	if err := ParseNamespaceSettings(query, &namespace); err != nil {
+		http.Error(response, "Invalid params, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	g_network.Namespaces[name] = namespace
+	g_network.OnUpdated()
+	SetZoneWarningHeader(response, namespace.ReplicationFactor)
+
+	log.Printf("Updated namespace %+v\n", namespace)
+	response.WriteHeader(http.StatusNoContent)
+}
+
+func (node *DBNode) GetNamespaceStats(namespace string) (*NamespaceStats, error) {
+	res, err := g_rpc.Get(context.Background(), fmt.Sprintf("%s/internal/stats?namespace=%s", node.Addr, url.QueryEscape(namespace)), NodeCall(1))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("stats request failed with status %d", res.StatusCode)
+	}
+
+	var stats NamespaceStats
+	err = json.Unmarshal(res.Body, &stats)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+// periodically adds up how much every namespace with a quota stores and flags the ones that are over it,
+// the nodes reject writes to flagged namespaces until enough data expires
+func Namespace_MonitorQuotas() {
+	for {
+		time.Sleep(NAMESPACE_QUOTA_CHECK_INTERVAL_S * time.Second)
+
+		g_networkLock.Lock()
+		nodes := make([]DBNode, len(g_network.Nodes))
+		copy(nodes, g_network.Nodes)
+		namespaces := make([]DBNamespace, 0, len(g_network.Namespaces))
+		for _, namespace := range g_network.Namespaces {
+			if namespace.QuotaBytes > 0 || namespace.OverQuota {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+		g_networkLock.Unlock()
+
+		changed := make(map[string]bool)
+		for _, namespace := range namespaces {
+			totalBytes := int64(0)
+			complete := true
+			for _, node := range nodes {
+				if node.State == NODESTATE_DEAD {
+					continue
+				}
+
+				stats, err := node.GetNamespaceStats(namespace.Name)
+				if err != nil {
+					log.Printf("Namespace_MonitorQuotas: Failed to get stats of namespace %s from node %d: %s\n", namespace.Name, node.ID, err.Error())
+					complete = false
+					break
+				}
+				totalBytes += stats.SizeBytes
+			}
+
+			if !complete {
+				continue // don't flip the flag based on a partial count
+			}
+
+			// every entry is stored once per replica
+			usedBytes := totalBytes / int64(namespace.ReplicationFactor)
+			overQuota := namespace.QuotaBytes > 0 && usedBytes > namespace.QuotaBytes
+			if overQuota != namespace.OverQuota {
+				log.Printf("Namespace_MonitorQuotas: namespace %s uses %d of %d bytes, over quota: %t\n", namespace.Name, usedBytes, namespace.QuotaBytes, overQuota)
+				changed[namespace.Name] = overQuota
+			}
+		}
+
+		if len(changed) == 0 {
+			continue
+		}
+
+		g_networkLock.Lock()
+		for name, overQuota := range changed {
+			if namespace, found := g_network.Namespaces[name]; found {
+				namespace.OverQuota = overQuota
+				g_network.Namespaces[name] = namespace
+			}
+		}
+		g_network.OnUpdated()
+		g_networkLock.Unlock()
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 type HostPool struct {
 	Hosts []string
+	Zones map[string]string // zone (rack, lab room, ...) of a host, keyed by "host:port" or just "host"
 }
 
 const HOSTS_FILENAME = "hosts.json"
@@ -43,10 +44,18 @@ func ParseHostsList() {
 	log.Println("Self hostname:", g_selfHostName)
 }
 
+// zone of the host from the hosts file, empty if it has none
+func (pool *HostPool) GetZone(host string, port int) string {
+	if zone, found := pool.Zones[fmt.Sprintf("%s:%d", host, port)]; found {
+		return zone
+	}
+	return pool.Zones[host]
+}
+
 func DeployNode(hostAddr string, port int, id int) bool {
 	log.Println("===== Deploying Node =====")
 	log.Printf("Node addr: %s\n\t\tNode port: %d\n\t\tNode id: %d\n", hostAddr, port, id)
-	cmd := exec.Command(path.Join(g_currDir, DEPLOY_NODE_SCRIPT), hostAddr, fmt.Sprintf("%d", id), fmt.Sprintf("%d", port), fmt.Sprintf("\"http://%s.utm.utoronto.ca:%d\"", g_selfHostName, g_listenPort))
+	cmd := exec.Command(path.Join(g_currDir, DEPLOY_NODE_SCRIPT), hostAddr, fmt.Sprintf("%d", id), fmt.Sprintf("%d", port), fmt.Sprintf("\"%s://%s.utm.utoronto.ca:%d\"", GetNodeScheme(), g_selfHostName, g_listenPort), GetNodeTLSFlags())
 	err := cmd.Start()
 	if err != nil {
 		log.Printf("Failed to deploy node with error: %s\n", err.Error())
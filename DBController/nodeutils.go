@@ -1,21 +1,32 @@
 package main
 
 import (
+	"DBCommon/rpcclient"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
+	"unicode/utf8"
 )
 
 type DBEntry struct {
-	Key   string
-	Value string
+	Namespace   string `json:",omitempty"` // empty for the default namespace
+	Key         string
+	Value       string
+	ExpiresAt   int64  `json:",omitempty"` // unix timestamp (in ms), 0 if the entry never expires
+	Flags       uint32 `json:",omitempty"`
+	ContentType string `json:",omitempty"`
+	Parts       uint32 `json:",omitempty"` // set if the value was split, see DBValueManifest
+	UpdatedAt   int64  `json:",omitempty"` // unix timestamp (in ms) of the last write, only known for entries read from snapshots
 }
 
+type dbEntryJSON DBEntry
+
 type DBChunk struct {
 	Entries []DBEntry
 	Owner   uint32 // owner node id
@@ -26,9 +37,64 @@ type DBEntryInfo struct {
 	OwnerNodes []uint32
 }
 
+// mirrors DBEntry.MarshalJSON on the nodes, values that aren't valid utf-8 are sent base64 encoded in ValueBase64
+func (entry DBEntry) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(entry.Value) {
+		return json.Marshal(dbEntryJSON(entry))
+	}
+
+	raw := dbEntryJSON(entry)
+	raw.Value = ""
+	return json.Marshal(struct {
+		dbEntryJSON
+		ValueBase64 string
+	}{raw, base64.StdEncoding.EncodeToString([]byte(entry.Value))})
+}
+
+func (entry *DBEntry) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		dbEntryJSON
+		ValueBase64 string
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*entry = DBEntry(raw.dbEntryJSON)
+	if len(raw.ValueBase64) > 0 {
+		value, err := base64.StdEncoding.DecodeString(raw.ValueBase64)
+		if err != nil {
+			return err
+		}
+		entry.Value = string(value)
+	}
+	return nil
+}
+
 const CATCHUP_NOTI_RETRIES = 3
+const NETWORK_UPDATE_NOTI_TRIES = 3
+const SEND_CHUNK_TRIES = 3
+const MAX_BACKPRESSURE_RETRIES = 8
+const NODE_REQUEST_TIMEOUT = 5 * time.Second
+const NODE_BULK_TIMEOUT = 60 * time.Second
+const NODE_SNAPSHOT_TIMEOUT = 30 * time.Minute
+
+// every call to the nodes goes through this client, it keeps a circuit breaker per node
+var g_rpc = rpcclient.New(rpcclient.Config{})
+
+// options for small requests to a node
+func NodeCall(attempts int) rpcclient.CallOptions {
+	return rpcclient.CallOptions{Timeout: NODE_REQUEST_TIMEOUT, Attempts: attempts, BusyRetries: MAX_BACKPRESSURE_RETRIES}
+}
+
+// options for requests that move a lot of data
+func BulkCall(attempts int) rpcclient.CallOptions {
+	return rpcclient.CallOptions{Timeout: NODE_BULK_TIMEOUT, Attempts: attempts, BusyRetries: MAX_BACKPRESSURE_RETRIES}
+}
 
 func (network *DBNetwork) OnUpdated() {
+	network.Epoch++
+	network.WarnIfZonesTooFew()
 	for i := 0; i < int(g_network.NumNodes); i++ {
 		go g_network.Nodes[i].NotifyNetworkUpdated()
 	}
@@ -110,21 +176,19 @@ func (node *DBNode) SplitAddrAndPort() (string, int) {
 	return parsedURL.Hostname(), port
 }
 
-func (node *DBNode) GetAllData() *DBChunk {
-	res, err := http.Get(node.Addr + "/internal/getall")
+func (node *DBNode) GetAllData(namespace string) *DBChunk {
+	res, err := g_rpc.Get(context.Background(), node.Addr+"/internal/getall?namespace="+url.QueryEscape(namespace), BulkCall(1))
 	if err != nil {
 		log.Printf("failed to fetch data from node %d: %s", node.ID, err.Error())
 		return nil
 	}
-
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		log.Printf("Failed to parse data sent by node %d: %s", node.ID, err.Error())
+	if res.StatusCode != http.StatusOK {
+		log.Printf("failed to fetch data from node %d: status %d", node.ID, res.StatusCode)
 		return nil
 	}
 
 	var data DBChunk
-	err = json.Unmarshal(body, &data)
+	err = json.Unmarshal(res.Body, &data)
 	if err != nil {
 		log.Printf("Failed to parse data sent by node %d into DBChunk: %s", node.ID, err.Error())
 		return nil
@@ -133,6 +197,29 @@ func (node *DBNode) GetAllData() *DBChunk {
 	return &data
 }
 
+// pushes a chunk through the node's bulk write path and waits for it to be committed,
+// backs off (honouring Retry-After) while the node reports it is saturated
+func (node *DBNode) SendChunk(chunk *DBChunk) bool {
+	serializedChunk, err := json.Marshal(chunk)
+	if err != nil {
+		log.Printf("SendChunk: Failed to serialize chunk for node %d\n", chunk.Owner)
+		return false
+	}
+
+	res, err := g_rpc.Post(context.Background(), node.Addr+"/internal/setchunk?durable=true", serializedChunk, BulkCall(SEND_CHUNK_TRIES))
+	if err != nil {
+		log.Printf("SendChunk: Failed to send chunk to node %d: %s\n", node.ID, err.Error())
+		return false
+	}
+
+	if res.StatusCode != http.StatusCreated {
+		log.Printf("SendChunk: Node %d rejected chunk with status %d\n", node.ID, res.StatusCode)
+		return false
+	}
+
+	return true
+}
+
 func (node *DBNode) SpawnReplacement() {
 	time.Sleep(NODE_MAX_UNREACHABLE_TIME_S * time.Second)
 
@@ -154,24 +241,35 @@ func (node *DBNode) SpawnReplacement() {
 }
 
 func (node *DBNode) Catchup() {
-	for i := 0; i < CATCHUP_NOTI_RETRIES; i++ {
-		time.Sleep(NODE_HEALTH_CHECK_INTERVAL_S * time.Second) // let it come back online before telling it to catchup
+	time.Sleep(NODE_HEALTH_CHECK_INTERVAL_S * time.Second) // let it come back online before telling it to catchup
 
-		_, err := http.Post(node.Addr+"/internal/catchup", "text/html", http.NoBody)
-		if err != nil {
-			log.Printf("Failed to notify node %s to catchup | try %d\n", node.Addr, i)
-		} else {
-			break
-		}
+	options := NodeCall(CATCHUP_NOTI_RETRIES)
+	options.BaseBackoff = NODE_HEALTH_CHECK_INTERVAL_S * time.Second
+	options.IgnoreBreaker = true // the breaker most likely opened while the node was down
+	_, err := g_rpc.Post(context.Background(), node.Addr+"/internal/catchup", nil, options)
+	if err != nil {
+		log.Printf("Failed to notify node %s to catchup: %s\n", node.Addr, err.Error())
+	}
+}
+
+// health checks go through an open breaker, they are what closes it again once the node is back
+func (node *DBNode) CheckHealth() error {
+	options := NodeCall(1)
+	options.IgnoreBreaker = true
+
+	res, err := g_rpc.Get(context.Background(), node.Addr+"/internal/healthcheck", options)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.New("HealthCheckError: Incorrect response code")
 	}
+	return nil
 }
 
 func (node *DBNode) UpdateState() {
-	response, err := http.Get(node.Addr + "/internal/healthcheck")
-	if err != nil || response.StatusCode != http.StatusOK {
-		if err == nil {
-			err = errors.New("HealthCheckError: Incorrect response code")
-		}
+	err := node.CheckHealth()
+	if err != nil {
 		log.Printf("Node %d: Health check failed - %s", node.ID, err.Error())
 		node.State = NODESTATE_UNREACHABLE
 
@@ -182,11 +280,8 @@ func (node *DBNode) UpdateState() {
 }
 
 func (node *DBNode) UpdateStateAndReturn() DBNodeState {
-	response, err := http.Get(node.Addr + "/internal/healthcheck")
-	if err != nil || response.StatusCode != http.StatusOK {
-		if err == nil {
-			err = errors.New("HealthCheckError: Incorrect response code")
-		}
+	err := node.CheckHealth()
+	if err != nil {
 		log.Printf("Node %d: Health check failed - %s", node.ID, err.Error())
 		node.State = NODESTATE_UNREACHABLE
 	} else {
@@ -196,13 +291,15 @@ func (node *DBNode) UpdateStateAndReturn() DBNodeState {
 	return node.State
 }
 
+// the node rehashes before answering, so this gets the bulk deadline
 func (node *DBNode) NotifyNetworkUpdated() {
-	_, err := http.Get(node.Addr + "/internal/networkupdate")
+	_, err := g_rpc.Get(context.Background(), node.Addr+"/internal/networkupdate", BulkCall(NETWORK_UPDATE_NOTI_TRIES))
 	if err != nil {
 		log.Printf("Failed to notify node of network change: %s\n", err.Error())
 	}
 }
 
+// merges the chunks of every node into one entry per key, along with the nodes that hold it
 func ProcessDBChunks(chunks []*DBChunk) map[string]DBEntryInfo {
 	entryTable := make(map[string]DBEntryInfo)
 
@@ -211,17 +308,40 @@ func ProcessDBChunks(chunks []*DBChunk) map[string]DBEntryInfo {
 			continue
 		}
 		for _, entry := range chunk.Entries {
-			if value, found := entryTable[entry.Value]; found {
+			if value, found := entryTable[entry.Key]; found {
 				owners := append(value.OwnerNodes, chunk.Owner)
 				value.OwnerNodes = owners
-				entryTable[entry.Value] = value
+				entryTable[entry.Key] = value
 			} else {
 				ownerArr := make([]uint32, 0)
 				ownerArr = append(ownerArr, chunk.Owner)
-				entryTable[entry.Value] = DBEntryInfo{Entry: entry, OwnerNodes: ownerArr}
+				entryTable[entry.Key] = DBEntryInfo{Entry: entry, OwnerNodes: ownerArr}
 			}
 		}
 	}
 
 	return entryTable
 }
+
+// latency and circuit breaker state of every node the controller talked to
+func HandlePeers(response http.ResponseWriter, request *http.Request) {
+	EnableCors(response)
+	if HandlePreflightRequests(response, request) {
+		return
+	}
+
+	if request.Method != http.MethodGet {
+		log.Printf("[%s]: Got a request for /peers route with non-get method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := json.Marshal(g_rpc.Stats())
+	if err != nil {
+		log.Println("HandlePeers: Failed to serialize peer stats", err.Error())
+		http.Error(response, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	response.Write(body)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"DBCommon/placement"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+type DBReplicationRule = placement.Rule
+
+// replication factor of the key, from the longest matching prefix rule, then the namespace and then the
+// network. capped at the number of nodes
+func (network *DBNetwork) GetReplicationFactor(namespace string, key string) uint32 {
+	replicationFactor := network.ReplicationFactor
+	if settings, found := network.Namespaces[namespace]; found && namespace != DEFAULT_NAMESPACE {
+		replicationFactor = settings.ReplicationFactor
+	}
+	return placement.GetReplicationFactor(network.ReplicationRules, namespace, key, replicationFactor, network.NumNodes)
+}
+
+func (node *DBNode) GetWeight() float64 {
+	return placement.GetWeight(node.Weight)
+}
+
+// the nodes as the placement package sees them
+func (network *DBNetwork) GetPlacementNodes() []placement.Node {
+	nodes := make([]placement.Node, 0, len(network.Nodes))
+	for _, node := range network.Nodes {
+		nodes = append(nodes, placement.Node{ID: node.ID, Addr: node.Addr, Zone: node.Zone, Weight: node.Weight})
+	}
+	return nodes
+}
+
+// the nodes holding the key, placed the same way the nodes place it
+func (network *DBNetwork) GetTargetNodes(namespace string, key string) []uint32 {
+	replicationFactor := network.GetReplicationFactor(namespace, placement.GetPlacementKey(key))
+	return placement.GetTargetNodes(network.GetPlacementNodes(), network.NumNodes, key, replicationFactor)
+}
+
+// number of distinct zones the nodes are in, 0 if none of them has a zone
+func (network *DBNetwork) GetNumZones() int {
+	zones := make(map[string]bool)
+	labeled := false
+	for _, node := range network.Nodes {
+		zones[node.Zone] = true
+		labeled = labeled || len(node.Zone) > 0
+	}
+
+	if !labeled {
+		return 0
+	}
+	return len(zones)
+}
+
+// the largest replication factor used anywhere in the network
+func (network *DBNetwork) GetMaxReplicationFactor() uint32 {
+	replicationFactor := network.ReplicationFactor
+	for _, namespace := range network.Namespaces {
+		if namespace.ReplicationFactor > replicationFactor {
+			replicationFactor = namespace.ReplicationFactor
+		}
+	}
+	for _, rule := range network.ReplicationRules {
+		if rule.ReplicationFactor > replicationFactor {
+			replicationFactor = rule.ReplicationFactor
+		}
+	}
+
+	return replicationFactor
+}
+
+// replicas of some keys will share a zone if any replication factor is larger than the number of zones
+func (network *DBNetwork) WarnIfZonesTooFew() {
+	numZones := network.GetNumZones()
+	if rf := network.GetMaxReplicationFactor(); numZones > 0 && int(rf) > numZones {
+		log.Printf("WARNING: replication factor %d is larger than the number of zones (%d), some replicas will share a zone\n", rf, numZones)
+	}
+}
+
+func SetZoneWarningHeader(response http.ResponseWriter, replicationFactor uint32) {
+	if numZones := g_network.GetNumZones(); numZones > 0 && int(replicationFactor) > numZones {
+		response.Header().Set("Warning", fmt.Sprintf(`199 - "replication factor %d is larger than the number of zones (%d)"`, replicationFactor, numZones))
+	}
+}
+
+// GET lists the prefix rules, POST adds or replaces the rule for namespace+prefix (rf) and DELETE removes
+// it. the nodes only move the keys under the prefix when a rule changes
+func HandleReplicationRules(response http.ResponseWriter, request *http.Request) {
+	EnableCors(response)
+	if HandlePreflightRequests(response, request) {
+		return
+	}
+
+	g_networkLock.Lock()
+	defer g_networkLock.Unlock()
+
+	if request.Method == http.MethodGet {
+		serialized, err := json.Marshal(g_network.ReplicationRules)
+		if err != nil {
+			log.Println("HandleReplicationRules: Failed to serialize replication rules", err.Error())
+			http.Error(response, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+
+		response.Write(serialized)
+		return
+	}
+
+	if request.Method != http.MethodPost && request.Method != http.MethodDelete {
+		log.Printf("[%s]: Got a request for /rfrules route with unsupported method %s\n", request.RemoteAddr, request.Method)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+	namespace := query.Get("namespace")
+	prefix := query.Get("prefix")
+	if len(prefix) == 0 {
+		log.Printf("[%s]: invalid query params for /rfrules", request.RemoteAddr)
+		http.Error(response, "Invalid params, prefix is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, found := g_network.Namespaces[namespace]; !found && namespace != DEFAULT_NAMESPACE {
+		http.Error(response, "Namespace not found", http.StatusNotFound)
+		return
+	}
+
+	ruleIndex := -1
+	for i, rule := range g_network.ReplicationRules {
+		if rule.Namespace == namespace && rule.Prefix == prefix {
+			ruleIndex = i
+			break
+		}
+	}
+
+	if request.Method == http.MethodDelete {
+		if ruleIndex < 0 {
+			http.Error(response, "Rule not found", http.StatusNotFound)
+			return
+		}
+
+		log.Printf("Removing replication rule %+v\n", g_network.ReplicationRules[ruleIndex])
+		g_network.ReplicationRules = append(g_network.ReplicationRules[:ruleIndex], g_network.ReplicationRules[ruleIndex+1:]...)
+		g_network.OnUpdated()
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	rf, err := strconv.Atoi(query.Get("rf"))
+	if err != nil || rf <= 0 || rf > int(g_network.NumNodes) {
+		http.Error(response, fmt.Sprintf("Invalid params, rf should be between 1 and %d", g_network.NumNodes), http.StatusBadRequest)
+		return
+	}
+
+	rule := DBReplicationRule{Namespace: namespace, Prefix: prefix, ReplicationFactor: uint32(rf)}
+	if ruleIndex >= 0 {
+		if g_network.ReplicationRules[ruleIndex] == rule {
+			response.WriteHeader(http.StatusNoContent)
+			return
+		}
+		g_network.ReplicationRules[ruleIndex] = rule
+	} else {
+		g_network.ReplicationRules = append(g_network.ReplicationRules, rule)
+	}
+
+	log.Printf("Setting replication rule %+v\n", rule)
+	g_network.OnUpdated()
+	SetZoneWarningHeader(response, rule.ReplicationFactor)
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// PATCH sets the capacity weight of a node (nodeID, weight), the node's share of the keyspace is
+// proportional to it. only the keys whose replicas change are moved
+func HandleNodeWeight(response http.ResponseWriter, request *http.Request) {
+	EnableCors(response)
+	if HandlePreflightRequests(response, request) {
+		return
+	}
+
+	if request.Method != http.MethodPatch {
+		log.Printf("[%s]: Got a request for /nodeweight route with non-patch method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+	nodeID, err := strconv.Atoi(query.Get("nodeID"))
+	if err != nil {
+		log.Printf("[%s]: invalid nodeID param for /nodeweight", request.RemoteAddr)
+		http.Error(response, "Invalid params", http.StatusBadRequest)
+		return
+	}
+
+	weight, err := strconv.ParseFloat(query.Get("weight"), 64)
+	if err != nil || weight <= 0 || math.IsInf(weight, 0) || math.IsNaN(weight) {
+		log.Printf("[%s]: invalid weight param for /nodeweight", request.RemoteAddr)
+		http.Error(response, "Invalid params, weight should be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	g_networkLock.Lock()
+	defer g_networkLock.Unlock()
+
+	for i := range g_network.Nodes {
+		node := &g_network.Nodes[i]
+		if node.ID != int32(nodeID) {
+			continue
+		}
+
+		if node.GetWeight() == weight {
+			response.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		log.Printf("Changing weight of node %d from %g to %g\n", node.ID, node.GetWeight(), weight)
+		node.Weight = weight
+		g_network.OnUpdated()
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	http.Error(response, "Node not found", http.StatusNotFound)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// the node test places the same network, so both agree with DBCommon/placement and with each other
+func TestGetTargetNodesMatchesNodes(t *testing.T) {
+	var network DBNetwork
+	var targets []struct {
+		Namespace string
+		Key       string
+		Nodes     []uint32
+	}
+	for name, v := range map[string]interface{}{"network.json": &network, "targets.json": &targets} {
+		data, err := os.ReadFile("../DBCommon/placement/testdata/" + name)
+		if err != nil {
+			t.Fatalf("os.ReadFile() = %v", err)
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("json.Unmarshal() of %s = %v", name, err)
+		}
+	}
+
+	for _, target := range targets {
+		if nodes := network.GetTargetNodes(target.Namespace, target.Key); !reflect.DeepEqual(nodes, target.Nodes) {
+			t.Errorf("GetTargetNodes(%q, %q) = %v, want %v", target.Namespace, target.Key, nodes, target.Nodes)
+		}
+	}
+}
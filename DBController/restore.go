@@ -0,0 +1,801 @@
+package main
+
+import (
+	"DBCommon/compression"
+	"DBCommon/encryption"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type RestoreOptions struct {
+	BatchSize int  // entries per /internal/setchunk request
+	Rate      int  // max entries sent per second across the cluster, 0 means unthrottled
+	Verify    bool // read everything back from the nodes once it has been sent
+}
+
+type RestoreStatus struct {
+	BackupID      string
+	PointInTime   string `json:",omitempty"` // set when archived changes are replayed on top of the backup
+	State         string
+	StartedAt     time.Time
+	FinishedAt    time.Time // zero while the restore is running
+	TargetNodes   uint32
+	TargetRF      uint32
+	SnapshotsRead int
+	KeysRead      int64 // unique keys found across all snapshots
+	ChangesRead   int64 // archived changes replayed on top of the snapshots
+	EntriesSent   int64 // key/replica pairs committed on the target cluster
+	ChunksSent    int64
+	ChunksFailed  int64
+	Removed       int64 // keys the target cluster held that didn't exist at the restore point, deleted from it
+	Verified      int64 // key/replica pairs read back with the expected value
+	Missing       int64
+	Mismatched    int64
+	Errors        []string
+}
+
+const RESTORE_STATE_RUNNING = "running"
+const RESTORE_STATE_DONE = "done"
+const RESTORE_STATE_FAILED = "failed"
+const RESTORE_DEFAULT_BATCH_SIZE = 500
+const RESTORE_DEFAULT_RATE = 2000
+const RESTORE_SCAN_PAGE_SIZE = 1000 // keys listed per /internal/scan request when looking for keys to remove
+
+var g_restoreStatus *RestoreStatus
+var g_restoreLock sync.Mutex // guards g_restoreStatus and every field in it
+
+var ErrRestoreRunning = errors.New("a restore is already running")
+
+func ReadBackupManifest(backupID string) (*BackupManifest, error) {
+	reader, err := g_backupTarget.Get(backupID + "/" + BACKUP_MANIFEST_FILE)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var manifest BackupManifest
+	err = json.NewDecoder(reader).Decode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// downloads a snapshot to a temp file, checks it against the manifest and calls visit for every entry in it
+func LoadSnapshotEntries(file BackupNodeFile, visit func(DBEntry)) error {
+	reader, err := g_backupTarget.Get(file.File)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tmpFile, err := os.CreateTemp("", "restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(tmpFile, io.TeeReader(reader, hash))
+	if err != nil {
+		return err
+	}
+
+	if len(file.SHA256) > 0 && hex.EncodeToString(hash.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("checksum of %s doesn't match the manifest", file.File)
+	}
+
+	switch file.Format {
+	case SNAPSHOT_FORMAT_SQLITE:
+		return LoadSqliteSnapshotEntries(tmpFile.Name(), visit)
+	case SNAPSHOT_FORMAT_NDJSON:
+		tmpFile.Seek(0, io.SeekStart)
+		return LoadNDJSONEntries(tmpFile, visit)
+	default:
+		return fmt.Errorf("unknown snapshot format '%s' for %s", file.Format, file.File)
+	}
+}
+
+// the default namespace is the KVStore table, every other namespace is KVStore_<namespace>
+func LoadSqliteSnapshotEntries(path string, visit func(DBEntry)) error {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND (name = 'KVStore' OR substr(name, 1, 8) = 'KVStore_') ORDER BY name")
+	if err != nil {
+		return err
+	}
+	tables := make([]string, 0)
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		if err := LoadSqliteTableEntries(db, table, strings.TrimPrefix(strings.TrimPrefix(table, "KVStore"), "_"), visit); err != nil {
+			return fmt.Errorf("table %s: %s", table, err.Error())
+		}
+	}
+	return nil
+}
+
+func LoadSqliteTableEntries(db *sql.DB, table string, namespace string, visit func(DBEntry)) error {
+	// snapshots of older nodes don't have every column yet
+	columns := map[string]string{"expires_at": "0", "flags": "0", "content_type": "''", "parts": "0", "compression": "0", "key_id": "0", "updated_at": "0"}
+	for column := range columns {
+		var found int
+		err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found > 0 {
+			columns[column] = column
+		}
+	}
+
+	rows, err := db.Query(fmt.Sprintf("SELECT key, value, %s, %s, %s, %s, %s, %s, %s FROM `%s`", columns["expires_at"], columns["flags"], columns["content_type"], columns["parts"], columns["compression"], columns["key_id"], columns["updated_at"], table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := DBEntry{Namespace: namespace}
+		var value []byte
+		var codec compression.Codec
+		var keyID uint32
+		if err := rows.Scan(&entry.Key, &value, &entry.ExpiresAt, &entry.Flags, &entry.ContentType, &entry.Parts, &codec, &keyID, &entry.UpdatedAt); err != nil {
+			return err
+		}
+
+		value, err = DecryptSnapshotValue(entry.Key, value, keyID)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt key=%s: %s", entry.Key, err.Error())
+		}
+
+		value, err = compression.Decompress(value, codec)
+		if err != nil {
+			return fmt.Errorf("failed to decompress key=%s: %s", entry.Key, err.Error())
+		}
+		entry.Value = string(value)
+		visit(entry)
+	}
+
+	return rows.Err()
+}
+
+// values of nodes with encryption on are stored encrypted with one of the keys of the keyring, with the key
+// of the entry authenticated along with them
+func DecryptSnapshotValue(key string, value []byte, keyID uint32) ([]byte, error) {
+	if keyID == encryption.NO_KEY {
+		return value, nil
+	}
+	if g_keyring == nil {
+		return nil, errors.New("snapshot is encrypted, start the controller with -keyfile")
+	}
+
+	return g_keyring.Decrypt(value, keyID, []byte(key))
+}
+
+func LoadNDJSONEntries(reader io.Reader, visit func(DBEntry)) error {
+	decoder := json.NewDecoder(reader)
+	for {
+		var entry DBEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		visit(entry)
+	}
+}
+
+func GetRestoreStatus() *RestoreStatus {
+	g_restoreLock.Lock()
+	defer g_restoreLock.Unlock()
+
+	if g_restoreStatus == nil {
+		return nil
+	}
+
+	status := *g_restoreStatus
+	status.Errors = append([]string{}, g_restoreStatus.Errors...)
+	return &status
+}
+
+func UpdateRestoreStatus(update func(status *RestoreStatus)) {
+	g_restoreLock.Lock()
+	defer g_restoreLock.Unlock()
+
+	update(g_restoreStatus)
+}
+
+func RecordRestoreError(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Println("Restore:", message)
+	UpdateRestoreStatus(func(status *RestoreStatus) { status.Errors = append(status.Errors, message) })
+}
+
+// kicks off a restore of backupID into the current network in the background
+func StartRestore(backupID string, options RestoreOptions) (*RestoreStatus, error) {
+	manifest, err := ReadBackupManifest(backupID)
+	if err != nil {
+		return nil, err
+	}
+
+	CreateMissingNamespaces(manifest)
+	return StartRestoreWith(backupID, func(plan *RestorePlan) error {
+		return LoadBackupEntries(manifest, plan)
+	}, options)
+}
+
+// creates the namespaces of the backup the network doesn't have (with the settings they had), so their keys
+// can be restored
+func CreateMissingNamespaces(manifest *BackupManifest) {
+	g_networkLock.Lock()
+	created := make([]string, 0)
+	for name, namespace := range manifest.Namespaces {
+		if _, found := g_network.Namespaces[name]; found {
+			continue
+		}
+
+		if g_network.Namespaces == nil {
+			g_network.Namespaces = make(map[string]DBNamespace)
+		}
+		if namespace.ReplicationFactor > g_network.NumNodes {
+			namespace.ReplicationFactor = g_network.NumNodes
+		}
+		namespace.OverQuota = false
+		g_network.Namespaces[name] = namespace
+		created = append(created, name)
+	}
+	if len(created) > 0 {
+		g_network.OnUpdated()
+	}
+	nodes := make([]DBNode, len(g_network.Nodes))
+	copy(nodes, g_network.Nodes)
+	g_networkLock.Unlock()
+
+	if len(created) == 0 {
+		return
+	}
+
+	log.Printf("CreateMissingNamespaces: created namespaces %v of backup %s\n", created, manifest.ID)
+	// OnUpdated doesn't wait for the nodes, the restore writes to the namespaces right away
+	for i := range nodes {
+		nodes[i].NotifyNetworkUpdated()
+	}
+}
+
+// adds every snapshot in the backup to the plan, the newest copy of a key across replicas is restored
+func LoadBackupEntries(manifest *BackupManifest, plan *RestorePlan) error {
+	if !manifest.Complete {
+		RecordRestoreError("backup %s is incomplete, keys that only lived on the missing nodes won't be restored", manifest.ID)
+	}
+
+	for _, file := range manifest.Nodes {
+		if len(file.Error) > 0 {
+			continue
+		}
+
+		err := plan.AddSource(func(add func(PointInTimeEntry)) error {
+			return LoadSnapshotEntries(file, func(entry DBEntry) { add(PointInTimeEntry{Entry: entry, Timestamp: entry.UpdatedAt}) })
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read snapshot %s: %s", file.File, err.Error())
+		}
+
+		UpdateRestoreStatus(func(status *RestoreStatus) {
+			status.SnapshotsRead++
+			status.KeysRead = plan.NumKeys()
+		})
+	}
+
+	return nil
+}
+
+// a key as one node held it at the restore point, the newest version across replicas wins
+type PointInTimeEntry struct {
+	Entry     DBEntry
+	Timestamp int64 // ms of the last write, 0 if the snapshot didn't record it
+	Deleted   bool
+}
+
+// keys are only unique within their namespace
+func GetRestoreKey(namespace string, key string) string {
+	return namespace + "/" + key
+}
+
+// the newest copy of a key across the sources of a restore
+type RestoreWinner struct {
+	Timestamp int64
+	Source    int // index of the source holding the copy
+	Deleted   bool
+}
+
+// what a restore places on the cluster. every node of the backup is a source, its entries as of the restore
+// point are spooled to a temp file so that only the winner of every key is kept in memory, values are read
+// back from the spool one source at a time while they are sent
+type RestorePlan struct {
+	sources []string // spool files
+	winners map[string]RestoreWinner
+}
+
+func MakeRestorePlan() *RestorePlan {
+	return &RestorePlan{sources: make([]string, 0), winners: make(map[string]RestoreWinner)}
+}
+
+// adds a source with the entries load passes to add, a key only moves to a later source if its copy there is newer
+func (plan *RestorePlan) AddSource(load func(add func(PointInTimeEntry)) error) error {
+	file, err := os.CreateTemp("", "restore-source-*")
+	if err != nil {
+		return err
+	}
+	plan.sources = append(plan.sources, file.Name()) // so Close removes it even if loading fails
+	source := len(plan.sources) - 1
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	var encodeErr error
+	err = load(func(entry PointInTimeEntry) {
+		restoreKey := GetRestoreKey(entry.Entry.Namespace, entry.Entry.Key)
+		if current, found := plan.winners[restoreKey]; found && entry.Timestamp <= current.Timestamp {
+			return
+		}
+
+		plan.winners[restoreKey] = RestoreWinner{Timestamp: entry.Timestamp, Source: source, Deleted: entry.Deleted}
+		if !entry.Deleted && encodeErr == nil {
+			encodeErr = encoder.Encode(entry)
+		}
+	})
+	if err == nil {
+		err = encodeErr
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// calls visit for every entry of the source that is the newest copy of its key
+func (plan *RestorePlan) ReadSource(source int, visit func(DBEntry)) error {
+	file, err := os.Open(plan.sources[source])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var entry PointInTimeEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if winner := plan.winners[GetRestoreKey(entry.Entry.Namespace, entry.Entry.Key)]; winner.Source == source && !winner.Deleted {
+			visit(entry.Entry)
+		}
+	}
+}
+
+// keys the restore puts back, deleted ones don't count
+func (plan *RestorePlan) NumKeys() int64 {
+	var numKeys int64
+	for _, winner := range plan.winners {
+		if !winner.Deleted {
+			numKeys++
+		}
+	}
+	return numKeys
+}
+
+func (plan *RestorePlan) Close() {
+	for _, path := range plan.sources {
+		os.Remove(path)
+	}
+}
+
+// picks the newest backup taken at or before the given time
+func FindBackupBefore(at time.Time) (*BackupManifest, error) {
+	ids, err := ListBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(ids) - 1; i >= 0; i-- {
+		createdAt, err := ParseBackupID(ids[i])
+		if err != nil || createdAt.After(at) {
+			continue
+		}
+
+		return ReadBackupManifest(ids[i])
+	}
+
+	return nil, fmt.Errorf("no backup was taken at or before %s", at.Format(time.RFC3339))
+}
+
+// restores the cluster to how it was at the given time, using backupID (or the newest backup before
+// the given time if empty) as the base and replaying every node's archived changes on top of it
+func StartPointInTimeRestore(backupID string, at time.Time, options RestoreOptions) (*RestoreStatus, error) {
+	var manifest *BackupManifest
+	var err error
+	if len(backupID) > 0 {
+		manifest, err = ReadBackupManifest(backupID)
+	} else {
+		manifest, err = FindBackupBefore(at)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.CreatedAt.After(at) {
+		return nil, fmt.Errorf("backup %s was taken after %s", manifest.ID, at.Format(time.RFC3339))
+	}
+
+	CreateMissingNamespaces(manifest)
+	status, err := StartRestoreWith(manifest.ID, func(plan *RestorePlan) error {
+		return LoadPointInTimeEntries(manifest, at, plan)
+	}, options)
+
+	if status != nil {
+		status.PointInTime = at.UTC().Format(time.RFC3339)
+	}
+	return status, err
+}
+
+func LoadPointInTimeEntries(manifest *BackupManifest, at time.Time, plan *RestorePlan) error {
+	UpdateRestoreStatus(func(status *RestoreStatus) { status.PointInTime = at.UTC().Format(time.RFC3339) })
+	if !manifest.Complete {
+		RecordRestoreError("backup %s is incomplete, keys that only lived on the missing nodes won't be restored", manifest.ID)
+	}
+	if time.Since(at) < g_changeArchiveInterval {
+		RecordRestoreError("changes made shortly before %s may not have been archived yet", at.Format(time.RFC3339))
+	}
+
+	namespaces := []string{DEFAULT_NAMESPACE}
+	for name := range manifest.Namespaces {
+		namespaces = append(namespaces, name)
+	}
+
+	for _, file := range manifest.Nodes {
+		if len(file.Error) > 0 {
+			continue
+		}
+
+		// the changes replay on top of the node's snapshot, only the keys of this one node are held at once
+		var changesRead int64
+		err := plan.AddSource(func(add func(PointInTimeEntry)) error {
+			nodeEntries := make(map[string]PointInTimeEntry)
+			err := LoadSnapshotEntries(file, func(entry DBEntry) {
+				nodeEntries[GetRestoreKey(entry.Namespace, entry.Key)] = PointInTimeEntry{Entry: entry, Timestamp: entry.UpdatedAt}
+			})
+			if err != nil {
+				return fmt.Errorf("failed to read snapshot %s: %s", file.File, err.Error())
+			}
+
+			for _, namespace := range namespaces {
+				since := file.ChangeSeq
+				if namespace != DEFAULT_NAMESPACE {
+					since = file.NamespaceChangeSeqs[namespace]
+				}
+
+				complete, err := ReplayArchivedChanges(file.Addr, namespace, since, at, func(change DBChange) {
+					changesRead++
+					restoreKey := GetRestoreKey(namespace, change.Key)
+					if change.Op == CHANGE_OP_DROP {
+						// the key moved to other nodes, their copies decide what it was. not a delete that could win the merge
+						delete(nodeEntries, restoreKey)
+						return
+					}
+					entry := DBEntry{Namespace: namespace, Key: change.Key, Value: change.Value, ExpiresAt: change.ExpiresAt, Flags: change.Flags, ContentType: change.ContentType, Parts: change.Parts}
+					nodeEntries[restoreKey] = PointInTimeEntry{Entry: entry, Timestamp: change.Timestamp, Deleted: change.Op == CHANGE_OP_DELETE}
+				})
+				if err != nil {
+					return fmt.Errorf("failed to replay archived changes of node %d namespace '%s': %s", file.NodeID, namespace, err.Error())
+				}
+				if !complete {
+					RecordRestoreError("archived changes of node %d (%s) namespace '%s' have gaps, some of its writes before %s are lost", file.NodeID, file.Addr, namespace, at.Format(time.RFC3339))
+				}
+			}
+
+			for _, entry := range nodeEntries {
+				add(entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		UpdateRestoreStatus(func(status *RestoreStatus) {
+			status.SnapshotsRead++
+			status.ChangesRead += changesRead
+			status.KeysRead = plan.NumKeys()
+		})
+	}
+
+	return nil
+}
+
+// load fills the plan, which is then placed on the current network
+func StartRestoreWith(backupID string, load func(plan *RestorePlan) error, options RestoreOptions) (*RestoreStatus, error) {
+	g_restoreLock.Lock()
+	if g_restoreStatus != nil && g_restoreStatus.State == RESTORE_STATE_RUNNING {
+		g_restoreLock.Unlock()
+		return nil, ErrRestoreRunning
+	}
+
+	g_networkLock.Lock()
+	network := g_network
+	network.Nodes = make([]DBNode, len(g_network.Nodes))
+	copy(network.Nodes, g_network.Nodes)
+	g_networkLock.Unlock()
+
+	g_restoreStatus = &RestoreStatus{
+		BackupID:    backupID,
+		State:       RESTORE_STATE_RUNNING,
+		StartedAt:   time.Now().UTC(),
+		TargetNodes: network.NumNodes,
+		TargetRF:    network.ReplicationFactor,
+		Errors:      make([]string, 0),
+	}
+	g_restoreLock.Unlock()
+
+	go func() {
+		state := RESTORE_STATE_DONE
+		plan := MakeRestorePlan()
+		err := load(plan)
+		if err == nil {
+			err = RestoreEntries(&network, plan, options)
+		}
+		plan.Close()
+		if err != nil {
+			RecordRestoreError("%s", err.Error())
+			state = RESTORE_STATE_FAILED
+		}
+
+		UpdateRestoreStatus(func(status *RestoreStatus) {
+			status.State = state
+			status.FinishedAt = time.Now().UTC()
+		})
+
+		log.Printf("Restore of %s finished: %+v\n", backupID, *GetRestoreStatus())
+	}()
+
+	return GetRestoreStatus(), nil
+}
+
+// places every entry of the plan on the nodes the network says should own it, using the bulk chunk path.
+// entries are sent as soon as a node has a batch of them together
+func RestoreEntries(network *DBNetwork, plan *RestorePlan, options RestoreOptions) error {
+	if network.NumNodes == 0 {
+		return errors.New("target network has no nodes")
+	}
+
+	nodes := make(map[uint32]*DBNode, len(network.Nodes))
+	for i := range network.Nodes {
+		nodes[uint32(network.Nodes[i].ID)] = &network.Nodes[i]
+	}
+
+	pending := make(map[uint32][]DBEntry)
+	expected := make(map[uint32]map[string]uint64) // hashes of the values sent to every node by restore key, if they're verified
+	send := func(node *DBNode) {
+		chunk := DBChunk{Entries: pending[uint32(node.ID)], Owner: uint32(node.ID)}
+		pending[uint32(node.ID)] = nil
+		if len(chunk.Entries) == 0 {
+			return
+		}
+
+		sentAt := time.Now()
+		sent := node.SendChunk(&chunk)
+
+		UpdateRestoreStatus(func(status *RestoreStatus) {
+			if sent {
+				status.ChunksSent++
+				status.EntriesSent += int64(len(chunk.Entries))
+			} else {
+				status.ChunksFailed++
+			}
+		})
+		if !sent {
+			RecordRestoreError("failed to send %d entries to node %d", len(chunk.Entries), node.ID)
+		}
+
+		if options.Rate > 0 {
+			budget := time.Duration(len(chunk.Entries)) * time.Second / time.Duration(options.Rate)
+			time.Sleep(budget - time.Since(sentAt))
+		}
+	}
+
+	for source := range plan.sources {
+		err := plan.ReadSource(source, func(entry DBEntry) {
+			for _, nodeID := range network.GetTargetNodes(entry.Namespace, entry.Key) {
+				pending[nodeID] = append(pending[nodeID], entry)
+				if options.Verify {
+					if expected[nodeID] == nil {
+						expected[nodeID] = make(map[string]uint64)
+					}
+					expected[nodeID][GetRestoreKey(entry.Namespace, entry.Key)] = GetValueHash(entry.Value)
+				}
+
+				if len(pending[nodeID]) >= options.BatchSize && nodes[nodeID] != nil {
+					send(nodes[nodeID])
+				}
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read back restored entries: %s", err.Error())
+		}
+	}
+
+	for i := range network.Nodes {
+		send(&network.Nodes[i])
+	}
+
+	RemoveStaleKeys(network, nodes, plan)
+
+	if options.Verify {
+		VerifyRestore(network, expected)
+	}
+
+	return nil
+}
+
+// one page of the keys a node is the first replica of, what /internal/scan answers
+type DBScanPage struct {
+	Keys []string
+	Next uint64
+	Done bool
+}
+
+func (node *DBNode) ScanKeys(namespace string, start uint64, count int) *DBScanPage {
+	res, err := g_rpc.Get(context.Background(), fmt.Sprintf("%s/internal/scan?namespace=%s&start=%d&count=%d", node.Addr, url.QueryEscape(namespace), start, count), NodeCall(SEND_CHUNK_TRIES))
+	if err != nil {
+		log.Printf("ScanKeys: Failed to scan node %d: %s\n", node.ID, err.Error())
+		return nil
+	}
+	if res.StatusCode != http.StatusOK {
+		log.Printf("ScanKeys: Node %d rejected scan with status %d\n", node.ID, res.StatusCode)
+		return nil
+	}
+
+	var page DBScanPage
+	if err := json.Unmarshal(res.Body, &page); err != nil {
+		log.Printf("ScanKeys: Failed to parse scan page sent by node %d: %s\n", node.ID, err.Error())
+		return nil
+	}
+	return &page
+}
+
+func (node *DBNode) DeleteKey(namespace string, key string) bool {
+	res, err := g_rpc.Do(context.Background(), http.MethodDelete, fmt.Sprintf("%s/internal/delete?namespace=%s&key=%s", node.Addr, url.QueryEscape(namespace), url.QueryEscape(key)), nil, NodeCall(SEND_CHUNK_TRIES))
+	if err != nil {
+		log.Printf("DeleteKey: Failed to delete key=%s on node %d: %s\n", key, node.ID, err.Error())
+		return false
+	}
+	return res.StatusCode == http.StatusNoContent
+}
+
+// a restore only writes the keys of the plan, keys the target cluster got after the restore point (or that
+// were deleted before it) are deleted from every replica so the cluster ends up as it was
+func RemoveStaleKeys(network *DBNetwork, nodes map[uint32]*DBNode, plan *RestorePlan) {
+	for _, namespace := range network.GetNamespaceNames() {
+		for i := range network.Nodes {
+			RemoveStaleNodeKeys(network, nodes, plan, namespace, &network.Nodes[i])
+		}
+	}
+}
+
+// the keys of the namespace node is the first replica of
+func RemoveStaleNodeKeys(network *DBNetwork, nodes map[uint32]*DBNode, plan *RestorePlan, namespace string, node *DBNode) {
+	var start uint64
+	for {
+		page := node.ScanKeys(namespace, start, RESTORE_SCAN_PAGE_SIZE)
+		if page == nil {
+			RecordRestoreError("failed to list the keys of node %d namespace '%s', keys added after the restore point may be left on it", node.ID, namespace)
+			return
+		}
+
+		var removed int64
+		for _, key := range page.Keys {
+			if winner, found := plan.winners[GetRestoreKey(namespace, key)]; found && !winner.Deleted {
+				continue
+			}
+
+			for _, nodeID := range network.GetTargetNodes(namespace, key) {
+				if target := nodes[nodeID]; target == nil || !target.DeleteKey(namespace, key) {
+					RecordRestoreError("failed to delete key %s of namespace '%s' from node %d", key, namespace, nodeID)
+				}
+			}
+			removed++
+		}
+		UpdateRestoreStatus(func(status *RestoreStatus) { status.Removed += removed })
+
+		if page.Done {
+			return
+		}
+		start = page.Next
+	}
+}
+
+func GetValueHash(value string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+	return hash.Sum64()
+}
+
+// reads every node's data back and checks it holds what was sent to it
+func VerifyRestore(network *DBNetwork, expected map[uint32]map[string]uint64) {
+	for _, node := range network.Nodes {
+		stored := make(map[string]uint64)
+		for _, namespace := range network.GetNamespaceNames() {
+			chunk := node.GetAllData(namespace)
+			if chunk == nil {
+				RecordRestoreError("failed to fetch data of namespace '%s' from node %d for verification", namespace, node.ID)
+				continue
+			}
+
+			for _, entry := range chunk.Entries {
+				stored[GetRestoreKey(namespace, entry.Key)] = GetValueHash(entry.Value)
+			}
+		}
+
+		var verified, missing, mismatched int64
+		for key, hash := range expected[uint32(node.ID)] {
+			storedHash, found := stored[key]
+			if !found {
+				missing++
+			} else if storedHash != hash {
+				mismatched++
+			} else {
+				verified++
+			}
+		}
+
+		UpdateRestoreStatus(func(status *RestoreStatus) {
+			status.Verified += verified
+			status.Missing += missing
+			status.Mismatched += mismatched
+		})
+	}
+}
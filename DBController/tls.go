@@ -0,0 +1,71 @@
+package main
+
+import (
+	"DBCommon/clustertls"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// with -tlscert/-tlskey/-tlsca (or -tlsdev) set, the controller serves over TLS, talks to the nodes over
+// https presenting its certificate and deploys nodes with the same TLS flags
+
+var g_tlsOptions clustertls.Options
+var g_tls *clustertls.Config // nil if TLS is off
+
+func TLS_Setup() {
+	config, err := clustertls.Load(g_tlsOptions)
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %s\n", err.Error())
+	}
+	if config == nil {
+		return
+	}
+
+	g_tls = config
+	g_rpc.SetTLSConfig(config.Client)
+	log.Println("TLS_Setup: serving over TLS, nodes are reached over https")
+}
+
+func GetNodeScheme() string {
+	if g_tls != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func GetNodeURL(host string, port int) string {
+	return fmt.Sprintf("%s://%s:%d", GetNodeScheme(), host, port)
+}
+
+// the TLS flags deployed nodes are started with, paths are made absolute since nodes run from their own directory
+func GetNodeTLSFlags() string {
+	if g_tls == nil {
+		return ""
+	}
+	if g_tlsOptions.Dev {
+		return fmt.Sprintf("-tlsdev -tlsdevdir %s", g_tlsOptions.DevDir)
+	}
+
+	flags := make([]string, 0, 3)
+	for flag, path := range map[string]string{"tlscert": g_tlsOptions.CertFile, "tlskey": g_tlsOptions.KeyFile, "tlsca": g_tlsOptions.CAFile} {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			absPath = path
+		}
+		flags = append(flags, fmt.Sprintf("-%s %s", flag, absPath))
+	}
+	return strings.Join(flags, " ")
+}
+
+func TLS_ListenAndServe() error {
+	addr := fmt.Sprintf(":%d", g_listenPort)
+	if g_tls == nil {
+		return http.ListenAndServe(addr, nil)
+	}
+
+	server := &http.Server{Addr: addr, Handler: Auth_RequireToken(http.DefaultServeMux), TLSConfig: g_tls.Server}
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"DBCommon/placement"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"strings"
+)
+
+// mirrors the split values of the nodes. a large value is stored as a manifest under its key and parts
+// under keys derived from it, which are placed on the same nodes as the key
+
+const VALUE_PART_SEPARATOR = placement.VALUE_PART_SEPARATOR
+
+type DBValueManifest struct {
+	WriteID  string
+	Size     int
+	Checksum uint32 // crc32 (IEEE) of the whole value
+}
+
+func GetValuePartKey(key string, writeID string, index int) string {
+	return fmt.Sprintf("%s%s%s.%d", key, VALUE_PART_SEPARATOR, writeID, index)
+}
+
+func IsValuePartKey(key string) bool {
+	return strings.Contains(key, VALUE_PART_SEPARATOR)
+}
+
+// replaces the manifests in the table with the whole values and drops the parts, so exports hold every
+// key with its value. values whose parts are missing are left out
+func AssembleSplitValues(entryTable map[string]DBEntryInfo) {
+	for key, info := range entryTable {
+		if info.Entry.Parts == 0 {
+			continue
+		}
+
+		var manifest DBValueManifest
+		if err := json.Unmarshal([]byte(info.Entry.Value), &manifest); err != nil {
+			log.Printf("AssembleSplitValues: invalid manifest for key=%s: %s\n", key, err.Error())
+			delete(entryTable, key)
+			continue
+		}
+
+		var builder strings.Builder
+		builder.Grow(manifest.Size)
+		for i := 0; i < int(info.Entry.Parts); i++ {
+			part, found := entryTable[GetValuePartKey(key, manifest.WriteID, i)]
+			if !found {
+				break
+			}
+			builder.WriteString(part.Entry.Value)
+		}
+
+		value := builder.String()
+		if len(value) != manifest.Size || crc32.ChecksumIEEE([]byte(value)) != manifest.Checksum {
+			log.Printf("AssembleSplitValues: parts of key=%s are missing or don't match its manifest\n", key)
+			delete(entryTable, key)
+			continue
+		}
+
+		info.Entry.Value = value
+		info.Entry.Parts = 0
+		entryTable[key] = info
+	}
+
+	for key := range entryTable {
+		if IsValuePartKey(key) {
+			delete(entryTable, key)
+		}
+	}
+}
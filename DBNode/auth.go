@@ -0,0 +1,192 @@
+package main
+
+import (
+	"DBCommon/auth"
+	"DBCommon/clustertls"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// clients of a controller started with -auth have to present one of its API tokens. the controller
+// pushes the tokens to the nodes whenever they change and the nodes download them again every
+// AUTH_REFRESH_INTERVAL in case a push was missed. auth needs TLS: without it /internal/* is open to
+// anyone, so a node without TLS never asks for credentials. with TLS the node refuses clients until it
+// got the tokens, other processes of the cluster (cluster certificates) are let through as before
+
+const AUTH_REFRESH_INTERVAL = time.Minute
+
+var g_authLoaded bool  // false until the tokens were downloaded once
+var g_authEnabled bool // the controller asks for tokens
+var g_authTokens map[string]auth.Token
+var g_authLock sync.RWMutex
+
+func Auth_Setup() {
+	if g_tls == nil {
+		return
+	}
+
+	go func() {
+		for {
+			Auth_Refresh()
+			time.Sleep(AUTH_REFRESH_INTERVAL)
+		}
+	}()
+}
+
+func Auth_Refresh() {
+	res, err := g_rpc.Get(context.Background(), g_controllerAddr+"/internal/auth", InternalCall(THREE_TRIES))
+	if err != nil {
+		log.Printf("Auth_Refresh: Failed to download API tokens from the controller: %s\n", err.Error())
+		return
+	}
+
+	config := auth.Config{}
+	switch res.StatusCode {
+	case http.StatusOK:
+		if err := json.Unmarshal(res.Body, &config); err != nil {
+			log.Printf("Auth_Refresh: Failed to parse API tokens: %s\n", err.Error())
+			return
+		}
+	case http.StatusNotFound:
+		// controllers from before auth don't have the route, their clients don't need tokens
+	default:
+		log.Printf("Auth_Refresh: Controller answered %d for the API tokens\n", res.StatusCode)
+		return
+	}
+
+	Auth_Adopt(config)
+}
+
+func Auth_Adopt(config auth.Config) {
+	tokens := make(map[string]auth.Token, len(config.Tokens))
+	for _, token := range config.Tokens {
+		tokens[token.ID] = token
+	}
+
+	g_authLock.Lock()
+	changed := !g_authLoaded || g_authEnabled != config.Enabled || len(g_authTokens) != len(tokens)
+	g_authLoaded, g_authEnabled, g_authTokens = true, config.Enabled, tokens
+	g_authLock.Unlock()
+
+	if changed {
+		log.Printf("Auth_Adopt: client authentication enabled=%t, %d API tokens\n", config.Enabled, len(tokens))
+	}
+}
+
+func Auth_Lookup(id string) (auth.Token, bool) {
+	g_authLock.RLock()
+	defer g_authLock.RUnlock()
+
+	token, found := g_authTokens[id]
+	return token, found
+}
+
+// whether clients have to authenticate, and whether the tokens are there to check them with
+func Auth_GetState() (required bool, ready bool) {
+	if g_tls == nil {
+		return false, true
+	}
+
+	g_authLock.RLock()
+	defer g_authLock.RUnlock()
+
+	return !g_authLoaded || g_authEnabled, g_authLoaded
+}
+
+// checks the credentials of an http request for a key of namespace, answers 401/403/503 and returns false
+// if the request may not go through
+func Auth_Authorize(response http.ResponseWriter, request *http.Request, scope string, namespace string, key string) bool {
+	required, ready := Auth_GetState()
+	if !required || clustertls.IsClusterPeer(request.TLS) {
+		return true
+	}
+	if !ready {
+		response.Header().Set("Retry-After", "1")
+		http.Error(response, "Node hasn't loaded the API tokens yet", http.StatusServiceUnavailable)
+		return false
+	}
+
+	token, err := auth.Authenticate(request, Auth_Lookup, g_maxValueSize)
+	if err != nil {
+		log.Printf("[%s]: Rejected a request for %s: %s\n", request.RemoteAddr, request.URL.Path, err.Error())
+		auth.WriteUnauthorized(response, err)
+		return false
+	}
+
+	denied := ""
+	switch {
+	case !token.HasScope(scope):
+		denied = fmt.Sprintf("Token doesn't have the %s scope", scope)
+	case !token.AllowsNamespace(namespace):
+		denied = "Token may not use this namespace"
+	case !token.AllowsKey(key):
+		denied = "Token may not use keys outside of its prefixes"
+	}
+	if len(denied) > 0 {
+		log.Printf("[%s]: Token %s may not %s key=%s (namespace='%s')\n", request.RemoteAddr, token.ID, scope, key, namespace)
+		http.Error(response, denied, http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// the token an <id>.<secret> credential (or its id and secret apart) belongs to, for the redis and
+// memcached listeners. returns the token id
+func Auth_Login(credential string) (string, error) {
+	_, ready := Auth_GetState()
+	if !ready {
+		return "", errors.New("node hasn't loaded the API tokens yet")
+	}
+
+	token, err := auth.CheckCredential(credential, Auth_Lookup)
+	return token.ID, err
+}
+
+// checks the token a redis or memcached client logged in with, it is looked up on every command so
+// revoked tokens stop working right away
+func Auth_Allows(tokenID string, scope string, namespace string, key string) bool {
+	if required, _ := Auth_GetState(); !required {
+		return true
+	}
+
+	token, found := Auth_Lookup(tokenID)
+	return found && token.Allows(scope, namespace, key)
+}
+
+// PUT from the controller whenever the tokens change
+func HandleAuthUpdate(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPut {
+		log.Printf("[%s]: Got a request for /internal/auth route with unsupported method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if g_tls == nil {
+		http.Error(response, "TLS is off, the node doesn't authenticate clients", http.StatusConflict)
+		return
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[%s]: Failed to read API tokens: %s\n", request.RemoteAddr, err.Error())
+		http.Error(response, "Error reading body", http.StatusBadRequest)
+		return
+	}
+
+	config := auth.Config{}
+	if err := json.Unmarshal(body, &config); err != nil {
+		log.Printf("[%s]: Failed to parse API tokens: %s\n", request.RemoteAddr, err.Error())
+		http.Error(response, "Invalid body", http.StatusBadRequest)
+		return
+	}
+
+	Auth_Adopt(config)
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"DBCommon/rpcclient"
+	"DBCommon/wire"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// what /internal/hello tells other nodes about the protocols this node speaks
+type DBProtocolInfo struct {
+	Protocols  []string
+	BinaryPort uint `json:",omitempty"`
+}
+
+// the protocol negotiated with one peer
+type PeerProtocol struct {
+	lock         sync.Mutex
+	binary       *wire.Client // nil while the peer is talked to over http
+	negotiatedAt time.Time
+	retryAfter   time.Duration
+}
+
+const BINARY_PORT_OFFSET = 1000                           // default binary port is the http port + this
+const PROTOCOL_RENEGOTIATE_INTERVAL = 5 * time.Minute     // picks up peers that were upgraded (or downgraded) in place
+const PROTOCOL_RETRY_INTERVAL = 10 * time.Second          // after the peer couldn't be asked at all
+const BINARY_CHUNK_PIECE_ENTRIES = 1000                   // most entries per piece when streaming a chunk back
+const BINARY_CHUNK_PIECE_BYTES = wire.MAX_FRAME_BYTES / 4 // most bytes per piece, an entry larger than that gets a piece of its own
+
+var g_peerProtocols = make(map[string]*PeerProtocol)
+var g_peerProtocolsLock sync.Mutex
+
+func GetBinaryPort() uint {
+	if g_binaryPort != 0 {
+		return g_binaryPort
+	}
+	return g_listenPort + BINARY_PORT_OFFSET
+}
+
+func StartBinaryServer() {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", GetBinaryPort()))
+	if err != nil {
+		log.Printf("StartBinaryServer: Failed to listen on port %d, other nodes will talk to this one over http: %s\n", GetBinaryPort(), err.Error())
+		g_binaryProtocol = false
+		return
+	}
+	listener = TLS_WrapListener(listener, true) // only nodes talk to each other over it
+
+	log.Printf("StartBinaryServer: Listening for binary protocol on port %d\n", GetBinaryPort())
+	err = wire.Serve(listener, HandleBinaryRequest)
+	log.Printf("StartBinaryServer: Stopped serving binary protocol: %s\n", err.Error())
+}
+
+func HandleHello(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		log.Printf("[%s]: Got a request for /internal/hello route with non-get method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info := DBProtocolInfo{Protocols: []string{}}
+	if g_binaryProtocol {
+		info.Protocols = append(info.Protocols, wire.PROTOCOL_NAME)
+		info.BinaryPort = GetBinaryPort()
+	}
+
+	body, err := json.Marshal(info)
+	if err != nil {
+		log.Println("HandleHello: Failed to serialize protocol info", err.Error())
+		http.Error(response, "Error serializing protocol info", http.StatusInternalServerError)
+		return
+	}
+
+	response.Write(body)
+}
+
+// the binary client for the node, or nil if it should be talked to over http. negotiated on first use and
+// again every PROTOCOL_RENEGOTIATE_INTERVAL, nodes that don't know /internal/hello predate the protocol
+func Peer_GetBinaryClient(node *DBNode) *wire.Client {
+	if !g_binaryProtocol {
+		return nil // talk to everyone the way an older node would
+	}
+
+	g_peerProtocolsLock.Lock()
+	peer, found := g_peerProtocols[node.Addr]
+	if !found {
+		peer = &PeerProtocol{}
+		g_peerProtocols[node.Addr] = peer
+	}
+	g_peerProtocolsLock.Unlock()
+
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+
+	if !peer.negotiatedAt.IsZero() && time.Since(peer.negotiatedAt) < peer.retryAfter {
+		return peer.binary
+	}
+
+	binaryAddr, err := NegotiateProtocol(node)
+	peer.negotiatedAt = time.Now()
+	if err != nil {
+		log.Printf("Peer_GetBinaryClient: Failed to negotiate protocol with node %s, using http: %s\n", node.Addr, err.Error())
+		peer.retryAfter = PROTOCOL_RETRY_INTERVAL
+		return peer.binary // keep whatever worked last time
+	}
+
+	peer.retryAfter = PROTOCOL_RENEGOTIATE_INTERVAL
+	if peer.binary != nil && peer.binary.Addr() == binaryAddr {
+		return peer.binary
+	}
+
+	if peer.binary != nil {
+		peer.binary.Close()
+		peer.binary = nil
+	}
+	if len(binaryAddr) > 0 {
+		peer.binary = wire.NewClient(binaryAddr, 0, TLS_GetClientConfig())
+		log.Printf("Peer_GetBinaryClient: talking to node %s over %s at %s\n", node.Addr, wire.PROTOCOL_NAME, binaryAddr)
+	} else {
+		log.Printf("Peer_GetBinaryClient: node %s doesn't speak %s, talking to it over http\n", node.Addr, wire.PROTOCOL_NAME)
+	}
+
+	return peer.binary
+}
+
+// makes the next call to the node renegotiate, used when its binary connection fails
+func Peer_ResetProtocol(node *DBNode) {
+	g_peerProtocolsLock.Lock()
+	peer, found := g_peerProtocols[node.Addr]
+	g_peerProtocolsLock.Unlock()
+
+	if found {
+		peer.lock.Lock()
+		peer.negotiatedAt = time.Time{}
+		peer.lock.Unlock()
+	}
+}
+
+// returns the address of the node's binary listener, empty if it only speaks http
+func NegotiateProtocol(node *DBNode) (string, error) {
+	res, err := g_rpc.Get(context.Background(), node.Addr+"/internal/hello", InternalCall(SINGLE_TRY))
+	if err != nil {
+		return "", err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("hello failed with status %d", res.StatusCode)
+	}
+
+	var info DBProtocolInfo
+	if err := json.Unmarshal(res.Body, &info); err != nil {
+		return "", err
+	}
+
+	for _, protocol := range info.Protocols {
+		if protocol == wire.PROTOCOL_NAME && info.BinaryPort != 0 {
+			addr, err := url.Parse(node.Addr)
+			if err != nil {
+				return "", err
+			}
+			return net.JoinHostPort(addr.Hostname(), fmt.Sprint(info.BinaryPort)), nil
+		}
+	}
+
+	return "", nil
+}
+
+// makes the call over the binary protocol if the node speaks it. returns false if the call should be made
+// over http instead, because the node doesn't speak the protocol, doesn't know the op or its binary
+// connection failed. pieces of a streamed answer are handed to onPiece once the call succeeded
+func (node *DBNode) CallBinary(ctx context.Context, op wire.Op, body []byte, options rpcclient.CallOptions, onPiece func([]byte) error) (*rpcclient.Response, bool, error) {
+	binary := Peer_GetBinaryClient(node)
+	if binary == nil {
+		return nil, false, nil
+	}
+
+	var pieces [][]byte
+	res, err := g_rpc.Invoke(ctx, node.Addr, options, func(ctx context.Context) (*rpcclient.Response, error) {
+		pieces = pieces[:0] // a retried call streams everything again
+		return binary.RoundTrip(ctx, op, body, func(piece []byte) error {
+			pieces = append(pieces, piece)
+			return nil
+		})
+	})
+
+	if err != nil {
+		if wire.IsConnError(err) && ctx.Err() == nil {
+			log.Printf("CallBinary: binary connection to node %s failed, falling back to http: %s\n", node.Addr, err.Error())
+			Peer_ResetProtocol(node)
+			return nil, false, nil
+		}
+		return nil, true, err
+	}
+
+	if res.StatusCode == http.StatusNotImplemented {
+		return nil, false, nil // older version of the protocol
+	}
+
+	if onPiece != nil {
+		for _, piece := range pieces {
+			if err := onPiece(piece); err != nil {
+				return nil, true, err
+			}
+		}
+	}
+
+	return res, true, nil
+}
+
+func EncodeEntry(encoder *wire.Encoder, entry *DBEntry) {
+	encoder.String(entry.Namespace)
+	encoder.String(entry.Key)
+	encoder.String(entry.Value)
+	encoder.Varint(entry.ExpiresAt)
+	encoder.Uvarint(uint64(entry.Flags))
+	encoder.String(entry.ContentType)
+	encoder.Uvarint(uint64(entry.Parts))
+}
+
+func DecodeEntry(decoder *wire.Decoder) DBEntry {
+	var entry DBEntry
+	entry.Namespace = decoder.String()
+	entry.Key = decoder.String()
+	entry.Value = decoder.String()
+	entry.ExpiresAt = decoder.Varint()
+	entry.Flags = uint32(decoder.Uvarint())
+	entry.ContentType = decoder.String()
+	entry.Parts = uint32(decoder.Uvarint())
+	return entry
+}
+
+// upper bound of the bytes EncodeEntry writes for the entry
+func GetEncodedEntrySize(entry *DBEntry) int {
+	return len(entry.Namespace) + len(entry.Key) + len(entry.Value) + len(entry.ContentType) + 7*binary.MaxVarintLen64
+}
+
+// splits entries into pieces of at most BINARY_CHUNK_PIECE_ENTRIES entries and BINARY_CHUNK_PIECE_BYTES
+// encoded, so every piece fits in a frame
+func SplitEntryPieces(entries []DBEntry) [][]DBEntry {
+	pieces := make([][]DBEntry, 0, 1)
+	start, size := 0, 0
+	for i := range entries {
+		entrySize := GetEncodedEntrySize(&entries[i])
+		if i > start && (i-start == BINARY_CHUNK_PIECE_ENTRIES || size+entrySize > BINARY_CHUNK_PIECE_BYTES) {
+			pieces = append(pieces, entries[start:i])
+			start, size = i, 0
+		}
+		size += entrySize
+	}
+	return append(pieces, entries[start:])
+}
+
+func EncodeEntries(encoder *wire.Encoder, entries []DBEntry) {
+	encoder.Uvarint(uint64(len(entries)))
+	for i := range entries {
+		EncodeEntry(encoder, &entries[i])
+	}
+}
+
+func DecodeEntries(decoder *wire.Decoder, entries []DBEntry) []DBEntry {
+	count := decoder.Uvarint()
+	for i := uint64(0); i < count && decoder.Err() == nil; i++ {
+		entries = append(entries, DecodeEntry(decoder))
+	}
+	return entries
+}
+
+func EncodeChunkHeader(encoder *wire.Encoder, chunk *DBChunk) {
+	encoder.Uvarint(uint64(chunk.Owner))
+	encoder.Uvarint(chunk.Epoch)
+	encoder.String(chunk.Sender)
+}
+
+func DecodeChunkHeader(decoder *wire.Decoder, chunk *DBChunk) {
+	chunk.Owner = uint32(decoder.Uvarint())
+	chunk.Epoch = decoder.Uvarint()
+	chunk.Sender = decoder.String()
+}
+
+// the answer for a write of numWrites that the local write queue can't take, 0 if it can
+func GetAdmissionStatus(numWrites int) int {
+	switch DB_CheckWriteAdmission(numWrites) {
+	case ADMISSION_ACCEPT:
+		return 0
+	case ADMISSION_THROTTLE:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// serves the binary protocol, every op answers the way its /internal http route does
+func HandleBinaryRequest(remoteAddr string, op wire.Op, body []byte, response *wire.ResponseWriter) {
+	decoder := wire.NewDecoder(body)
+
+	switch op {
+	case wire.OP_SET:
+		entry := DecodeEntry(decoder)
+		durable := decoder.Bool()
+		if decoder.Err() != nil || len(entry.Key) == 0 {
+			log.Printf("[%s]: Got a malformed binary set\n", remoteAddr)
+			response.Write(http.StatusBadRequest, nil)
+			return
+		}
+
+		log.Printf("[%s]: Got a binary set with key=%s\n", remoteAddr, entry.Key)
+		if status := GetAdmissionStatus(1); status != 0 {
+			response.WriteBusy(status, GetRetryAfterSeconds(), nil)
+			return
+		}
+
+		if DB_LocalWrite(entry, durable) {
+			response.Write(http.StatusCreated, nil)
+		} else {
+			response.Write(http.StatusNotAcceptable, nil)
+		}
+	case wire.OP_GET:
+		namespace, key := decoder.String(), decoder.String()
+		if decoder.Err() != nil {
+			log.Printf("[%s]: Got a malformed binary get\n", remoteAddr)
+			response.Write(http.StatusBadRequest, nil)
+			return
+		}
+
+		log.Printf("[%s]: Got a binary get for key=%s\n", remoteAddr, key)
+		entry := DB_LocalRead(namespace, key)
+		if entry == nil {
+			response.Write(http.StatusNotFound, nil)
+			return
+		}
+
+		encoder := wire.Encoder{}
+		EncodeEntry(&encoder, entry)
+		response.Write(http.StatusOK, encoder.Data())
+	case wire.OP_SETCHUNK:
+		chunkBody, err := Compression_DecodeTransfer(body)
+		if err != nil {
+			log.Printf("[%s]: Got a binary setchunk that can't be decompressed: %s\n", remoteAddr, err.Error())
+			response.Write(http.StatusBadRequest, nil)
+			return
+		}
+		HandleBinarySetChunk(remoteAddr, wire.NewDecoder(chunkBody), response)
+	case wire.OP_GETALL:
+		namespace := decoder.String()
+		if decoder.Err() != nil {
+			log.Printf("[%s]: Got a malformed binary getall\n", remoteAddr)
+			response.Write(http.StatusBadRequest, nil)
+			return
+		}
+
+		if DB_GetStorage(namespace) == nil {
+			log.Printf("[%s]: Got a binary getall for unknown namespace %s\n", remoteAddr, namespace)
+			response.Write(http.StatusNotFound, nil)
+			return
+		}
+
+		chunk := DB_GetLocalChunk(namespace)
+		if chunk == nil {
+			log.Printf("[%s]: Failed to read the local chunk of namespace %s for a binary getall\n", remoteAddr, namespace)
+			response.Write(http.StatusInternalServerError, nil)
+			return
+		}
+
+		// the last piece goes out with the chunk header as the answer
+		pieces := SplitEntryPieces(chunk.Entries)
+		for _, piece := range pieces[:len(pieces)-1] {
+			encoder := wire.Encoder{}
+			EncodeEntries(&encoder, piece)
+			if response.WritePiece(Compression_EncodeTransfer(encoder.Data())) != nil {
+				return
+			}
+		}
+
+		encoder := wire.Encoder{}
+		EncodeChunkHeader(&encoder, chunk)
+		EncodeEntries(&encoder, pieces[len(pieces)-1])
+		response.Write(http.StatusOK, Compression_EncodeTransfer(encoder.Data()))
+	case wire.OP_DELETE:
+		entry := DBEntry{Namespace: decoder.String(), Key: decoder.String()}
+		if decoder.Err() != nil || len(entry.Key) == 0 {
+			log.Printf("[%s]: Got a malformed binary delete\n", remoteAddr)
+			response.Write(http.StatusBadRequest, nil)
+			return
+		}
+
+		log.Printf("[%s]: Got a binary delete for key=%s\n", remoteAddr, entry.Key)
+		if DB_LocalDelete(entry, true) {
+			response.Write(http.StatusNoContent, nil)
+		} else {
+			response.Write(http.StatusNotAcceptable, nil)
+		}
+	case wire.OP_SCAN:
+		namespace, start, count, match := decoder.String(), decoder.Uvarint(), decoder.Uvarint(), decoder.String()
+		scanCount, pattern, valid := ParseScanParams(int(count), match)
+		if decoder.Err() != nil || !valid {
+			log.Printf("[%s]: Got a malformed binary scan\n", remoteAddr)
+			response.Write(http.StatusBadRequest, nil)
+			return
+		}
+
+		page := DB_ScanLocal(namespace, start, scanCount, pattern)
+		if page == nil {
+			response.Write(http.StatusNotFound, nil)
+			return
+		}
+
+		encoder := wire.Encoder{}
+		encoder.Uvarint(uint64(len(page.Keys)))
+		for _, key := range page.Keys {
+			encoder.String(key)
+		}
+		encoder.Uvarint(page.Next)
+		encoder.Bool(page.Done)
+		response.Write(http.StatusOK, encoder.Data())
+	case wire.OP_TOPOLOGY:
+		network, err := json.Marshal(g_dbNetwork)
+		if err != nil {
+			log.Println("HandleBinaryRequest: Failed to serialize network", err.Error())
+			response.Write(http.StatusInternalServerError, nil)
+			return
+		}
+		response.Write(http.StatusOK, network)
+	default:
+		log.Printf("[%s]: Got a binary request with unknown op %d\n", remoteAddr, op)
+		response.Write(http.StatusNotImplemented, nil)
+	}
+}
+
+func HandleBinarySetChunk(remoteAddr string, decoder *wire.Decoder, response *wire.ResponseWriter) {
+	var chunk DBChunk
+	DecodeChunkHeader(decoder, &chunk)
+	durable := decoder.Bool()
+	chunk.Entries = DecodeEntries(decoder, make([]DBEntry, 0))
+	if decoder.Err() != nil {
+		log.Printf("[%s]: Got a malformed binary setchunk\n", remoteAddr)
+		response.Write(http.StatusBadRequest, nil)
+		return
+	}
+
+	log.Printf("[%s]: Got a binary setchunk\n", remoteAddr)
+
+	if chunk.Epoch > g_dbNetwork.Epoch {
+		log.Printf("Got chunk placed with network epoch %d but ours is %d, syncing network first\n", chunk.Epoch, g_dbNetwork.Epoch)
+		SyncNetworkFromPeer(chunk.Sender, chunk.Epoch)
+	}
+
+	if chunk.Owner != uint32(g_id) {
+		log.Printf("Got chunk with owner ID %d, but self id is %d\n", chunk.Owner, g_id)
+		response.Write(http.StatusNotAcceptable, nil)
+		return
+	}
+
+	if status := GetAdmissionStatus(len(chunk.Entries)); status != 0 {
+		response.WriteBusy(status, GetRetryAfterSeconds(), nil)
+		return
+	}
+
+	log.Printf("Got chunk with %d entries to save\n", len(chunk.Entries))
+	if !durable {
+		queued := DB_LocalWriteChunk(&chunk)
+		if queued < len(chunk.Entries) {
+			log.Printf("HandleBinarySetChunk: only queued %d of %d entries\n", queued, len(chunk.Entries))
+			response.Write(http.StatusServiceUnavailable, nil)
+			return
+		}
+
+		response.Write(http.StatusCreated, nil)
+		return
+	}
+
+	written := DB_LocalWriteChunkDurable(&chunk)
+	if written < len(chunk.Entries) {
+		log.Printf("HandleBinarySetChunk: only committed %d of %d entries\n", written, len(chunk.Entries))
+		response.Write(http.StatusServiceUnavailable, nil)
+		return
+	}
+
+	response.Write(http.StatusCreated, nil)
+}
+
+// asks the node at addr for its network, nil if it can't be asked over the binary protocol
+func GetTopologyFromPeer(addr string) *DBNetwork {
+	node := DBNode{Addr: addr}
+	res, handled, err := node.CallBinary(context.Background(), wire.OP_TOPOLOGY, nil, InternalCall(SINGLE_TRY), nil)
+	if !handled || err != nil || res.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	var network DBNetwork
+	if err := json.Unmarshal(res.Body, &network); err != nil {
+		log.Printf("GetTopologyFromPeer: Failed to parse network sent by %s: %s\n", addr, err.Error())
+		return nil
+	}
+	return &network
+}
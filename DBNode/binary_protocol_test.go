@@ -0,0 +1,107 @@
+package main
+
+import (
+	"DBCommon/wire"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// sends one request to a connection served by HandleBinaryRequest and collects the pieces and the answer
+func callBinary(t *testing.T, op wire.Op, body []byte) (uint16, [][]byte, []byte) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go wire.ServeConn(server, HandleBinaryRequest)
+
+	if err := wire.WriteFrame(client, []byte{byte(op)}, body); err != nil {
+		t.Fatalf("WriteFrame() = %v", err)
+	}
+
+	pieces := make([][]byte, 0)
+	for {
+		frame, err := wire.ReadFrame(client)
+		if err != nil {
+			t.Fatalf("ReadFrame() = %v, want an answer", err)
+		}
+
+		status := binary.BigEndian.Uint16(frame[0:2])
+		if status != wire.STATUS_PIECE {
+			return status, pieces, frame[6:]
+		}
+		pieces = append(pieces, frame[6:])
+	}
+}
+
+func TestBinaryGetAllUnknownNamespace(t *testing.T) {
+	g_dbNetwork = DBNetwork{}
+
+	encoder := wire.Encoder{}
+	encoder.String("created-elsewhere")
+	if status, pieces, _ := callBinary(t, wire.OP_GETALL, encoder.Data()); status != http.StatusNotFound || len(pieces) != 0 {
+		t.Fatalf("getall of an unknown namespace = status %d with %d pieces, want 404 without pieces", status, len(pieces))
+	}
+}
+
+func TestBinaryGetAll(t *testing.T) {
+	g_dbNetwork = DBNetwork{}
+	g_storage = MakeMemoryEngine(DEFAULT_NAMESPACE)
+	numEntries := BINARY_CHUNK_PIECE_ENTRIES*2 + 10
+	for i := 0; i < numEntries; i++ {
+		mustPut(t, g_storage, DBEntry{Key: fmt.Sprintf("key%d", i), Value: "value"})
+	}
+
+	encoder := wire.Encoder{}
+	encoder.String(DEFAULT_NAMESPACE)
+	status, pieces, answer := callBinary(t, wire.OP_GETALL, encoder.Data())
+	if status != http.StatusOK || len(pieces) != 2 {
+		t.Fatalf("getall = status %d with %d pieces, want 200 with 2 pieces", status, len(pieces))
+	}
+
+	entries := make([]DBEntry, 0)
+	for _, piece := range pieces {
+		body, err := Compression_DecodeTransfer(piece)
+		if err != nil {
+			t.Fatalf("Compression_DecodeTransfer() of a piece = %v", err)
+		}
+		entries = DecodeEntries(wire.NewDecoder(body), entries)
+	}
+
+	body, err := Compression_DecodeTransfer(answer)
+	if err != nil {
+		t.Fatalf("Compression_DecodeTransfer() of the answer = %v", err)
+	}
+	var chunk DBChunk
+	decoder := wire.NewDecoder(body)
+	DecodeChunkHeader(decoder, &chunk)
+	entries = DecodeEntries(decoder, entries)
+	if decoder.Err() != nil || len(entries) != numEntries {
+		t.Fatalf("getall returned %d entries, %v, want %d", len(entries), decoder.Err(), numEntries)
+	}
+}
+
+func TestSplitEntryPieces(t *testing.T) {
+	large := strings.Repeat("v", BINARY_CHUNK_PIECE_BYTES/2)
+	entries := []DBEntry{{Key: "a", Value: large}, {Key: "b", Value: large}, {Key: "c", Value: "small"}, {Key: "d", Value: strings.Repeat("v", BINARY_CHUNK_PIECE_BYTES)}}
+
+	pieces := SplitEntryPieces(entries)
+	sizes := make([]int, 0, len(pieces))
+	for _, piece := range pieces {
+		sizes = append(sizes, len(piece))
+		encoder := wire.Encoder{}
+		EncodeEntries(&encoder, piece)
+		if len(encoder.Data()) > wire.MAX_FRAME_BYTES-6 {
+			t.Errorf("piece of %d entries encodes to %d bytes, more than fits in a frame", len(piece), len(encoder.Data()))
+		}
+	}
+	if fmt.Sprint(sizes) != "[1 2 1]" {
+		t.Fatalf("SplitEntryPieces() = pieces of %v entries, want [1 2 1]", sizes)
+	}
+
+	if pieces := SplitEntryPieces(nil); len(pieces) != 1 || len(pieces[0]) != 0 {
+		t.Fatalf("SplitEntryPieces(nil) = %d pieces, want a single empty one for the answer", len(pieces))
+	}
+}
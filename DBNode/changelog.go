@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"time"
+	"unicode/utf8"
+)
+
+type DBChangeOp uint8
+
+const (
+	CHANGE_OP_WRITE  DBChangeOp = iota
+	CHANGE_OP_DELETE DBChangeOp = iota
+	CHANGE_OP_DROP   DBChangeOp = iota // the key moved to other replicas and this node dropped its copy, it wasn't deleted
+)
+
+type DBChange struct {
+	Seq         int64 // monotonically increasing per node, never reused
+	Op          DBChangeOp
+	Key         string
+	Value       string // empty for deletes
+	Timestamp   int64  // unix timestamp (in ms) when the change was committed
+	Parts       uint32 `json:",omitempty"` // set if Value is the manifest of a split value, see DBEntry.Parts
+	ExpiresAt   int64  `json:",omitempty"` // metadata of the written entry, see DBEntry
+	Flags       uint32 `json:",omitempty"`
+	ContentType string `json:",omitempty"`
+}
+
+type dbChangeJSON DBChange
+
+// binary values are base64 encoded in ValueBase64, like in the json of DBEntry
+func (change DBChange) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(change.Value) {
+		return json.Marshal(dbChangeJSON(change))
+	}
+
+	raw := dbChangeJSON(change)
+	raw.Value = ""
+	return json.Marshal(struct {
+		dbChangeJSON
+		ValueBase64 string
+	}{raw, base64.StdEncoding.EncodeToString([]byte(change.Value))})
+}
+
+type DBChangeBatch struct {
+	Changes   []DBChange
+	OldestSeq int64 // oldest seq still retained, a reader whose since is older than this has missed changes
+	LatestSeq int64 // newest seq, a reader whose since is newer than this is reading a log that started over
+}
+
+const CHANGE_LOG_DEFAULT_LIMIT = 1000
+const CHANGE_LOG_MAX_LIMIT = 10000
+const CHANGE_LOG_TRIM_INTERVAL_S = 60
+
+// periodically drops changes older than the retention window, trimming is queued like any other write
+func ChangeLog_RunRetention() {
+	if g_changeLogRetention <= 0 {
+		log.Println("ChangeLog_RunRetention: retention disabled, change log will grow unbounded")
+		return
+	}
+
+	for {
+		time.Sleep(CHANGE_LOG_TRIM_INTERVAL_S * time.Second)
+		Sqlite_TrimChangeLog()
+	}
+}
+
+// returns nil if the storage engine doesn't keep a change log or reading it failed
+func DB_GetChanges(storage StorageEngine, since int64, limit int) *DBChangeBatch {
+	changeLog, ok := storage.(ChangeLogReader)
+	if !ok {
+		return nil
+	}
+
+	changes := changeLog.ReadChanges(since, limit)
+	if changes == nil {
+		return nil
+	}
+
+	return &DBChangeBatch{Changes: changes, OldestSeq: changeLog.OldestChangeSeq(), LatestSeq: changeLog.LatestChangeSeq()}
+}
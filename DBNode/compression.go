@@ -0,0 +1,112 @@
+package main
+
+import (
+	"DBCommon/compression"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// values of at least -compressthreshold bytes are compressed before the sqlite and log engines store them,
+// the codec is stored next to the value and reads decompress it again. chunks sent to other nodes over
+// the binary protocol are compressed as a whole, and bulk http answers are gzipped for clients that accept it
+
+type DBCompressionStats struct {
+	Codec     string
+	Threshold uint
+	Values    compression.Stats // values written to storage since the node started
+	Transfers compression.Stats // chunks and bulk answers sent to other nodes and the controller
+}
+
+const COMPRESSION_MIN_TRANSFER_BYTES = 1024
+
+var g_valueCompression compression.Counter
+var g_transferCompression compression.Counter
+
+// the value as it should be stored and the codec it is stored with
+func Compression_EncodeValue(value string) (string, compression.Codec) {
+	if !g_compressValues || len(value) < int(g_compressThreshold) {
+		g_valueCompression.Record(len(value), len(value), compression.CODEC_NONE)
+		return value, compression.CODEC_NONE
+	}
+
+	compressed, codec := compression.Compress([]byte(value))
+	g_valueCompression.Record(len(value), len(compressed), codec)
+	return string(compressed), codec
+}
+
+func Compression_DecodeValue(value string, codec compression.Codec) (string, error) {
+	if codec == compression.CODEC_NONE {
+		return value, nil
+	}
+
+	decompressed, err := compression.Decompress([]byte(value), codec)
+	return string(decompressed), err
+}
+
+// prefixes the body of a transfer with the codec it is compressed with
+func Compression_EncodeTransfer(body []byte) []byte {
+	encoded, codec := body, compression.CODEC_NONE
+	if g_compressTransfers && len(body) >= COMPRESSION_MIN_TRANSFER_BYTES {
+		encoded, codec = compression.Compress(body)
+	}
+
+	g_transferCompression.Record(len(body), len(encoded)+1, codec)
+	return append([]byte{byte(codec)}, encoded...)
+}
+
+func Compression_DecodeTransfer(body []byte) ([]byte, error) {
+	if len(body) == 0 {
+		return nil, compression.ErrUnknownCodec
+	}
+	return compression.Decompress(body[1:], compression.Codec(body[0]))
+}
+
+// writes a bulk answer, gzipped if the client accepts it. go's http client asks for gzip and decompresses
+// transparently, so older nodes and the controller read it like before
+func WriteCompressedResponse(response http.ResponseWriter, request *http.Request, body []byte) {
+	if !g_compressTransfers || len(body) < COMPRESSION_MIN_TRANSFER_BYTES || !strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") {
+		response.Write(body)
+		return
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(body)
+	writer.Close()
+	g_transferCompression.Record(len(body), compressed.Len(), compression.CODEC_GZIP)
+
+	response.Header().Set("Content-Encoding", "gzip")
+	response.Header().Add("Vary", "Accept-Encoding")
+	response.Write(compressed.Bytes())
+}
+
+func HandleGetCompressionStats(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		log.Printf("[%s]: Got a request for /internal/compression route with non-get method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := DBCompressionStats{
+		Codec:     compression.CODEC_ZSTD.String(),
+		Threshold: g_compressThreshold,
+		Values:    g_valueCompression.Stats(),
+		Transfers: g_transferCompression.Stats(),
+	}
+	if !g_compressValues {
+		stats.Codec = compression.CODEC_NONE.String()
+	}
+
+	body, err := json.Marshal(stats)
+	if err != nil {
+		log.Println("HandleGetCompressionStats: Failed to serialize stats", err.Error())
+		http.Error(response, "Error serializing stats", http.StatusInternalServerError)
+		return
+	}
+
+	response.Write(body)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"DBCommon/compression"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCompressionTransferRoundTrip(t *testing.T) {
+	g_compressTransfers = true
+	defer func() { g_compressTransfers = false }()
+
+	tests := []struct {
+		name  string
+		body  []byte
+		codec compression.Codec
+	}{
+		{"Small", []byte("below the transfer threshold"), compression.CODEC_NONE},
+		{"Empty", []byte{}, compression.CODEC_NONE},
+		{"Large", bytes.Repeat([]byte("entry,"), COMPRESSION_MIN_TRANSFER_BYTES), compression.CODEC_ZSTD},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			encoded := Compression_EncodeTransfer(test.body)
+			if compression.Codec(encoded[0]) != test.codec {
+				t.Fatalf("Compression_EncodeTransfer() used %s, want %s", compression.Codec(encoded[0]), test.codec)
+			}
+
+			decoded, err := Compression_DecodeTransfer(encoded)
+			if err != nil || !bytes.Equal(decoded, test.body) {
+				t.Fatalf("Compression_DecodeTransfer() = %d bytes, %v, want the %d encoded", len(decoded), err, len(test.body))
+			}
+		})
+	}
+}
+
+func TestCompressionTransferMalformed(t *testing.T) {
+	for _, body := range [][]byte{nil, {9, 'a'}, {byte(compression.CODEC_ZSTD), 'a', 'b'}} {
+		if decoded, err := Compression_DecodeTransfer(body); err == nil {
+			t.Errorf("Compression_DecodeTransfer(%v) = %q, want an error", body, decoded)
+		}
+	}
+}
+
+func TestCompressionValueThreshold(t *testing.T) {
+	g_compressValues, g_compressThreshold = true, 64
+	defer func() { g_compressValues = false }()
+
+	small := strings.Repeat("s", 63)
+	if stored, codec := Compression_EncodeValue(small); codec != compression.CODEC_NONE || stored != small {
+		t.Errorf("Compression_EncodeValue() of %d bytes used %s, want it stored as it is", len(small), codec)
+	}
+
+	large := strings.Repeat("l", 64)
+	stored, codec := Compression_EncodeValue(large)
+	if codec != compression.CODEC_ZSTD {
+		t.Fatalf("Compression_EncodeValue() of %d bytes used %s, want zstd", len(large), codec)
+	}
+	if value, err := Compression_DecodeValue(stored, codec); err != nil || value != large {
+		t.Fatalf("Compression_DecodeValue() = %q, %v, want %q", value, err, large)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const DEFAULT_DATA_DIR_ROOT = "/virtual/guptalak"
+const DATA_DIR_LOCK_FILE = "LOCK"
+
+// before -datadir every node kept its store right in DEFAULT_DATA_DIR_ROOT
+var g_legacyDataFiles = [][]string{
+	{DBFileName, DBFileName + "-wal", DBFileName + "-shm"}, // the first file of a group is moved first, the others follow it
+	{LOG_ENGINE_FILE_NAME},
+}
+
+var g_dataDirLock *os.File // held open for as long as the node runs, the lock goes away with the process
+
+// takes an exclusive lock on dir so two nodes never share one store, exits if another node holds it
+func LockDataDir(dir string) {
+	if g_dataDirLock != nil {
+		return
+	}
+
+	lockPath := dir + "/" + DATA_DIR_LOCK_FILE
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatalf("LockDataDir: failed to open lock file %s: %s\n", lockPath, err.Error())
+	}
+
+	err = TryLockFile(file)
+	if err != nil {
+		holder, _ := os.ReadFile(lockPath)
+		log.Fatalf("LockDataDir: data dir %s is in use by another node (pid %s): %s\n", dir, strings.TrimSpace(string(holder)), err.Error())
+	}
+
+	file.Truncate(0)
+	file.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+
+	g_dataDirLock = file
+	log.Printf("LockDataDir: locked data dir %s\n", dir)
+}
+
+// moves a store left in DEFAULT_DATA_DIR_ROOT by nodes from before -datadir into dir, so upgrading doesn't
+// start the node on an empty store. nodes sharing the host race for it, the first one to move it takes it.
+// exits if dir already has a store of its own, one of them would be silently ignored otherwise
+func MigrateLegacyDataDir(dir string) {
+	for _, group := range g_legacyDataFiles {
+		legacyPath := DEFAULT_DATA_DIR_ROOT + "/" + group[0]
+		if _, err := os.Stat(legacyPath); err != nil {
+			continue
+		}
+
+		if _, err := os.Stat(dir + "/" + group[0]); err == nil {
+			log.Fatalf("MigrateLegacyDataDir: found a store from before -datadir at %s but %s has one too, move or delete one of them (or pass -datadir %s to keep using the old one)\n", legacyPath, dir, DEFAULT_DATA_DIR_ROOT)
+		}
+
+		os.MkdirAll(dir, 0700)
+		if err := os.Rename(legacyPath, dir+"/"+group[0]); err != nil {
+			log.Printf("MigrateLegacyDataDir: didn't move %s, another node may have taken it: %s\n", legacyPath, err.Error())
+			continue
+		}
+		for _, name := range group[1:] {
+			if err := os.Rename(DEFAULT_DATA_DIR_ROOT+"/"+name, dir+"/"+name); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Fatalf("MigrateLegacyDataDir: moved %s but failed to move %s along with it: %s\n", legacyPath, name, err.Error())
+			}
+		}
+
+		log.Printf("MigrateLegacyDataDir: moved the store at %s into %s\n", legacyPath, dir)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// no flock outside of unix, the lock file is still written so the pid of the owner is visible
+func TryLockFile(file *os.File) error {
+	log.Println("TryLockFile: data dir locking isn't supported on this platform")
+	return nil
+}
@@ -1,64 +1,244 @@
 package main
 
 import (
+	"DBCommon/placement"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"hash/fnv"
 	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
 type DBEntry struct {
-	Key   string
-	Value string
+	Namespace   string `json:",omitempty"` // empty for the default namespace
+	Key         string
+	Value       string
+	ExpiresAt   int64  `json:",omitempty"` // unix timestamp (in ms) after which the entry is gone, 0 if it never expires
+	Flags       uint32 `json:",omitempty"` // opaque to the db, set and returned by memcached clients
+	ContentType string `json:",omitempty"` // media type the value was stored with through /v1/kv, empty if none was given
+	Parts       uint32 `json:",omitempty"` // set if the value was split into this many parts, Value then holds a DBValueManifest
+	UpdatedAt   int64  `json:",omitempty"` // unix timestamp (in ms) of the last write, only filled in for snapshots
 }
 
+type dbEntryJSON DBEntry
+
 type DBChunk struct {
 	Entries []DBEntry
 	Owner   uint32 // owner node id
+	Epoch   uint64 `json:",omitempty"` // network epoch the sender placed the entries with
+	Sender  string `json:",omitempty"` // http addr of the node that placed the entries, asked for the network if ours is behind
 }
 
+type WriteAdmission uint8
+
+const (
+	ADMISSION_ACCEPT   WriteAdmission = iota
+	ADMISSION_THROTTLE WriteAdmission = iota // queue is past its soft limit, callers should slow down
+	ADMISSION_REJECT   WriteAdmission = iota // queue has no room for the writes
+)
+
 const SINGLE_TRY uint16 = 1
 const THREE_TRIES uint16 = 3
 const CACHE_SIZE uint32 = 500
+const KEY_LOCK_STRIPES = 64
+const LOG_VALUE_PREVIEW_BYTES = 64
 
-var g_dataCache LRUCache = MakeLRUCache(CACHE_SIZE)
+var g_dataCache *LRUCache = MakeLRUCache(CACHE_SIZE)
 
+// read-modify-write commands (INCR, memcached cas and friends) hold the lock of their key, so they are
+// serialized when they go through the same node. the same key modified through different nodes can still race
+var g_keyLocks [KEY_LOCK_STRIPES]sync.Mutex
+
+// the parts of a split value hash like the key they belong to, so they live on the same replicas
 func (entry *DBEntry) Hash() uint64 {
-	hash := fnv.New64()
-	hash.Write([]byte(entry.Key))
-	return hash.Sum64()
+	return placement.HashKey(entry.Key)
 }
 
-func (entry *DBEntry) GetTargetNodes() []uint32 {
-	targetNodes := make([]uint32, g_dbNetwork.ReplicationFactor)
-	nodeID := uint32(entry.Hash() % uint64(g_dbNetwork.NumNodes))
+// values can be large and binary, logs only get the start of them
+func (entry DBEntry) String() string {
+	value := entry.Value
+	if len(value) > LOG_VALUE_PREVIEW_BYTES {
+		value = value[:LOG_VALUE_PREVIEW_BYTES] + "..."
+	}
+	return fmt.Sprintf("{Namespace:%s Key:%q Value:%q (%d bytes) ExpiresAt:%d Flags:%d ContentType:%s Parts:%d}", entry.Namespace, entry.Key, value, len(entry.Value), entry.ExpiresAt, entry.Flags, entry.ContentType, entry.Parts)
+}
+
+// encoding/json replaces invalid utf-8 in strings, so binary values are sent base64 encoded in ValueBase64 instead
+func (entry DBEntry) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(entry.Value) {
+		return json.Marshal(dbEntryJSON(entry))
+	}
+
+	raw := dbEntryJSON(entry)
+	raw.Value = ""
+	return json.Marshal(struct {
+		dbEntryJSON
+		ValueBase64 string
+	}{raw, base64.StdEncoding.EncodeToString([]byte(entry.Value))})
+}
+
+func (entry *DBEntry) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		dbEntryJSON
+		ValueBase64 string
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
 
-	for i := 0; i < int(g_dbNetwork.ReplicationFactor); i++ {
-		targetNodes[i] = nodeID
-		nodeID = (nodeID + 1) % g_dbNetwork.NumNodes
+	*entry = DBEntry(raw.dbEntryJSON)
+	if len(raw.ValueBase64) > 0 {
+		value, err := base64.StdEncoding.DecodeString(raw.ValueBase64)
+		if err != nil {
+			return err
+		}
+		entry.Value = string(value)
 	}
+	return nil
+}
+
+// identifies the contents of the entry, it changes whenever the value, flags or content type do. used as
+// the ETag of /v1/kv and the cas unique of memcached. it's derived instead of stored, so a value that was
+// changed and then changed back gets its old version back
+func (entry *DBEntry) GetVersion() uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(strconv.FormatUint(uint64(entry.Flags), 10)))
+	hash.Write([]byte{0})
+	hash.Write([]byte(entry.ContentType))
+	hash.Write([]byte{0})
+	hash.Write([]byte(entry.Value))
+	return placement.MixHash(hash.Sum64())
+}
 
-	return targetNodes
+// the cache only keeps values, entries with an expiry, flags, a content type or parts have to be read from
+// storage. parts of split values are too large to be worth caching
+func (entry *DBEntry) IsCacheable() bool {
+	return entry.ExpiresAt == 0 && entry.Flags == 0 && len(entry.ContentType) == 0 && entry.Parts == 0 && !IsValuePartKey(entry.Key)
+}
+
+func DB_LockKey(namespace string, key string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(namespace))
+	hash.Write([]byte{0})
+	hash.Write([]byte(key))
+	return &g_keyLocks[hash.Sum32()%KEY_LOCK_STRIPES]
+}
+
+func (entry *DBEntry) GetTargetNodes() []uint32 {
+	return entry.GetTargetNodesIn(&g_dbNetwork)
 }
 
 func DB_Write(data DBEntry) {
+	if ShouldSplitValue(data) {
+		go DB_WriteDurable(data, 1) // the parts have to be stored before the manifest points at them
+		return
+	}
+
 	targetNodes := data.GetTargetNodes()
 	log.Printf("Entry %+v will be written to %v nodes\n", data, targetNodes)
 
 	for _, nodeID := range targetNodes {
 		if nodeID == uint32(g_id) {
-			go DB_LocalWrite(data)
+			go DB_LocalWrite(data, false)
 		} else {
-			go SendToNodeWithID(data, nodeID, SINGLE_TRY)
+			go func(nodeID uint32) {
+				DB_NotePeerAdmission(nodeID, GetWriteAdmission(SendWriteToNodeWithID(data, nodeID, SINGLE_TRY, false)))
+			}(nodeID)
 		}
 	}
 }
 
-// returns the value for the corrosponding key (if it exists)
-func DB_Read(key string) *DBEntry {
-	if value, found := g_dataCache.Find(key); found {
-		return &value
+// like DB_Write, but only returns once requiredAcks replicas have committed the entry (or the
+// timeout passed), returns the number of replicas that acknowledged the write
+func DB_WriteDurable(data DBEntry, requiredAcks int) int {
+	acks, _ := DB_WriteToReplicas(data, requiredAcks, true)
+	return acks
+}
+
+// sends the entry to every replica and waits for requiredAcks of them (or the timeout), durable says whether
+// they have to commit it or only queue it. replicas check their own write queue, besides the acks this
+// returns the admission of the busiest replica that turned the write down
+func DB_WriteToReplicas(data DBEntry, requiredAcks int, durable bool) (int, WriteAdmission) {
+	if ShouldSplitValue(data) {
+		if !durable {
+			DB_Write(data)
+			return requiredAcks, ADMISSION_ACCEPT
+		}
+		return DB_WriteSplit(data, requiredAcks), ADMISSION_ACCEPT
+	}
+
+	targetNodes := data.GetTargetNodes()
+	log.Printf("Entry %+v will be written to %v nodes, waiting for %d acks (durable=%t)\n", data, targetNodes, requiredAcks, durable)
+
+	type replicaResult struct {
+		success   bool
+		admission WriteAdmission
+	}
+	results := make(chan replicaResult, len(targetNodes))
+	for _, nodeID := range targetNodes {
+		if nodeID == uint32(g_id) {
+			go func() {
+				if admission := DB_CheckWriteAdmission(1); admission != ADMISSION_ACCEPT {
+					results <- replicaResult{false, admission}
+					return
+				}
+				results <- replicaResult{DB_LocalWrite(data, durable), ADMISSION_ACCEPT}
+			}()
+		} else {
+			go func(nodeID uint32) {
+				status := SendWriteToNodeWithID(data, nodeID, SINGLE_TRY, durable)
+				results <- replicaResult{status == http.StatusCreated, GetWriteAdmission(status)}
+			}(nodeID)
+		}
+	}
+
+	acks := 0
+	admission := ADMISSION_ACCEPT
+	timeout := time.After(g_durableWriteTimeout)
+	for responses := 0; responses < len(targetNodes) && acks < requiredAcks; responses++ {
+		select {
+		case result := <-results:
+			if result.success {
+				acks++
+			}
+			if result.admission > admission {
+				admission = result.admission
+			}
+		case <-timeout:
+			log.Printf("DB_WriteToReplicas: timed out waiting for acks for key=%s, got %d of %d\n", data.Key, acks, requiredAcks)
+			return acks, admission
+		}
+	}
+
+	return acks, admission
+}
+
+// writes to every replica and waits for all of them, for protocols whose clients expect to read their own writes
+func DB_WriteAllReplicas(data DBEntry) bool {
+	numReplicas := len(data.GetTargetNodes())
+	return DB_WriteDurable(data, numReplicas) >= numReplicas
+}
+
+// returns the value for the corrosponding key (if it exists), split values are put back together
+func DB_Read(namespace string, key string) *DBEntry {
+	return DB_AssembleValue(DB_ReadEntry(namespace, key))
+}
+
+// like DB_Read, but returns the manifest of a split value as it is stored
+func DB_ReadEntry(namespace string, key string) *DBEntry {
+	if namespace == DEFAULT_NAMESPACE {
+		if value, found := g_dataCache.Find(key); found {
+			return &value
+		}
 	}
 
-	entry := DBEntry{Key: key, Value: ""}
+	entry := DBEntry{Namespace: namespace, Key: key, Value: ""}
 	ownerNodes := entry.GetTargetNodes()
 
 	hasDataLocally := false
@@ -70,32 +250,171 @@ func DB_Read(key string) *DBEntry {
 	}
 
 	if hasDataLocally {
-		savedEntry := Sqlite_Read(entry.Key)
+		savedEntry := DB_LocalRead(namespace, key)
 		if savedEntry != nil {
-			g_dataCache.Add(*savedEntry)
+			if namespace == DEFAULT_NAMESPACE && savedEntry.IsCacheable() {
+				g_dataCache.Add(*savedEntry)
+			}
 			return savedEntry
 		}
 	}
 
+	remoteOwners := make([]uint32, 0, len(ownerNodes))
 	for _, ownerID := range ownerNodes {
 		if ownerID != uint32(g_id) {
-			savedEntry := GetDataFromNode(key, ownerID)
+			remoteOwners = append(remoteOwners, ownerID)
+		}
+	}
+
+	savedEntry := DB_ReadRemote(namespace, key, remoteOwners)
+	if savedEntry == nil {
+		log.Printf("Failed to find value for %s\n", key)
+	}
+	return savedEntry
+}
+
+// asks the fastest replica first. if it hasn't answered after the hedge delay the next fastest is asked
+// as well, and a replica that answers without the key is followed up right away. the first replica to
+// return the key wins
+func DB_ReadRemote(namespace string, key string, ownerIDs []uint32) *DBEntry {
+	replicas := Peer_SortByLatency(ownerIDs)
+	results := make(chan *DBEntry, len(replicas))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // abandons the requests still in flight once one replica answered
+
+	next := 0
+	askNext := func() {
+		ownerID := replicas[next]
+		next++
+		go func() {
+			savedEntry, _ := GetDataFromNode(ctx, namespace, key, ownerID)
+			results <- savedEntry
+		}()
+	}
+
+	pending := 0
+	if len(replicas) > 0 {
+		askNext()
+		pending++
+	}
+
+	for pending > 0 {
+		var hedge <-chan time.Time
+		if next < len(replicas) && g_hedgeDelay > 0 {
+			hedge = time.After(g_hedgeDelay)
+		}
+
+		select {
+		case savedEntry := <-results:
+			pending--
 			if savedEntry != nil {
 				return savedEntry
 			}
-
-			log.Printf("Failed to get value from node %d, trying a different node\n", ownerID)
+			if next < len(replicas) {
+				askNext()
+				pending++
+			}
+		case <-hedge:
+			log.Printf("DB_ReadRemote: no answer for key=%s after %s, hedging to node %d\n", key, g_hedgeDelay, replicas[next])
+			askNext()
+			pending++
 		}
 	}
 
-	log.Printf("Failed to find value for %s\n", key)
 	return nil
 }
 
+// reads the key from as many replicas as the consistency level asks for, returns false if not enough
+// replicas answered
+func DB_ReadWithConsistency(namespace string, key string, consistency string) (*DBEntry, bool) {
+	if consistency == CONSISTENCY_ONE {
+		return DB_Read(namespace, key), true
+	}
+
+	numReplicas := int(g_dbNetwork.GetReplicationFactor(namespace, key))
+	entry, answered := DB_ReadQuorum(namespace, key, GetRequiredReplicas(consistency, numReplicas))
+	return DB_AssembleValue(entry), answered
+}
+
+// asks every replica for the key and waits for requiredReplicas of them to answer, the value most
+// of them agree on wins. returns false if not enough replicas answered
+func DB_ReadQuorum(namespace string, key string, requiredReplicas int) (*DBEntry, bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	entry := DBEntry{Namespace: namespace, Key: key}
+	ownerNodes := entry.GetTargetNodes()
+
+	type replicaAnswer struct {
+		entry    *DBEntry
+		answered bool
+	}
+
+	answers := make(chan replicaAnswer, len(ownerNodes))
+	for _, ownerID := range ownerNodes {
+		if ownerID == uint32(g_id) {
+			go func() { answers <- replicaAnswer{DB_LocalRead(namespace, key), true} }()
+		} else {
+			go func(ownerID uint32) {
+				savedEntry, answered := GetDataFromNode(ctx, namespace, key, ownerID)
+				answers <- replicaAnswer{savedEntry, answered}
+			}(ownerID)
+		}
+	}
+
+	votes := make(map[string]int) // value -> replicas holding it, "" stands for replicas that don't have the key
+	entries := make(map[string]*DBEntry)
+	answered := 0
+	timeout := time.After(g_durableWriteTimeout)
+	for responses := 0; responses < len(ownerNodes) && answered < requiredReplicas; responses++ {
+		var answer replicaAnswer
+		select {
+		case answer = <-answers:
+		case <-timeout:
+			log.Printf("DB_ReadQuorum: timed out waiting for replicas for key=%s, got %d of %d\n", key, answered, requiredReplicas)
+			return nil, false
+		}
+
+		if !answer.answered {
+			continue
+		}
+
+		answered++
+		value := ""
+		if answer.entry != nil {
+			value = answer.entry.Value
+			entries[value] = answer.entry
+		}
+		votes[value]++
+	}
+
+	if answered < requiredReplicas {
+		log.Printf("DB_ReadQuorum: only %d of %d required replicas answered for key=%s\n", answered, requiredReplicas, key)
+		return nil, false
+	}
+
+	winner := ""
+	for value, count := range votes {
+		if count > votes[winner] || (count == votes[winner] && value > winner) {
+			winner = value
+		}
+	}
+
+	return entries[winner], true
+}
+
 func DB_RehashData() {
-	localChunk := DB_GetLocalChunk()
+	for _, namespace := range g_dbNetwork.GetNamespaceNames() {
+		DB_RehashNamespace(namespace)
+	}
+
+	g_dataCache.Purge()
+}
+
+func DB_RehashNamespace(namespace string) {
+	localChunk := DB_GetLocalChunk(namespace)
 	if localChunk == nil {
-		log.Println("DB_RehashData: failed to rehash data because DB_GetLocalChunk returned nil")
+		log.Printf("DB_RehashNamespace: failed to rehash namespace '%s' because DB_GetLocalChunk returned nil\n", namespace)
 		return
 	}
 
@@ -111,7 +430,7 @@ func DB_RehashData() {
 				if chunk, found := nodeToEntriesTable[nodeID]; found {
 					chunk.Entries = append(chunk.Entries, entry)
 				} else {
-					nodeToEntriesTable[nodeID] = &DBChunk{Entries: make([]DBEntry, 0), Owner: nodeID}
+					nodeToEntriesTable[nodeID] = &DBChunk{Entries: make([]DBEntry, 0), Owner: nodeID, Epoch: g_dbNetwork.Epoch}
 					chunk := nodeToEntriesTable[nodeID]
 					chunk.Entries = append(chunk.Entries, entry)
 				}
@@ -121,18 +440,157 @@ func DB_RehashData() {
 		}
 
 		if shouldDeleteThisEntry {
-			go DB_LocalDelete(entry)
+			go DB_LocalDrop(entry)
 		}
 	}
 
 	for id, chunk := range nodeToEntriesTable {
 		go SendChunkToNodeWithID(chunk, id, THREE_TRIES) // this is a lot of data, try a few times before giving up
 	}
+}
 
-	g_dataCache.Purge()
+func ContainsNodeID(nodeIDs []uint32, id uint32) bool {
+	for _, nodeID := range nodeIDs {
+		if nodeID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// used when only replication factors or node weights changed, the nodes stay the same so the old primary
+// of every key is still around. it copies keys to the replicas they gained and replicas that were dropped
+// delete their copy, keys whose replicas didn't change aren't touched
+func DB_MoveReplicas(oldNetwork *DBNetwork, scopes []DBReplicationScope) {
+	for _, scope := range scopes {
+		storage := DB_GetStorage(scope.Namespace)
+		if storage == nil {
+			continue
+		}
+
+		localChunk := storage.Scan(scope.Prefix)
+		if localChunk == nil {
+			log.Printf("DB_MoveReplicas: failed to scan namespace '%s' for prefix '%s'\n", scope.Namespace, scope.Prefix)
+			continue
+		}
+
+		nodeToEntriesTable := make(map[uint32]*DBChunk, 0)
+		moved, dropped := 0, 0
+		for _, entry := range localChunk.Entries {
+			if entry.IsExpired() {
+				continue
+			}
+
+			oldTargets := entry.GetTargetNodesIn(oldNetwork)
+			newTargets := entry.GetTargetNodes()
+
+			if oldTargets[0] == uint32(g_id) {
+				gained := false
+				for _, nodeID := range newTargets {
+					if ContainsNodeID(oldTargets, nodeID) {
+						continue
+					}
+
+					if _, found := nodeToEntriesTable[nodeID]; !found {
+						nodeToEntriesTable[nodeID] = &DBChunk{Entries: make([]DBEntry, 0), Owner: nodeID, Epoch: g_dbNetwork.Epoch}
+					}
+					nodeToEntriesTable[nodeID].Entries = append(nodeToEntriesTable[nodeID].Entries, entry)
+					gained = true
+				}
+				if gained {
+					moved++
+				}
+			}
+
+			if !ContainsNodeID(newTargets, uint32(g_id)) {
+				DB_LocalDrop(entry)
+				dropped++
+			}
+		}
+
+		log.Printf("DB_MoveReplicas: namespace '%s' prefix '%s': copying %d keys to new replicas, dropped %d local copies\n", scope.Namespace, scope.Prefix, moved, dropped)
+
+		for id, chunk := range nodeToEntriesTable {
+			go SendChunkToNodeWithID(chunk, id, THREE_TRIES)
+		}
+	}
+}
+
+// decides whether this node can take numWrites more local writes right now
+func DB_CheckWriteAdmission(numWrites int) WriteAdmission {
+	queuedEngine, ok := g_storage.(QueuedStorageEngine)
+	if !ok {
+		return ADMISSION_ACCEPT
+	}
+
+	queueDepth := queuedEngine.QueueDepth()
+	if queueDepth+numWrites > int(g_maxQueuedJobs) {
+		return ADMISSION_REJECT
+	}
+	if queueDepth >= int(g_queueSoftLimit) {
+		return ADMISSION_THROTTLE
+	}
+
+	return ADMISSION_ACCEPT
+}
+
+// the last write queue answer of every peer that turned a write down. DB_Write doesn't wait for the replicas,
+// so their answers slow down the writes after it instead
+type PeerAdmission struct {
+	admission WriteAdmission
+	until     time.Time
+}
+
+var g_peerAdmissions = make(map[uint32]PeerAdmission)
+var g_peerAdmissionsLock sync.Mutex
+
+func DB_NotePeerAdmission(nodeID uint32, admission WriteAdmission) {
+	g_peerAdmissionsLock.Lock()
+	defer g_peerAdmissionsLock.Unlock()
+
+	if admission == ADMISSION_ACCEPT {
+		delete(g_peerAdmissions, nodeID)
+		return
+	}
+	g_peerAdmissions[nodeID] = PeerAdmission{admission, time.Now().Add(time.Duration(GetRetryAfterSeconds()) * time.Second)}
+}
+
+// admission of the busiest owner of the entry, this node's queue as it is and the others' as they last answered
+func DB_CheckOwnerAdmission(data DBEntry) WriteAdmission {
+	g_peerAdmissionsLock.Lock()
+	defer g_peerAdmissionsLock.Unlock()
+
+	admission := ADMISSION_ACCEPT
+	for _, nodeID := range data.GetTargetNodes() {
+		nodeAdmission := ADMISSION_ACCEPT
+		if nodeID == uint32(g_id) {
+			nodeAdmission = DB_CheckWriteAdmission(1)
+		} else if peer, found := g_peerAdmissions[nodeID]; found && time.Now().Before(peer.until) {
+			nodeAdmission = peer.admission
+		}
+
+		if nodeAdmission > admission {
+			admission = nodeAdmission
+		}
+	}
+
+	return admission
+}
+
+// what a replica's answer to a write says about its write queue
+func GetWriteAdmission(status int) WriteAdmission {
+	switch status {
+	case http.StatusTooManyRequests:
+		return ADMISSION_THROTTLE
+	case http.StatusServiceUnavailable:
+		return ADMISSION_REJECT
+	default:
+		return ADMISSION_ACCEPT
+	}
 }
 
-func DB_LocalWrite(data DBEntry) bool {
+// if durable is set, returns once the entry has been committed instead of once it has been queued
+func DB_LocalWrite(data DBEntry, durable bool) bool {
 	targetNodes := data.GetTargetNodes()
 	shouldSaveLocally := false
 	for _, id := range targetNodes {
@@ -147,40 +605,166 @@ func DB_LocalWrite(data DBEntry) bool {
 		return false
 	}
 
-	if _, found := g_dataCache.Find(data.Key); found {
-		g_dataCache.UpdateValue(data) // if entry in cache, update it as well
+	storage := DB_GetStorage(data.Namespace)
+	if storage == nil {
+		log.Printf("DB_LocalWrite: called with entry %+v but namespace '%s' doesn't exist\n", data, data.Namespace)
+		return false
+	}
+
+	if _, found := g_dataCache.Find(data.Key); found && data.Namespace == DEFAULT_NAMESPACE {
+		if data.IsCacheable() {
+			g_dataCache.UpdateValue(data) // if entry in cache, update it as well
+		} else {
+			g_dataCache.Delete(data.Key)
+		}
+	}
+
+	var success bool
+	if durable {
+		success = storage.PutDurable(data)
+	} else {
+		success = storage.Put(data)
 	}
 
-	success := Sqlite_Write(data)
 	if success {
+		Namespace_NoteExpiry(data.Namespace, data.ExpiresAt)
 		log.Printf("DB_LocalWrite: Wrote %+v to database\n", data)
 	}
 
-	return true
+	return success
 }
 
-func DB_LocalWriteChunk(chunk *DBChunk) {
+// queues every entry of the chunk, returns how many were queued
+func DB_LocalWriteChunk(chunk *DBChunk) int {
+	written := 0
 	for _, entry := range chunk.Entries {
-		DB_LocalWrite(entry)
+		if DB_LocalWrite(entry, false) {
+			written++
+		}
+	}
+	return written
+}
+
+// writes every entry of the chunk and waits for them to be committed, returns how many made it
+func DB_LocalWriteChunkDurable(chunk *DBChunk) int {
+	results := make(chan bool, len(chunk.Entries))
+	for _, entry := range chunk.Entries {
+		go func(entry DBEntry) { results <- DB_LocalWrite(entry, true) }(entry) // queued together so they share a batch
+	}
+
+	written := 0
+	for range chunk.Entries {
+		if <-results {
+			written++
+		}
 	}
+
+	return written
 }
 
-func DB_LocalRead(key string) *DBEntry {
-	if value, found := g_dataCache.Find(key); found {
-		return &value // cache hit
+// only the default namespace is cached, entries of other namespaces can expire
+func DB_LocalRead(namespace string, key string) *DBEntry {
+	if namespace == DEFAULT_NAMESPACE {
+		if value, found := g_dataCache.Find(key); found {
+			return &value // cache hit
+		}
 	}
 
-	return Sqlite_Read(key)
+	storage := DB_GetStorage(namespace)
+	if storage == nil {
+		return nil
+	}
+
+	entry := storage.Get(key)
+	if entry == nil || entry.IsExpired() {
+		return nil
+	}
+
+	return entry
 }
 
-func DB_LocalDelete(data DBEntry) {
-	g_dataCache.Delete(data.Key)
-	Sqlite_Delete(data.Key)
+// if durable is set, returns once the delete has been committed instead of once it has been queued
+func DB_LocalDelete(data DBEntry, durable bool) bool {
+	storage := DB_GetStorage(data.Namespace)
+	if storage == nil {
+		return false
+	}
+
+	if data.Namespace == DEFAULT_NAMESPACE {
+		g_dataCache.Delete(data.Key)
+	}
+	if durable {
+		return storage.DeleteDurable(data.Key)
+	}
+	return storage.Delete(data.Key)
 }
 
-func DB_GetLocalChunk() *DBChunk {
-	data := Sqlite_ReadAll()
+// removes the local copy of a key that moved to other replicas. the change log records it as a drop, so
+// readers of the log (restores) don't take it for a delete of the key
+func DB_LocalDrop(data DBEntry) bool {
+	storage := DB_GetStorage(data.Namespace)
+	if storage == nil {
+		return false
+	}
+
+	if data.Namespace == DEFAULT_NAMESPACE {
+		g_dataCache.Delete(data.Key)
+	}
+	return storage.Drop(data.Key)
+}
+
+// deletes the key on every replica, returns the number of replicas that acknowledged the delete
+func DB_Delete(namespace string, key string) int {
+	entry := DBEntry{Namespace: namespace, Key: key}
+	targetNodes := entry.GetTargetNodes()
+	log.Printf("Key %s will be deleted from %v nodes\n", key, targetNodes)
+
+	results := make(chan bool, len(targetNodes))
+	for _, nodeID := range targetNodes {
+		if nodeID == uint32(g_id) {
+			go func() { results <- DB_LocalDelete(entry, true) }()
+		} else {
+			go func(nodeID uint32) { results <- SendDeleteToNodeWithID(entry, nodeID, SINGLE_TRY) }(nodeID)
+		}
+	}
+
+	acks := 0
+	timeout := time.After(g_durableWriteTimeout)
+	for responses := 0; responses < len(targetNodes); responses++ {
+		select {
+		case success := <-results:
+			if success {
+				acks++
+			}
+		case <-timeout:
+			log.Printf("DB_Delete: timed out waiting for acks for key=%s, got %d of %d\n", key, acks, len(targetNodes))
+			return acks
+		}
+	}
+
+	return acks
+}
+
+// every live entry of the namespace stored on this node
+func DB_GetLocalChunk(namespace string) *DBChunk {
+	storage := DB_GetStorage(namespace)
+	if storage == nil {
+		return nil
+	}
+
+	data := storage.Scan("")
+	if data == nil {
+		return nil
+	}
+
+	live := data.Entries[:0]
+	for _, entry := range data.Entries {
+		if !entry.IsExpired() {
+			live = append(live, entry)
+		}
+	}
 
+	data.Entries = live
 	data.Owner = uint32(g_id)
 	return data
 }
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestDBCheckOwnerAdmission(t *testing.T) {
+	g_id = 0
+	g_storage = MakeMemoryEngine(DEFAULT_NAMESPACE)
+	g_dbNetwork = DBNetwork{Nodes: []DBNode{{Addr: "http://10.0.0.1:5000", ID: 0}, {Addr: "http://10.0.0.2:5000", ID: 1}}, NumNodes: 2, ReplicationFactor: 2}
+	defer func() { g_dbNetwork = DBNetwork{} }()
+	entry := DBEntry{Key: "key", Value: "value"}
+
+	tests := []struct {
+		peer WriteAdmission // last answer of node 1
+		want WriteAdmission
+	}{
+		{ADMISSION_ACCEPT, ADMISSION_ACCEPT},
+		{ADMISSION_THROTTLE, ADMISSION_THROTTLE},
+		{ADMISSION_REJECT, ADMISSION_REJECT},
+		{ADMISSION_ACCEPT, ADMISSION_ACCEPT}, // the peer took a write since
+	}
+
+	for _, test := range tests {
+		DB_NotePeerAdmission(1, test.peer)
+		if got := DB_CheckOwnerAdmission(entry); got != test.want {
+			t.Errorf("DB_CheckOwnerAdmission() after the peer answered %d = %d, want %d", test.peer, got, test.want)
+		}
+	}
+
+	// a node that isn't an owner of the key doesn't hold it up
+	g_dbNetwork.ReplicationFactor = 1
+	owner := entry.GetTargetNodes()[0]
+	DB_NotePeerAdmission(1-owner, ADMISSION_REJECT)
+	if got := DB_CheckOwnerAdmission(entry); got != ADMISSION_ACCEPT {
+		t.Errorf("DB_CheckOwnerAdmission() with a saturated node that doesn't own the key = %d, want %d", got, ADMISSION_ACCEPT)
+	}
+	DB_NotePeerAdmission(1-owner, ADMISSION_ACCEPT)
+}
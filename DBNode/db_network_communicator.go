@@ -1,49 +1,110 @@
 package main
 
 import (
-	"bytes"
+	"DBCommon/rpcclient"
+	"DBCommon/wire"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"time"
 )
 
-const SEND_RETRY_INTERVAL_S = 2
+const MAX_BACKPRESSURE_RETRIES = 8 // times a busy node is waited on before a send gives up, these don't count against numTries
+const SEND_CHUNK_MAX_ENTRIES = 500
 
-func (node *DBNode) Send(data DBEntry, numTries uint16) {
-	for numTries > 0 {
-		_, err := http.Post(fmt.Sprintf("%s/internal/set?key=%s&value=%s", node.Addr, url.QueryEscape(data.Key), url.QueryEscape(data.Value)), "application/json", http.NoBody)
+// options for single key calls to other nodes
+func InternalCall(numTries uint16) rpcclient.CallOptions {
+	return rpcclient.CallOptions{Timeout: g_internalTimeout, Attempts: int(numTries), BusyRetries: MAX_BACKPRESSURE_RETRIES}
+}
+
+// options for chunk transfers, which legitimately take longer
+func BulkCall(numTries uint16) rpcclient.CallOptions {
+	return rpcclient.CallOptions{Timeout: g_bulkTimeout, Attempts: int(numTries), BusyRetries: MAX_BACKPRESSURE_RETRIES}
+}
+
+// if durable is set, the target only responds once the entry is committed, returns whether the target accepted the entry
+func (node *DBNode) Send(data DBEntry, numTries uint16, durable bool) bool {
+	return node.SendWrite(data, numTries, durable) == http.StatusCreated
+}
+
+// like Send, but returns the status the node answered with, 0 if it couldn't be reached
+func (node *DBNode) SendWrite(data DBEntry, numTries uint16, durable bool) int {
+	encoder := wire.Encoder{}
+	EncodeEntry(&encoder, &data)
+	encoder.Bool(durable)
+
+	res, handled, err := node.CallBinary(context.Background(), wire.OP_SET, encoder.Data(), InternalCall(numTries), nil)
+	if !handled {
+		res, err = g_rpc.Post(context.Background(), fmt.Sprintf("%s/internal/set?namespace=%s&key=%s&value=%s&expiresat=%d&flags=%d&contenttype=%s&parts=%d&durable=%t", node.Addr, url.QueryEscape(data.Namespace), url.QueryEscape(data.Key), url.QueryEscape(data.Value), data.ExpiresAt, data.Flags, url.QueryEscape(data.ContentType), data.Parts, durable), nil, InternalCall(numTries))
+	}
+	if err != nil {
+		log.Printf("Failed to send data to node %v: %s", node, err.Error())
+		return 0
+	}
+
+	if res.StatusCode != http.StatusCreated {
+		log.Printf("Node %v rejected data with status %d", node, res.StatusCode)
+	}
+
+	return res.StatusCode
+}
+
+func (node *DBNode) GetAllData(namespace string) *DBChunk {
+	encoder := wire.Encoder{}
+	encoder.String(namespace)
+
+	entries := make([]DBEntry, 0)
+	res, handled, err := node.CallBinary(context.Background(), wire.OP_GETALL, encoder.Data(), BulkCall(SINGLE_TRY), func(piece []byte) error {
+		piece, err := Compression_DecodeTransfer(piece)
 		if err != nil {
-			log.Printf("Failed to send data to node %v: %s", node, err.Error())
-		} else {
-			return
+			return err
 		}
 
-		numTries--
-		if numTries > 0 {
-			time.Sleep(SEND_RETRY_INTERVAL_S * time.Second)
+		decoder := wire.NewDecoder(piece)
+		entries = DecodeEntries(decoder, entries)
+		return decoder.Err()
+	})
+	if handled {
+		if err != nil {
+			log.Printf("failed to fetch data from node %d: %s", node.ID, err.Error())
+			return nil
+		}
+		if res.StatusCode != http.StatusOK {
+			log.Printf("failed to fetch data from node %d: status %d", node.ID, res.StatusCode)
+			return nil
 		}
+
+		body, err := Compression_DecodeTransfer(res.Body)
+		if err != nil {
+			log.Printf("Failed to decompress data sent by node %d: %s", node.ID, err.Error())
+			return nil
+		}
+
+		var data DBChunk
+		decoder := wire.NewDecoder(body)
+		DecodeChunkHeader(decoder, &data)
+		data.Entries = DecodeEntries(decoder, entries)
+		if decoder.Err() != nil {
+			log.Printf("Failed to parse data sent by node %d into DBChunk: %s", node.ID, decoder.Err().Error())
+			return nil
+		}
+		return &data
 	}
-}
 
-func (node *DBNode) GetAllData() *DBChunk {
-	res, err := http.Get(node.Addr + "/internal/getall")
+	res, err = g_rpc.Get(context.Background(), node.Addr+"/internal/getall?namespace="+url.QueryEscape(namespace), BulkCall(SINGLE_TRY))
 	if err != nil {
 		log.Printf("failed to fetch data from node %d: %s", node.ID, err.Error())
 		return nil
 	}
-
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		log.Printf("Failed to parse data sent by node %d: %s", node.ID, err.Error())
+	if res.StatusCode != http.StatusOK {
+		log.Printf("failed to fetch data from node %d: status %d", node.ID, res.StatusCode)
 		return nil
 	}
 
 	var data DBChunk
-	err = json.Unmarshal(body, &data)
+	err = json.Unmarshal(res.Body, &data)
 	if err != nil {
 		log.Printf("Failed to parse data sent by node %d into DBChunk: %s", node.ID, err.Error())
 		return nil
@@ -52,33 +113,121 @@ func (node *DBNode) GetAllData() *DBChunk {
 	return &data
 }
 
+// large chunks are split up and sent one piece at a time so a rehash doesn't flood the target's write queue
 func (node *DBNode) SendChunk(data *DBChunk, numTries uint16) {
-	serializedChunk, err := json.Marshal(data)
-	log.Printf("Chunk: %s\n", string(serializedChunk))
-	if err != nil {
-		log.Printf("SendChunk: Failed to serialize chunk for target node %d\n", data.Owner)
-		return
+	for start := 0; start < len(data.Entries); start += SEND_CHUNK_MAX_ENTRIES {
+		end := start + SEND_CHUNK_MAX_ENTRIES
+		if end > len(data.Entries) {
+			end = len(data.Entries)
+		}
+
+		if !node.SendChunkPiece(&DBChunk{Entries: data.Entries[start:end], Owner: data.Owner, Epoch: data.Epoch, Sender: GetSelfAddr()}, numTries) {
+			log.Printf("SendChunk: giving up on sending entries [%d, %d) to node %d\n", start, end, data.Owner)
+		}
 	}
+}
 
-	for numTries > 0 {
-		_, err := http.Post(fmt.Sprintf("%s/internal/setchunk", node.Addr), "application/json", bytes.NewBuffer(serializedChunk))
-		if err != nil {
-			log.Printf("Failed to send data to node %v: %s", node, err.Error())
-		} else {
-			return
+func (node *DBNode) SendChunkPiece(data *DBChunk, numTries uint16) bool {
+	encoder := wire.Encoder{}
+	EncodeChunkHeader(&encoder, data)
+	encoder.Bool(false) // durable
+	EncodeEntries(&encoder, data.Entries)
+
+	res, handled, err := node.CallBinary(context.Background(), wire.OP_SETCHUNK, Compression_EncodeTransfer(encoder.Data()), BulkCall(numTries), nil)
+	if !handled {
+		serializedChunk, serializeErr := json.Marshal(data)
+		if serializeErr != nil {
+			log.Printf("SendChunk: Failed to serialize chunk for target node %d\n", data.Owner)
+			return false
 		}
 
-		numTries--
-		if numTries > 0 {
-			time.Sleep(SEND_RETRY_INTERVAL_S * time.Second)
+		res, err = g_rpc.Post(context.Background(), fmt.Sprintf("%s/internal/setchunk", node.Addr), serializedChunk, BulkCall(numTries))
+	}
+	if err != nil {
+		log.Printf("Failed to send chunk to node %v: %s", node, err.Error())
+		return false
+	}
+
+	if res.StatusCode != http.StatusCreated {
+		log.Printf("Node %v rejected chunk with status %d", node, res.StatusCode)
+		return false
+	}
+
+	return true
+}
+
+func (node *DBNode) SendDelete(data DBEntry, numTries uint16) bool {
+	encoder := wire.Encoder{}
+	encoder.String(data.Namespace)
+	encoder.String(data.Key)
+
+	res, handled, err := node.CallBinary(context.Background(), wire.OP_DELETE, encoder.Data(), InternalCall(numTries), nil)
+	if !handled {
+		res, err = g_rpc.Do(context.Background(), http.MethodDelete, fmt.Sprintf("%s/internal/delete?namespace=%s&key=%s", node.Addr, url.QueryEscape(data.Namespace), url.QueryEscape(data.Key)), nil, InternalCall(numTries))
+	}
+	if err != nil {
+		log.Printf("Failed to send delete to node %v: %s", node, err.Error())
+		return false
+	}
+
+	if res.StatusCode != http.StatusNoContent {
+		log.Printf("Node %v rejected delete with status %d", node, res.StatusCode)
+		return false
+	}
+
+	return true
+}
+
+// one page of the keys the node is the first replica of, see DB_ScanLocal
+func (node *DBNode) ScanKeys(namespace string, start uint64, count int, match string) *DBScanPage {
+	encoder := wire.Encoder{}
+	encoder.String(namespace)
+	encoder.Uvarint(start)
+	encoder.Uvarint(uint64(count))
+	encoder.String(match)
+
+	res, handled, err := node.CallBinary(context.Background(), wire.OP_SCAN, encoder.Data(), InternalCall(SINGLE_TRY), nil)
+	if !handled {
+		res, err = g_rpc.Get(context.Background(), fmt.Sprintf("%s/internal/scan?namespace=%s&start=%d&count=%d&match=%s", node.Addr, url.QueryEscape(namespace), start, count, url.QueryEscape(match)), InternalCall(SINGLE_TRY))
+	}
+	if err != nil {
+		log.Printf("ScanKeys: Failed to scan node %d: %s\n", node.ID, err.Error())
+		return nil
+	}
+	if res.StatusCode != http.StatusOK {
+		log.Printf("ScanKeys: Node %d rejected scan with status %d\n", node.ID, res.StatusCode)
+		return nil
+	}
+
+	var page DBScanPage
+	if !handled {
+		if err := json.Unmarshal(res.Body, &page); err != nil {
+			log.Printf("ScanKeys: Failed to parse scan page sent by node %d: %s\n", node.ID, err.Error())
+			return nil
 		}
+		return &page
+	}
+
+	decoder := wire.NewDecoder(res.Body)
+	numKeys := decoder.Uvarint()
+	page.Keys = make([]string, 0)
+	for i := uint64(0); i < numKeys && decoder.Err() == nil; i++ {
+		page.Keys = append(page.Keys, decoder.String())
+	}
+	page.Next = decoder.Uvarint()
+	page.Done = decoder.Bool()
+	if decoder.Err() != nil {
+		log.Printf("ScanKeys: Failed to parse scan page sent by node %d: %s\n", node.ID, decoder.Err().Error())
+		return nil
 	}
+
+	return &page
 }
 
-func GetChunkFromNode(id uint32) *DBChunk {
+func GetChunkFromNode(namespace string, id uint32) *DBChunk {
 	for _, node := range g_dbNetwork.Nodes {
 		if node.ID == int32(id) {
-			chunk := node.GetAllData()
+			chunk := node.GetAllData(namespace)
 			return chunk
 		}
 	}
@@ -86,45 +235,98 @@ func GetChunkFromNode(id uint32) *DBChunk {
 	return nil
 }
 
-func GetDataFromNode(key string, id uint32) *DBEntry {
+// the bool is false if the node couldn't be asked, a node that answers without the key returns nil, true.
+// cancelling ctx abandons the request, hedged reads do that once another replica answered
+func GetDataFromNode(ctx context.Context, namespace string, key string, id uint32) (*DBEntry, bool) {
 	for _, node := range g_dbNetwork.Nodes {
 		if node.ID == int32(id) {
-			res, err := http.Get(fmt.Sprintf("%s/internal/get?key=%s", node.Addr, url.QueryEscape(key)))
+			encoder := wire.Encoder{}
+			encoder.String(namespace)
+			encoder.String(key)
 
+			res, handled, err := node.CallBinary(ctx, wire.OP_GET, encoder.Data(), InternalCall(SINGLE_TRY), nil)
+			if !handled {
+				res, err = g_rpc.Get(ctx, fmt.Sprintf("%s/internal/get?namespace=%s&key=%s", node.Addr, url.QueryEscape(namespace), url.QueryEscape(key)), InternalCall(SINGLE_TRY))
+			}
 			if err != nil {
-				log.Printf("GetDataFromNode: Failed to fetch key=%s from node=%d\n", key, id)
-				return nil
+				if ctx.Err() == nil {
+					log.Printf("GetDataFromNode: Failed to fetch key=%s from node=%d: %s\n", key, id, err.Error())
+				}
+				return nil, false
 			}
 
-			if res.StatusCode == http.StatusOK {
-				body, err := ioutil.ReadAll(res.Body)
-				if err != nil {
-					log.Printf("GetDataFromNode: Failed to read body for response\n")
-					return nil
+			if res.StatusCode == http.StatusNotFound {
+				return nil, true
+			}
+
+			if res.StatusCode == http.StatusOK && handled {
+				decoder := wire.NewDecoder(res.Body)
+				entry := DecodeEntry(decoder)
+				if decoder.Err() != nil {
+					log.Printf("GetDataFromNode: Failed to parse body for response\n")
+					return nil, false
 				}
 
+				return &entry, true
+			}
+
+			if res.StatusCode == http.StatusOK {
 				var entry DBEntry
-				err = json.Unmarshal(body, &entry)
+				err = json.Unmarshal(res.Body, &entry)
 				if err != nil {
 					log.Printf("GetDataFromNode: Failed to parse body for response\n")
-					return nil
+					return nil, false
 				}
 
-				return &entry
+				return &entry, true
 			}
+
+			return nil, false
 		}
 	}
 
-	return nil
+	return nil, false
+}
+
+// http addr of this node in the current network
+func GetSelfAddr() string {
+	for _, node := range g_dbNetwork.Nodes {
+		if node.ID == int32(g_id) {
+			return node.Addr
+		}
+	}
+
+	return ""
 }
 
-func SendToNodeWithID(data DBEntry, id uint32, numTries uint16) {
+func SendToNodeWithID(data DBEntry, id uint32, numTries uint16, durable bool) bool {
 	for _, node := range g_dbNetwork.Nodes {
 		if node.ID == int32(id) {
-			node.Send(data, numTries)
-			return
+			return node.Send(data, numTries, durable)
 		}
 	}
+
+	return false
+}
+
+func SendWriteToNodeWithID(data DBEntry, id uint32, numTries uint16, durable bool) int {
+	for _, node := range g_dbNetwork.Nodes {
+		if node.ID == int32(id) {
+			return node.SendWrite(data, numTries, durable)
+		}
+	}
+
+	return 0
+}
+
+func SendDeleteToNodeWithID(data DBEntry, id uint32, numTries uint16) bool {
+	for _, node := range g_dbNetwork.Nodes {
+		if node.ID == int32(id) {
+			return node.SendDelete(data, numTries)
+		}
+	}
+
+	return false
 }
 
 func SendChunkToNodeWithID(data *DBChunk, id uint32, numTries uint16) {
@@ -153,7 +355,8 @@ func (network *DBNetwork) NodeExists(node *DBNode) bool {
 // compares local version of DBNetwork against the provided
 // and returns true if any changes are detected
 func DiffNetworkAgainstLocal(network *DBNetwork) bool {
-	if network.NumNodes != g_dbNetwork.NumNodes || network.ReplicationFactor != g_dbNetwork.ReplicationFactor {
+	// replication factor changes only move the affected keys, see GetChangedReplicationScopes
+	if network.NumNodes != g_dbNetwork.NumNodes {
 		return true
 	}
 
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"DBCommon/encryption"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// with -keyfile (or DB_ENCRYPTION_KEYS) set, the sqlite engine encrypts every value it stores, entries and
+// change log alike, with the active key of the keyring. the id of the key is stored next to the value, so
+// after a new key is added to the keyfile (as the last line) the rows under older keys are re-encrypted in
+// the background through the job executor. snapshots are copies of the db file, their values stay encrypted
+
+type DBEncryptionStatus struct {
+	Enabled     bool
+	ActiveKey   uint32           `json:",omitempty"`
+	Keys        []uint32         `json:",omitempty"`
+	ValuesByKey map[uint32]int64 // stored entries and changes per id of the key they are encrypted with, 0 is unencrypted
+	Rotation    DBKeyRotationStatus
+}
+
+type DBKeyRotationStatus struct {
+	Running    bool
+	Key        uint32 // key the rows are re-encrypted with
+	Rewritten  int64  // rows re-encrypted so far
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Error      string `json:",omitempty"`
+}
+
+const ENCRYPTION_ROTATION_BATCH_ROWS = 256
+const ENCRYPTION_ROTATION_PAUSE = 10 * time.Millisecond // between batches, so client writes don't queue up behind the rotation
+const ENCRYPTION_QUEUE_FULL_BACKOFF = time.Second
+
+var g_keyring *encryption.Keyring // nil if encryption is off
+var g_rotationStatus DBKeyRotationStatus
+var g_rotationLock sync.Mutex
+
+func Encryption_LoadKeys() {
+	keyring, err := encryption.LoadKeyring(g_keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %s\n", err.Error())
+	}
+	if keyring == nil {
+		return
+	}
+
+	if g_storageEngineName != STORAGE_ENGINE_SQLITE {
+		log.Fatalf("Encryption at rest is only supported by the %s engine\n", STORAGE_ENGINE_SQLITE)
+	}
+	if info, err := os.Stat(g_keyFile); err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Printf("Encryption_LoadKeys: keyfile %s can be read by other users (mode %s)\n", g_keyFile, info.Mode().Perm())
+	}
+
+	g_keyring = keyring
+	log.Printf("Encryption_LoadKeys: loaded keys %v, new values are encrypted with key %d\n", keyring.KeyIDs(), keyring.ActiveKey())
+}
+
+// the value as it should be stored and the id of the key it is encrypted with. the key of the entry is
+// authenticated along with it, so values can't be swapped between keys
+func Encryption_EncryptValue(key string, value string) (string, uint32) {
+	if g_keyring == nil {
+		return value, encryption.NO_KEY
+	}
+
+	encrypted, keyID := g_keyring.Encrypt([]byte(value), []byte(key))
+	return string(encrypted), keyID
+}
+
+func Encryption_DecryptValue(key string, value string, keyID uint32) (string, error) {
+	if keyID == encryption.NO_KEY {
+		return value, nil
+	}
+	if g_keyring == nil {
+		return "", encryption.ErrUnknownKey
+	}
+
+	decrypted, err := g_keyring.Decrypt([]byte(value), keyID, []byte(key))
+	return string(decrypted), err
+}
+
+// re-encrypts every row that isn't under the active key in the background, no-op if a rotation is running.
+// a running rotation goes over the rows again if the active key changed while it ran
+func Encryption_StartRotation() bool {
+	g_rotationLock.Lock()
+	defer g_rotationLock.Unlock()
+
+	if g_rotationStatus.Running {
+		return false
+	}
+
+	g_rotationStatus = DBKeyRotationStatus{Running: true, Key: g_keyring.ActiveKey(), StartedAt: time.Now()}
+	go Encryption_RunRotation()
+	return true
+}
+
+func Encryption_RunRotation() {
+	var err error
+	for {
+		keyID := g_keyring.ActiveKey()
+		Encryption_UpdateRotation(func(status *DBKeyRotationStatus) { status.Key = keyID })
+
+		err = Encryption_RotateTables(keyID)
+		if err != nil || g_keyring.ActiveKey() == keyID {
+			break
+		}
+	}
+
+	if err == nil {
+		err = Sqlite_Checkpoint()
+	}
+
+	Encryption_UpdateRotation(func(status *DBKeyRotationStatus) {
+		status.Running = false
+		status.FinishedAt = time.Now()
+		if err != nil {
+			status.Error = err.Error()
+		}
+	})
+
+	status := Encryption_GetRotationStatus()
+	if err != nil {
+		log.Printf("Encryption_RunRotation: rotation to key %d failed after %d rows: %s\n", status.Key, status.Rewritten, err.Error())
+		return
+	}
+	if status.Rewritten > 0 {
+		log.Printf("Encryption_RunRotation: re-encrypted %d rows with key %d\n", status.Rewritten, status.Key)
+	}
+}
+
+func Encryption_RotateTables(keyID uint32) error {
+	tables, err := Sqlite_ListValueTables()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		afterID := int64(0)
+		for {
+			rowIDs, err := Sqlite_FindRowsToReencrypt(table, keyID, afterID, ENCRYPTION_ROTATION_BATCH_ROWS)
+			if err != nil {
+				return err
+			}
+			if len(rowIDs) == 0 {
+				break
+			}
+
+			if !Encryption_ReencryptRows(table, rowIDs) {
+				return fmt.Errorf("failed to re-encrypt rows of %s", table)
+			}
+
+			afterID = rowIDs[len(rowIDs)-1]
+			Encryption_UpdateRotation(func(status *DBKeyRotationStatus) { status.Rewritten += int64(len(rowIDs)) })
+			time.Sleep(ENCRYPTION_ROTATION_PAUSE)
+		}
+	}
+
+	return nil
+}
+
+// queues a re-encryption job and waits for it, backing off while the queue is full of client writes
+func Encryption_ReencryptRows(table string, rowIDs []int64) bool {
+	done := make(chan bool, 1)
+	job := SqliteJob{jobType: SQLITE_REENCRYPT, createdAt: time.Now().Unix(), done: done, table: table, rowIDs: rowIDs}
+	for {
+		err := g_sqlJobExecutor.QueueJob(job)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrWriteQueueFull) {
+			return false
+		}
+		time.Sleep(ENCRYPTION_QUEUE_FULL_BACKOFF)
+	}
+
+	return <-done
+}
+
+func Encryption_UpdateRotation(update func(status *DBKeyRotationStatus)) {
+	g_rotationLock.Lock()
+	defer g_rotationLock.Unlock()
+
+	update(&g_rotationStatus)
+}
+
+func Encryption_GetRotationStatus() DBKeyRotationStatus {
+	g_rotationLock.Lock()
+	defer g_rotationLock.Unlock()
+
+	return g_rotationStatus
+}
+
+func Encryption_GetStatus() (*DBEncryptionStatus, error) {
+	status := &DBEncryptionStatus{Enabled: g_keyring != nil, Rotation: Encryption_GetRotationStatus()}
+	if g_keyring != nil {
+		status.ActiveKey = g_keyring.ActiveKey()
+		status.Keys = g_keyring.KeyIDs()
+	}
+
+	var err error
+	status.ValuesByKey, err = Sqlite_CountRowsByKey()
+	return status, err
+}
+
+// reads the keyfile again and starts re-encrypting the rows that aren't under the (new) active key. keys
+// that stored values are still encrypted with can't be dropped
+func Encryption_ReloadKeys() error {
+	reloaded, err := encryption.LoadKeyring(g_keyFile)
+	if err != nil {
+		return err
+	}
+
+	counts, err := Sqlite_CountRowsByKey()
+	if err != nil {
+		return err
+	}
+	for keyID, count := range counts {
+		if !reloaded.HasKey(keyID) {
+			return fmt.Errorf("%d values are still encrypted with key %d", count, keyID)
+		}
+	}
+
+	err = g_keyring.Reload()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Encryption_ReloadKeys: loaded keys %v, new values are encrypted with key %d\n", g_keyring.KeyIDs(), g_keyring.ActiveKey())
+	Encryption_StartRotation()
+	return nil
+}
+
+// GET serves the keys in use and the progress of the last rotation, POST reloads the keyfile and rotates
+func HandleEncryption(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodPost {
+		log.Printf("[%s]: Got a request for /internal/encryption route with unsupported method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if g_storageEngineName != STORAGE_ENGINE_SQLITE || !Sqlite_Connect() {
+		http.Error(response, "Storage engine doesn't support encryption at rest", http.StatusNotImplemented)
+		return
+	}
+
+	if request.Method == http.MethodPost {
+		if g_keyring == nil {
+			http.Error(response, "Encryption is off, start the node with -keyfile to turn it on", http.StatusConflict)
+			return
+		}
+
+		err := Encryption_ReloadKeys()
+		if err != nil {
+			log.Printf("[%s]: Failed to reload encryption keys: %s\n", request.RemoteAddr, err.Error())
+			http.Error(response, "Failed to reload keys: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	status, err := Encryption_GetStatus()
+	if err != nil {
+		log.Println("HandleEncryption: Failed to count stored values by key", err.Error())
+		http.Error(response, "Error reading encryption status", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		log.Println("HandleEncryption: Failed to serialize status", err.Error())
+		http.Error(response, "Error serializing status", http.StatusInternalServerError)
+		return
+	}
+
+	response.Write(body)
+}
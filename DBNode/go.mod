@@ -2,4 +2,11 @@ module DBNode
 
 go 1.19
 
-require github.com/mattn/go-sqlite3 v1.14.15
+require (
+	DBCommon v0.0.0
+	github.com/mattn/go-sqlite3 v1.14.15
+)
+
+require github.com/klauspost/compress v1.17.0 // indirect
+
+replace DBCommon => ../DBCommon
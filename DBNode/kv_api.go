@@ -0,0 +1,284 @@
+package main
+
+import (
+	"DBCommon/auth"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /v1/kv/{key} serves every key as a resource. GET and HEAD read it, PUT stores the request body along
+// with its content type and DELETE removes it. responses carry the entry version as ETag, so reads and
+// writes can be made conditional with If-Match and If-None-Match. namespace= picks the namespace, and
+// consistency= and ttl= override its defaults like on /ns/{name}/...
+
+const KV_API_PREFIX = "/v1/kv/"
+const KV_MAX_CONTENT_TYPE_LENGTH = 255
+const KV_DEFAULT_CONTENT_TYPE = "text/plain; charset=utf-8" // for entries written without one, through /set for example
+const KV_BINARY_CONTENT_TYPE = "application/octet-stream"   // for bodies PUT without a Content-Type
+const HEADER_ENTRY_VERSION = "X-Entry-Version"
+
+func (entry *DBEntry) GetETag() string {
+	return fmt.Sprintf("\"%016x\"", entry.GetVersion())
+}
+
+func KV_WriteVersionHeaders(response http.ResponseWriter, entry *DBEntry) {
+	response.Header().Set("ETag", entry.GetETag())
+	response.Header().Set(HEADER_ENTRY_VERSION, strconv.FormatUint(entry.GetVersion(), 10))
+}
+
+// headers describing the value of the entry, sent along with it by GET and HEAD (and /get)
+func KV_WriteEntryHeaders(response http.ResponseWriter, entry *DBEntry) {
+	contentType := entry.ContentType
+	if len(contentType) == 0 {
+		contentType = KV_DEFAULT_CONTENT_TYPE
+	}
+	response.Header().Set("Content-Type", contentType)
+
+	if entry.ExpiresAt > 0 {
+		response.Header().Set("Expires", time.UnixMilli(entry.ExpiresAt).UTC().Format(http.TimeFormat))
+	}
+	KV_WriteVersionHeaders(response, entry)
+}
+
+// whether an If-Match or If-None-Match header matches the entry, a missing entry matches nothing. If-Match
+// compares strongly, so weak ETags (W/"...") in it never match
+func KV_ETagMatches(header string, entry *DBEntry, weak bool) bool {
+	if entry == nil {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	etag := entry.GetETag()
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checks the preconditions of the request against the current entry (nil if there is none), answers with
+// 304 or 412 and returns false if one of them failed
+func KV_CheckPreconditions(response http.ResponseWriter, request *http.Request, entry *DBEntry) bool {
+	ifMatch, ifNoneMatch := request.Header.Get("If-Match"), request.Header.Get("If-None-Match")
+	if len(ifMatch) > 0 && !KV_ETagMatches(ifMatch, entry, false) {
+		http.Error(response, "Entry doesn't match If-Match", http.StatusPreconditionFailed)
+		return false
+	}
+
+	if len(ifNoneMatch) > 0 && KV_ETagMatches(ifNoneMatch, entry, true) {
+		if request.Method == http.MethodGet || request.Method == http.MethodHead {
+			KV_WriteVersionHeaders(response, entry)
+			response.WriteHeader(http.StatusNotModified)
+		} else {
+			http.Error(response, "Entry matches If-None-Match", http.StatusPreconditionFailed)
+		}
+		return false
+	}
+
+	return true
+}
+
+func HandleKVRequest(response http.ResponseWriter, request *http.Request) {
+	key, err := url.PathUnescape(strings.TrimPrefix(request.URL.EscapedPath(), KV_API_PREFIX))
+	if err != nil || len(key) == 0 {
+		http.Error(response, "Expected /v1/kv/{key}", http.StatusNotFound)
+		return
+	}
+
+	query := request.URL.Query()
+	namespace := DBNamespace{Name: DEFAULT_NAMESPACE, Consistency: CONSISTENCY_ONE}
+	if name := query.Get("namespace"); len(name) > 0 {
+		var found bool
+		namespace, found = g_dbNetwork.GetNamespace(name)
+		if !found {
+			log.Printf("[%s]: Got a request for unknown namespace %s\n", request.RemoteAddr, name)
+			http.Error(response, "Namespace not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	consistency := namespace.Consistency
+	if query.Has("consistency") {
+		consistency = query.Get("consistency")
+		if !IsValidConsistency(consistency) {
+			http.Error(response, "Invalid params, consistency should be one, quorum or all", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if IsValuePartKey(key) {
+		http.Error(response, "Invalid key, it contains a reserved sequence", http.StatusBadRequest)
+		return
+	}
+
+	scope := auth.SCOPE_READ
+	if request.Method == http.MethodPut || request.Method == http.MethodDelete {
+		scope = auth.SCOPE_WRITE
+	}
+	if !Auth_Authorize(response, request, scope, namespace.Name, key) {
+		return
+	}
+
+	log.Printf("[%s]: Got a %s request for /v1/kv with key=%s (namespace='%s', consistency=%s)\n", request.RemoteAddr, request.Method, key, namespace.Name, consistency)
+
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		KV_HandleGet(response, request, namespace, key, consistency)
+	case http.MethodPut:
+		KV_HandlePut(response, request, namespace, key, consistency)
+	case http.MethodDelete:
+		KV_HandleDelete(response, request, namespace, key, consistency)
+	default:
+		log.Printf("[%s]: Got a request for /v1/kv with unsupported method %s\n", request.RemoteAddr, request.Method)
+		response.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+	}
+}
+
+func KV_HandleGet(response http.ResponseWriter, request *http.Request, namespace DBNamespace, key string, consistency string) {
+	entry, answered := DB_ReadWithConsistency(namespace.Name, key, consistency)
+	if !answered {
+		http.Error(response, "Not enough replicas answered for the requested consistency", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !KV_CheckPreconditions(response, request, entry) {
+		return
+	}
+
+	if entry == nil {
+		http.Error(response, "Not found", http.StatusNotFound)
+		return
+	}
+
+	KV_WriteEntryHeaders(response, entry)
+	response.Header().Set("Content-Length", strconv.Itoa(len(entry.Value)))
+	response.WriteHeader(http.StatusOK)
+	if request.Method == http.MethodGet {
+		io.WriteString(response, entry.Value)
+	}
+}
+
+// answers 201 if the key was created and 204 if it was replaced, both with the version of the new entry
+func KV_HandlePut(response http.ResponseWriter, request *http.Request, namespace DBNamespace, key string, consistency string) {
+	if namespace.OverQuota {
+		log.Printf("[%s]: Rejecting write to namespace %s, it is over its quota\n", request.RemoteAddr, namespace.Name)
+		http.Error(response, "Namespace is over its quota", http.StatusInsufficientStorage)
+		return
+	}
+
+	ttl, valid := ParseTTLParam(request.URL.Query(), namespace)
+	if !valid {
+		http.Error(response, "Invalid params, ttl should be a duration like 30s or 12h", http.StatusBadRequest)
+		return
+	}
+
+	contentType := request.Header.Get("Content-Type")
+	if len(contentType) == 0 {
+		contentType = KV_BINARY_CONTENT_TYPE // the body is stored as is, it isn't known to be text
+	}
+	if len(contentType) > KV_MAX_CONTENT_TYPE_LENGTH {
+		http.Error(response, fmt.Sprintf("Content-Type can't be longer than %d bytes", KV_MAX_CONTENT_TYPE_LENGTH), http.StatusBadRequest)
+		return
+	}
+
+	if request.ContentLength > g_maxValueSize {
+		http.Error(response, fmt.Sprintf("Value is larger than the max value size of %d bytes", g_maxValueSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	value, err := io.ReadAll(http.MaxBytesReader(response, request.Body, g_maxValueSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(response, fmt.Sprintf("Value is larger than the max value size of %d bytes", g_maxValueSize), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(response, "Failed to read the request body", http.StatusBadRequest)
+		}
+		return
+	}
+
+	entry := DBEntry{Namespace: namespace.Name, Key: key, Value: string(value), ContentType: contentType}
+	if ttl > 0 {
+		entry.ExpiresAt = time.Now().Add(ttl).UnixMilli()
+	}
+
+	// the precondition check and the write can't interleave with other conditional writes through this node
+	lock := DB_LockKey(namespace.Name, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	current, answered := DB_ReadWithConsistency(namespace.Name, key, consistency)
+	if !answered {
+		http.Error(response, "Not enough replicas answered for the requested consistency", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !KV_CheckPreconditions(response, request, current) {
+		return
+	}
+
+	numReplicas := len(entry.GetTargetNodes())
+	requiredAcks := GetRequiredReplicas(consistency, numReplicas)
+	acks, admission := DB_WriteToReplicas(entry, requiredAcks, true)
+	if acks < requiredAcks {
+		RespondWriteShortfall(response, request, acks, requiredAcks, admission)
+		return
+	}
+
+	KV_WriteVersionHeaders(response, &entry)
+	if current == nil {
+		response.Header().Set("Location", request.URL.RequestURI())
+		response.WriteHeader(http.StatusCreated)
+	} else {
+		response.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func KV_HandleDelete(response http.ResponseWriter, request *http.Request, namespace DBNamespace, key string, consistency string) {
+	lock := DB_LockKey(namespace.Name, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	current, answered := DB_ReadWithConsistency(namespace.Name, key, consistency)
+	if !answered {
+		http.Error(response, "Not enough replicas answered for the requested consistency", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !KV_CheckPreconditions(response, request, current) {
+		return
+	}
+
+	if current == nil {
+		http.Error(response, "Not found", http.StatusNotFound)
+		return
+	}
+
+	numReplicas := len(current.GetTargetNodes())
+	requiredAcks := GetRequiredReplicas(consistency, numReplicas)
+	acks := DB_Delete(namespace.Name, key)
+	if acks < requiredAcks {
+		http.Error(response, fmt.Sprintf("Delete committed on %d of %d required replicas", acks, requiredAcks), http.StatusServiceUnavailable)
+		return
+	}
+
+	response.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKVCheckPreconditions(t *testing.T) {
+	entry := &DBEntry{Key: "key", Value: "value", ContentType: "text/plain"}
+	etag := entry.GetETag()
+	other := (&DBEntry{Key: "key", Value: "other"}).GetETag()
+
+	tests := []struct {
+		name        string
+		method      string
+		ifMatch     string
+		ifNoneMatch string
+		entry       *DBEntry
+		want        int // 0 if the request should go ahead
+	}{
+		{"NoPreconditions", http.MethodGet, "", "", entry, 0},
+		{"NoPreconditionsMissing", http.MethodPut, "", "", nil, 0},
+		{"IfMatch", http.MethodPut, etag, "", entry, 0},
+		{"IfMatchList", http.MethodPut, other + ", " + etag, "", entry, 0},
+		{"IfMatchOther", http.MethodPut, other, "", entry, http.StatusPreconditionFailed},
+		{"IfMatchWeak", http.MethodPut, "W/" + etag, "", entry, http.StatusPreconditionFailed},
+		{"IfMatchUnquoted", http.MethodPut, etag[1 : len(etag)-1], "", entry, http.StatusPreconditionFailed},
+		{"IfMatchAny", http.MethodDelete, "*", "", entry, 0},
+		{"IfMatchAnyMissing", http.MethodDelete, "*", "", nil, http.StatusPreconditionFailed},
+		{"IfMatchMissing", http.MethodPut, etag, "", nil, http.StatusPreconditionFailed},
+		{"IfNoneMatchGet", http.MethodGet, "", etag, entry, http.StatusNotModified},
+		{"IfNoneMatchHead", http.MethodHead, "", etag, entry, http.StatusNotModified},
+		{"IfNoneMatchWeakGet", http.MethodGet, "", "W/" + etag, entry, http.StatusNotModified},
+		{"IfNoneMatchOther", http.MethodGet, "", other, entry, 0},
+		{"IfNoneMatchPut", http.MethodPut, "", etag, entry, http.StatusPreconditionFailed},
+		{"IfNoneMatchAnyPut", http.MethodPut, "", "*", entry, http.StatusPreconditionFailed},
+		{"IfNoneMatchAnyCreate", http.MethodPut, "", "*", nil, 0},
+		{"IfMatchFailsFirst", http.MethodGet, other, etag, entry, http.StatusPreconditionFailed},
+		{"BothMatchGet", http.MethodGet, etag, etag, entry, http.StatusNotModified},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, KV_API_PREFIX+"key", nil)
+			if len(test.ifMatch) > 0 {
+				request.Header.Set("If-Match", test.ifMatch)
+			}
+			if len(test.ifNoneMatch) > 0 {
+				request.Header.Set("If-None-Match", test.ifNoneMatch)
+			}
+
+			response := httptest.NewRecorder()
+			passed := KV_CheckPreconditions(response, request, test.entry)
+			if passed != (test.want == 0) {
+				t.Fatalf("KV_CheckPreconditions() = %v, want %v", passed, test.want == 0)
+			}
+			if test.want != 0 && response.Code != test.want {
+				t.Fatalf("status = %d, want %d", response.Code, test.want)
+			}
+			if test.want == http.StatusNotModified && response.Header().Get("ETag") != etag {
+				t.Errorf("304 has ETag %q, want %q", response.Header().Get("ETag"), etag)
+			}
+		})
+	}
+}
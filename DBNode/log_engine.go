@@ -0,0 +1,691 @@
+package main
+
+import (
+	"DBCommon/compression"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// append-only, log-structured engine: every write/delete is appended to a single file and an
+// in-memory index points at the latest value of each key. The file is rewritten in the background
+// with only the live records once most of it is garbage, the rewritten log starts with a marker
+// that tells change log readers which changes were compacted away.
+type LogEngine struct {
+	namespace        string
+	file             *os.File
+	path             string
+	index            map[string]LogIndexEntry
+	size             int64 // offset where the next record is appended
+	liveBytes        int64 // bytes taken by records that are still referenced by the index
+	nextSeq          int64
+	oldestSeq        int64
+	compactedThrough int64     // changes up to this seq were compacted, only the latest write of live keys is left of them
+	compactions      chan bool // wakes up RunCompaction
+	lock             sync.RWMutex
+}
+
+type LogIndexEntry struct {
+	offset      int64 // offset of the record (not the value) in the log file
+	length      int64 // length of the whole record
+	valueOffset int64
+	valueLen    uint32
+	seq         int64
+	timestamp   int64
+	expiresAt   int64
+	flags       uint32
+	contentType string
+	parts       uint32
+	codec       compression.Codec
+}
+
+type LogRecord struct {
+	seq         int64
+	timestamp   int64 // unix timestamp (in ms)
+	op          DBChangeOp
+	key         string
+	value       string
+	expiresAt   int64 // unix timestamp (in ms), 0 if the entry never expires
+	flags       uint32
+	contentType string
+	parts       uint32
+	codec       compression.Codec // what value is compressed with
+}
+
+const LOG_ENGINE_FILE_NAME = "KVStore.log"
+const LOG_RECORD_HEADER_SIZE = 29         // crc(4) + seq(8) + timestamp(8) + op(1) + keyLen(4) + valueLen(4)
+const LOG_RECORD_FLAG_EXPIRES = 0x80      // set on the op byte when an 8 byte expiry precedes the value, valueLen includes it
+const LOG_RECORD_FLAG_FLAGS = 0x40        // set on the op byte when 4 bytes of entry flags precede the value (after the expiry)
+const LOG_RECORD_FLAG_CONTENT_TYPE = 0x20 // set on the op byte when a content type with a 2 byte length comes after the flags
+const LOG_RECORD_FLAG_PARTS = 0x10        // set on the op byte when the 4 byte number of value parts comes after the content type
+const LOG_RECORD_FLAG_COMPRESSED = 0x08   // set on the op byte when the value is compressed with zstd
+const LOG_RECORD_METADATA_BITS = LOG_RECORD_FLAG_EXPIRES | LOG_RECORD_FLAG_FLAGS | LOG_RECORD_FLAG_CONTENT_TYPE | LOG_RECORD_FLAG_PARTS | LOG_RECORD_FLAG_COMPRESSED
+const LOG_RECORD_EXPIRY_SIZE = 8
+const LOG_RECORD_FLAGS_SIZE = 4
+const LOG_RECORD_CONTENT_TYPE_LEN_SIZE = 2
+const LOG_RECORD_PARTS_SIZE = 4
+const LOG_ENGINE_COMPACT_MIN_BYTES = 4 * 1024 * 1024
+const LOG_RECORD_OP_COMPACTED DBChangeOp = 0x07 // first record of a compacted log, its seq is the last one that was compacted
+const LOG_RECORD_MAX_KEY_SIZE = 1 << 20         // keys arrive in urls, net/http doesn't take larger headers
+const LOG_RECORD_MAX_METADATA_SIZE = LOG_RECORD_EXPIRY_SIZE + LOG_RECORD_FLAGS_SIZE + LOG_RECORD_CONTENT_TYPE_LEN_SIZE + 0xffff + LOG_RECORD_PARTS_SIZE
+const LOG_ENGINE_SYNC_INTERVAL_MS = 1000
+
+var ErrCorruptLogRecord = errors.New("corrupt log record")
+
+func MakeLogEngine(namespace string) *LogEngine {
+	path := g_dataDir + "/" + LOG_ENGINE_FILE_NAME
+	if namespace != DEFAULT_NAMESPACE {
+		path = fmt.Sprintf("%s/KVStore_%s.log", g_dataDir, namespace)
+	}
+
+	return &LogEngine{namespace: namespace, path: path, index: make(map[string]LogIndexEntry), nextSeq: 1, compactions: make(chan bool, 1)}
+}
+
+// largest value (with its metadata) a record can hold. values written while -maxvaluesize was larger than
+// the default stay readable as long as it isn't lowered again
+func LogEngine_MaxValueLen() int64 {
+	maxValueSize := g_maxValueSize
+	if maxValueSize < DEFAULT_MAX_VALUE_SIZE {
+		maxValueSize = DEFAULT_MAX_VALUE_SIZE
+	}
+	return maxValueSize + LOG_RECORD_MAX_METADATA_SIZE
+}
+
+// bytes between the key and the value of the record
+func (record *LogRecord) MetadataSize() int {
+	size := 0
+	if record.expiresAt > 0 {
+		size += LOG_RECORD_EXPIRY_SIZE
+	}
+	if record.flags != 0 {
+		size += LOG_RECORD_FLAGS_SIZE
+	}
+	if len(record.contentType) > 0 {
+		size += LOG_RECORD_CONTENT_TYPE_LEN_SIZE + len(record.contentType)
+	}
+	if record.parts != 0 {
+		size += LOG_RECORD_PARTS_SIZE
+	}
+	return size
+}
+
+func (record *LogRecord) Encode() []byte {
+	metadataStart := LOG_RECORD_HEADER_SIZE + len(record.key)
+	valueStart := metadataStart + record.MetadataSize()
+	buffer := make([]byte, valueStart+len(record.value))
+
+	op := byte(record.op)
+	if record.expiresAt > 0 {
+		op |= LOG_RECORD_FLAG_EXPIRES
+		binary.LittleEndian.PutUint64(buffer[metadataStart:], uint64(record.expiresAt))
+		metadataStart += LOG_RECORD_EXPIRY_SIZE
+	}
+	if record.flags != 0 {
+		op |= LOG_RECORD_FLAG_FLAGS
+		binary.LittleEndian.PutUint32(buffer[metadataStart:], record.flags)
+		metadataStart += LOG_RECORD_FLAGS_SIZE
+	}
+	if len(record.contentType) > 0 {
+		op |= LOG_RECORD_FLAG_CONTENT_TYPE
+		binary.LittleEndian.PutUint16(buffer[metadataStart:], uint16(len(record.contentType)))
+		copy(buffer[metadataStart+LOG_RECORD_CONTENT_TYPE_LEN_SIZE:], record.contentType)
+		metadataStart += LOG_RECORD_CONTENT_TYPE_LEN_SIZE + len(record.contentType)
+	}
+	if record.parts != 0 {
+		op |= LOG_RECORD_FLAG_PARTS
+		binary.LittleEndian.PutUint32(buffer[metadataStart:], record.parts)
+	}
+	if record.codec == compression.CODEC_ZSTD {
+		op |= LOG_RECORD_FLAG_COMPRESSED
+	}
+
+	binary.LittleEndian.PutUint64(buffer[4:], uint64(record.seq))
+	binary.LittleEndian.PutUint64(buffer[12:], uint64(record.timestamp))
+	buffer[20] = op
+	binary.LittleEndian.PutUint32(buffer[21:], uint32(len(record.key)))
+	binary.LittleEndian.PutUint32(buffer[25:], uint32(record.MetadataSize()+len(record.value)))
+	copy(buffer[LOG_RECORD_HEADER_SIZE:], record.key)
+	copy(buffer[valueStart:], record.value)
+
+	binary.LittleEndian.PutUint32(buffer[0:], crc32.ChecksumIEEE(buffer[4:]))
+	return buffer
+}
+
+// reads the next record from reader, returns io.EOF only when the reader ended exactly on a record boundary
+func ReadLogRecord(reader io.Reader) (LogRecord, int64, error) {
+	header := make([]byte, LOG_RECORD_HEADER_SIZE)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		if err == io.EOF {
+			return LogRecord{}, 0, io.EOF
+		}
+		return LogRecord{}, 0, ErrCorruptLogRecord
+	}
+
+	// the lengths aren't covered by a checked crc yet, a torn header mustn't make us allocate gigabytes
+	keyLen := binary.LittleEndian.Uint32(header[21:])
+	valueLen := binary.LittleEndian.Uint32(header[25:])
+	if keyLen > LOG_RECORD_MAX_KEY_SIZE || int64(valueLen) > LogEngine_MaxValueLen() {
+		return LogRecord{}, 0, ErrCorruptLogRecord
+	}
+	body := make([]byte, int(keyLen)+int(valueLen))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return LogRecord{}, 0, ErrCorruptLogRecord
+	}
+
+	checksum := crc32.ChecksumIEEE(header[4:])
+	checksum = crc32.Update(checksum, crc32.IEEETable, body)
+	if checksum != binary.LittleEndian.Uint32(header[0:]) {
+		return LogRecord{}, 0, ErrCorruptLogRecord
+	}
+
+	record := LogRecord{
+		seq:       int64(binary.LittleEndian.Uint64(header[4:])),
+		timestamp: int64(binary.LittleEndian.Uint64(header[12:])),
+		op:        DBChangeOp(header[20] &^ LOG_RECORD_METADATA_BITS),
+		key:       string(body[:keyLen]),
+	}
+
+	if header[20]&LOG_RECORD_FLAG_COMPRESSED != 0 {
+		record.codec = compression.CODEC_ZSTD
+	}
+
+	metadata := body[keyLen:]
+	if header[20]&LOG_RECORD_FLAG_EXPIRES != 0 {
+		if len(metadata) < LOG_RECORD_EXPIRY_SIZE {
+			return LogRecord{}, 0, ErrCorruptLogRecord
+		}
+		record.expiresAt = int64(binary.LittleEndian.Uint64(metadata))
+		metadata = metadata[LOG_RECORD_EXPIRY_SIZE:]
+	}
+	if header[20]&LOG_RECORD_FLAG_FLAGS != 0 {
+		if len(metadata) < LOG_RECORD_FLAGS_SIZE {
+			return LogRecord{}, 0, ErrCorruptLogRecord
+		}
+		record.flags = binary.LittleEndian.Uint32(metadata)
+		metadata = metadata[LOG_RECORD_FLAGS_SIZE:]
+	}
+	if header[20]&LOG_RECORD_FLAG_CONTENT_TYPE != 0 {
+		if len(metadata) < LOG_RECORD_CONTENT_TYPE_LEN_SIZE {
+			return LogRecord{}, 0, ErrCorruptLogRecord
+		}
+		length := int(binary.LittleEndian.Uint16(metadata))
+		if len(metadata) < LOG_RECORD_CONTENT_TYPE_LEN_SIZE+length {
+			return LogRecord{}, 0, ErrCorruptLogRecord
+		}
+		record.contentType = string(metadata[LOG_RECORD_CONTENT_TYPE_LEN_SIZE : LOG_RECORD_CONTENT_TYPE_LEN_SIZE+length])
+		metadata = metadata[LOG_RECORD_CONTENT_TYPE_LEN_SIZE+length:]
+	}
+	if header[20]&LOG_RECORD_FLAG_PARTS != 0 {
+		if len(metadata) < LOG_RECORD_PARTS_SIZE {
+			return LogRecord{}, 0, ErrCorruptLogRecord
+		}
+		record.parts = binary.LittleEndian.Uint32(metadata)
+		metadata = metadata[LOG_RECORD_PARTS_SIZE:]
+	}
+	record.value = string(metadata)
+
+	return record, int64(LOG_RECORD_HEADER_SIZE + len(body)), nil
+}
+
+func (engine *LogEngine) Open() bool {
+	os.MkdirAll(g_dataDir, 0700)
+	LockDataDir(g_dataDir)
+
+	file, err := os.OpenFile(engine.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatalf("LogEngine.Open: failed to open log file %s: %s\n", engine.path, err.Error())
+	}
+
+	engine.lock.Lock()
+	engine.file = file
+	engine.Replay()
+	engine.lock.Unlock()
+
+	log.Printf("LogEngine.Open: loaded %d keys from %s (%d bytes)\n", len(engine.index), engine.path, engine.size)
+
+	go engine.RunSync()
+	go engine.RunCompaction()
+	return true
+}
+
+// rebuilds the index from the log file, a torn write at the end of the file is truncated away
+func (engine *LogEngine) Replay() {
+	engine.index = make(map[string]LogIndexEntry)
+	engine.size = 0
+	engine.liveBytes = 0
+	engine.oldestSeq = 0
+	engine.compactedThrough = 0
+
+	reader := bufio.NewReader(io.NewSectionReader(engine.file, 0, 1<<62))
+	for {
+		record, length, err := ReadLogRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("LogEngine.Replay: found corrupt record at offset %d, truncating log\n", engine.size)
+			engine.file.Truncate(engine.size)
+			break
+		}
+
+		engine.Apply(&record, engine.size, length)
+		engine.size += length
+	}
+}
+
+// updates the index to account for a record that was written at offset, must hold the write lock
+func (engine *LogEngine) Apply(record *LogRecord, offset int64, length int64) {
+	if record.seq >= engine.nextSeq {
+		engine.nextSeq = record.seq + 1
+	}
+	if record.op == LOG_RECORD_OP_COMPACTED {
+		engine.compactedThrough = record.seq
+		return
+	}
+
+	if old, found := engine.index[record.key]; found {
+		engine.liveBytes -= old.length
+	}
+
+	if record.op == CHANGE_OP_DELETE || record.op == CHANGE_OP_DROP {
+		delete(engine.index, record.key)
+	} else {
+		engine.index[record.key] = LogIndexEntry{
+			offset:      offset,
+			length:      length,
+			valueOffset: offset + int64(LOG_RECORD_HEADER_SIZE+len(record.key)+record.MetadataSize()),
+			valueLen:    uint32(len(record.value)),
+			seq:         record.seq,
+			timestamp:   record.timestamp,
+			expiresAt:   record.expiresAt,
+			flags:       record.flags,
+			contentType: record.contentType,
+			parts:       record.parts,
+			codec:       record.codec,
+		}
+		engine.liveBytes += length
+	}
+
+	if engine.oldestSeq == 0 {
+		engine.oldestSeq = record.seq
+	}
+}
+
+func (engine *LogEngine) Append(op DBChangeOp, entry DBEntry) bool {
+	value, codec := entry.Value, compression.CODEC_NONE
+	if op == CHANGE_OP_WRITE {
+		value, codec = Compression_EncodeValue(entry.Value) // before taking the lock, it's the slow part
+	}
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	if engine.file == nil {
+		log.Println("LogEngine.Append: tried to write before the log file was opened")
+		return false
+	}
+
+	record := LogRecord{seq: engine.nextSeq, timestamp: time.Now().UnixMilli(), op: op, key: entry.Key, value: value, expiresAt: entry.ExpiresAt, flags: entry.Flags, contentType: entry.ContentType, parts: entry.Parts, codec: codec}
+	encoded := record.Encode()
+
+	_, err := engine.file.WriteAt(encoded, engine.size)
+	if err != nil {
+		log.Printf("LogEngine.Append: failed to append record for key=%s: %s\n", entry.Key, err.Error())
+		return false
+	}
+
+	engine.Apply(&record, engine.size, int64(len(encoded)))
+	engine.size += int64(len(encoded))
+
+	if engine.size > LOG_ENGINE_COMPACT_MIN_BYTES && engine.size > 2*engine.liveBytes {
+		select {
+		case engine.compactions <- true:
+		default: // a compaction is already pending
+		}
+	}
+
+	return true
+}
+
+// the value as it is stored in the log, compressed if entry.codec says so
+func (engine *LogEngine) ReadRawValue(entry LogIndexEntry) (string, error) {
+	value := make([]byte, entry.valueLen)
+	_, err := engine.file.ReadAt(value, entry.valueOffset)
+	return string(value), err
+}
+
+func (engine *LogEngine) ReadValue(entry LogIndexEntry) (string, error) {
+	value, err := engine.ReadRawValue(entry)
+	if err != nil {
+		return "", err
+	}
+	return Compression_DecodeValue(value, entry.codec)
+}
+
+func (engine *LogEngine) RunCompaction() {
+	for range engine.compactions {
+		engine.Compact()
+	}
+}
+
+// rewrites the log with only live records. the live records are copied without holding the lock, only
+// the records appended in the meantime are copied over under it before the files are swapped
+func (engine *LogEngine) Compact() {
+	engine.lock.RLock()
+	file, end, compactedThrough := engine.file, engine.size, engine.nextSeq-1
+	entries := make([]LogIndexEntry, 0, len(engine.index))
+	keys := make(map[int64]string, len(engine.index)) // by seq, seqs are unique
+	for key, entry := range engine.index {
+		entries = append(entries, entry)
+		keys[entry.seq] = key
+	}
+	engine.lock.RUnlock()
+
+	compactPath := engine.path + ".compact"
+	compactFile, err := os.OpenFile(compactPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Printf("LogEngine.Compact: failed to create %s: %s\n", compactPath, err.Error())
+		return
+	}
+	abort := func(reason string) {
+		log.Printf("LogEngine.Compact: %s, keeping the old log\n", reason)
+		compactFile.Close()
+		os.Remove(compactPath)
+	}
+
+	// the compacted log is rebuilt the way Replay would, starting with the marker
+	compacted := &LogEngine{namespace: engine.namespace, index: make(map[string]LogIndexEntry), nextSeq: 1}
+	writer := bufio.NewWriter(compactFile)
+	write := func(record *LogRecord) {
+		encoded := record.Encode()
+		writer.Write(encoded)
+		compacted.Apply(record, compacted.size, int64(len(encoded)))
+		compacted.size += int64(len(encoded))
+	}
+	write(&LogRecord{seq: compactedThrough, timestamp: time.Now().UnixMilli(), op: LOG_RECORD_OP_COMPACTED})
+
+	// keep records in seq order so readers of the change log can stop at their limit
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	for _, entry := range entries {
+		value := make([]byte, entry.valueLen)
+		if _, err := file.ReadAt(value, entry.valueOffset); err != nil {
+			abort(fmt.Sprintf("failed to read key=%s: %s", keys[entry.seq], err.Error()))
+			return
+		}
+
+		write(&LogRecord{seq: entry.seq, timestamp: entry.timestamp, op: CHANGE_OP_WRITE, key: keys[entry.seq], value: string(value), expiresAt: entry.expiresAt, flags: entry.flags, contentType: entry.contentType, parts: entry.parts, codec: entry.codec})
+	}
+	if err := writer.Flush(); err != nil {
+		abort("failed to write compacted log: " + err.Error())
+		return
+	}
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	// records appended while the live ones were copied
+	tail := make([]byte, engine.size-end)
+	if _, err := file.ReadAt(tail, end); err != nil {
+		abort("failed to read the end of the log: " + err.Error())
+		return
+	}
+	if _, err := compactFile.WriteAt(tail, compacted.size); err != nil || compactFile.Sync() != nil {
+		abort("failed to write compacted log")
+		return
+	}
+
+	reader := bytes.NewReader(tail)
+	for {
+		record, length, err := ReadLogRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			abort("failed to read back the end of the log")
+			return
+		}
+		compacted.Apply(&record, compacted.size, length)
+		compacted.size += length
+	}
+
+	if err := os.Rename(compactPath, engine.path); err != nil {
+		abort("failed to replace the log: " + err.Error())
+		return
+	}
+
+	engine.file.Close()
+	engine.file = compactFile
+	engine.index, engine.size, engine.liveBytes = compacted.index, compacted.size, compacted.liveBytes
+	engine.oldestSeq, engine.compactedThrough = compacted.oldestSeq, compacted.compactedThrough
+	// seqs of dropped records are never handed out again, the marker keeps nextSeq past them
+
+	log.Printf("LogEngine.Compact: compacted log down to %d bytes, changes up to %d were compacted\n", engine.size, compactedThrough)
+}
+
+func (engine *LogEngine) RunSync() {
+	for {
+		time.Sleep(LOG_ENGINE_SYNC_INTERVAL_MS * time.Millisecond)
+
+		engine.lock.RLock()
+		engine.file.Sync()
+		engine.lock.RUnlock()
+	}
+}
+
+func (engine *LogEngine) Get(key string) *DBEntry {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	entry, found := engine.index[key]
+	if !found {
+		return nil
+	}
+
+	value, err := engine.ReadValue(entry)
+	if err != nil {
+		log.Printf("LogEngine.Get: failed to read value for key=%s: %s\n", key, err.Error())
+		return nil
+	}
+
+	return &DBEntry{Namespace: engine.namespace, Key: key, Value: value, ExpiresAt: entry.expiresAt, Flags: entry.flags, ContentType: entry.contentType, Parts: entry.parts}
+}
+
+func (engine *LogEngine) Put(entry DBEntry) bool {
+	if len(entry.Key) == 0 {
+		log.Println("LogEngine.Put: tried to write entry with empty key")
+		return false
+	}
+
+	return engine.Append(CHANGE_OP_WRITE, entry)
+}
+
+func (engine *LogEngine) PutDurable(entry DBEntry) bool {
+	if !engine.Put(entry) {
+		return false
+	}
+
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	err := engine.file.Sync()
+	if err != nil {
+		log.Printf("LogEngine.PutDurable: failed to sync log for key=%s: %s\n", entry.Key, err.Error())
+		return false
+	}
+
+	return true
+}
+
+func (engine *LogEngine) Delete(key string) bool {
+	return engine.Remove(CHANGE_OP_DELETE, key)
+}
+
+func (engine *LogEngine) Drop(key string) bool {
+	return engine.Remove(CHANGE_OP_DROP, key)
+}
+
+// appends a delete or drop record for key, if the key is there
+func (engine *LogEngine) Remove(op DBChangeOp, key string) bool {
+	engine.lock.RLock()
+	_, found := engine.index[key]
+	engine.lock.RUnlock()
+
+	if !found {
+		return true
+	}
+
+	return engine.Append(op, DBEntry{Key: key})
+}
+
+func (engine *LogEngine) DeleteDurable(key string) bool {
+	if !engine.Delete(key) {
+		return false
+	}
+
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	err := engine.file.Sync()
+	if err != nil {
+		log.Printf("LogEngine.DeleteDurable: failed to sync log for key=%s: %s\n", key, err.Error())
+		return false
+	}
+
+	return true
+}
+
+func (engine *LogEngine) Scan(prefix string) *DBChunk {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	chunk := DBChunk{Entries: make([]DBEntry, 0)}
+	for key, entry := range engine.index {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		value, err := engine.ReadValue(entry)
+		if err != nil {
+			log.Printf("LogEngine.Scan: failed to read value for key=%s: %s\n", key, err.Error())
+			continue
+		}
+
+		chunk.Entries = append(chunk.Entries, DBEntry{Namespace: engine.namespace, Key: key, Value: value, ExpiresAt: entry.expiresAt, Flags: entry.flags, ContentType: entry.contentType, Parts: entry.parts})
+	}
+
+	return &chunk
+}
+
+// the index holds the keys and the expiry of every entry, neither needs the log file
+func (engine *LogEngine) ScanKeys(prefix string) []string {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	keys := make([]string, 0)
+	for key := range engine.index {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func (engine *LogEngine) ExpiredKeys(now int64) ([]string, int64) {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	keys := make([]string, 0)
+	nextExpiry := int64(0)
+	for key, entry := range engine.index {
+		if entry.expiresAt == 0 {
+			continue
+		}
+
+		if entry.expiresAt <= now {
+			keys = append(keys, key)
+		} else if nextExpiry == 0 || entry.expiresAt < nextExpiry {
+			nextExpiry = entry.expiresAt
+		}
+	}
+
+	return keys, nextExpiry
+}
+
+func (engine *LogEngine) Snapshot(path string) error {
+	entries := engine.Scan("").Entries
+	engine.lock.RLock()
+	for i := range entries {
+		entries[i].UpdatedAt = engine.index[entries[i].Key].timestamp // 0 if the key was deleted since the scan
+	}
+	engine.lock.RUnlock()
+
+	return WriteNDJSONSnapshot(path, entries)
+}
+
+func (engine *LogEngine) Stats() StorageStats {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	return StorageStats{Engine: STORAGE_ENGINE_LOG, NumKeys: int64(len(engine.index)), SizeBytes: engine.size}
+}
+
+// the log itself is the change log, compaction plays the role of retention
+func (engine *LogEngine) ReadChanges(since int64, limit int) []DBChange {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	changes := make([]DBChange, 0)
+	reader := bufio.NewReader(io.NewSectionReader(engine.file, 0, engine.size))
+	for len(changes) < limit {
+		record, _, err := ReadLogRecord(reader)
+		if err != nil {
+			break
+		}
+
+		if record.seq <= since || record.op == LOG_RECORD_OP_COMPACTED {
+			continue
+		}
+
+		value, err := Compression_DecodeValue(record.value, record.codec)
+		if err != nil {
+			log.Printf("LogEngine.ReadChanges: failed to decompress change %d: %s\n", record.seq, err.Error())
+			continue
+		}
+		changes = append(changes, DBChange{Seq: record.seq, Op: record.op, Key: record.key, Value: value, Timestamp: record.timestamp, Parts: record.parts, ExpiresAt: record.expiresAt, Flags: record.flags, ContentType: record.contentType})
+	}
+
+	return changes
+}
+
+// readers that are behind the last compaction have missed changes, even though the latest write of every
+// live key from before it is still there. an empty log continues at the next seq
+func (engine *LogEngine) OldestChangeSeq() int64 {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	if engine.compactedThrough > 0 {
+		return engine.compactedThrough + 1
+	}
+	if engine.oldestSeq == 0 {
+		return engine.nextSeq
+	}
+	return engine.oldestSeq
+}
+
+func (engine *LogEngine) LatestChangeSeq() int64 {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	return engine.nextSeq - 1
+}
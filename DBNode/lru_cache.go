@@ -20,8 +20,8 @@ type CacheItem struct {
 
 const CACHE_ITEM_EXPIRY_TIME_S = 300
 
-func MakeLRUCache(size uint32) LRUCache {
-	cache := LRUCache{data: list.New(), size: size, lookupTable: make(map[string]*list.Element, size)}
+func MakeLRUCache(size uint32) *LRUCache {
+	cache := &LRUCache{data: list.New(), size: size, lookupTable: make(map[string]*list.Element, size)}
 
 	return cache
 }
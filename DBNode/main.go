@@ -1,6 +1,10 @@
 package main
 
 import (
+	"DBCommon/auth"
+	"DBCommon/clustertls"
+	"DBCommon/encryption"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,7 +12,12 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type DBNodeState uint8
@@ -21,51 +30,101 @@ const (
 )
 
 type DBNode struct {
-	Addr  string      // http addr
-	ID    int32       // index of the node
-	State DBNodeState // last known state of this node (updates periodically)
+	Addr   string      // http addr
+	ID     int32       // index of the node
+	State  DBNodeState // last known state of this node (updates periodically)
+	Zone   string      `json:",omitempty"` // replicas of a key are spread over as many zones as possible
+	Weight float64     `json:",omitempty"` // share of the keyspace relative to the other nodes, 0 means 1
 }
 
 type DBNetwork struct {
 	Nodes             []DBNode // list of nodes
 	NumNodes          uint32
 	ReplicationFactor uint32
+	Epoch             uint64                 // bumped by the controller every time the network changes
+	Namespaces        map[string]DBNamespace `json:",omitempty"`
+	ReplicationRules  []DBReplicationRule    `json:",omitempty"`
+	PlacementVersion  uint32                 // strategy keys are placed with, see DB_MigratePlacement
 }
 
 const INVALID_ID = -1
+const DEFAULT_MAX_VALUE_SIZE = 64 << 20
 
 var g_id int
 var g_listenPort uint
 var g_controllerAddr string
 var g_dbNetwork DBNetwork
+var g_networkSyncLock sync.Mutex
+var g_changeLogRetention time.Duration
+var g_storageEngineName string
+var g_dataDir string
+var g_batchMaxJobs uint
+var g_batchWindow time.Duration
+var g_durableWrites bool
+var g_maxQueuedJobs uint
+var g_queueSoftLimit uint
+var g_durableWriteTimeout time.Duration
+var g_internalTimeout time.Duration
+var g_bulkTimeout time.Duration
+var g_hedgeDelay time.Duration
+var g_binaryPort uint
+var g_binaryProtocol bool
+var g_respPort uint
+var g_respNamespace string
+var g_memcachePort uint
+var g_memcacheNamespace string
+var g_valuePartThreshold uint64
+var g_valuePartSize uint64
+var g_maxValueSize int64
+var g_compressValues bool
+var g_compressThreshold uint
+var g_compressTransfers bool
+var g_keyFile string
 
 func init() {
 	flag.IntVar(&g_id, "id", -1, "ID/Index of the node")
 	flag.StringVar(&g_controllerAddr, "controller", "http://localhost:8080", "Address of the database controller")
 	flag.UintVar(&g_listenPort, "port", 8000, "Port that this node will bind to and listen")
-}
-
-func Mod(d, m int) int {
-	var res int = d % m
-	if (res < 0 && m > 0) || (res > 0 && m < 0) {
-		return res + m
-	}
-	return res
+	flag.StringVar(&g_dataDir, "datadir", "", "Directory the node keeps its data in, defaults to a directory per port under "+DEFAULT_DATA_DIR_ROOT)
+	flag.StringVar(&g_storageEngineName, "engine", STORAGE_ENGINE_SQLITE, "Storage engine used for local data (sqlite, memory or log)")
+	flag.UintVar(&g_batchMaxJobs, "batchsize", 256, "Max number of queued writes applied in a single sqlite transaction")
+	flag.DurationVar(&g_batchWindow, "batchwindow", 5*time.Millisecond, "How long the sqlite job executor waits for more writes before committing a batch")
+	flag.UintVar(&g_maxQueuedJobs, "maxqueue", 100000, "Max number of writes waiting in the sqlite job queue, further writes get 503")
+	flag.UintVar(&g_queueSoftLimit, "queuesoftlimit", 50000, "Write queue depth at which clients start getting 429 to slow them down")
+	flag.BoolVar(&g_durableWrites, "durablewrites", false, "Only acknowledge /set once the write is committed on the replicas, can be overridden per request with durable=")
+	flag.DurationVar(&g_durableWriteTimeout, "durabletimeout", 5*time.Second, "How long a durable write waits for replicas to acknowledge it")
+	flag.DurationVar(&g_internalTimeout, "internaltimeout", 2*time.Second, "Timeout of single key requests to other nodes and the controller")
+	flag.DurationVar(&g_bulkTimeout, "bulktimeout", 60*time.Second, "Timeout of chunk transfers between nodes")
+	flag.DurationVar(&g_hedgeDelay, "hedgedelay", 50*time.Millisecond, "How long a read waits on the fastest replica before also asking the next one, 0 disables hedging")
+	flag.UintVar(&g_binaryPort, "binaryport", 0, "Port other nodes reach this one on over the binary protocol, defaults to port + 1000")
+	flag.BoolVar(&g_binaryProtocol, "binaryprotocol", true, "Talk to other nodes over the binary protocol when they support it, disable to only use http")
+	flag.UintVar(&g_respPort, "respport", 0, "Port to serve the redis protocol (RESP) on, 0 disables it")
+	flag.StringVar(&g_respNamespace, "respnamespace", DEFAULT_NAMESPACE, "Namespace redis clients read and write")
+	flag.UintVar(&g_memcachePort, "memcacheport", 0, "Port to serve the memcached text protocol on, 0 disables it")
+	flag.StringVar(&g_memcacheNamespace, "memcachenamespace", DEFAULT_NAMESPACE, "Namespace memcached clients read and write")
+	flag.Uint64Var(&g_valuePartThreshold, "valuepartthreshold", 256<<10, "Values larger than this many bytes are split into parts stored as separate entries")
+	flag.Uint64Var(&g_valuePartSize, "valuepartsize", 256<<10, "Size in bytes of the parts large values are split into")
+	flag.Int64Var(&g_maxValueSize, "maxvaluesize", DEFAULT_MAX_VALUE_SIZE, "Largest value in bytes that can be written, larger ones get 413")
+	flag.BoolVar(&g_compressValues, "compressvalues", true, "Compress values with zstd before storing them (sqlite and log engines)")
+	flag.UintVar(&g_compressThreshold, "compressthreshold", 256, "Values smaller than this many bytes are stored uncompressed")
+	flag.BoolVar(&g_compressTransfers, "compresstransfers", true, "Compress chunks sent to other nodes and gzip bulk answers for clients that accept it")
+	flag.StringVar(&g_keyFile, "keyfile", "", "File with the keys values are encrypted with at rest (sqlite engine), "+encryption.KEYS_ENV_VAR+" is used if it isn't set")
+	flag.StringVar(&g_tlsOptions.CertFile, "tlscert", "", "Certificate issued by the cluster CA, turns on TLS for every listener and is presented to other nodes and the controller")
+	flag.StringVar(&g_tlsOptions.KeyFile, "tlskey", "", "Private key of -tlscert")
+	flag.StringVar(&g_tlsOptions.CAFile, "tlsca", "", "Cluster CA, internal routes only accept peers with a certificate issued by it")
+	flag.BoolVar(&g_tlsOptions.Dev, "tlsdev", false, "Turn on TLS with a throwaway certificate issued by a dev CA that is generated on first use, for local clusters")
+	flag.StringVar(&g_tlsOptions.DevDir, "tlsdevdir", clustertls.DefaultDevDir(), "Directory the dev CA is kept in, shared by every process on the host")
+	flag.DurationVar(&g_changeLogRetention, "changelogretention", 24*time.Hour, "How long entries are kept in the change log, 0 keeps them forever")
 }
 
 func DownloadNetworkInfo() DBNetwork {
-	res, err := http.Get(g_controllerAddr + "/network")
+	res, err := g_rpc.Get(context.Background(), g_controllerAddr+"/network", InternalCall(THREE_TRIES))
 	if err != nil {
 		log.Fatalf("Failed to download node list from controller: %s\n", err.Error())
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		log.Fatalf("Failed to parse response from controller: %s\n", err.Error())
-	}
-
 	var network DBNetwork
-	err = json.Unmarshal(body, &network)
+	err = json.Unmarshal(res.Body, &network)
 	if err != nil {
 		log.Fatalf("Failed to parse node list: %s\n", err.Error())
 	}
@@ -100,19 +159,69 @@ func ValidateWriteRequest(response http.ResponseWriter, request *http.Request) b
 
 	query := request.URL.Query()
 	key := query.Get("key")
-	value := query.Get("value")
 
-	if len(key) == 0 || len(value) == 0 {
+	if len(key) == 0 || !query.Has("value") {
 		log.Printf("[%s]: invalid query params for /set", request.RemoteAddr)
 		http.Error(response, "Invalid params", http.StatusBadRequest)
 		return false
 	}
 
+	if int64(len(query.Get("value"))) > g_maxValueSize {
+		log.Printf("[%s]: value for key=%s is larger than the max value size\n", request.RemoteAddr, key)
+		http.Error(response, fmt.Sprintf("Value is larger than the max value size of %d bytes", g_maxValueSize), http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	return true
+}
+
+// keys that look like the parts of a split value can't be written by clients
+func RejectIfReservedKey(response http.ResponseWriter, key string) bool {
+	if !IsValuePartKey(key) {
+		return false
+	}
+
+	http.Error(response, "Invalid params, key contains a reserved sequence", http.StatusBadRequest)
+	return true
+}
+
+// responds with 429/503 and a Retry-After if the local write queue can't take numWrites more writes
+func RejectIfSaturated(response http.ResponseWriter, request *http.Request, numWrites int) bool {
+	admission := DB_CheckWriteAdmission(numWrites)
+	if admission == ADMISSION_ACCEPT {
+		return false
+	}
+
+	RespondSaturated(response, request, admission)
 	return true
 }
 
+// 429 if a write queue is past its soft limit, 503 if it's full
+func RespondSaturated(response http.ResponseWriter, request *http.Request, admission WriteAdmission) {
+	response.Header().Set("Retry-After", strconv.Itoa(GetRetryAfterSeconds()))
+	if admission == ADMISSION_THROTTLE {
+		log.Printf("[%s]: Throttling %s, write queue is past its soft limit\n", request.RemoteAddr, request.URL.Path)
+		http.Error(response, "Node is busy, slow down", http.StatusTooManyRequests)
+	} else {
+		log.Printf("[%s]: Rejecting %s, write queue is full\n", request.RemoteAddr, request.URL.Path)
+		http.Error(response, "Node is saturated, try again later", http.StatusServiceUnavailable)
+	}
+}
+
+// answers a write that fewer than requiredAcks replicas took, with 429/503 if replicas turned it down for
+// their write queues
+func RespondWriteShortfall(response http.ResponseWriter, request *http.Request, acks int, requiredAcks int, admission WriteAdmission) {
+	if admission != ADMISSION_ACCEPT {
+		RespondSaturated(response, request, admission)
+		return
+	}
+
+	http.Error(response, fmt.Sprintf("Write committed on %d of %d required replicas", acks, requiredAcks), http.StatusServiceUnavailable)
+}
+
 func ProcessWrite(response http.ResponseWriter, request *http.Request) {
-	if !ValidateWriteRequest(response, request) {
+	if !ValidateWriteRequest(response, request) || !Auth_Authorize(response, request, auth.SCOPE_WRITE, DEFAULT_NAMESPACE, request.URL.Query().Get("key")) ||
+		RejectIfReservedKey(response, request.URL.Query().Get("key")) {
 		return
 	}
 
@@ -120,17 +229,54 @@ func ProcessWrite(response http.ResponseWriter, request *http.Request) {
 	key := query.Get("key")
 	value := query.Get("value")
 
-	log.Printf("[%s]:Got a post request for /set with key=%s, value=%s\n", request.RemoteAddr, key, value)
+	log.Printf("[%s]:Got a post request for /set with key=%s (%d bytes)\n", request.RemoteAddr, key, len(value))
+
+	durable := g_durableWrites
+	if query.Has("durable") {
+		durable = query.Get("durable") == "true"
+	}
+
+	// non-durable writes are answered without waiting for the replicas, owners that recently turned writes
+	// down for their write queues turn this one down too
+	entry := DBEntry{Key: key, Value: value}
+	if !durable {
+		if admission := DB_CheckOwnerAdmission(entry); admission != ADMISSION_ACCEPT {
+			RespondSaturated(response, request, admission)
+			return
+		}
 
-	DB_Write(DBEntry{Key: key, Value: value})
+		DB_Write(entry)
+		response.WriteHeader(http.StatusCreated)
+		io.WriteString(response, GetApproxWriteDelay())
+		return
+	}
+
+	// the owners of the key check their write queues, this node may not be one of them
+	numReplicas := len(entry.GetTargetNodes())
+	requiredAcks := numReplicas
+	if query.Has("acks") {
+		parsed, err := strconv.Atoi(query.Get("acks"))
+		if err != nil || parsed <= 0 || parsed > numReplicas {
+			log.Printf("[%s]: invalid acks param for /set", request.RemoteAddr)
+			http.Error(response, fmt.Sprintf("Invalid params, acks should be between 1 and %d", numReplicas), http.StatusBadRequest)
+			return
+		}
+		requiredAcks = parsed
+	}
+
+	acks, admission := DB_WriteToReplicas(entry, requiredAcks, true)
+	if acks < requiredAcks {
+		RespondWriteShortfall(response, request, acks, requiredAcks, admission)
+		return
+	}
 
 	response.WriteHeader(http.StatusCreated)
-	io.WriteString(response, GetApproxWriteDelay())
+	io.WriteString(response, fmt.Sprintf("Committed on %d of %d replicas", acks, numReplicas))
 }
 
 // Try Write but don't propogate to other nodes
 func ProcessSingleWrite(response http.ResponseWriter, request *http.Request) {
-	if !ValidateWriteRequest(response, request) {
+	if !ValidateWriteRequest(response, request) || RejectIfSaturated(response, request, 1) {
 		return
 	}
 
@@ -138,9 +284,41 @@ func ProcessSingleWrite(response http.ResponseWriter, request *http.Request) {
 	key := query.Get("key")
 	value := query.Get("value")
 
-	log.Printf("[%s]:Got a post request for /internal/set with key=%s, value=%s\n", request.RemoteAddr, key, value)
+	log.Printf("[%s]:Got a post request for /internal/set with key=%s (%d bytes)\n", request.RemoteAddr, key, len(value))
 
-	success := DB_LocalWrite(DBEntry{Key: key, Value: value})
+	entry := DBEntry{Namespace: query.Get("namespace"), Key: key, Value: value}
+	if query.Has("expiresat") {
+		expiresAt, err := strconv.ParseInt(query.Get("expiresat"), 10, 64)
+		if err != nil || expiresAt < 0 {
+			log.Printf("[%s]: invalid expiresat param for /internal/set", request.RemoteAddr)
+			http.Error(response, "Invalid params", http.StatusBadRequest)
+			return
+		}
+		entry.ExpiresAt = expiresAt
+	}
+
+	if query.Has("flags") {
+		flags, err := strconv.ParseUint(query.Get("flags"), 10, 32)
+		if err != nil {
+			log.Printf("[%s]: invalid flags param for /internal/set", request.RemoteAddr)
+			http.Error(response, "Invalid params", http.StatusBadRequest)
+			return
+		}
+		entry.Flags = uint32(flags)
+	}
+	entry.ContentType = query.Get("contenttype")
+
+	if query.Has("parts") {
+		parts, err := strconv.ParseUint(query.Get("parts"), 10, 32)
+		if err != nil {
+			log.Printf("[%s]: invalid parts param for /internal/set", request.RemoteAddr)
+			http.Error(response, "Invalid params", http.StatusBadRequest)
+			return
+		}
+		entry.Parts = uint32(parts)
+	}
+
+	success := DB_LocalWrite(entry, query.Get("durable") == "true")
 
 	if success {
 		response.WriteHeader(http.StatusCreated)
@@ -150,6 +328,31 @@ func ProcessSingleWrite(response http.ResponseWriter, request *http.Request) {
 	}
 }
 
+// deletes the key locally without propagating to other nodes
+func HandleInternalDelete(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodDelete {
+		log.Printf("[%s]: Got a request for /internal/delete route with non-delete method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+	entry := DBEntry{Namespace: query.Get("namespace"), Key: query.Get("key")}
+	if len(entry.Key) == 0 {
+		log.Printf("[%s]: invalid query params for /internal/delete", request.RemoteAddr)
+		http.Error(response, "Invalid params", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("[%s]: Got a request for /internal/delete with key=%s\n", request.RemoteAddr, entry.Key)
+
+	if DB_LocalDelete(entry, true) {
+		response.WriteHeader(http.StatusNoContent)
+	} else {
+		response.WriteHeader(http.StatusNotAcceptable)
+	}
+}
+
 func HandleGetAllData(response http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
 		log.Printf("[%s]: Got a request for /internal/getall route with non-get method\n", request.RemoteAddr)
@@ -157,14 +360,162 @@ func HandleGetAllData(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	chunk, err := json.Marshal(DB_GetLocalChunk())
+	namespace := request.URL.Query().Get("namespace")
+	if DB_GetStorage(namespace) == nil {
+		log.Printf("[%s]: Got a request for /internal/getall for unknown namespace %s\n", request.RemoteAddr, namespace)
+		http.Error(response, "Namespace not found", http.StatusNotFound)
+		return
+	}
+
+	localChunk := DB_GetLocalChunk(namespace)
+	if localChunk == nil {
+		log.Printf("[%s]: Failed to read the local chunk of namespace %s\n", request.RemoteAddr, namespace)
+		http.Error(response, "Error reading local chunk", http.StatusInternalServerError)
+		return
+	}
+
+	chunk, err := json.Marshal(localChunk)
 	if err != nil {
 		log.Println("HandleGetAllData: Failed to serialize local data chunk", err.Error())
 		http.Error(response, "Error serializing local chunk", http.StatusInternalServerError)
 		return
 	}
 
-	response.Write(chunk)
+	WriteCompressedResponse(response, request, chunk)
+}
+
+func HandleGetChanges(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		log.Printf("[%s]: Got a request for /internal/changes route with non-get method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+
+	since := int64(0)
+	if query.Has("since") {
+		parsed, err := strconv.ParseInt(query.Get("since"), 10, 64)
+		if err != nil || parsed < 0 {
+			log.Printf("[%s]: invalid since param for /internal/changes\n", request.RemoteAddr)
+			http.Error(response, "Invalid params", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+
+	limit := CHANGE_LOG_DEFAULT_LIMIT
+	if query.Has("limit") {
+		parsed, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || parsed <= 0 {
+			log.Printf("[%s]: invalid limit param for /internal/changes\n", request.RemoteAddr)
+			http.Error(response, "Invalid params", http.StatusBadRequest)
+			return
+		}
+		if parsed < CHANGE_LOG_MAX_LIMIT {
+			limit = parsed
+		} else {
+			limit = CHANGE_LOG_MAX_LIMIT
+		}
+	}
+
+	storage := DB_GetStorage(query.Get("namespace"))
+	if storage == nil {
+		http.Error(response, "Namespace not found", http.StatusNotFound)
+		return
+	}
+	if _, ok := storage.(ChangeLogReader); !ok {
+		http.Error(response, "Storage engine doesn't keep a change log", http.StatusNotImplemented)
+		return
+	}
+
+	batch := DB_GetChanges(storage, since, limit)
+	if batch == nil {
+		http.Error(response, "Failed to read change log", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		log.Println("HandleGetChanges: Failed to serialize change batch", err.Error())
+		http.Error(response, "Error serializing changes", http.StatusInternalServerError)
+		return
+	}
+
+	WriteCompressedResponse(response, request, body)
+}
+
+func HandleGetStats(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		log.Printf("[%s]: Got a request for /internal/stats route with non-get method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	storage := DB_GetStorage(request.URL.Query().Get("namespace"))
+	if storage == nil {
+		http.Error(response, "Namespace not found", http.StatusNotFound)
+		return
+	}
+
+	body, err := json.Marshal(storage.Stats())
+	if err != nil {
+		log.Println("HandleGetStats: Failed to serialize stats", err.Error())
+		http.Error(response, "Error serializing stats", http.StatusInternalServerError)
+		return
+	}
+
+	response.Write(body)
+}
+
+// takes a consistent snapshot of the local store and streams it back, used by the controller for backups
+func HandleSnapshot(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		log.Printf("[%s]: Got a request for /internal/snapshot route with non-get method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	os.MkdirAll(g_dataDir, 0700)
+	snapshotPath := fmt.Sprintf("%s/snapshot-%d.tmp", g_dataDir, time.Now().UnixNano())
+	defer os.Remove(snapshotPath)
+
+	changeSeqs, err := DB_Snapshot(snapshotPath)
+	if err != nil {
+		log.Printf("HandleSnapshot: Failed to take snapshot: %s\n", err.Error())
+		http.Error(response, "Failed to take snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	snapshot, err := os.Open(snapshotPath)
+	if err != nil {
+		log.Printf("HandleSnapshot: Failed to open snapshot: %s\n", err.Error())
+		http.Error(response, "Failed to read snapshot", http.StatusInternalServerError)
+		return
+	}
+	defer snapshot.Close()
+
+	info, err := snapshot.Stat()
+	if err != nil {
+		log.Printf("HandleSnapshot: Failed to stat snapshot: %s\n", err.Error())
+		http.Error(response, "Failed to read snapshot", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("HandleSnapshot: streaming %d byte snapshot to %s\n", info.Size(), request.RemoteAddr)
+
+	response.Header().Set("Content-Type", "application/octet-stream")
+	response.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	response.Header().Set("X-Snapshot-Format", GetSnapshotFormat(g_storageEngineName))
+	if changeSeq, found := changeSeqs[DEFAULT_NAMESPACE]; found {
+		response.Header().Set("X-Snapshot-Change-Seq", strconv.FormatInt(changeSeq, 10))
+	}
+	delete(changeSeqs, DEFAULT_NAMESPACE)
+	if len(changeSeqs) > 0 {
+		serializedSeqs, _ := json.Marshal(changeSeqs)
+		response.Header().Set("X-Snapshot-Namespace-Change-Seqs", string(serializedSeqs))
+	}
+	io.Copy(response, snapshot)
 }
 
 func HandleHealthCheck(response http.ResponseWriter, request *http.Request) {
@@ -173,17 +524,58 @@ func HandleHealthCheck(response http.ResponseWriter, request *http.Request) {
 
 func HandleNetworkUpdate(response http.ResponseWriter, request *http.Request) {
 	log.Println("/internal/networkupdate: Network update received")
+	SyncNetwork()
+}
 
-	updatedNetwork := DownloadNetworkInfo()
+// downloads the network from the controller and moves data around if placement changed
+func SyncNetwork() {
+	g_networkSyncLock.Lock()
+	defer g_networkSyncLock.Unlock()
+
+	AdoptNetwork(DownloadNetworkInfo())
+}
+
+// brings the network up to at least epoch, the node at senderAddr already has it so it is asked before
+// the controller
+func SyncNetworkFromPeer(senderAddr string, epoch uint64) {
+	g_networkSyncLock.Lock()
+	defer g_networkSyncLock.Unlock()
+
+	if g_dbNetwork.Epoch >= epoch {
+		return // another sync got there while we waited for the lock
+	}
+
+	if len(senderAddr) > 0 {
+		if network := GetTopologyFromPeer(senderAddr); network != nil && network.Epoch >= epoch {
+			AdoptNetwork(*network)
+			return
+		}
+	}
+
+	AdoptNetwork(DownloadNetworkInfo())
+}
+
+// moves data around if placement changed between our network and updatedNetwork, callers hold g_networkSyncLock
+func AdoptNetwork(updatedNetwork DBNetwork) {
 	if DiffNetworkAgainstLocal(&updatedNetwork) {
 		log.Printf("Network changed, rehashing data")
 
 		SyncSelfID(&updatedNetwork)
 		g_dbNetwork = updatedNetwork
 		DB_RehashData()
+		DB_WritePlacementVersion(g_dbNetwork.PlacementVersion)
+	} else if scopes := GetChangedReplicationScopes(&g_dbNetwork, &updatedNetwork); len(scopes) > 0 {
+		log.Printf("Replication factor changed for %+v, moving affected replicas", scopes)
+
+		oldNetwork := g_dbNetwork
+		g_dbNetwork = updatedNetwork
+		DB_MoveReplicas(&oldNetwork, scopes)
 	} else {
-		log.Printf("/internal/networkupdate: No change detected\n curr: %v\n new: %v\n", g_dbNetwork, updatedNetwork)
+		log.Printf("SyncNetwork: No change detected\n curr: %v\n new: %v\n", g_dbNetwork, updatedNetwork)
+		g_dbNetwork = updatedNetwork // still pick up namespace settings, they don't need a rehash
 	}
+
+	DB_MigratePlacement()
 }
 
 func ValidateGetRequest(response http.ResponseWriter, request *http.Request) bool {
@@ -205,7 +597,7 @@ func ValidateGetRequest(response http.ResponseWriter, request *http.Request) boo
 }
 
 func HandleGet(response http.ResponseWriter, request *http.Request) {
-	if !ValidateGetRequest(response, request) {
+	if !ValidateGetRequest(response, request) || !Auth_Authorize(response, request, auth.SCOPE_READ, DEFAULT_NAMESPACE, request.URL.Query().Get("key")) {
 		return
 	}
 
@@ -214,16 +606,125 @@ func HandleGet(response http.ResponseWriter, request *http.Request) {
 
 	log.Printf("[%s]: Got a request for /get route for key=%s\n", request.RemoteAddr, key)
 
-	entry := DB_Read(key)
+	entry := DB_Read(DEFAULT_NAMESPACE, key)
 	if entry == nil {
 		log.Printf("[%s]: failed to find value for key=%s\n", request.RemoteAddr, key)
 		http.Error(response, "Failed to find original URL, is the key correct?", http.StatusNotFound)
 		return
 	}
 
+	KV_WriteEntryHeaders(response, entry)
 	io.WriteString(response, entry.Value)
 }
 
+// serves /ns/{name}/get and /ns/{name}/set, the same as /get and /set but inside the namespace and with
+// its ttl and consistency defaults, which can be overridden per request with ttl= and consistency=
+func HandleNamespaceRequest(response http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(request.URL.Path, "/ns/"), "/")
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		http.Error(response, "Expected /ns/{name}/get or /ns/{name}/set", http.StatusNotFound)
+		return
+	}
+
+	namespace, found := g_dbNetwork.GetNamespace(parts[0])
+	if !found {
+		log.Printf("[%s]: Got a request for unknown namespace %s\n", request.RemoteAddr, parts[0])
+		http.Error(response, "Namespace not found", http.StatusNotFound)
+		return
+	}
+
+	query := request.URL.Query()
+	consistency := namespace.Consistency
+	if query.Has("consistency") {
+		consistency = query.Get("consistency")
+		if !IsValidConsistency(consistency) {
+			http.Error(response, "Invalid params, consistency should be one, quorum or all", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch parts[1] {
+	case "get":
+		if !ValidateGetRequest(response, request) || !Auth_Authorize(response, request, auth.SCOPE_READ, namespace.Name, query.Get("key")) {
+			return
+		}
+		HandleNamespaceGet(response, request, namespace, consistency)
+	case "set":
+		if !ValidateWriteRequest(response, request) || !Auth_Authorize(response, request, auth.SCOPE_WRITE, namespace.Name, query.Get("key")) ||
+			RejectIfReservedKey(response, query.Get("key")) {
+			return
+		}
+		HandleNamespaceSet(response, request, namespace, consistency)
+	default:
+		http.Error(response, "Expected /ns/{name}/get or /ns/{name}/set", http.StatusNotFound)
+	}
+}
+
+func HandleNamespaceGet(response http.ResponseWriter, request *http.Request, namespace DBNamespace, consistency string) {
+	key := request.URL.Query().Get("key")
+	log.Printf("[%s]: Got a request for /ns/%s/get for key=%s (consistency=%s)\n", request.RemoteAddr, namespace.Name, key, consistency)
+
+	entry, answered := DB_ReadWithConsistency(namespace.Name, key, consistency)
+	if !answered {
+		http.Error(response, "Not enough replicas answered for the requested consistency", http.StatusServiceUnavailable)
+		return
+	}
+
+	if entry == nil {
+		http.Error(response, "Not found", http.StatusNotFound)
+		return
+	}
+
+	KV_WriteEntryHeaders(response, entry)
+	io.WriteString(response, entry.Value)
+}
+
+// the ttl= param of a write, the namespace's default ttl without one. returns false if it's invalid
+func ParseTTLParam(query url.Values, namespace DBNamespace) (time.Duration, bool) {
+	if !query.Has("ttl") {
+		return time.Duration(namespace.TTLSeconds) * time.Second, true
+	}
+
+	ttl, err := time.ParseDuration(query.Get("ttl"))
+	if err != nil || ttl < 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+func HandleNamespaceSet(response http.ResponseWriter, request *http.Request, namespace DBNamespace, consistency string) {
+	if namespace.OverQuota {
+		log.Printf("[%s]: Rejecting write to namespace %s, it is over its quota\n", request.RemoteAddr, namespace.Name)
+		http.Error(response, "Namespace is over its quota", http.StatusInsufficientStorage)
+		return
+	}
+
+	query := request.URL.Query()
+	ttl, valid := ParseTTLParam(query, namespace)
+	if !valid {
+		http.Error(response, "Invalid params, ttl should be a duration like 30s or 12h", http.StatusBadRequest)
+		return
+	}
+
+	entry := DBEntry{Namespace: namespace.Name, Key: query.Get("key"), Value: query.Get("value")}
+	if ttl > 0 {
+		entry.ExpiresAt = time.Now().Add(ttl).UnixMilli()
+	}
+
+	log.Printf("[%s]: Got a request for /ns/%s/set with key=%s (ttl=%s, consistency=%s)\n", request.RemoteAddr, namespace.Name, entry.Key, ttl, consistency)
+
+	numReplicas := len(entry.GetTargetNodes())
+	requiredAcks := GetRequiredReplicas(consistency, numReplicas)
+	acks, admission := DB_WriteToReplicas(entry, requiredAcks, true)
+	if acks < requiredAcks {
+		RespondWriteShortfall(response, request, acks, requiredAcks, admission)
+		return
+	}
+
+	response.WriteHeader(http.StatusCreated)
+	io.WriteString(response, fmt.Sprintf("Committed on %d of %d replicas", acks, numReplicas))
+}
+
 func HandleInternalGet(response http.ResponseWriter, request *http.Request) {
 	if !ValidateGetRequest(response, request) {
 		return
@@ -234,7 +735,7 @@ func HandleInternalGet(response http.ResponseWriter, request *http.Request) {
 
 	log.Printf("[%s]: Got a request for /internal/get route for key=%s\n", request.RemoteAddr, key)
 
-	entry := DB_LocalRead(key)
+	entry := DB_LocalRead(query.Get("namespace"), key)
 	if entry == nil {
 		log.Printf("[%s]: Failed to find value locally for key=%s\n", request.RemoteAddr, key)
 		http.Error(response, "Not found", http.StatusNotFound)
@@ -276,14 +777,41 @@ func HandleSetChunk(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if chunk.Epoch > g_dbNetwork.Epoch {
+		log.Printf("Got chunk placed with network epoch %d but ours is %d, syncing network first\n", chunk.Epoch, g_dbNetwork.Epoch)
+		SyncNetworkFromPeer(chunk.Sender, chunk.Epoch) // the controller's update notification hasn't reached us yet
+	}
+
 	if chunk.Owner != uint32(g_id) {
 		log.Printf("Got chunk with owner ID %d, but self id is %d\n", chunk.Owner, g_id)
 		http.Error(response, "Got chunk with owner ID not meant for me", http.StatusNotAcceptable)
 		return
 	}
 
+	if RejectIfSaturated(response, request, len(chunk.Entries)) {
+		return
+	}
+
 	log.Printf("Got chunk with %d entries to save\n", len(chunk.Entries))
-	go DB_LocalWriteChunk(&chunk)
+	if request.URL.Query().Get("durable") != "true" {
+		// answered once the entries are queued, so a sender hears about entries that didn't make it
+		queued := DB_LocalWriteChunk(&chunk)
+		if queued < len(chunk.Entries) {
+			log.Printf("HandleSetChunk: only queued %d of %d entries\n", queued, len(chunk.Entries))
+			http.Error(response, fmt.Sprintf("Queued %d of %d entries", queued, len(chunk.Entries)), http.StatusServiceUnavailable)
+			return
+		}
+
+		response.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	written := DB_LocalWriteChunkDurable(&chunk)
+	if written < len(chunk.Entries) {
+		log.Printf("HandleSetChunk: only committed %d of %d entries\n", written, len(chunk.Entries))
+		http.Error(response, fmt.Sprintf("Committed %d of %d entries", written, len(chunk.Entries)), http.StatusServiceUnavailable)
+		return
+	}
 
 	response.WriteHeader(http.StatusCreated)
 }
@@ -306,20 +834,22 @@ func HandleCatchupCmd(response http.ResponseWriter, request *http.Request) {
 		g_dbNetwork = updatedNetwork
 	}
 
+	// replicas of a key can be on any node, so everyone might have something that belongs here
 	nodesToAsk := make([]int, 0)
-	lookAheadWindow := g_dbNetwork.ReplicationFactor - 1
-
-	for i := 0; i < int(lookAheadWindow); i++ {
-		nodesToAsk = append(nodesToAsk, (i+g_id+1)%int(g_dbNetwork.NumNodes))
-		nodesToAsk = append(nodesToAsk, Mod((g_id-1-i), int(g_dbNetwork.NumNodes)))
+	for _, node := range g_dbNetwork.Nodes {
+		if int(node.ID) != g_id {
+			nodesToAsk = append(nodesToAsk, int(node.ID))
+		}
 	}
 
 	log.Printf("Asking nodes %v for their chunks for catchup process\n", nodesToAsk)
 
-	for _, nodeID := range nodesToAsk {
-		chunk := GetChunkFromNode(uint32(nodeID))
-		if chunk != nil {
-			go DB_LocalWriteChunk(chunk)
+	for _, namespace := range g_dbNetwork.GetNamespaceNames() {
+		for _, nodeID := range nodesToAsk {
+			chunk := GetChunkFromNode(namespace, uint32(nodeID))
+			if chunk != nil {
+				go DB_LocalWriteChunk(chunk) // entries that don't belong here are skipped by DB_LocalWrite
+			}
 		}
 	}
 }
@@ -341,16 +871,47 @@ func main() {
 		log.Fatalln("Invalid id provided for node, exiting")
 	}
 
-	log.Printf("Running with ID: %d, port: %d, pid: %d\n", g_id, g_listenPort, os.Getpid())
+	if g_batchMaxJobs == 0 {
+		log.Fatalln("Invalid batch size provided, it should be at least 1")
+	}
+
+	if g_queueSoftLimit > g_maxQueuedJobs {
+		log.Fatalln("Invalid queue limits provided, soft limit should be <= than the max queue size")
+	}
+
+	if g_valuePartSize == 0 || g_maxValueSize <= 0 {
+		log.Fatalln("Invalid value size limits provided, the part size and max value size should be at least 1")
+	}
+
+	if len(g_dataDir) == 0 {
+		g_dataDir = fmt.Sprintf("%s/node-%d", DEFAULT_DATA_DIR_ROOT, g_listenPort) // port is unique per host, ids get reshuffled
+		MigrateLegacyDataDir(g_dataDir)
+	}
+
+	log.Printf("Running with ID: %d, port: %d, pid: %d, data dir: %s\n", g_id, g_listenPort, os.Getpid(), g_dataDir)
+	Encryption_LoadKeys()
+	TLS_Setup()
+	Auth_Setup()
+
+	g_storage = MakeStorageEngine(g_storageEngineName, DEFAULT_NAMESPACE)
+	storageOpened := make(chan bool, 1)
+	go func() { storageOpened <- g_storage.Open() }()
 
 	go func() {
 		g_dbNetwork = DownloadNetworkInfo()
+		if <-storageOpened {
+			g_networkSyncLock.Lock()
+			g_placementStorageOpen = true
+			DB_MigratePlacement()
+			g_networkSyncLock.Unlock()
+		}
 	}()
-
-	go Sqlite_Connect()
+	go Namespace_RunExpiry()
 
 	http.HandleFunc("/set", ProcessWrite)
 	http.HandleFunc("/get", HandleGet)
+	http.HandleFunc("/ns/", HandleNamespaceRequest)
+	http.HandleFunc(KV_API_PREFIX, HandleKVRequest)
 	http.HandleFunc("/internal/set", ProcessSingleWrite)
 	http.HandleFunc("/internal/getall", HandleGetAllData)
 	http.HandleFunc("/internal/healthcheck", HandleHealthCheck)
@@ -358,6 +919,27 @@ func main() {
 	http.HandleFunc("/internal/get", HandleInternalGet)
 	http.HandleFunc("/internal/setchunk", HandleSetChunk)
 	http.HandleFunc("/internal/catchup", HandleCatchupCmd)
+	http.HandleFunc("/internal/changes", HandleGetChanges)
+	http.HandleFunc("/internal/stats", HandleGetStats)
+	http.HandleFunc("/internal/snapshot", HandleSnapshot)
+	http.HandleFunc("/internal/peers", HandleGetPeers)
+	http.HandleFunc("/internal/hello", HandleHello)
+	http.HandleFunc("/internal/delete", HandleInternalDelete)
+	http.HandleFunc("/internal/scan", HandleScan)
+	http.HandleFunc("/internal/compression", HandleGetCompressionStats)
+	http.HandleFunc("/internal/encryption", HandleEncryption)
+	http.HandleFunc("/internal/auth", HandleAuthUpdate)
+
+	if g_binaryProtocol {
+		go StartBinaryServer()
+	}
+	if g_respPort != 0 {
+		go StartRESPServer()
+	}
+	if g_memcachePort != 0 {
+		go StartMemcacheServer()
+	}
 
-	http.ListenAndServe(fmt.Sprintf(":%d", g_listenPort), nil)
+	err := TLS_ListenAndServe()
+	log.Printf("Stopped serving http: %s\n", err.Error())
 }
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"DBCommon/auth"
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a client connection speaking the memcached text protocol
+type MemcacheConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	tokenID string // API token the client authenticated with
+}
+
+const MEMCACHE_MAX_KEY_LENGTH = 250
+const MEMCACHE_MAX_RELATIVE_EXPTIME = 60 * 60 * 24 * 30 // larger exptimes are unix timestamps
+const MEMCACHE_VERSION = "1.6.0-dbnode"
+const MEMCACHE_MAX_AUTH_BYTES = 1024
+
+func StartMemcacheServer() {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", g_memcachePort))
+	if err != nil {
+		log.Printf("StartMemcacheServer: Failed to listen on port %d: %s\n", g_memcachePort, err.Error())
+		return
+	}
+	listener = TLS_WrapListener(listener, false)
+
+	log.Printf("StartMemcacheServer: Listening for memcached clients on port %d (namespace '%s')\n", g_memcachePort, g_memcacheNamespace)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("StartMemcacheServer: Stopped accepting connections: %s\n", err.Error())
+			return
+		}
+
+		go Memcache_ServeConn(conn)
+	}
+}
+
+func Memcache_ServeConn(conn net.Conn) {
+	defer conn.Close()
+	client := &MemcacheConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+
+	for {
+		line, err := client.readLine()
+		if err != nil {
+			return
+		}
+
+		if !Memcache_Execute(client, strings.Fields(line)) {
+			client.writer.Flush()
+			return
+		}
+
+		// pipelined commands are answered together
+		if client.reader.Buffered() == 0 {
+			if err := client.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (client *MemcacheConn) readLine() (string, error) {
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// reads the data block of a storage command, it has to end with \r\n
+func (client *MemcacheConn) readData(length int) (string, bool, error) {
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(client.reader, data); err != nil {
+		return "", false, err
+	}
+	return string(data[:length]), string(data[length:]) == "\r\n", nil
+}
+
+func (client *MemcacheConn) WriteLine(line string) {
+	client.writer.WriteString(line + "\r\n")
+}
+
+func (client *MemcacheConn) WriteValue(entry *DBEntry, withCas bool) {
+	header := fmt.Sprintf("VALUE %s %d %d", entry.Key, entry.Flags, len(entry.Value))
+	if withCas {
+		header += " " + strconv.FormatUint(entry.GetVersion(), 10)
+	}
+	client.WriteLine(header)
+	client.WriteLine(entry.Value)
+}
+
+// keys can't be longer than 250 bytes or contain whitespace and control characters
+func Memcache_IsValidKey(key string) bool {
+	if len(key) == 0 || len(key) > MEMCACHE_MAX_KEY_LENGTH {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// exptimes up to 30 days are relative, larger ones are unix timestamps and negative ones expire the item
+// right away. returns the expiry in ms (0 for never) and false if the item is already expired
+func Memcache_GetExpiresAt(exptime int64) (int64, bool) {
+	now := time.Now()
+	switch {
+	case exptime == 0:
+		return 0, true
+	case exptime < 0:
+		return 0, false
+	case exptime <= MEMCACHE_MAX_RELATIVE_EXPTIME:
+		return now.Add(time.Duration(exptime) * time.Second).UnixMilli(), true
+	default:
+		return exptime * 1000, exptime*1000 > now.UnixMilli()
+	}
+}
+
+// the memcached equivalent of the 429/503 /set answers with when the write queue is full
+func Memcache_RejectIfSaturated(client *MemcacheConn) bool {
+	if GetAdmissionStatus(1) == 0 {
+		return false
+	}
+
+	log.Printf("[%s]: Rejecting memcached write, write queue is full\n", client.conn.RemoteAddr())
+	client.WriteLine(fmt.Sprintf("SERVER_ERROR node is busy, retry in %ds", GetRetryAfterSeconds()))
+	return true
+}
+
+// runs one command and writes its reply, returns false once the client asked to close the connection
+func Memcache_Execute(client *MemcacheConn, args []string) bool {
+	if len(args) == 0 {
+		client.WriteLine("ERROR")
+		return true
+	}
+
+	command := args[0]
+	args = args[1:]
+
+	if required, _ := Auth_GetState(); required {
+		if _, found := Auth_Lookup(client.tokenID); !found {
+			switch command {
+			case "set":
+				return Memcache_HandleAuth(client, args)
+			case "quit":
+				return false
+			default:
+				client.WriteLine("CLIENT_ERROR unauthenticated")
+				return true
+			}
+		}
+	}
+
+	if DB_GetStorage(g_memcacheNamespace) == nil {
+		client.WriteLine(fmt.Sprintf("SERVER_ERROR namespace '%s' doesn't exist", g_memcacheNamespace))
+		return true
+	}
+
+	switch command {
+	case "get", "gets":
+		if len(args) == 0 {
+			client.WriteLine("ERROR")
+			return true
+		}
+		for _, key := range args {
+			if !Memcache_IsValidKey(key) {
+				client.WriteLine("CLIENT_ERROR bad command line format")
+				return true
+			}
+		}
+		for _, key := range args {
+			if Memcache_RejectIfDenied(client, auth.SCOPE_READ, key) {
+				return true
+			}
+		}
+		for _, key := range args {
+			if entry := DB_Read(g_memcacheNamespace, key); entry != nil {
+				client.WriteValue(entry, command == "gets")
+			}
+		}
+		client.WriteLine("END")
+	case "set", "add", "replace", "cas":
+		return Memcache_HandleStore(client, command, args)
+	case "delete":
+		Memcache_HandleDelete(client, args)
+	case "incr", "decr":
+		Memcache_HandleIncr(client, command, args)
+	case "touch":
+		Memcache_HandleTouch(client, args)
+	case "version":
+		client.WriteLine("VERSION " + MEMCACHE_VERSION)
+	case "quit":
+		return false
+	default:
+		client.WriteLine("ERROR")
+	}
+
+	return true
+}
+
+// with auth on, memcached text protocol clients authenticate with a set whose data is "<token id> <secret>",
+// the key, flags and exptime are ignored. returns false if the connection broke
+func Memcache_HandleAuth(client *MemcacheConn, args []string) bool {
+	args, _ = Memcache_ParseNoReply(args)
+	if len(args) != 4 {
+		client.WriteLine("CLIENT_ERROR unauthenticated")
+		return true
+	}
+
+	length, err := strconv.Atoi(args[3])
+	if err != nil || length < 0 || length > MEMCACHE_MAX_AUTH_BYTES {
+		client.WriteLine("CLIENT_ERROR authentication failure")
+		return false // the data block can't be skipped safely
+	}
+
+	data, terminated, err := client.readData(length)
+	if err != nil {
+		return false
+	}
+
+	tokenID, err := Auth_Login(strings.Replace(strings.TrimSpace(data), " ", ".", 1))
+	if err != nil || !terminated {
+		if err != nil {
+			log.Printf("[%s]: Rejected memcached authentication: %s\n", client.conn.RemoteAddr(), err.Error())
+		}
+		client.WriteLine("CLIENT_ERROR authentication failure")
+		return true
+	}
+
+	client.tokenID = tokenID
+	client.WriteLine("STORED")
+	return true
+}
+
+// answers CLIENT_ERROR and returns true if the client's token may not use the key
+func Memcache_RejectIfDenied(client *MemcacheConn, scope string, key string) bool {
+	if Auth_Allows(client.tokenID, scope, g_memcacheNamespace, key) {
+		return false
+	}
+
+	client.WriteLine("CLIENT_ERROR access denied")
+	return true
+}
+
+// takes the optional noreply off the end of args
+func Memcache_ParseNoReply(args []string) ([]string, bool) {
+	if len(args) > 0 && args[len(args)-1] == "noreply" {
+		return args[:len(args)-1], true
+	}
+	return args, false
+}
+
+// <command> <key> <flags> <exptime> <bytes> [noreply], cas has a <cas unique> after <bytes>. the data
+// block that follows is read even if the command is rejected, returns false if the connection broke
+func Memcache_HandleStore(client *MemcacheConn, command string, args []string) bool {
+	args, noReply := Memcache_ParseNoReply(args)
+	reply := func(line string) {
+		if !noReply {
+			client.WriteLine(line)
+		}
+	}
+
+	numArgs := 4
+	if command == "cas" {
+		numArgs = 5
+	}
+	if len(args) != numArgs {
+		client.WriteLine("ERROR")
+		return true
+	}
+
+	length, err := strconv.Atoi(args[3])
+	if err != nil || length < 0 {
+		client.WriteLine("CLIENT_ERROR bad command line format")
+		return true
+	}
+
+	if int64(length) > g_maxValueSize {
+		if _, err := io.CopyN(io.Discard, client.reader, int64(length)+2); err != nil {
+			return false
+		}
+		client.WriteLine("SERVER_ERROR object too large for cache")
+		return true
+	}
+
+	value, terminated, err := client.readData(length)
+	if err != nil {
+		return false
+	}
+	if !terminated {
+		client.WriteLine("CLIENT_ERROR bad data chunk")
+		return true
+	}
+
+	flags, flagsErr := strconv.ParseUint(args[1], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[2], 10, 64)
+	var casUnique uint64
+	var casErr error
+	if command == "cas" {
+		casUnique, casErr = strconv.ParseUint(args[4], 10, 64)
+	}
+	if !Memcache_IsValidKey(args[0]) || flagsErr != nil || exptimeErr != nil || casErr != nil {
+		client.WriteLine("CLIENT_ERROR bad command line format")
+		return true
+	}
+
+	if Memcache_RejectIfDenied(client, auth.SCOPE_WRITE, args[0]) || Memcache_RejectIfSaturated(client) {
+		return true
+	}
+
+	entry := DBEntry{Namespace: g_memcacheNamespace, Key: args[0], Value: value, Flags: uint32(flags)}
+	expiresAt, live := Memcache_GetExpiresAt(exptime)
+	entry.ExpiresAt = expiresAt
+
+	lock := DB_LockKey(g_memcacheNamespace, entry.Key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	current := DB_Read(g_memcacheNamespace, entry.Key)
+	switch {
+	case command == "add" && current != nil, command == "replace" && current == nil:
+		reply("NOT_STORED")
+		return true
+	case command == "cas" && current == nil:
+		reply("NOT_FOUND")
+		return true
+	case command == "cas" && current.GetVersion() != casUnique:
+		reply("EXISTS")
+		return true
+	}
+
+	// storing an item that is already expired only removes the one it replaces
+	if !live {
+		if current != nil && DB_Delete(g_memcacheNamespace, entry.Key) == 0 {
+			client.WriteLine("SERVER_ERROR delete wasn't acknowledged by any replica")
+			return true
+		}
+		reply("STORED")
+		return true
+	}
+
+	if !DB_WriteAllReplicas(entry) {
+		client.WriteLine("SERVER_ERROR write wasn't acknowledged by every replica")
+		return true
+	}
+	reply("STORED")
+	return true
+}
+
+// delete <key> [noreply], old clients send a 0 hold time after the key
+func Memcache_HandleDelete(client *MemcacheConn, args []string) {
+	args, noReply := Memcache_ParseNoReply(args)
+	if len(args) == 2 && args[1] == "0" {
+		args = args[:1]
+	}
+	if len(args) != 1 || !Memcache_IsValidKey(args[0]) {
+		client.WriteLine("CLIENT_ERROR bad command line format")
+		return
+	}
+	if Memcache_RejectIfDenied(client, auth.SCOPE_WRITE, args[0]) {
+		return
+	}
+
+	lock := DB_LockKey(g_memcacheNamespace, args[0])
+	lock.Lock()
+	defer lock.Unlock()
+
+	reply := "DELETED"
+	if DB_Read(g_memcacheNamespace, args[0]) == nil {
+		reply = "NOT_FOUND"
+	} else if DB_Delete(g_memcacheNamespace, args[0]) == 0 {
+		reply = "SERVER_ERROR delete wasn't acknowledged by any replica"
+	}
+
+	if !noReply || strings.HasPrefix(reply, "SERVER_ERROR") {
+		client.WriteLine(reply)
+	}
+}
+
+// incr|decr <key> <delta> [noreply]. values are unsigned 64 bit numbers, incr wraps around and decr
+// stops at 0. the key keeps its flags and expiry
+func Memcache_HandleIncr(client *MemcacheConn, command string, args []string) {
+	args, noReply := Memcache_ParseNoReply(args)
+	if len(args) != 2 || !Memcache_IsValidKey(args[0]) {
+		client.WriteLine("ERROR")
+		return
+	}
+
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		client.WriteLine("CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+
+	if Memcache_RejectIfDenied(client, auth.SCOPE_WRITE, args[0]) || Memcache_RejectIfSaturated(client) {
+		return
+	}
+
+	lock := DB_LockKey(g_memcacheNamespace, args[0])
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := DB_Read(g_memcacheNamespace, args[0])
+	if entry == nil {
+		if !noReply {
+			client.WriteLine("NOT_FOUND")
+		}
+		return
+	}
+
+	value, err := strconv.ParseUint(strings.TrimRight(entry.Value, " "), 10, 64)
+	if err != nil {
+		client.WriteLine("CLIENT_ERROR cannot increment or decrement non-numeric value")
+		return
+	}
+
+	if command == "incr" {
+		value += delta
+	} else if delta > value {
+		value = 0
+	} else {
+		value -= delta
+	}
+
+	entry.Value = strconv.FormatUint(value, 10)
+	if !DB_WriteAllReplicas(*entry) {
+		client.WriteLine("SERVER_ERROR write wasn't acknowledged by every replica")
+		return
+	}
+	if !noReply {
+		client.WriteLine(entry.Value)
+	}
+}
+
+// touch <key> <exptime> [noreply] sets a new expiry without changing the value
+func Memcache_HandleTouch(client *MemcacheConn, args []string) {
+	args, noReply := Memcache_ParseNoReply(args)
+	if len(args) != 2 || !Memcache_IsValidKey(args[0]) {
+		client.WriteLine("ERROR")
+		return
+	}
+
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		client.WriteLine("CLIENT_ERROR invalid exptime argument")
+		return
+	}
+
+	if Memcache_RejectIfDenied(client, auth.SCOPE_WRITE, args[0]) || Memcache_RejectIfSaturated(client) {
+		return
+	}
+
+	lock := DB_LockKey(g_memcacheNamespace, args[0])
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := DB_Read(g_memcacheNamespace, args[0])
+	reply := "TOUCHED"
+	if entry == nil {
+		reply = "NOT_FOUND"
+	} else if expiresAt, live := Memcache_GetExpiresAt(exptime); !live {
+		if DB_Delete(g_memcacheNamespace, entry.Key) == 0 {
+			reply = "SERVER_ERROR delete wasn't acknowledged by any replica"
+		}
+	} else {
+		entry.ExpiresAt = expiresAt
+		if !DB_WriteAllReplicas(*entry) {
+			reply = "SERVER_ERROR write wasn't acknowledged by every replica"
+		}
+	}
+
+	if !noReply || strings.HasPrefix(reply, "SERVER_ERROR") {
+		client.WriteLine(reply)
+	}
+}
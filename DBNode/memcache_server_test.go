@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runs the commands in input the way Memcache_ServeConn does and returns the replies. commands that get
+// past parsing need the cluster, the tests only send ones that are rejected before that
+func runMemcache(t *testing.T, input string) (string, bool) {
+	t.Helper()
+	g_memcacheNamespace = DEFAULT_NAMESPACE
+	g_storage = MakeMemoryEngine(DEFAULT_NAMESPACE)
+	g_maxValueSize = 16
+
+	var output bytes.Buffer
+	client := &MemcacheConn{reader: bufio.NewReader(strings.NewReader(input)), writer: bufio.NewWriter(&output)}
+
+	for {
+		line, err := client.readLine()
+		if err != nil {
+			client.writer.Flush()
+			return output.String(), true
+		}
+		if !Memcache_Execute(client, strings.Fields(line)) {
+			client.writer.Flush()
+			return output.String(), false
+		}
+	}
+}
+
+func TestMemcacheMalformedCommands(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"Empty", "\r\n", "ERROR\r\n"},
+		{"Unknown", "flush_everything\r\n", "ERROR\r\n"},
+		{"Version", "version\r\n", "VERSION " + MEMCACHE_VERSION + "\r\n"},
+		{"GetWithoutKey", "get\r\n", "ERROR\r\n"},
+		{"GetLongKey", "get " + strings.Repeat("k", MEMCACHE_MAX_KEY_LENGTH+1) + "\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"GetControlCharacter", "gets ok bad\x01key\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"SetMissingArgs", "set key 0 0\r\n", "ERROR\r\n"},
+		{"CasMissingUnique", "cas key 0 0 1\r\n", "ERROR\r\n"},
+		{"SetBadLength", "set key 0 0 x\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"SetNegativeLength", "set key 0 0 -1\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		// the data block is read before the rest of the line is checked, the next command still parses
+		{"SetBadFlags", "set key x 0 3\r\nabc\r\nversion\r\n", "CLIENT_ERROR bad command line format\r\nVERSION " + MEMCACHE_VERSION + "\r\n"},
+		{"SetFlagsOverflow", "set key 4294967296 0 1\r\na\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"SetBadExptime", "add key 0 soon 1\r\na\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"CasBadUnique", "cas key 0 0 1 -5\r\na\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"SetBadKey", "set bad\x7fkey 0 0 1\r\na\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"SetBadDataChunk", "set key 0 0 3 noreply\r\nabcde\r\n", "CLIENT_ERROR bad data chunk\r\nERROR\r\n"},
+		{"SetTooLarge", "set key 0 0 17\r\n" + strings.Repeat("v", 17) + "\r\nversion\r\n", "SERVER_ERROR object too large for cache\r\nVERSION " + MEMCACHE_VERSION + "\r\n"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			got, open := runMemcache(t, test.input)
+			if got != test.want || !open {
+				t.Fatalf("replies = %q, connection open %v, want %q and open", got, open, test.want)
+			}
+		})
+	}
+}
+
+func TestMemcacheClosesConnection(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"Quit", "quit\r\nversion\r\n"},
+		{"TruncatedData", "set key 0 0 10\r\nabc"},
+		{"TruncatedTooLarge", "set key 0 0 100\r\nabc"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if got, open := runMemcache(t, test.input); open || got != "" {
+				t.Fatalf("replies = %q, connection open %v, want it closed without a reply", got, open)
+			}
+		})
+	}
+}
+
+func TestMemcacheParseNoReply(t *testing.T) {
+	args, noReply := Memcache_ParseNoReply([]string{"key", "0", "noreply"})
+	if !noReply || !equalKeys(args, []string{"key", "0"}) {
+		t.Errorf("Memcache_ParseNoReply() = %q, %v, want [key 0], true", args, noReply)
+	}
+
+	args, noReply = Memcache_ParseNoReply([]string{"noreply", "0"})
+	if noReply || len(args) != 2 {
+		t.Errorf("Memcache_ParseNoReply() = %q, %v, want the args unchanged, false", args, noReply)
+	}
+}
+
+func TestMemcacheGetExpiresAt(t *testing.T) {
+	now := time.Now().UnixMilli()
+
+	if expiresAt, live := Memcache_GetExpiresAt(0); expiresAt != 0 || !live {
+		t.Errorf("Memcache_GetExpiresAt(0) = %d, %v, want 0, true", expiresAt, live)
+	}
+	if _, live := Memcache_GetExpiresAt(-1); live {
+		t.Error("Memcache_GetExpiresAt(-1) is live, want it expired")
+	}
+
+	expiresAt, live := Memcache_GetExpiresAt(MEMCACHE_MAX_RELATIVE_EXPTIME)
+	if want := now + MEMCACHE_MAX_RELATIVE_EXPTIME*1000; !live || expiresAt < want || expiresAt > want+60*1000 {
+		t.Errorf("Memcache_GetExpiresAt(30 days) = %d, %v, want about %d, true", expiresAt, live, want)
+	}
+
+	future := time.Now().Add(365 * 24 * time.Hour).Unix()
+	if expiresAt, live := Memcache_GetExpiresAt(future); expiresAt != future*1000 || !live {
+		t.Errorf("Memcache_GetExpiresAt(unix time) = %d, %v, want %d, true", expiresAt, live, future*1000)
+	}
+	if _, live := Memcache_GetExpiresAt(MEMCACHE_MAX_RELATIVE_EXPTIME + 1); live {
+		t.Error("Memcache_GetExpiresAt() of a unix time in 1970 is live, want it expired")
+	}
+}
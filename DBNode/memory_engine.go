@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// pure Go engine that keeps everything in a map, nothing survives a restart
+type MemoryEngine struct {
+	namespace string
+	data      map[string]DBEntry
+	lock      sync.RWMutex
+}
+
+func MakeMemoryEngine(namespace string) *MemoryEngine {
+	return &MemoryEngine{namespace: namespace, data: make(map[string]DBEntry)}
+}
+
+func (engine *MemoryEngine) Open() bool {
+	return true
+}
+
+func (engine *MemoryEngine) Get(key string) *DBEntry {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	if entry, found := engine.data[key]; found {
+		return &entry
+	}
+
+	return nil
+}
+
+func (engine *MemoryEngine) Put(entry DBEntry) bool {
+	if len(entry.Key) == 0 {
+		return false
+	}
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	entry.Namespace = engine.namespace
+	engine.data[entry.Key] = entry
+	return true
+}
+
+// nothing is ever persisted, a write is as durable as it gets once it's in the map
+func (engine *MemoryEngine) PutDurable(entry DBEntry) bool {
+	return engine.Put(entry)
+}
+
+func (engine *MemoryEngine) Delete(key string) bool {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	delete(engine.data, key)
+	return true
+}
+
+func (engine *MemoryEngine) DeleteDurable(key string) bool {
+	return engine.Delete(key)
+}
+
+// there is no change log to tell a drop apart from a delete in
+func (engine *MemoryEngine) Drop(key string) bool {
+	return engine.Delete(key)
+}
+
+func (engine *MemoryEngine) Scan(prefix string) *DBChunk {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	chunk := DBChunk{Entries: make([]DBEntry, 0)}
+	for key, entry := range engine.data {
+		if strings.HasPrefix(key, prefix) {
+			chunk.Entries = append(chunk.Entries, entry)
+		}
+	}
+
+	return &chunk
+}
+
+func (engine *MemoryEngine) ScanKeys(prefix string) []string {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	keys := make([]string, 0)
+	for key := range engine.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+func (engine *MemoryEngine) ExpiredKeys(now int64) ([]string, int64) {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	keys := make([]string, 0)
+	nextExpiry := int64(0)
+	for key, entry := range engine.data {
+		if entry.ExpiresAt == 0 {
+			continue
+		}
+
+		if entry.ExpiresAt <= now {
+			keys = append(keys, key)
+		} else if nextExpiry == 0 || entry.ExpiresAt < nextExpiry {
+			nextExpiry = entry.ExpiresAt
+		}
+	}
+
+	return keys, nextExpiry
+}
+
+func (engine *MemoryEngine) Snapshot(path string) error {
+	return WriteNDJSONSnapshot(path, engine.Scan("").Entries)
+}
+
+func (engine *MemoryEngine) Stats() StorageStats {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+
+	stats := StorageStats{Engine: STORAGE_ENGINE_MEMORY, NumKeys: int64(len(engine.data))}
+	for key, entry := range engine.data {
+		stats.SizeBytes += int64(len(key) + len(entry.Value))
+	}
+
+	return stats
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"DBCommon/placement"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a named keyspace with its own settings, created through the controller and shipped with the network.
+// every namespace is kept in its own table/file on the nodes, the default namespace is the original KVStore
+type DBNamespace struct {
+	Name              string
+	ReplicationFactor uint32
+	TTLSeconds        int64  // default time to live of entries, 0 means they never expire
+	Consistency       string // default number of replicas reads and writes wait for (one, quorum or all)
+	QuotaBytes        int64  // 0 means unlimited
+	OverQuota         bool   // set by the controller once the namespace uses more than its quota
+}
+
+type DBReplicationRule = placement.Rule
+
+// a slice of the data whose replication factor might have changed
+type DBReplicationScope struct {
+	Namespace string
+	Prefix    string
+}
+
+const DEFAULT_NAMESPACE = ""
+const CONSISTENCY_ONE = "one"
+const CONSISTENCY_QUORUM = "quorum"
+const CONSISTENCY_ALL = "all"
+const NAMESPACE_EXPIRY_INTERVAL_S = 60
+
+var g_namespaceStorage = make(map[string]StorageEngine) // storage of every namespace but the default one
+var g_namespaceLock sync.Mutex
+
+// earliest expiry of an entry in every namespace, 0 if nothing in it expires. namespaces are only checked for
+// expired entries once that time has passed, so namespaces without a ttl and without expiring entries are
+// skipped. namespaces missing from it haven't been checked yet
+var g_nextExpiry = make(map[string]int64)
+var g_nextExpiryLock sync.Mutex
+
+func IsValidConsistency(consistency string) bool {
+	return consistency == CONSISTENCY_ONE || consistency == CONSISTENCY_QUORUM || consistency == CONSISTENCY_ALL
+}
+
+// number of replicas that need to answer for the given consistency level
+func GetRequiredReplicas(consistency string, numReplicas int) int {
+	switch consistency {
+	case CONSISTENCY_ALL:
+		return numReplicas
+	case CONSISTENCY_QUORUM:
+		return numReplicas/2 + 1
+	default:
+		return 1
+	}
+}
+
+func (network *DBNetwork) GetNamespace(name string) (DBNamespace, bool) {
+	namespace, found := network.Namespaces[name]
+	return namespace, found
+}
+
+// replication factor of the key, from the longest matching prefix rule, then the namespace and then the
+// network. capped at the number of nodes
+func (network *DBNetwork) GetReplicationFactor(namespace string, key string) uint32 {
+	replicationFactor := network.ReplicationFactor
+	if settings, found := network.Namespaces[namespace]; found && namespace != DEFAULT_NAMESPACE {
+		replicationFactor = settings.ReplicationFactor
+	}
+	return placement.GetReplicationFactor(network.ReplicationRules, namespace, key, replicationFactor, network.NumNodes)
+}
+
+// the default namespace followed by every namespace the network knows about
+func (network *DBNetwork) GetNamespaceNames() []string {
+	names := []string{DEFAULT_NAMESPACE}
+	for name := range network.Namespaces {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// the parts of the data whose replication factor differs between the two networks, a namespace
+// that only exists in one of them has nothing to move
+func GetChangedReplicationScopes(oldNetwork *DBNetwork, newNetwork *DBNetwork) []DBReplicationScope {
+	scopes := make([]DBReplicationScope, 0)
+	if WeightsChanged(oldNetwork, newNetwork) {
+		// any key can move, but only the ones whose ranking changed actually do
+		for _, name := range newNetwork.GetNamespaceNames() {
+			scopes = append(scopes, DBReplicationScope{Namespace: name})
+		}
+		return scopes
+	}
+
+	if oldNetwork.ReplicationFactor != newNetwork.ReplicationFactor {
+		scopes = append(scopes, DBReplicationScope{Namespace: DEFAULT_NAMESPACE})
+	}
+
+	for name, namespace := range newNetwork.Namespaces {
+		if current, found := oldNetwork.Namespaces[name]; found && current.ReplicationFactor != namespace.ReplicationFactor {
+			scopes = append(scopes, DBReplicationScope{Namespace: name})
+		}
+	}
+
+	oldRules := make(map[DBReplicationScope]uint32)
+	for _, rule := range oldNetwork.ReplicationRules {
+		oldRules[DBReplicationScope{rule.Namespace, rule.Prefix}] = rule.ReplicationFactor
+	}
+	for _, rule := range newNetwork.ReplicationRules {
+		scope := DBReplicationScope{rule.Namespace, rule.Prefix}
+		if rf, found := oldRules[scope]; !found || rf != rule.ReplicationFactor {
+			scopes = append(scopes, scope)
+		}
+		delete(oldRules, scope)
+	}
+	for scope := range oldRules {
+		scopes = append(scopes, scope) // removed rules, these keys fall back to a different rf
+	}
+
+	// drop scopes that are already covered by a shorter prefix of the same namespace
+	covered := make([]DBReplicationScope, 0, len(scopes))
+	for i, scope := range scopes {
+		redundant := false
+		for j, other := range scopes {
+			if i != j && other.Namespace == scope.Namespace && strings.HasPrefix(scope.Prefix, other.Prefix) &&
+				(len(other.Prefix) < len(scope.Prefix) || j < i) {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			covered = append(covered, scope)
+		}
+	}
+
+	return covered
+}
+
+// returns the storage of the namespace, opening it on first use. nil if the namespace doesn't exist
+func DB_GetStorage(namespace string) StorageEngine {
+	if namespace == DEFAULT_NAMESPACE {
+		return g_storage
+	}
+
+	g_namespaceLock.Lock()
+	defer g_namespaceLock.Unlock()
+
+	if storage, found := g_namespaceStorage[namespace]; found {
+		return storage
+	}
+
+	if _, found := g_dbNetwork.GetNamespace(namespace); !found {
+		return nil
+	}
+
+	storage := MakeStorageEngine(g_storageEngineName, namespace)
+	if !storage.Open() {
+		log.Printf("DB_GetStorage: failed to open storage for namespace %s\n", namespace)
+		return nil
+	}
+
+	log.Printf("DB_GetStorage: opened storage for namespace %s\n", namespace)
+	g_namespaceStorage[namespace] = storage
+	return storage
+}
+
+func (entry *DBEntry) IsExpired() bool {
+	return entry.ExpiresAt > 0 && entry.ExpiresAt <= time.Now().UnixMilli()
+}
+
+// called for every entry written locally, brings the next expiry check of its namespace forward if the
+// entry expires before anything else in it
+func Namespace_NoteExpiry(namespace string, expiresAt int64) {
+	if expiresAt == 0 {
+		return
+	}
+
+	g_nextExpiryLock.Lock()
+	defer g_nextExpiryLock.Unlock()
+
+	if nextExpiry, found := g_nextExpiry[namespace]; found && (nextExpiry == 0 || expiresAt < nextExpiry) {
+		g_nextExpiry[namespace] = expiresAt
+	}
+}
+
+// deletes the expired entries of the namespace if any are due, returns how many were deleted
+func Namespace_DeleteExpired(name string, storage StorageEngine, now int64) int {
+	g_nextExpiryLock.Lock()
+	nextExpiry, found := g_nextExpiry[name]
+	if found && (nextExpiry == 0 || nextExpiry > now) {
+		g_nextExpiryLock.Unlock()
+		return 0
+	}
+	g_nextExpiry[name] = 0 // writes during the pass note their expiry from here on
+	g_nextExpiryLock.Unlock()
+
+	keys, nextExpiry := storage.ExpiredKeys(now)
+	for _, key := range keys {
+		storage.Delete(key)
+	}
+
+	g_nextExpiryLock.Lock()
+	if noted := g_nextExpiry[name]; noted > 0 && (nextExpiry == 0 || noted < nextExpiry) {
+		nextExpiry = noted
+	}
+	g_nextExpiry[name] = nextExpiry
+	g_nextExpiryLock.Unlock()
+
+	return len(keys)
+}
+
+// periodically deletes expired entries so they stop taking up space, reads already skip them
+func Namespace_RunExpiry() {
+	for {
+		time.Sleep(NAMESPACE_EXPIRY_INTERVAL_S * time.Second)
+
+		for _, name := range g_dbNetwork.GetNamespaceNames() {
+			storage := DB_GetStorage(name)
+			if storage == nil {
+				continue
+			}
+
+			if expired := Namespace_DeleteExpired(name, storage, time.Now().UnixMilli()); expired > 0 {
+				log.Printf("Namespace_RunExpiry: deleted %d expired entries from namespace %s\n", expired, name)
+			}
+
+			keys := storage.ScanKeys("")
+			if keys == nil {
+				continue
+			}
+
+			if orphans := ValueParts_SweepOrphans(name, storage, keys); orphans > 0 {
+				log.Printf("Namespace_RunExpiry: deleted %d orphaned value parts from namespace %s\n", orphans, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestNamespaceDeleteExpiredSkipsUntilDue(t *testing.T) {
+	const namespace = "expiry"
+	delete(g_nextExpiry, namespace)
+	storage := MakeMemoryEngine(namespace)
+	mustPut(t, storage, DBEntry{Key: "forever", Value: "1"})
+
+	if deleted := Namespace_DeleteExpired(namespace, storage, 1000); deleted != 0 {
+		t.Fatalf("Namespace_DeleteExpired() = %d, want 0", deleted)
+	}
+
+	// nothing in the namespace expires, so an entry that didn't go through DB_LocalWrite isn't found
+	mustPut(t, storage, DBEntry{Key: "unnoted", Value: "2", ExpiresAt: 500})
+	if deleted := Namespace_DeleteExpired(namespace, storage, 2000); deleted != 0 {
+		t.Fatalf("Namespace_DeleteExpired() of a namespace without expiring entries = %d, want it skipped", deleted)
+	}
+
+	mustPut(t, storage, DBEntry{Key: "noted", Value: "3", ExpiresAt: 3000})
+	Namespace_NoteExpiry(namespace, 3000)
+	if deleted := Namespace_DeleteExpired(namespace, storage, 2500); deleted != 0 {
+		t.Fatalf("Namespace_DeleteExpired() before the next expiry = %d, want it skipped", deleted)
+	}
+	if deleted := Namespace_DeleteExpired(namespace, storage, 3000); deleted != 2 {
+		t.Fatalf("Namespace_DeleteExpired() once due = %d, want 2", deleted)
+	}
+	if keys := scanKeys(storage, ""); !equalKeys(keys, []string{"forever"}) {
+		t.Errorf("keys left = %q, want [forever]", keys)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"DBCommon/rpcclient"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// every call to other nodes and the controller goes through this client, it tracks latency and keeps a
+// circuit breaker per peer
+var g_rpc = rpcclient.New(rpcclient.Config{})
+
+// the given nodes ordered from the fastest to the slowest peer
+func Peer_SortByLatency(nodeIDs []uint32) []uint32 {
+	latencies := make(map[uint32]float64)
+	for _, node := range g_dbNetwork.Nodes {
+		latencies[uint32(node.ID)] = g_rpc.GetLatency(node.Addr)
+	}
+
+	sorted := make([]uint32, len(nodeIDs))
+	copy(sorted, nodeIDs)
+	sort.SliceStable(sorted, func(i, j int) bool { return latencies[sorted[i]] < latencies[sorted[j]] })
+	return sorted
+}
+
+// latency and circuit breaker state of every peer this node talked to
+func HandleGetPeers(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		log.Printf("[%s]: Got a request for /internal/peers route with non-get method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := json.Marshal(g_rpc.Stats())
+	if err != nil {
+		log.Println("HandleGetPeers: Failed to serialize peer stats", err.Error())
+		http.Error(response, "Error serializing peer stats", http.StatusInternalServerError)
+		return
+	}
+
+	response.Write(body)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"DBCommon/placement"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const PLACEMENT_VERSION_FILE = "placement" // in the data dir, the placement version the local data is laid out with
+
+var g_placementStorageOpen bool // set once storage opened, placement isn't migrated before then. guarded by g_networkSyncLock
+
+// the placement version of the local data. data dirs from before placement versions hold version 0
+func DB_ReadPlacementVersion() uint32 {
+	contents, err := os.ReadFile(g_dataDir + "/" + PLACEMENT_VERSION_FILE)
+	if err != nil {
+		return 0
+	}
+
+	version, _ := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 32)
+	return uint32(version)
+}
+
+func DB_WritePlacementVersion(version uint32) {
+	err := os.WriteFile(g_dataDir+"/"+PLACEMENT_VERSION_FILE, []byte(strconv.FormatUint(uint64(version), 10)), 0600)
+	if err != nil {
+		log.Printf("DB_WritePlacementVersion: failed to record placement version %d: %s\n", version, err.Error())
+	}
+}
+
+// keys laid out by an older placement strategy than the network's are on the wrong nodes, they are moved
+// once. callers hold g_networkSyncLock
+func DB_MigratePlacement() {
+	if !g_placementStorageOpen {
+		return
+	}
+
+	version := DB_ReadPlacementVersion()
+	if version == g_dbNetwork.PlacementVersion {
+		return
+	}
+
+	log.Printf("DB_MigratePlacement: local data is placed with version %d, the network uses %d, rehashing data\n", version, g_dbNetwork.PlacementVersion)
+	DB_RehashData()
+	DB_WritePlacementVersion(g_dbNetwork.PlacementVersion)
+}
+
+func (node *DBNode) GetWeight() float64 {
+	return placement.GetWeight(node.Weight)
+}
+
+// the nodes as the placement package sees them
+func (network *DBNetwork) GetPlacementNodes() []placement.Node {
+	nodes := make([]placement.Node, 0, len(network.Nodes))
+	for _, node := range network.Nodes {
+		nodes = append(nodes, placement.Node{ID: node.ID, Addr: node.Addr, Zone: node.Zone, Weight: node.Weight})
+	}
+	return nodes
+}
+
+// the first node is the key's primary, the rest are its replicas
+func (entry *DBEntry) GetTargetNodesIn(network *DBNetwork) []uint32 {
+	replicationFactor := network.GetReplicationFactor(entry.Namespace, placement.GetPlacementKey(entry.Key))
+	return placement.GetTargetNodes(network.GetPlacementNodes(), network.NumNodes, entry.Key, replicationFactor)
+}
+
+// true if any node's weight differs between the two networks, the nodes themselves have to be the same
+func WeightsChanged(oldNetwork *DBNetwork, newNetwork *DBNetwork) bool {
+	oldWeights := make(map[string]float64)
+	for _, node := range oldNetwork.Nodes {
+		oldWeights[node.Addr] = node.GetWeight()
+	}
+
+	for _, node := range newNetwork.Nodes {
+		if oldWeights[node.Addr] != node.GetWeight() {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"DBCommon/auth"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a client connection speaking the redis protocol (RESP2)
+type RESPConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	tokenID string // API token the client sent with AUTH
+}
+
+const RESP_MAX_BULK_BYTES = 64 << 20
+const RESP_MAX_ARGS = 1 << 20
+const RESP_MAX_INLINE_BYTES = 64 << 10
+
+// limits until the connection has authenticated, AUTH and the connection commands fit in them
+const RESP_UNAUTHENTICATED_MAX_BULK_BYTES = 4 << 10
+const RESP_UNAUTHENTICATED_MAX_ARGS = 16
+
+var ErrRESPProtocol = errors.New("protocol error")
+
+func StartRESPServer() {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", g_respPort))
+	if err != nil {
+		log.Printf("StartRESPServer: Failed to listen on port %d: %s\n", g_respPort, err.Error())
+		return
+	}
+	listener = TLS_WrapListener(listener, false)
+
+	log.Printf("StartRESPServer: Listening for redis clients on port %d (namespace '%s')\n", g_respPort, g_respNamespace)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("StartRESPServer: Stopped accepting connections: %s\n", err.Error())
+			return
+		}
+
+		go RESP_ServeConn(conn)
+	}
+}
+
+func RESP_ServeConn(conn net.Conn) {
+	defer conn.Close()
+	client := &RESPConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+
+	for {
+		args, err := client.ReadCommand()
+		if err != nil {
+			if errors.Is(err, ErrRESPProtocol) {
+				client.WriteError("ERR Protocol error: " + err.Error())
+				client.writer.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if !RESP_Execute(client, args) {
+			client.writer.Flush()
+			return
+		}
+
+		// pipelined commands are answered together
+		if client.reader.Buffered() == 0 {
+			if err := client.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// whether the connection may send commands of the full size, true for every connection if clients don't
+// have to authenticate
+func (client *RESPConn) IsAuthenticated() bool {
+	if required, _ := Auth_GetState(); !required {
+		return true
+	}
+
+	_, found := Auth_Lookup(client.tokenID)
+	return found
+}
+
+// reads a line of at most RESP_MAX_INLINE_BYTES
+func (client *RESPConn) readLine() (string, error) {
+	line := make([]byte, 0)
+	for {
+		data, err := client.reader.ReadSlice('\n')
+		if len(line)+len(data) > RESP_MAX_INLINE_BYTES {
+			return "", fmt.Errorf("%w: too big inline request", ErrRESPProtocol)
+		}
+		line = append(line, data...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+	}
+}
+
+// reads an array of bulk strings, or an inline command (what telnet sends). the args and their buffers
+// grow as the data arrives, so a client announcing a huge command doesn't get the memory for it up front
+func (client *RESPConn) ReadCommand() ([]string, error) {
+	line, err := client.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	maxArgs, maxBulkBytes := RESP_MAX_ARGS, RESP_MAX_BULK_BYTES
+	if !client.IsAuthenticated() {
+		maxArgs, maxBulkBytes = RESP_UNAUTHENTICATED_MAX_ARGS, RESP_UNAUTHENTICATED_MAX_BULK_BYTES
+	}
+
+	numArgs, err := strconv.Atoi(line[1:])
+	if err != nil || numArgs > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrRESPProtocol)
+	}
+	if numArgs <= 0 {
+		return nil, nil // a null or empty array, ignored like redis does
+	}
+
+	args := make([]string, 0)
+	for i := 0; i < numArgs; i++ {
+		header, err := client.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(header, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", ErrRESPProtocol, header)
+		}
+
+		length, err := strconv.Atoi(header[1:])
+		if err != nil || length < 0 || length > maxBulkBytes {
+			return nil, fmt.Errorf("%w: invalid bulk length", ErrRESPProtocol)
+		}
+
+		data, err := io.ReadAll(io.LimitReader(client.reader, int64(length)+2)) // with the trailing \r\n
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < length+2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if data[length] != '\r' || data[length+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string isn't followed by CRLF", ErrRESPProtocol)
+		}
+		args = append(args, string(data[:length]))
+	}
+
+	return args, nil
+}
+
+func (client *RESPConn) WriteSimple(value string) {
+	client.writer.WriteString("+" + value + "\r\n")
+}
+
+func (client *RESPConn) WriteError(message string) {
+	client.writer.WriteString("-" + message + "\r\n")
+}
+
+func (client *RESPConn) WriteInteger(value int64) {
+	client.writer.WriteString(":" + strconv.FormatInt(value, 10) + "\r\n")
+}
+
+func (client *RESPConn) WriteBulk(value string) {
+	client.writer.WriteString("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+}
+
+func (client *RESPConn) WriteNil() {
+	client.writer.WriteString("$-1\r\n")
+}
+
+func (client *RESPConn) WriteArrayHeader(length int) {
+	client.writer.WriteString("*" + strconv.Itoa(length) + "\r\n")
+}
+
+func (client *RESPConn) WriteWrongArgs(command string) {
+	client.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+}
+
+// runs one command and writes its reply, returns false once the client asked to close the connection
+func RESP_Execute(client *RESPConn, args []string) bool {
+	command := strings.ToUpper(args[0])
+	args = args[1:]
+
+	if command == "AUTH" {
+		RESP_HandleAuth(client, args)
+		return true
+	}
+	if command != "QUIT" && !RESP_Authorize(client, command, args) {
+		return true
+	}
+
+	// connection commands don't touch the namespace and keep working without it
+	if scope, _ := RESP_GetAccess(command, args); len(scope) > 0 && DB_GetStorage(g_respNamespace) == nil {
+		client.WriteError(fmt.Sprintf("ERR namespace '%s' doesn't exist", g_respNamespace))
+		return true
+	}
+
+	switch command {
+	case "PING":
+		if len(args) > 0 {
+			client.WriteBulk(args[0])
+		} else {
+			client.WriteSimple("PONG")
+		}
+	case "ECHO":
+		if len(args) != 1 {
+			client.WriteWrongArgs(command)
+			return true
+		}
+		client.WriteBulk(args[0])
+	case "QUIT":
+		client.WriteSimple("OK")
+		return false
+	case "SELECT":
+		if len(args) != 1 || args[0] != "0" {
+			client.WriteError("ERR only database 0 is supported")
+			return true
+		}
+		client.WriteSimple("OK")
+	case "COMMAND":
+		client.WriteArrayHeader(0) // redis-cli asks for command docs on connect
+	case "GET":
+		if len(args) != 1 {
+			client.WriteWrongArgs(command)
+			return true
+		}
+		RESP_WriteValue(client, DB_Read(g_respNamespace, args[0]))
+	case "MGET":
+		if len(args) == 0 {
+			client.WriteWrongArgs(command)
+			return true
+		}
+		client.WriteArrayHeader(len(args))
+		for _, key := range args {
+			RESP_WriteValue(client, DB_Read(g_respNamespace, key))
+		}
+	case "SET":
+		RESP_HandleSet(client, args)
+	case "MSET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			client.WriteWrongArgs(command)
+			return true
+		}
+		if RESP_RejectIfSaturated(client, len(args)/2) {
+			return true
+		}
+		for i := 0; i < len(args); i += 2 {
+			if RESP_RejectInvalidWrite(client, args[i], args[i+1]) {
+				return true
+			}
+		}
+		for i := 0; i < len(args); i += 2 {
+			if !DB_WriteAllReplicas(DBEntry{Namespace: g_respNamespace, Key: args[i], Value: args[i+1]}) {
+				client.WriteError("ERR failed to write key " + args[i])
+				return true
+			}
+		}
+		client.WriteSimple("OK")
+	case "DEL":
+		if len(args) == 0 {
+			client.WriteWrongArgs(command)
+			return true
+		}
+		deleted := int64(0)
+		for _, key := range args {
+			if DB_Read(g_respNamespace, key) != nil && DB_Delete(g_respNamespace, key) > 0 {
+				deleted++
+			}
+		}
+		client.WriteInteger(deleted)
+	case "EXISTS":
+		if len(args) == 0 {
+			client.WriteWrongArgs(command)
+			return true
+		}
+		found := int64(0)
+		for _, key := range args {
+			if DB_Read(g_respNamespace, key) != nil {
+				found++
+			}
+		}
+		client.WriteInteger(found)
+	case "INCR":
+		if len(args) != 1 {
+			client.WriteWrongArgs(command)
+			return true
+		}
+		RESP_HandleIncr(client, args[0])
+	case "EXPIRE":
+		if len(args) != 2 {
+			client.WriteWrongArgs(command)
+			return true
+		}
+		RESP_HandleExpire(client, args[0], args[1])
+	case "TTL":
+		if len(args) != 1 {
+			client.WriteWrongArgs(command)
+			return true
+		}
+		entry := DB_Read(g_respNamespace, args[0])
+		if entry == nil {
+			client.WriteInteger(-2)
+		} else if entry.ExpiresAt == 0 {
+			client.WriteInteger(-1)
+		} else {
+			client.WriteInteger((entry.ExpiresAt - time.Now().UnixMilli() + 999) / 1000)
+		}
+	case "SCAN":
+		RESP_HandleScan(client, args)
+	default:
+		client.WriteError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(command)))
+	}
+
+	return true
+}
+
+// AUTH <id>.<secret> or AUTH <id> <secret>, so both redis-cli -a and --user/--pass work
+func RESP_HandleAuth(client *RESPConn, args []string) {
+	if len(args) == 0 || len(args) > 2 {
+		client.WriteWrongArgs("AUTH")
+		return
+	}
+	if required, _ := Auth_GetState(); !required {
+		client.WriteError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		return
+	}
+
+	tokenID, err := Auth_Login(strings.Join(args, "."))
+	if err != nil {
+		log.Printf("[%s]: Rejected redis AUTH: %s\n", client.conn.RemoteAddr(), err.Error())
+		client.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+
+	client.tokenID = tokenID
+	client.WriteSimple("OK")
+}
+
+// the scope a command needs and the keys it touches. only connection commands go without a scope and
+// need just a valid token, commands not listed here need admin so new ones don't slip through unchecked
+func RESP_GetAccess(command string, args []string) (string, []string) {
+	switch command {
+	case "PING", "ECHO", "QUIT", "SELECT", "COMMAND":
+		return "", nil
+	case "GET", "TTL", "MGET", "EXISTS":
+		return auth.SCOPE_READ, args
+	case "SCAN":
+		return auth.SCOPE_READ, nil // keys the token may not use are left out of the results
+	case "SET", "INCR", "EXPIRE":
+		if len(args) == 0 {
+			return auth.SCOPE_WRITE, nil
+		}
+		return auth.SCOPE_WRITE, args[:1] // the rest are the value and options
+	case "DEL":
+		return auth.SCOPE_WRITE, args
+	case "MSET":
+		keys := make([]string, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return auth.SCOPE_WRITE, keys
+	default:
+		return auth.SCOPE_ADMIN, nil
+	}
+}
+
+// writes NOAUTH/NOPERM and returns false if the client's token doesn't allow the command. the token is
+// looked up every time, so a revoked token stops working right away
+func RESP_Authorize(client *RESPConn, command string, args []string) bool {
+	if required, _ := Auth_GetState(); !required {
+		return true
+	}
+
+	token, found := Auth_Lookup(client.tokenID)
+	if !found {
+		client.WriteError("NOAUTH Authentication required.")
+		return false
+	}
+
+	scope, keys := RESP_GetAccess(command, args)
+	if len(scope) == 0 {
+		return true
+	}
+	if !token.HasScope(scope) || !token.AllowsNamespace(g_respNamespace) {
+		client.WriteError(fmt.Sprintf("NOPERM this token has no permissions to run the '%s' command", strings.ToLower(command)))
+		return false
+	}
+	for _, key := range keys {
+		if !token.AllowsKey(key) {
+			client.WriteError("NOPERM this token has no permissions to access one of the keys used as arguments")
+			return false
+		}
+	}
+	return true
+}
+
+func RESP_WriteValue(client *RESPConn, entry *DBEntry) {
+	if entry == nil {
+		client.WriteNil()
+	} else {
+		client.WriteBulk(entry.Value)
+	}
+}
+
+// the redis equivalent of the 429/503 /set answers with when the write queue is full
+func RESP_RejectIfSaturated(client *RESPConn, numWrites int) bool {
+	if GetAdmissionStatus(numWrites) == 0 {
+		return false
+	}
+
+	log.Printf("[%s]: Rejecting redis write, write queue is full\n", client.conn.RemoteAddr())
+	client.WriteError(fmt.Sprintf("TRYAGAIN node is busy, retry in %ds", GetRetryAfterSeconds()))
+	return true
+}
+
+// keys of value parts can't be written by clients, and values are capped like on the http routes
+func RESP_RejectInvalidWrite(client *RESPConn, key string, value string) bool {
+	if IsValuePartKey(key) {
+		client.WriteError("ERR key contains a reserved sequence")
+		return true
+	}
+	if int64(len(value)) > g_maxValueSize {
+		client.WriteError(fmt.Sprintf("ERR value is larger than the max value size of %d bytes", g_maxValueSize))
+		return true
+	}
+	return false
+}
+
+// SET key value [EX seconds | PX milliseconds] [NX | XX]
+func RESP_HandleSet(client *RESPConn, args []string) {
+	if len(args) < 2 {
+		client.WriteWrongArgs("SET")
+		return
+	}
+
+	if RESP_RejectInvalidWrite(client, args[0], args[1]) {
+		return
+	}
+
+	entry := DBEntry{Namespace: g_respNamespace, Key: args[0], Value: args[1]}
+	onlyIfMissing, onlyIfExists := false, false
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch option {
+		case "NX":
+			onlyIfMissing = true
+		case "XX":
+			onlyIfExists = true
+		case "EX", "PX":
+			if i+1 >= len(args) || entry.ExpiresAt != 0 {
+				client.WriteError("ERR syntax error")
+				return
+			}
+			i++
+			amount, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || amount <= 0 {
+				client.WriteError("ERR invalid expire time in 'set' command")
+				return
+			}
+
+			ttl := time.Duration(amount) * time.Millisecond
+			if option == "EX" {
+				ttl = time.Duration(amount) * time.Second
+			}
+			entry.ExpiresAt = time.Now().Add(ttl).UnixMilli()
+		default:
+			client.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	if onlyIfMissing && onlyIfExists {
+		client.WriteError("ERR syntax error")
+		return
+	}
+
+	if RESP_RejectIfSaturated(client, 1) {
+		return
+	}
+
+	if onlyIfMissing || onlyIfExists {
+		exists := DB_Read(g_respNamespace, entry.Key) != nil
+		if (onlyIfMissing && exists) || (onlyIfExists && !exists) {
+			client.WriteNil()
+			return
+		}
+	}
+
+	if !DB_WriteAllReplicas(entry) {
+		client.WriteError("ERR write wasn't acknowledged by every replica")
+		return
+	}
+	client.WriteSimple("OK")
+}
+
+func RESP_HandleIncr(client *RESPConn, key string) {
+	if RESP_RejectInvalidWrite(client, key, "") || RESP_RejectIfSaturated(client, 1) {
+		return
+	}
+
+	lock := DB_LockKey(g_respNamespace, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := DBEntry{Namespace: g_respNamespace, Key: key, Value: "0"}
+	if saved := DB_Read(g_respNamespace, key); saved != nil {
+		entry = *saved
+	}
+
+	value, err := strconv.ParseInt(entry.Value, 10, 64)
+	if err != nil {
+		client.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+	if value == 1<<63-1 {
+		client.WriteError("ERR increment or decrement would overflow")
+		return
+	}
+
+	entry.Value = strconv.FormatInt(value+1, 10) // keeps the key's expiry, like redis does
+	if !DB_WriteAllReplicas(entry) {
+		client.WriteError("ERR write wasn't acknowledged by every replica")
+		return
+	}
+	client.WriteInteger(value + 1)
+}
+
+func RESP_HandleExpire(client *RESPConn, key string, seconds string) {
+	ttl, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		client.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+
+	lock := DB_LockKey(g_respNamespace, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := DB_Read(g_respNamespace, key)
+	if entry == nil {
+		client.WriteInteger(0)
+		return
+	}
+
+	if ttl <= 0 {
+		DB_Delete(g_respNamespace, key) // expires right away
+		client.WriteInteger(1)
+		return
+	}
+
+	entry.ExpiresAt = time.Now().Add(time.Duration(ttl) * time.Second).UnixMilli()
+	if !DB_WriteAllReplicas(*entry) {
+		client.WriteError("ERR write wasn't acknowledged by every replica")
+		return
+	}
+	client.WriteInteger(1)
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]. the cursor holds the index of the node being scanned above
+// SCAN_POSITION_BITS and the position in that node's keys below, see DB_ScanLocal
+func RESP_HandleScan(client *RESPConn, args []string) {
+	if len(args) == 0 {
+		client.WriteWrongArgs("SCAN")
+		return
+	}
+
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		client.WriteError("ERR invalid cursor")
+		return
+	}
+
+	match, count := "", SCAN_DEFAULT_COUNT
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			client.WriteError("ERR syntax error")
+			return
+		}
+
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count <= 0 {
+				client.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			client.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	nodeIndex, position := int(cursor>>SCAN_POSITION_BITS), cursor&SCAN_POSITION_MASK
+	keys := make([]string, 0)
+	next := uint64(0)
+	for nodeIndex < len(g_dbNetwork.Nodes) {
+		page := DB_ScanNode(g_respNamespace, nodeIndex, position, count-len(keys), match)
+		if page == nil {
+			client.WriteError(fmt.Sprintf("ERR failed to scan node %d", g_dbNetwork.Nodes[nodeIndex].ID))
+			return
+		}
+		keys = append(keys, page.Keys...)
+
+		if !page.Done {
+			next = uint64(nodeIndex)<<SCAN_POSITION_BITS | page.Next
+			break
+		}
+
+		nodeIndex, position = nodeIndex+1, 0
+		if len(keys) >= count {
+			if nodeIndex < len(g_dbNetwork.Nodes) {
+				next = uint64(nodeIndex) << SCAN_POSITION_BITS
+			}
+			break
+		}
+	}
+
+	if required, _ := Auth_GetState(); required {
+		token, _ := Auth_Lookup(client.tokenID)
+		allowed := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if token.AllowsKey(key) {
+				allowed = append(allowed, key)
+			}
+		}
+		keys = allowed
+	}
+
+	client.WriteArrayHeader(2)
+	client.WriteBulk(strconv.FormatUint(next, 10))
+	client.WriteArrayHeader(len(keys))
+	for _, key := range keys {
+		client.WriteBulk(key)
+	}
+}
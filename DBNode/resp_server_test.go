@@ -0,0 +1,174 @@
+package main
+
+import (
+	"DBCommon/auth"
+	"DBCommon/clustertls"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func testRESPConn(input string) *RESPConn {
+	return &RESPConn{reader: bufio.NewReader(strings.NewReader(input))}
+}
+
+func TestRESPReadCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  [][]string
+	}{
+		{"Multibulk", "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n", [][]string{{"SET", "key", "value"}}},
+		{"BinaryArgument", "*2\r\n$3\r\nGET\r\n$4\r\na\r\nb\r\n", [][]string{{"GET", "a\r\nb"}}},
+		{"EmptyArgument", "*2\r\n$3\r\nGET\r\n$0\r\n\r\n", [][]string{{"GET", ""}}},
+		{"Inline", "PING\r\nGET  key\n", [][]string{{"PING"}, {"GET", "key"}}},
+		{"Pipelined", "*1\r\n$4\r\nPING\r\n*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n", [][]string{{"PING"}, {"ECHO", "hi"}}},
+		{"NullArray", "*-1\r\n*0\r\n*1\r\n$4\r\nPING\r\n", [][]string{nil, nil, {"PING"}}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			client := testRESPConn(test.input)
+			for _, want := range test.want {
+				got, err := client.ReadCommand()
+				if err != nil {
+					t.Fatalf("ReadCommand() = %v", err)
+				}
+				if !equalKeys(got, want) {
+					t.Fatalf("ReadCommand() = %q, want %q", got, want)
+				}
+			}
+			if _, err := client.ReadCommand(); err != io.EOF {
+				t.Fatalf("ReadCommand() at the end of the input = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestRESPReadCommandMalformed(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		protocol bool // the client gets a protocol error, otherwise the connection just ends
+	}{
+		{"BadMultibulkLength", "*x\r\n", true},
+		{"TooManyArgs", "*99999999\r\n", true},
+		{"MissingDollar", "*1\r\n+GET\r\n", true},
+		{"BadBulkLength", "*1\r\n$x\r\n", true},
+		{"NegativeBulkLength", "*1\r\n$-1\r\n", true},
+		{"HugeBulkLength", "*1\r\n$999999999\r\n", true},
+		{"MissingCRLF", "*1\r\n$3\r\nGETxx", true},
+		{"TruncatedBulk", "*1\r\n$10\r\nGET\r\n", false},
+		{"MissingArgument", "*2\r\n$3\r\nGET\r\n", false},
+		{"UnterminatedLine", "*1", false},
+		{"HugeInline", strings.Repeat("x", RESP_MAX_INLINE_BYTES+1) + "\r\n", true},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			args, err := testRESPConn(test.input).ReadCommand()
+			if err == nil {
+				t.Fatalf("ReadCommand() = %q, want an error", args)
+			}
+			if errors.Is(err, ErrRESPProtocol) != test.protocol {
+				t.Fatalf("ReadCommand() = %v, protocol error %v, want %v", err, !test.protocol, test.protocol)
+			}
+		})
+	}
+}
+
+func TestRESPReadCommandBeforeAuth(t *testing.T) {
+	g_tls = &clustertls.Config{} // clients have to authenticate until the tokens are loaded
+	defer func() { g_tls = nil }()
+
+	bulk := strings.Repeat("v", RESP_UNAUTHENTICATED_MAX_BULK_BYTES+1)
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"TooManyArgs", "*17\r\n"},
+		{"BigBulk", fmt.Sprintf("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$%d\r\n%s\r\n", len(bulk), bulk)},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if args, err := testRESPConn(test.input).ReadCommand(); !errors.Is(err, ErrRESPProtocol) {
+				t.Fatalf("ReadCommand() before AUTH = %.20q, %v, want a protocol error", args, err)
+			}
+
+			g_tls = nil
+			defer func() { g_tls = &clustertls.Config{} }()
+			if _, err := testRESPConn(test.input).ReadCommand(); errors.Is(err, ErrRESPProtocol) {
+				t.Fatalf("ReadCommand() without auth required = %v, want the full limits", err)
+			}
+		})
+	}
+
+	args, err := testRESPConn("*2\r\n$4\r\nAUTH\r\n$12\r\ntoken.secret\r\n").ReadCommand()
+	if err != nil || !equalKeys(args, []string{"AUTH", "token.secret"}) {
+		t.Fatalf("ReadCommand() of AUTH = %q, %v, want it read", args, err)
+	}
+}
+
+func TestRESPExecuteWithoutNamespace(t *testing.T) {
+	g_dbNetwork = DBNetwork{}
+	g_respNamespace = "missing"
+	defer func() { g_respNamespace = DEFAULT_NAMESPACE }()
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"ECHO", "hi"}, "$2\r\nhi\r\n"},
+		{[]string{"SELECT", "0"}, "+OK\r\n"},
+		{[]string{"COMMAND"}, "*0\r\n"},
+		{[]string{"QUIT"}, "+OK\r\n"},
+		{[]string{"GET", "key"}, "-ERR namespace 'missing' doesn't exist\r\n"},
+	}
+
+	for _, test := range tests {
+		var output bytes.Buffer
+		client := &RESPConn{writer: bufio.NewWriter(&output)}
+		RESP_Execute(client, test.args)
+		client.writer.Flush()
+		if output.String() != test.want {
+			t.Errorf("RESP_Execute(%q) = %q, want %q", test.args, output.String(), test.want)
+		}
+	}
+}
+
+func TestRESPGetAccess(t *testing.T) {
+	tests := []struct {
+		args  []string
+		scope string
+		keys  []string
+	}{
+		{[]string{"PING"}, "", nil},
+		{[]string{"SELECT", "0"}, "", nil},
+		{[]string{"GET", "a"}, auth.SCOPE_READ, []string{"a"}},
+		{[]string{"MGET", "a", "b"}, auth.SCOPE_READ, []string{"a", "b"}},
+		{[]string{"SCAN", "0"}, auth.SCOPE_READ, nil},
+		{[]string{"SET", "a", "value", "EX", "10"}, auth.SCOPE_WRITE, []string{"a"}},
+		{[]string{"SET"}, auth.SCOPE_WRITE, nil},
+		{[]string{"MSET", "a", "1", "b", "2"}, auth.SCOPE_WRITE, []string{"a", "b"}},
+		{[]string{"DEL", "a", "b"}, auth.SCOPE_WRITE, []string{"a", "b"}},
+		// commands without a listed scope need admin, a token without it can't run ones added later
+		{[]string{"FLUSHALL"}, auth.SCOPE_ADMIN, nil},
+		{[]string{"CONFIG", "SET", "x", "y"}, auth.SCOPE_ADMIN, nil},
+	}
+
+	for _, test := range tests {
+		scope, keys := RESP_GetAccess(test.args[0], test.args[1:])
+		if scope != test.scope || !equalKeys(keys, test.keys) {
+			t.Errorf("RESP_GetAccess(%q) = %q, %q, want %q, %q", test.args, scope, keys, test.scope, test.keys)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"DBCommon/placement"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// one page of a cluster wide key scan
+type DBScanPage struct {
+	Keys []string
+	Next uint64 // position to continue from, meaningless once Done is set
+	Done bool   // no keys left on the node
+}
+
+// keys are scanned in the order of the top SCAN_POSITION_BITS bits of their hash, so a position stays
+// valid while keys are added and removed. the bits above it hold the index of the node being scanned
+const SCAN_POSITION_BITS = 48
+const SCAN_POSITION_MASK = 1<<SCAN_POSITION_BITS - 1
+const SCAN_DEFAULT_COUNT = 10
+const SCAN_MAX_COUNT = 10000
+
+func (entry *DBEntry) GetScanPosition() uint64 {
+	return placement.MixHash(entry.Hash()) >> (64 - SCAN_POSITION_BITS) // fnv barely changes the top bits between similar keys
+}
+
+// turns a glob pattern (* ? [abc] [^a-z] and \ escapes) into a regexp matching whole keys
+func GlobToRegexp(pattern string) (*regexp.Regexp, error) {
+	var builder strings.Builder
+	builder.WriteString("(?s)^")
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '*':
+			builder.WriteString(".*")
+		case '?':
+			builder.WriteString(".")
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+			}
+			builder.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case '[':
+			end := i + 1
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end == len(runes) {
+				builder.WriteString(regexp.QuoteMeta("[")) // unterminated, taken literally
+				continue
+			}
+
+			class := string(runes[i+1 : end])
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			builder.WriteString("[" + class + "]")
+			i = end
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+
+	builder.WriteString("$")
+	return regexp.Compile(builder.String())
+}
+
+// up to count keys of the namespace that this node is the first replica of, starting at position start.
+// keys sharing a position always end up on the same page, so none are skipped when the scan continues
+func DB_ScanLocal(namespace string, start uint64, count int, match *regexp.Regexp) *DBScanPage {
+	chunk := DB_GetLocalChunk(namespace)
+	if chunk == nil {
+		return nil
+	}
+
+	entries := make([]DBEntry, 0)
+	for _, entry := range chunk.Entries {
+		if entry.GetScanPosition() < start || IsValuePartKey(entry.Key) || (match != nil && !match.MatchString(entry.Key)) {
+			continue
+		}
+
+		// every replica has the key, only the first one reports it
+		if targets := entry.GetTargetNodes(); len(targets) == 0 || targets[0] != uint32(g_id) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].GetScanPosition() != entries[j].GetScanPosition() {
+			return entries[i].GetScanPosition() < entries[j].GetScanPosition()
+		}
+		return entries[i].Key < entries[j].Key
+	})
+
+	page := &DBScanPage{Keys: make([]string, 0, count)}
+	for i, entry := range entries {
+		if i >= count && entry.GetScanPosition() != entries[i-1].GetScanPosition() {
+			page.Next = entry.GetScanPosition()
+			return page
+		}
+		page.Keys = append(page.Keys, entry.Key)
+	}
+
+	page.Done = true
+	return page
+}
+
+// scans the node with the given index in the network, locally or over the network
+func DB_ScanNode(namespace string, nodeIndex int, start uint64, count int, match string) *DBScanPage {
+	node := g_dbNetwork.Nodes[nodeIndex]
+	if node.ID != int32(g_id) {
+		return node.ScanKeys(namespace, start, count, match)
+	}
+
+	count, pattern, valid := ParseScanParams(count, match)
+	if !valid {
+		return nil
+	}
+	return DB_ScanLocal(namespace, start, count, pattern)
+}
+
+// parses the params of a scan request, the same for /internal/scan and the binary protocol
+func ParseScanParams(count int, match string) (int, *regexp.Regexp, bool) {
+	if count <= 0 {
+		count = SCAN_DEFAULT_COUNT
+	}
+	if count > SCAN_MAX_COUNT {
+		count = SCAN_MAX_COUNT
+	}
+
+	if len(match) == 0 {
+		return count, nil, true
+	}
+
+	pattern, err := GlobToRegexp(match)
+	if err != nil {
+		return 0, nil, false
+	}
+	return count, pattern, true
+}
+
+func HandleScan(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		log.Printf("[%s]: Got a request for /internal/scan route with non-get method\n", request.RemoteAddr)
+		http.Error(response, "Incorrect method for route", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+	start, err := strconv.ParseUint(query.Get("start"), 10, 64)
+	if err != nil && query.Has("start") {
+		http.Error(response, "Invalid params, start should be a scan position", http.StatusBadRequest)
+		return
+	}
+
+	count, _ := strconv.Atoi(query.Get("count"))
+	count, match, valid := ParseScanParams(count, query.Get("match"))
+	if !valid {
+		http.Error(response, "Invalid params, match should be a glob pattern", http.StatusBadRequest)
+		return
+	}
+
+	page := DB_ScanLocal(query.Get("namespace"), start, count, match)
+	if page == nil {
+		http.Error(response, "Namespace not found", http.StatusNotFound)
+		return
+	}
+
+	body, err := json.Marshal(page)
+	if err != nil {
+		log.Println("HandleScan: Failed to serialize scan page", err.Error())
+		http.Error(response, "Error serializing scan page", http.StatusInternalServerError)
+		return
+	}
+
+	response.Write(body)
+}
@@ -0,0 +1,31 @@
+//go:build cgo
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// sqlite keeps one connection per process, so every sqlite engine of the tests lives in this directory.
+// it outlives the tests, the job executor never stops using it
+var g_testSqliteDir string
+
+func init() {
+	g_testEngines = append(g_testEngines, engineFactory{STORAGE_ENGINE_SQLITE, func(t *testing.T, namespace string) StorageEngine {
+		if len(g_testSqliteDir) == 0 {
+			dir, err := os.MkdirTemp("", "DBNode-sqlite-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			g_testSqliteDir = dir
+		}
+
+		g_dataDir = g_testSqliteDir
+		engine := MakeSqliteEngine(namespace)
+		if !engine.Open() {
+			t.Fatalf("failed to open sqlite engine in %s", g_testSqliteDir)
+		}
+		return engine
+	}})
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type SqliteJobType uint8
+
+const (
+	SQLITE_WRITE           SqliteJobType = iota
+	SQLITE_DELETE          SqliteJobType = iota
+	SQLITE_TRIM_CHANGE_LOG SqliteJobType = iota
+	SQLITE_REENCRYPT       SqliteJobType = iota
+	SQLITE_DROP            SqliteJobType = iota // a delete that is logged as CHANGE_OP_DROP
+)
+
+type SqliteJob struct {
+	entry     DBEntry             // entry that this job operates on (its namespace picks the table), can be partially invalid depending on the job type
+	encoding  SqliteValueEncoding // how the value of a write is stored
+	jobType   SqliteJobType
+	createdAt int64     // unix timestamp (in sec) when the job was queued
+	done      chan bool // if set, receives whether the job was committed once its batch is done
+	table     string    // table a re-encryption job rewrites rows of
+	rowIDs    []int64   // rows a re-encryption job rewrites
+}
+
+type SqliteJobExecutor struct {
+	conn               *sql.DB
+	jobQueue           *list.List
+	jobQueueLock       sync.Mutex
+	newJobNotification chan bool    // holds one pending wakeup, so a job queued while NextBatch is between unlocking and waiting isn't missed
+	waitTime           atomic.Int64 // last known wait time for jobs in seconds (time diff between being queued and executed)
+	stats              WriteQueueStats
+	statsLock          sync.Mutex
+}
+
+// a group of jobs applied in a single transaction, statements are prepared once per batch
+type SqliteBatch struct {
+	tx               *sql.Tx
+	tables           map[string]*SqliteTableStatements // prepared the first time a job touches the namespace
+	appendChangeStmt *sql.Stmt
+}
+
+type SqliteTableStatements struct {
+	writeStmt  *sql.Stmt
+	deleteStmt *sql.Stmt
+}
+
+type WriteQueueStats struct {
+	QueueDepth       int
+	QueueLimit       int
+	RejectedJobs     int64 // writes refused because the queue was full
+	LastBatchSize    int
+	MaxBatchSize     int
+	TotalBatches     int64
+	TotalJobs        int64
+	AvgBatchSize     float64
+	FailedBatches    int64 // batches that had to be retried job by job
+	ApproxWriteDelay string
+}
+
+var g_sqlJobExecutor *SqliteJobExecutor
+
+var ErrWriteQueueFull = errors.New("sqlite write queue is full")
+
+func MakeSqliteJobExecutor(conn *sql.DB) *SqliteJobExecutor {
+	return &SqliteJobExecutor{conn: conn, jobQueue: list.New().Init(), newJobNotification: make(chan bool, 1)}
+}
+
+// writes and deletes are refused once the queue holds g_maxQueuedJobs, housekeeping jobs always get in
+func (executor *SqliteJobExecutor) QueueJob(job SqliteJob) error {
+	executor.jobQueueLock.Lock()
+	defer executor.jobQueueLock.Unlock()
+
+	if job.jobType != SQLITE_TRIM_CHANGE_LOG && executor.jobQueue.Len() >= int(g_maxQueuedJobs) {
+		return ErrWriteQueueFull
+	}
+
+	executor.jobQueue.PushBack(job)
+	select {
+	case executor.newJobNotification <- true:
+		return nil
+	default:
+		return nil
+	}
+}
+
+// blocks until there is at least one job, then keeps collecting jobs until the batch is
+// full or the batch window has passed since the first job was picked up
+func (executor *SqliteJobExecutor) NextBatch() []SqliteJob {
+	executor.jobQueueLock.Lock()
+	for executor.jobQueue.Len() == 0 {
+		executor.jobQueueLock.Unlock()
+		<-executor.newJobNotification
+		executor.jobQueueLock.Lock()
+	}
+
+	batch := make([]SqliteJob, 0, executor.jobQueue.Len())
+	deadline := time.Now().Add(g_batchWindow)
+	for {
+		for executor.jobQueue.Len() > 0 && len(batch) < int(g_batchMaxJobs) {
+			nextItem := executor.jobQueue.Front()
+			batch = append(batch, nextItem.Value.(SqliteJob))
+			executor.jobQueue.Remove(nextItem)
+		}
+
+		remaining := time.Until(deadline)
+		if len(batch) >= int(g_batchMaxJobs) || remaining <= 0 {
+			break
+		}
+
+		executor.jobQueueLock.Unlock()
+		select {
+		case <-executor.newJobNotification:
+		case <-time.After(remaining):
+		}
+		executor.jobQueueLock.Lock()
+	}
+	executor.jobQueueLock.Unlock()
+
+	return batch
+}
+
+func (executor *SqliteJobExecutor) Run() {
+	for {
+		batch := executor.NextBatch()
+		executor.waitTime.Store(time.Now().Unix() - batch[0].createdAt)
+
+		succeeded := executor.ExecuteBatch(batch)
+		if !succeeded && len(batch) > 1 {
+			// one bad job shouldn't sink the rest of the batch, retry them individually
+			for _, job := range batch {
+				job.Complete(executor.ExecuteBatch([]SqliteJob{job}))
+			}
+		} else {
+			for _, job := range batch {
+				job.Complete(succeeded)
+			}
+		}
+
+		executor.RecordBatch(len(batch), succeeded)
+	}
+}
+
+// done is buffered, so a job whose waiter gave up completes without blocking the executor
+func (job *SqliteJob) Complete(committed bool) {
+	if job.done != nil {
+		job.done <- committed
+	}
+}
+
+// applies every job in a single transaction, returns false (and rolls back) if any job fails
+func (executor *SqliteJobExecutor) ExecuteBatch(jobs []SqliteJob) bool {
+	batch, err := executor.BeginBatch()
+	if err != nil {
+		log.Printf("SqliteJobExecutor: Failed to start batch of %d jobs: %s\n", len(jobs), err.Error())
+		return false
+	}
+
+	for _, job := range jobs {
+		success := false
+		switch job.jobType {
+		case SQLITE_WRITE:
+			success = Sqlite_WriteInternal(batch, job.entry, job.encoding)
+		case SQLITE_DELETE:
+			success = Sqlite_DeleteInternal(batch, job.entry.Namespace, job.entry.Key, CHANGE_OP_DELETE)
+		case SQLITE_DROP:
+			success = Sqlite_DeleteInternal(batch, job.entry.Namespace, job.entry.Key, CHANGE_OP_DROP)
+		case SQLITE_TRIM_CHANGE_LOG:
+			success = Sqlite_TrimChangeLogInternal(batch, job.createdAt-int64(g_changeLogRetention.Seconds()))
+		case SQLITE_REENCRYPT:
+			success = Sqlite_ReencryptInternal(batch, job.table, job.rowIDs)
+		default:
+			success = true // should never get here
+		}
+
+		if !success {
+			batch.Rollback()
+			return false
+		}
+	}
+
+	err = batch.Commit()
+	if err != nil {
+		log.Printf("SqliteJobExecutor: Failed to commit batch of %d jobs: %s\n", len(jobs), err.Error())
+		return false
+	}
+
+	return true
+}
+
+func (executor *SqliteJobExecutor) BeginBatch() (*SqliteBatch, error) {
+	tx, err := executor.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &SqliteBatch{tx: tx, tables: make(map[string]*SqliteTableStatements)}
+	if batch.appendChangeStmt, err = tx.Prepare("INSERT INTO KVChangeLog (op, key, value, timestamp, namespace, parts, compression, key_id, expires_at, flags, content_type) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);"); err != nil {
+		batch.Rollback()
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+func (batch *SqliteBatch) GetTableStatements(namespace string) (*SqliteTableStatements, error) {
+	if statements, found := batch.tables[namespace]; found {
+		return statements, nil
+	}
+
+	table := Sqlite_GetTableName(namespace)
+	statements := &SqliteTableStatements{}
+	batch.tables[namespace] = statements // registered first so a half prepared set still gets closed
+
+	var err error
+	if statements.writeStmt, err = batch.tx.Prepare(fmt.Sprintf("REPLACE INTO `%s` (key, value, expires_at, flags, content_type, parts, compression, key_id, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);", table)); err != nil {
+		return nil, err
+	}
+	if statements.deleteStmt, err = batch.tx.Prepare(fmt.Sprintf("DELETE FROM `%s` WHERE key = ?", table)); err != nil {
+		return nil, err
+	}
+
+	return statements, nil
+}
+
+func (batch *SqliteBatch) CloseStatements() {
+	statements := []*sql.Stmt{batch.appendChangeStmt}
+	for _, table := range batch.tables {
+		statements = append(statements, table.writeStmt, table.deleteStmt)
+	}
+
+	for _, stmt := range statements {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
+
+func (batch *SqliteBatch) Commit() error {
+	batch.CloseStatements()
+	return batch.tx.Commit()
+}
+
+func (batch *SqliteBatch) Rollback() {
+	batch.CloseStatements()
+	batch.tx.Rollback()
+}
+
+func (executor *SqliteJobExecutor) RecordBatch(size int, succeeded bool) {
+	executor.statsLock.Lock()
+	defer executor.statsLock.Unlock()
+
+	executor.stats.LastBatchSize = size
+	if size > executor.stats.MaxBatchSize {
+		executor.stats.MaxBatchSize = size
+	}
+	executor.stats.TotalBatches++
+	executor.stats.TotalJobs += int64(size)
+	if !succeeded {
+		executor.stats.FailedBatches++
+	}
+}
+
+func (executor *SqliteJobExecutor) RecordRejectedJob() {
+	executor.statsLock.Lock()
+	defer executor.statsLock.Unlock()
+
+	executor.stats.RejectedJobs++
+}
+
+func (executor *SqliteJobExecutor) QueueDepth() int {
+	executor.jobQueueLock.Lock()
+	defer executor.jobQueueLock.Unlock()
+
+	return executor.jobQueue.Len()
+}
+
+func (executor *SqliteJobExecutor) Stats() WriteQueueStats {
+	queueDepth := executor.QueueDepth()
+
+	executor.statsLock.Lock()
+	defer executor.statsLock.Unlock()
+
+	stats := executor.stats
+	stats.QueueDepth = queueDepth
+	stats.QueueLimit = int(g_maxQueuedJobs)
+	if stats.TotalBatches > 0 {
+		stats.AvgBatchSize = float64(stats.TotalJobs) / float64(stats.TotalBatches)
+	}
+	stats.ApproxWriteDelay = GetApproxWriteDelay()
+
+	return stats
+}
+
+// seconds a client should wait before retrying a write the queue had no room for
+func GetRetryAfterSeconds() int {
+	if g_sqlJobExecutor == nil || g_sqlJobExecutor.waitTime.Load() < 1 {
+		return 1
+	}
+
+	return int(g_sqlJobExecutor.waitTime.Load())
+}
+
+func GetApproxWriteDelay() string {
+	if g_sqlJobExecutor == nil {
+		return time.Duration(0).String()
+	}
+
+	return time.Duration(g_sqlJobExecutor.waitTime.Load() * int64(time.Second)).String()
+}
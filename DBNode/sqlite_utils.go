@@ -1,9 +1,11 @@
 package main
 
 import (
-	"container/list"
+	"DBCommon/compression"
+	"DBCommon/encryption"
 	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"sync"
@@ -12,103 +14,179 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-type SqliteJobType uint8
-
-const (
-	SQLITE_WRITE  SqliteJobType = iota
-	SQLITE_DELETE SqliteJobType = iota
-)
-
-type SqliteJob struct {
-	entry     DBEntry // entry that this job operates on, can be partially invalid depending on the job type
-	jobType   SqliteJobType
-	createdAt int64 // unix timestamp (in sec) when the job was queued
-}
-
-type SqliteJobExecutor struct {
-	conn               *sql.DB
-	jobQueue           *list.List
-	jobQueueLock       sync.Mutex
-	newJobNotification chan bool
-	waitTime           int64 // last known wait time for jobs in seconds (time diff between being queued and executed)
-}
-
-const DBFilePath = "/virtual/guptalak"
 const DBFileName = "KVStore.db"
 const SQLITE_FILE_PREFIX = "file:"
 const SQLITE_PRAGMA_ARGS = "?_journal_mode=WAL&_synchronous=NORMAL"
+const SQLITE_SECURE_DELETE_ARG = "&_secure_delete=true"
+const SQLITE_DEFAULT_TABLE = "KVStore"
+const SQLITE_TRIMMED_THROUGH = "trimmed_through" // KVChangeLogState row with the last seq trimmed from the change log
 
 var g_localDB *sql.DB = nil
-var g_sqlJobExecutor SqliteJobExecutor
+var g_sqliteConnectOnce sync.Once // every namespace shares one connection and job executor
 
-func (executor *SqliteJobExecutor) QueueJob(job SqliteJob) {
-	executor.jobQueueLock.Lock()
-	defer executor.jobQueueLock.Unlock()
+func AssertNoError(err error, msg string) {
+	if err != nil {
+		log.Fatalf(msg+": %s\n", err.Error())
+	}
+}
 
-	executor.jobQueue.PushBack(job)
-	select {
-	case executor.newJobNotification <- true:
-		return
-	default:
+func Sqlite_InitDBFile() {
+	if g_localDB == nil {
+		log.Println("Sqlite_InitDBFile: tried to init local db file without active conn to db")
 		return
 	}
+
+	AssertNoError(Sqlite_CreateTable(SQLITE_DEFAULT_TABLE), "Failed to create KVStore table")
 }
 
-func (executor *SqliteJobExecutor) Run() {
-	for {
-		if executor.jobQueue.Len() > 0 {
-			executor.jobQueueLock.Lock()
+// the default namespace lives in KVStore, every other namespace in its own KVStore_<name> table.
+// namespace names are validated by the controller, so they are safe to use in a table name
+func Sqlite_GetTableName(namespace string) string {
+	if namespace == DEFAULT_NAMESPACE {
+		return SQLITE_DEFAULT_TABLE
+	}
 
-			nextItem := executor.jobQueue.Front()
-			var job SqliteJob = nextItem.Value.(SqliteJob)
-			executor.jobQueue.Remove(nextItem)
+	return SQLITE_DEFAULT_TABLE + "_" + namespace
+}
 
-			executor.jobQueueLock.Unlock()
-			executor.waitTime = time.Now().Unix() - job.createdAt
+func Sqlite_CreateTable(table string) error {
+	_, err := g_localDB.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` (`key` TEXT PRIMARY KEY, `value` BLOB NOT NULL, `expires_at` INTEGER NOT NULL DEFAULT 0, `flags` INTEGER NOT NULL DEFAULT 0, `content_type` TEXT NOT NULL DEFAULT '', `parts` INTEGER NOT NULL DEFAULT 0, `compression` INTEGER NOT NULL DEFAULT 0, `key_id` INTEGER NOT NULL DEFAULT 0, `updated_at` INTEGER NOT NULL DEFAULT 0)", table))
+	return err
+}
 
-			switch job.jobType {
-			case SQLITE_WRITE:
-				Sqlite_WriteInternal(job.entry)
-				continue
-			case SQLITE_DELETE:
-				Sqlite_DeleteInternal(job.entry.Key)
-				continue
-			default:
-				continue // should never get here
-			}
-		} else {
-			<-executor.newJobNotification
+func Sqlite_HasColumn(table string, column string) (bool, error) {
+	rows, err := g_localDB.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
 		}
 	}
+
+	return false, rows.Err()
 }
 
-func GetApproxWriteDelay() string {
-	return time.Duration(g_sqlJobExecutor.waitTime * int64(time.Second)).String()
+// adds the column to a table created by an older version of the node, no-op if it's already there
+func Sqlite_AddColumnIfMissing(table string, column string, definition string) error {
+	exists, err := Sqlite_HasColumn(table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	log.Printf("Sqlite_AddColumnIfMissing: adding column %s to %s\n", column, table)
+	_, err = g_localDB.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", table, column, definition))
+	return err
 }
 
-func AssertNoError(err error, msg string) {
+// brings db files written by older versions of the node up to the current schema
+func Sqlite_Migrate() {
+	err := Sqlite_MigrateTable(SQLITE_DEFAULT_TABLE)
+	AssertNoError(err, "Failed to migrate KVStore table")
+
+	err = Sqlite_AddColumnIfMissing("KVChangeLog", "namespace", "TEXT NOT NULL DEFAULT ''")
+	AssertNoError(err, "Failed to migrate KVChangeLog table")
+
+	err = Sqlite_AddColumnIfMissing("KVChangeLog", "parts", "INTEGER NOT NULL DEFAULT 0")
+	AssertNoError(err, "Failed to migrate KVChangeLog table")
+
+	err = Sqlite_AddColumnIfMissing("KVChangeLog", "compression", "INTEGER NOT NULL DEFAULT 0")
+	AssertNoError(err, "Failed to migrate KVChangeLog table")
+
+	err = Sqlite_AddColumnIfMissing("KVChangeLog", "key_id", "INTEGER NOT NULL DEFAULT 0")
+	AssertNoError(err, "Failed to migrate KVChangeLog table")
+
+	for _, column := range []string{"expires_at", "flags"} {
+		err = Sqlite_AddColumnIfMissing("KVChangeLog", column, "INTEGER NOT NULL DEFAULT 0")
+		AssertNoError(err, "Failed to migrate KVChangeLog table")
+	}
+
+	err = Sqlite_AddColumnIfMissing("KVChangeLog", "content_type", "TEXT NOT NULL DEFAULT ''")
+	AssertNoError(err, "Failed to migrate KVChangeLog table")
+}
+
+// brings a table of entries up to the current schema
+func Sqlite_MigrateTable(table string) error {
+	err := Sqlite_AddColumnIfMissing(table, "expires_at", "INTEGER NOT NULL DEFAULT 0")
 	if err != nil {
-		log.Fatalf(msg+": %s\n", err.Error())
+		return err
+	}
+
+	err = Sqlite_AddColumnIfMissing(table, "flags", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = Sqlite_AddColumnIfMissing(table, "content_type", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+
+	err = Sqlite_AddColumnIfMissing(table, "parts", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = Sqlite_AddColumnIfMissing(table, "compression", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	err = Sqlite_AddColumnIfMissing(table, "key_id", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	// unix timestamp (in ms) of the last write, restores keep the newest copy of a key across replicas by it
+	err = Sqlite_AddColumnIfMissing(table, "updated_at", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
 	}
+
+	// only entries that expire are indexed, Sqlite_ReadExpiredKeys doesn't go through the rest
+	_, err = g_localDB.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS `%s_expires_at` ON `%s` (`expires_at`) WHERE `expires_at` > 0", table, table))
+	return err
 }
 
-func Sqlite_InitDBFile() {
+// change log is created separately from KVStore so that db files from before it existed get one too
+func Sqlite_InitChangeLog() {
 	if g_localDB == nil {
-		log.Println("Sqlite_InitDBFile: tried to init local db file without active conn to db")
+		log.Println("Sqlite_InitChangeLog: tried to init change log without active conn to db")
 		return
 	}
 
-	_, err := g_localDB.Exec("CREATE TABLE `KVStore` (`key` TEXT PRIMARY KEY, `value` TEXT NOT NULL)")
-	AssertNoError(err, "Failed to create KVStore table")
+	_, err := g_localDB.Exec("CREATE TABLE IF NOT EXISTS `KVChangeLog` (`seq` INTEGER PRIMARY KEY AUTOINCREMENT, `op` INTEGER NOT NULL, `key` TEXT NOT NULL, `value` TEXT NOT NULL, `timestamp` INTEGER NOT NULL)")
+	AssertNoError(err, "Failed to create KVChangeLog table")
+
+	_, err = g_localDB.Exec("CREATE INDEX IF NOT EXISTS `KVChangeLogTimestamp` ON `KVChangeLog` (`timestamp`)")
+	AssertNoError(err, "Failed to create KVChangeLog index")
+
+	// remembers how far the log was trimmed, so an empty log still tells readers which changes are gone
+	_, err = g_localDB.Exec("CREATE TABLE IF NOT EXISTS `KVChangeLogState` (`name` TEXT PRIMARY KEY, `value` INTEGER NOT NULL)")
+	AssertNoError(err, "Failed to create KVChangeLogState table")
 }
 
 func Sqlite_Connect() bool {
+	g_sqliteConnectOnce.Do(Sqlite_ConnectInternal)
+	return g_localDB != nil
+}
+
+func Sqlite_ConnectInternal() {
+	os.MkdirAll(g_dataDir, 0700)
+	LockDataDir(g_dataDir)
+
 	shouldInitDB := false
-	fullPath := DBFilePath + "/" + DBFileName
+	fullPath := g_dataDir + "/" + DBFileName
 	if _, err := os.Stat(fullPath); errors.Is(err, os.ErrNotExist) {
 		log.Println("SQLite3 db file doesn't exist, creating one")
 
-		os.MkdirAll(DBFilePath, 0700)
 		dbfile, err := os.Create(fullPath)
 		AssertNoError(err, "Failed to create database file")
 		dbfile.Close()
@@ -119,7 +197,12 @@ func Sqlite_Connect() bool {
 		log.Println("SQLite3 db file already exists, reusing it")
 	}
 
-	db, err := sql.Open("sqlite3", SQLITE_FILE_PREFIX+fullPath+SQLITE_PRAGMA_ARGS)
+	pragmaArgs := SQLITE_PRAGMA_ARGS
+	if g_keyring != nil {
+		pragmaArgs += SQLITE_SECURE_DELETE_ARG // plaintext of re-encrypted and deleted rows doesn't linger in free pages
+	}
+
+	db, err := sql.Open("sqlite3", SQLITE_FILE_PREFIX+fullPath+pragmaArgs)
 	if err != nil {
 		log.Fatalf("Sqlite_Connect: Failed to connect to local sqlite3 database due to error: %s\n", err.Error())
 	}
@@ -129,11 +212,17 @@ func Sqlite_Connect() bool {
 	if shouldInitDB {
 		Sqlite_InitDBFile()
 	}
+	Sqlite_InitChangeLog()
+	Sqlite_Migrate()
+	Sqlite_CheckEncryptionKeys()
 
-	g_sqlJobExecutor = SqliteJobExecutor{conn: g_localDB, jobQueue: list.New().Init(), newJobNotification: make(chan bool)}
+	g_sqlJobExecutor = MakeSqliteJobExecutor(g_localDB)
 	go g_sqlJobExecutor.Run()
+	go ChangeLog_RunRetention()
 
-	return true
+	if g_keyring != nil {
+		Encryption_StartRotation() // picks up rows written before encryption was on or under an older key
+	}
 }
 
 func Sqlite_Write(entry DBEntry) bool {
@@ -142,37 +231,105 @@ func Sqlite_Write(entry DBEntry) bool {
 		return false
 	}
 
-	if len(entry.Key) == 0 || len(entry.Value) == 0 {
-		log.Println("Sqlite_Write: tried to write entry with empty value or key")
+	if len(entry.Key) == 0 {
+		log.Println("Sqlite_Write: tried to write entry with empty key")
 		return false
 	}
 
-	Sqlite_NewJob(entry, SQLITE_WRITE)
+	return Sqlite_QueueJob(Sqlite_MakeWriteJob(entry))
+}
+
+// how a value is stored, values are compressed first and the result is encrypted
+type SqliteValueEncoding struct {
+	codec compression.Codec
+	keyID uint32 // encryption.NO_KEY if the value isn't encrypted
+}
+
+// the value is compressed and encrypted before the write is queued, so the executor doesn't spend its time on it
+func Sqlite_MakeWriteJob(entry DBEntry) SqliteJob {
+	job := SqliteJob{entry: entry, jobType: SQLITE_WRITE, createdAt: time.Now().Unix()}
+	job.entry.Value, job.encoding.codec = Compression_EncodeValue(entry.Value)
+	job.entry.Value, job.encoding.keyID = Encryption_EncryptValue(entry.Key, job.entry.Value)
+	return job
+}
+
+// reads hand values out as they were written
+func Sqlite_DecodeValue(key string, value *string, encoding SqliteValueEncoding) error {
+	decrypted, err := Encryption_DecryptValue(key, *value, encoding.keyID)
+	if err != nil {
+		return err
+	}
+
+	decoded, err := Compression_DecodeValue(decrypted, encoding.codec)
+	if err != nil {
+		return err
+	}
 
-	return true
+	*value = decoded
+	return nil
 }
 
-func Sqlite_WriteInternal(entry DBEntry) bool {
+// queues the write and waits for the executor to commit the batch it ended up in
+func Sqlite_WriteAndWait(entry DBEntry) bool {
 	if g_localDB == nil {
-		log.Println("Sqlite_Write: tried to write without active conn to db")
+		log.Println("Sqlite_WriteAndWait: tried to write without active conn to db")
 		return false
 	}
 
-	if len(entry.Key) == 0 || len(entry.Value) == 0 {
-		log.Println("Sqlite_Write: tried to write entry with empty value or key")
+	if len(entry.Key) == 0 {
+		log.Println("Sqlite_WriteAndWait: tried to write entry with empty key")
 		return false
 	}
 
-	_, err := g_localDB.Exec("REPLACE INTO KVStore (key, value) VALUES (?, ?);", entry.Key, entry.Value)
+	job := Sqlite_MakeWriteJob(entry)
+	done := make(chan bool, 1)
+	job.done = done
+	err := g_sqlJobExecutor.QueueJob(job)
 	if err != nil {
-		log.Printf("Sqlite_Write: Failed to insert (%s, %s) to db: %s\n", entry.Key, entry.Value, err.Error())
+		log.Printf("Sqlite_WriteAndWait: failed to queue write for key=%s: %s\n", entry.Key, err.Error())
+		g_sqlJobExecutor.RecordRejectedJob()
 		return false
 	}
 
-	return true
+	return Sqlite_WaitForJob(done, "Sqlite_WriteAndWait", entry.Key)
+}
+
+// waits up to g_durableWriteTimeout for a job to be committed. a job that misses the deadline is still
+// applied later, the caller just can't report it as durable
+func Sqlite_WaitForJob(done chan bool, caller string, key string) bool {
+	select {
+	case committed := <-done:
+		return committed
+	case <-time.After(g_durableWriteTimeout):
+		log.Printf("%s: key=%s wasn't committed within %s\n", caller, key, g_durableWriteTimeout)
+		return false
+	}
 }
 
-func Sqlite_Read(key string) *DBEntry {
+// entry.Value is already encoded as encoding says
+func Sqlite_WriteInternal(batch *SqliteBatch, entry DBEntry, encoding SqliteValueEncoding) bool {
+	if len(entry.Key) == 0 {
+		log.Println("Sqlite_Write: tried to write entry with empty key")
+		return false
+	}
+
+	statements, err := batch.GetTableStatements(entry.Namespace)
+	if err != nil {
+		log.Printf("Sqlite_Write: Failed to prepare statements for namespace %s: %s\n", entry.Namespace, err.Error())
+		return false
+	}
+
+	timestamp := time.Now().UnixMilli()
+	_, err = statements.writeStmt.Exec(entry.Key, []byte(entry.Value), entry.ExpiresAt, entry.Flags, entry.ContentType, entry.Parts, encoding.codec, encoding.keyID, timestamp)
+	if err != nil {
+		log.Printf("Sqlite_Write: Failed to insert key=%s (%d bytes) to db: %s\n", entry.Key, len(entry.Value), err.Error())
+		return false
+	}
+
+	return Sqlite_AppendChange(batch, CHANGE_OP_WRITE, entry, encoding, timestamp)
+}
+
+func Sqlite_Read(namespace string, key string) *DBEntry {
 	if g_localDB == nil {
 		log.Println("Sqlite_Read: tried to read without active conn to db")
 		return nil
@@ -183,48 +340,322 @@ func Sqlite_Read(key string) *DBEntry {
 		return nil
 	}
 
-	row := g_localDB.QueryRow("SELECT * FROM KVStore WHERE key = ?", key)
-	entry := DBEntry{}
+	row := g_localDB.QueryRow(fmt.Sprintf("SELECT key, value, expires_at, flags, content_type, parts, compression, key_id FROM `%s` WHERE key = ?", Sqlite_GetTableName(namespace)), key)
+	entry := DBEntry{Namespace: namespace}
+	var encoding SqliteValueEncoding
 
-	err := row.Scan(&entry.Key, &entry.Value)
+	err := row.Scan(&entry.Key, &entry.Value, &entry.ExpiresAt, &entry.Flags, &entry.ContentType, &entry.Parts, &encoding.codec, &encoding.keyID)
+	if err == nil {
+		err = Sqlite_DecodeValue(entry.Key, &entry.Value, encoding)
+	}
 	if err == sql.ErrNoRows {
 		log.Printf("Sqlite_Read: no entry found in db with key=%s\n", key)
 		return nil
 	}
+	if err != nil {
+		log.Printf("Sqlite_Read: failed to read key=%s: %s\n", key, err.Error())
+		return nil
+	}
 
 	return &entry
 }
 
-func Sqlite_ReadAll() *DBChunk {
+func Sqlite_ReadAll(namespace string) *DBChunk {
 	if g_localDB == nil {
 		log.Println("Sqlite_ReadAll: tried to read without active conn to db")
 		return nil
 	}
 
-	rows, err := g_localDB.Query("SELECT * FROM KVStore")
+	rows, err := g_localDB.Query(fmt.Sprintf("SELECT key, value, expires_at, flags, content_type, parts, compression, key_id FROM `%s`", Sqlite_GetTableName(namespace)))
 	if err != nil {
 		log.Printf("Sqlite_ReadAll: failed to fetch entries from database")
 		return nil
 	}
+	defer rows.Close()
 
 	var data DBChunk
 	data.Entries = make([]DBEntry, 0)
 	for rows.Next() {
-		var key string
-		var value string
-		err := rows.Scan(&key, &value)
+		entry := DBEntry{Namespace: namespace}
+		var encoding SqliteValueEncoding
+		err := rows.Scan(&entry.Key, &entry.Value, &entry.ExpiresAt, &entry.Flags, &entry.ContentType, &entry.Parts, &encoding.codec, &encoding.keyID)
+		if err == nil {
+			err = Sqlite_DecodeValue(entry.Key, &entry.Value, encoding)
+		}
 		if err != nil {
 			log.Printf("Sqlite_ReadAll: error while building DBChunk: %s\n", err.Error())
 			continue
 		}
 
-		data.Entries = append(data.Entries, DBEntry{Key: key, Value: value})
+		data.Entries = append(data.Entries, entry)
+	}
+
+	return &data
+}
+
+// returns every entry whose key starts with prefix
+func Sqlite_Scan(namespace string, prefix string) *DBChunk {
+	if len(prefix) == 0 {
+		return Sqlite_ReadAll(namespace)
+	}
+
+	if g_localDB == nil {
+		log.Println("Sqlite_Scan: tried to read without active conn to db")
+		return nil
+	}
+
+	// keys compare byte by byte, so every key with the prefix sorts between it and the prefix's successor.
+	// substr would count characters instead of bytes
+	query := fmt.Sprintf("SELECT key, value, expires_at, flags, content_type, parts, compression, key_id FROM `%s` WHERE key >= ?", Sqlite_GetTableName(namespace))
+	args := []any{prefix}
+	if upperBound, found := GetPrefixUpperBound(prefix); found {
+		query += " AND key < ?"
+		args = append(args, upperBound)
+	}
+
+	rows, err := g_localDB.Query(query, args...)
+	if err != nil {
+		log.Printf("Sqlite_Scan: failed to fetch entries with prefix %s from database\n", prefix)
+		return nil
+	}
+	defer rows.Close()
+
+	var data DBChunk
+	data.Entries = make([]DBEntry, 0)
+	for rows.Next() {
+		entry := DBEntry{Namespace: namespace}
+		var encoding SqliteValueEncoding
+		err := rows.Scan(&entry.Key, &entry.Value, &entry.ExpiresAt, &entry.Flags, &entry.ContentType, &entry.Parts, &encoding.codec, &encoding.keyID)
+		if err == nil {
+			err = Sqlite_DecodeValue(entry.Key, &entry.Value, encoding)
+		}
+		if err != nil {
+			log.Printf("Sqlite_Scan: error while building DBChunk: %s\n", err.Error())
+			continue
+		}
+
+		data.Entries = append(data.Entries, entry)
 	}
 
 	return &data
 }
 
-func Sqlite_Delete(key string) bool {
+// like Sqlite_Scan, without reading the values
+func Sqlite_ScanKeys(namespace string, prefix string) []string {
+	if g_localDB == nil {
+		log.Println("Sqlite_ScanKeys: tried to read without active conn to db")
+		return nil
+	}
+
+	query := fmt.Sprintf("SELECT key FROM `%s` WHERE key >= ?", Sqlite_GetTableName(namespace))
+	args := []any{prefix}
+	if upperBound, found := GetPrefixUpperBound(prefix); found {
+		query += " AND key < ?"
+		args = append(args, upperBound)
+	}
+
+	rows, err := g_localDB.Query(query, args...)
+	if err != nil {
+		log.Printf("Sqlite_ScanKeys: failed to fetch keys with prefix %s from database\n", prefix)
+		return nil
+	}
+	defer rows.Close()
+
+	return Sqlite_ReadKeys("Sqlite_ScanKeys", rows)
+}
+
+// keys of the entries that expired at or before now and the earliest expiry after now, 0 if no other
+// entry expires. both queries only go through the expires_at index
+func Sqlite_ReadExpiredKeys(namespace string, now int64) ([]string, int64) {
+	if g_localDB == nil {
+		log.Println("Sqlite_ReadExpiredKeys: tried to read without active conn to db")
+		return nil, 0
+	}
+
+	table := Sqlite_GetTableName(namespace)
+	rows, err := g_localDB.Query(fmt.Sprintf("SELECT key FROM `%s` WHERE expires_at > 0 AND expires_at <= ?", table), now)
+	if err != nil {
+		log.Printf("Sqlite_ReadExpiredKeys: failed to fetch expired keys of namespace %s: %s\n", namespace, err.Error())
+		return nil, 0
+	}
+	defer rows.Close()
+	keys := Sqlite_ReadKeys("Sqlite_ReadExpiredKeys", rows)
+
+	var nextExpiry int64
+	err = g_localDB.QueryRow(fmt.Sprintf("SELECT COALESCE(MIN(expires_at), 0) FROM `%s` WHERE expires_at > ?", table), now).Scan(&nextExpiry)
+	if err != nil {
+		log.Printf("Sqlite_ReadExpiredKeys: failed to fetch the next expiry of namespace %s: %s\n", namespace, err.Error())
+	}
+
+	return keys, nextExpiry
+}
+
+func Sqlite_ReadKeys(caller string, rows *sql.Rows) []string {
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			log.Printf("%s: error while reading keys: %s\n", caller, err.Error())
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// the smallest string greater than every string starting with prefix, false if there is none (the prefix
+// is all 0xff bytes)
+func GetPrefixUpperBound(prefix string) (string, bool) {
+	bound := []byte(prefix)
+	for i := len(bound) - 1; i >= 0; i-- {
+		if bound[i] != 0xff {
+			bound[i]++
+			return string(bound[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// VACUUM INTO gives a consistent, compacted copy of the db without blocking writers for long
+func Sqlite_Snapshot(path string) error {
+	if g_localDB == nil {
+		return errors.New("no active conn to db")
+	}
+
+	os.Remove(path) // VACUUM INTO refuses to overwrite an existing file
+	_, err := g_localDB.Exec("VACUUM INTO ?", path)
+	return err
+}
+
+// every table that holds values, the tables of the namespaces and the change log
+func Sqlite_ListValueTables() ([]string, error) {
+	rows, err := g_localDB.Query("SELECT name FROM sqlite_master WHERE type = 'table' AND (name = ? OR name = 'KVChangeLog' OR substr(name, 1, ?) = ?) ORDER BY name", SQLITE_DEFAULT_TABLE, len(SQLITE_DEFAULT_TABLE)+1, SQLITE_DEFAULT_TABLE+"_")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := make([]string, 0)
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+
+	return tables, rows.Err()
+}
+
+// number of stored values (entries and changes) per id of the key they are encrypted with
+func Sqlite_CountRowsByKey() (map[uint32]int64, error) {
+	tables, err := Sqlite_ListValueTables()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[uint32]int64)
+	for _, table := range tables {
+		rows, err := g_localDB.Query(fmt.Sprintf("SELECT key_id, COUNT(*) FROM `%s` GROUP BY key_id", table))
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var keyID uint32
+			var count int64
+			if err := rows.Scan(&keyID, &count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			counts[keyID] += count
+		}
+		rows.Close()
+	}
+
+	return counts, nil
+}
+
+// refuses to start if the db holds values encrypted with keys that aren't loaded, they couldn't be read
+func Sqlite_CheckEncryptionKeys() {
+	counts, err := Sqlite_CountRowsByKey()
+	AssertNoError(err, "Failed to check the encryption keys of stored values")
+
+	for keyID, count := range counts {
+		if keyID == encryption.NO_KEY {
+			continue
+		}
+		if g_keyring == nil {
+			log.Fatalf("Sqlite_CheckEncryptionKeys: %d values are encrypted but no keys are loaded, start the node with -keyfile or %s\n", count, encryption.KEYS_ENV_VAR)
+		}
+		if !g_keyring.HasKey(keyID) {
+			log.Fatalf("Sqlite_CheckEncryptionKeys: %d values are encrypted with key %d which isn't in the keyring\n", count, keyID)
+		}
+	}
+}
+
+// ids of up to limit rows of the table after the row afterID that aren't encrypted with keyID, in order
+func Sqlite_FindRowsToReencrypt(table string, keyID uint32, afterID int64, limit int) ([]int64, error) {
+	rows, err := g_localDB.Query(fmt.Sprintf("SELECT rowid FROM `%s` WHERE rowid > ? AND key_id != ? ORDER BY rowid LIMIT ?", table), afterID, keyID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rowIDs := make([]int64, 0, limit)
+	for rows.Next() {
+		var rowID int64
+		if err := rows.Scan(&rowID); err != nil {
+			return nil, err
+		}
+		rowIDs = append(rowIDs, rowID)
+	}
+
+	return rowIDs, rows.Err()
+}
+
+// re-encrypts the rows with the active key. rows are read again inside the batch's transaction, so a write
+// that replaced one since it was picked isn't overwritten with its old value
+func Sqlite_ReencryptInternal(batch *SqliteBatch, table string, rowIDs []int64) bool {
+	activeKey := g_keyring.ActiveKey()
+	for _, rowID := range rowIDs {
+		var key string
+		var value []byte
+		var keyID uint32
+		err := batch.tx.QueryRow(fmt.Sprintf("SELECT key, value, key_id FROM `%s` WHERE rowid = ?", table), rowID).Scan(&key, &value, &keyID)
+		if err == sql.ErrNoRows || (err == nil && keyID == activeKey) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Sqlite_Reencrypt: failed to read row %d of %s: %s\n", rowID, table, err.Error())
+			return false
+		}
+
+		plaintext, err := g_keyring.Decrypt(value, keyID, []byte(key))
+		if err != nil {
+			log.Printf("Sqlite_Reencrypt: failed to decrypt key=%s in %s: %s\n", key, table, err.Error())
+			return false
+		}
+
+		value, keyID = g_keyring.Encrypt(plaintext, []byte(key))
+		_, err = batch.tx.Exec(fmt.Sprintf("UPDATE `%s` SET value = ?, key_id = ? WHERE rowid = ?", table), value, keyID, rowID)
+		if err != nil {
+			log.Printf("Sqlite_Reencrypt: failed to update key=%s in %s: %s\n", key, table, err.Error())
+			return false
+		}
+	}
+
+	return true
+}
+
+// moves everything in the WAL into the db file and truncates it, so rewritten values don't linger there
+func Sqlite_Checkpoint() error {
+	_, err := g_localDB.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	return err
+}
+
+func Sqlite_Delete(namespace string, key string) bool {
 	if g_localDB == nil {
 		log.Println("Sqlite_Delete: tried to delete without active conn to db")
 		return false
@@ -235,31 +666,320 @@ func Sqlite_Delete(key string) bool {
 		return false
 	}
 
-	Sqlite_NewJob(DBEntry{Key: key, Value: ""}, SQLITE_DELETE)
-
-	return true
+	return Sqlite_NewJob(DBEntry{Namespace: namespace, Key: key, Value: ""}, SQLITE_DELETE)
 }
 
-func Sqlite_DeleteInternal(key string) bool {
+func Sqlite_DeleteAndWait(namespace string, key string) bool {
 	if g_localDB == nil {
-		log.Println("Sqlite_Delete: tried to delete without active conn to db")
+		log.Println("Sqlite_DeleteAndWait: tried to delete without active conn to db")
+		return false
+	}
+
+	if len(key) == 0 {
+		log.Println("Sqlite_DeleteAndWait: tried to delete entry with empty key")
+		return false
+	}
+
+	done := make(chan bool, 1)
+	err := g_sqlJobExecutor.QueueJob(SqliteJob{entry: DBEntry{Namespace: namespace, Key: key, Value: ""}, jobType: SQLITE_DELETE, createdAt: time.Now().Unix(), done: done})
+	if err != nil {
+		log.Printf("Sqlite_DeleteAndWait: failed to queue delete for key=%s: %s\n", key, err.Error())
+		g_sqlJobExecutor.RecordRejectedJob()
 		return false
 	}
 
+	return Sqlite_WaitForJob(done, "Sqlite_DeleteAndWait", key)
+}
+
+// op is CHANGE_OP_DELETE, or CHANGE_OP_DROP if the key only moved to other replicas
+func Sqlite_DeleteInternal(batch *SqliteBatch, namespace string, key string, op DBChangeOp) bool {
 	if len(key) == 0 {
 		log.Println("Sqlite_Delete: tried to delete entry with empty key")
 		return false
 	}
 
-	_, err := g_localDB.Exec("DELETE FROM KVStore WHERE key = ?", key)
+	statements, err := batch.GetTableStatements(namespace)
+	if err != nil {
+		log.Printf("Sqlite_Delete: Failed to prepare statements for namespace %s: %s\n", namespace, err.Error())
+		return false
+	}
+
+	_, err = statements.deleteStmt.Exec(key)
 	if err != nil {
 		log.Printf("Sqlite_Delete: error deleting %s from db - %s\n", key, err.Error())
 		return false
 	}
 
+	return Sqlite_AppendChange(batch, op, DBEntry{Namespace: namespace, Key: key, Value: ""}, SqliteValueEncoding{}, time.Now().UnixMilli())
+}
+
+// records a change as part of the batch's transaction, so the log never disagrees with KVStore
+func Sqlite_AppendChange(batch *SqliteBatch, op DBChangeOp, entry DBEntry, encoding SqliteValueEncoding, timestamp int64) bool {
+	_, err := batch.appendChangeStmt.Exec(op, entry.Key, []byte(entry.Value), timestamp, entry.Namespace, entry.Parts, encoding.codec, encoding.keyID, entry.ExpiresAt, entry.Flags, entry.ContentType)
+	if err != nil {
+		log.Printf("Sqlite_AppendChange: Failed to log change for key=%s: %s\n", entry.Key, err.Error())
+		return false
+	}
+
 	return true
 }
 
-func Sqlite_NewJob(entry DBEntry, jobType SqliteJobType) {
-	g_sqlJobExecutor.QueueJob(SqliteJob{entry: entry, jobType: jobType, createdAt: time.Now().Unix()})
+// returns up to limit changes to the namespace with a sequence number greater than since, oldest first.
+// seqs are shared by every namespace, so the changes of one namespace can skip some
+func Sqlite_ReadChanges(namespace string, since int64, limit int) []DBChange {
+	if g_localDB == nil {
+		log.Println("Sqlite_ReadChanges: tried to read without active conn to db")
+		return nil
+	}
+
+	rows, err := g_localDB.Query("SELECT seq, op, key, value, timestamp, parts, compression, key_id, expires_at, flags, content_type FROM KVChangeLog WHERE seq > ? AND namespace = ? ORDER BY seq LIMIT ?", since, namespace, limit)
+	if err != nil {
+		log.Printf("Sqlite_ReadChanges: failed to fetch changes from database: %s\n", err.Error())
+		return nil
+	}
+	defer rows.Close()
+
+	changes := make([]DBChange, 0)
+	for rows.Next() {
+		var change DBChange
+		var encoding SqliteValueEncoding
+		err := rows.Scan(&change.Seq, &change.Op, &change.Key, &change.Value, &change.Timestamp, &change.Parts, &encoding.codec, &encoding.keyID, &change.ExpiresAt, &change.Flags, &change.ContentType)
+		if err == nil {
+			err = Sqlite_DecodeValue(change.Key, &change.Value, encoding)
+		}
+		if err != nil {
+			log.Printf("Sqlite_ReadChanges: error while reading change: %s\n", err.Error())
+			continue
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// returns the smallest sequence number still retained in the change log. once everything was trimmed it's
+// the seq the next change will get, so readers can still tell that they missed the trimmed ones
+func Sqlite_OldestChangeSeq() int64 {
+	if g_localDB == nil {
+		log.Println("Sqlite_OldestChangeSeq: tried to read without active conn to db")
+		return 0
+	}
+
+	var seq sql.NullInt64
+	err := g_localDB.QueryRow("SELECT MIN(seq) FROM KVChangeLog").Scan(&seq)
+	if err != nil {
+		log.Printf("Sqlite_OldestChangeSeq: failed to query change log: %s\n", err.Error())
+		return 0
+	}
+	if seq.Valid {
+		return seq.Int64
+	}
+
+	var trimmedThrough int64
+	err = g_localDB.QueryRow("SELECT value FROM KVChangeLogState WHERE name = ?", SQLITE_TRIMMED_THROUGH).Scan(&trimmedThrough)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Sqlite_OldestChangeSeq: failed to query change log state: %s\n", err.Error())
+		return 0
+	}
+
+	return trimmedThrough + 1
+}
+
+// returns the sequence number of the last change ever committed, trimming the log doesn't reset it
+func Sqlite_LatestChangeSeq() int64 {
+	if g_localDB == nil {
+		log.Println("Sqlite_LatestChangeSeq: tried to read without active conn to db")
+		return 0
+	}
+
+	var seq sql.NullInt64
+	err := g_localDB.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = 'KVChangeLog'").Scan(&seq)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Sqlite_LatestChangeSeq: failed to query change log: %s\n", err.Error())
+		return 0
+	}
+
+	return seq.Int64
+}
+
+func Sqlite_TrimChangeLog() {
+	if g_localDB == nil {
+		log.Println("Sqlite_TrimChangeLog: tried to trim without active conn to db")
+		return
+	}
+
+	Sqlite_NewJob(DBEntry{}, SQLITE_TRIM_CHANGE_LOG)
+}
+
+// cutoff is a unix timestamp in seconds, every change committed before it is dropped
+func Sqlite_TrimChangeLogInternal(batch *SqliteBatch, cutoff int64) bool {
+	var trimmedThrough sql.NullInt64
+	err := batch.tx.QueryRow("SELECT MAX(seq) FROM KVChangeLog WHERE timestamp < ?", cutoff*1000).Scan(&trimmedThrough)
+	if err != nil {
+		log.Printf("Sqlite_TrimChangeLog: failed to query change log: %s\n", err.Error())
+		return false
+	}
+	if !trimmedThrough.Valid {
+		return true // nothing to trim
+	}
+
+	_, err = batch.tx.Exec("INSERT INTO KVChangeLogState (name, value) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET value = MAX(value, excluded.value)", SQLITE_TRIMMED_THROUGH, trimmedThrough.Int64)
+	if err != nil {
+		log.Printf("Sqlite_TrimChangeLog: failed to record trimmed seq: %s\n", err.Error())
+		return false
+	}
+
+	res, err := batch.tx.Exec("DELETE FROM KVChangeLog WHERE seq <= ?", trimmedThrough.Int64)
+	if err != nil {
+		log.Printf("Sqlite_TrimChangeLog: failed to trim change log: %s\n", err.Error())
+		return false
+	}
+
+	if trimmed, err := res.RowsAffected(); err == nil && trimmed > 0 {
+		log.Printf("Sqlite_TrimChangeLog: trimmed %d changes older than %d\n", trimmed, cutoff)
+	}
+
+	return true
+}
+
+// SqliteEngine is the default StorageEngine, writes go through g_sqlJobExecutor
+type SqliteEngine struct {
+	namespace string
+}
+
+func MakeSqliteEngine(namespace string) *SqliteEngine {
+	return &SqliteEngine{namespace: namespace}
+}
+
+func (engine *SqliteEngine) Open() bool {
+	if !Sqlite_Connect() {
+		return false
+	}
+
+	if engine.namespace == DEFAULT_NAMESPACE {
+		return true // created or migrated while connecting
+	}
+
+	table := Sqlite_GetTableName(engine.namespace)
+	err := Sqlite_CreateTable(table)
+	if err == nil {
+		err = Sqlite_MigrateTable(table)
+	}
+	if err != nil {
+		log.Printf("SqliteEngine.Open: failed to create table for namespace %s: %s\n", engine.namespace, err.Error())
+		return false
+	}
+
+	return true
+}
+
+func (engine *SqliteEngine) Get(key string) *DBEntry {
+	return Sqlite_Read(engine.namespace, key)
+}
+
+func (engine *SqliteEngine) Put(entry DBEntry) bool {
+	entry.Namespace = engine.namespace
+	return Sqlite_Write(entry)
+}
+
+func (engine *SqliteEngine) PutDurable(entry DBEntry) bool {
+	entry.Namespace = engine.namespace
+	return Sqlite_WriteAndWait(entry)
+}
+
+func (engine *SqliteEngine) Delete(key string) bool {
+	return Sqlite_Delete(engine.namespace, key)
+}
+
+func (engine *SqliteEngine) DeleteDurable(key string) bool {
+	return Sqlite_DeleteAndWait(engine.namespace, key)
+}
+
+func (engine *SqliteEngine) Drop(key string) bool {
+	if len(key) == 0 {
+		log.Println("SqliteEngine.Drop: tried to drop entry with empty key")
+		return false
+	}
+	return Sqlite_NewJob(DBEntry{Namespace: engine.namespace, Key: key, Value: ""}, SQLITE_DROP)
+}
+
+func (engine *SqliteEngine) Scan(prefix string) *DBChunk {
+	return Sqlite_Scan(engine.namespace, prefix)
+}
+
+func (engine *SqliteEngine) ScanKeys(prefix string) []string {
+	return Sqlite_ScanKeys(engine.namespace, prefix)
+}
+
+func (engine *SqliteEngine) ExpiredKeys(now int64) ([]string, int64) {
+	return Sqlite_ReadExpiredKeys(engine.namespace, now)
+}
+
+func (engine *SqliteEngine) Snapshot(path string) error {
+	return Sqlite_Snapshot(path)
+}
+
+func (engine *SqliteEngine) Stats() StorageStats {
+	stats := StorageStats{Engine: STORAGE_ENGINE_SQLITE}
+	if g_localDB == nil {
+		return stats
+	}
+
+	table := Sqlite_GetTableName(engine.namespace)
+	if engine.namespace != DEFAULT_NAMESPACE {
+		// namespaces share the db file, so they report the bytes taken by their keys and values
+		g_localDB.QueryRow(fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(length(key) + length(value)), 0) FROM `%s`", table)).Scan(&stats.NumKeys, &stats.SizeBytes)
+		return stats
+	}
+
+	g_localDB.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM `%s`", table)).Scan(&stats.NumKeys)
+	for _, suffix := range []string{"", "-wal"} {
+		if info, err := os.Stat(g_dataDir + "/" + DBFileName + suffix); err == nil {
+			stats.SizeBytes += info.Size()
+		}
+	}
+
+	if g_sqlJobExecutor != nil {
+		writeQueueStats := g_sqlJobExecutor.Stats()
+		stats.WriteQueue = &writeQueueStats
+	}
+
+	return stats
+}
+
+func (engine *SqliteEngine) QueueDepth() int {
+	if g_sqlJobExecutor == nil {
+		return 0
+	}
+
+	return g_sqlJobExecutor.QueueDepth()
+}
+
+func (engine *SqliteEngine) ReadChanges(since int64, limit int) []DBChange {
+	return Sqlite_ReadChanges(engine.namespace, since, limit)
+}
+
+func (engine *SqliteEngine) OldestChangeSeq() int64 {
+	return Sqlite_OldestChangeSeq()
+}
+
+func (engine *SqliteEngine) LatestChangeSeq() int64 {
+	return Sqlite_LatestChangeSeq()
+}
+
+// returns false if the job executor had no room for the job
+func Sqlite_NewJob(entry DBEntry, jobType SqliteJobType) bool {
+	return Sqlite_QueueJob(SqliteJob{entry: entry, jobType: jobType, createdAt: time.Now().Unix()})
+}
+
+func Sqlite_QueueJob(job SqliteJob) bool {
+	err := g_sqlJobExecutor.QueueJob(job)
+	if err != nil {
+		log.Printf("Sqlite_QueueJob: failed to queue job for key=%s: %s\n", job.entry.Key, err.Error())
+		g_sqlJobExecutor.RecordRejectedJob()
+		return false
+	}
+
+	return true
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// StorageEngine is the local persistence layer of a node, DB_Local* functions only talk to storage through it.
+// each namespace gets its own instance, entries read back from it carry that namespace
+type StorageEngine interface {
+	Open() bool
+	Get(key string) *DBEntry
+	Put(entry DBEntry) bool
+	PutDurable(entry DBEntry) bool // like Put, but only returns once the entry is committed to storage
+	Delete(key string) bool
+	DeleteDurable(key string) bool           // like Delete, but only returns once the delete is committed to storage
+	Drop(key string) bool                    // like Delete for a key that moved to other replicas, logged as CHANGE_OP_DROP
+	Scan(prefix string) *DBChunk             // every entry whose key starts with prefix, "" scans everything
+	ScanKeys(prefix string) []string         // like Scan, without reading the values
+	ExpiredKeys(now int64) ([]string, int64) // keys expired at now (unix ms) and the next expiry after it, 0 if none
+	Snapshot(path string) error              // writes a consistent copy of the store to path
+	Stats() StorageStats
+}
+
+// ChangeLogReader is implemented by engines that keep a record of applied changes
+type ChangeLogReader interface {
+	ReadChanges(since int64, limit int) []DBChange
+	OldestChangeSeq() int64
+	LatestChangeSeq() int64
+}
+
+// QueuedStorageEngine is implemented by engines that apply writes asynchronously from a bounded queue
+type QueuedStorageEngine interface {
+	QueueDepth() int
+}
+
+type StorageStats struct {
+	Engine     string
+	NumKeys    int64
+	SizeBytes  int64            // bytes used by the store, on disk for persistent engines
+	WriteQueue *WriteQueueStats `json:",omitempty"` // only set by engines that queue writes
+}
+
+const SNAPSHOT_FORMAT_SQLITE = "sqlite"
+const SNAPSHOT_FORMAT_NDJSON = "ndjson"
+
+const STORAGE_ENGINE_SQLITE = "sqlite"
+const STORAGE_ENGINE_MEMORY = "memory"
+const STORAGE_ENGINE_LOG = "log"
+
+var g_storage StorageEngine // storage of the default namespace
+
+func MakeStorageEngine(name string, namespace string) StorageEngine {
+	switch name {
+	case STORAGE_ENGINE_SQLITE:
+		return MakeSqliteEngine(namespace)
+	case STORAGE_ENGINE_MEMORY:
+		return MakeMemoryEngine(namespace)
+	case STORAGE_ENGINE_LOG:
+		return MakeLogEngine(namespace)
+	default:
+		log.Fatalf("MakeStorageEngine: unknown storage engine '%s'\n", name)
+		return nil
+	}
+}
+
+// format of the files written by StorageEngine.Snapshot for the named engine
+func GetSnapshotFormat(engineName string) string {
+	if engineName == STORAGE_ENGINE_SQLITE {
+		return SNAPSHOT_FORMAT_SQLITE
+	}
+
+	return SNAPSHOT_FORMAT_NDJSON
+}
+
+// snapshots the storage of every namespace to path. the namespaces of sqlite are tables of one db file, so its
+// snapshot holds them all, the other engines snapshot every namespace on its own and the snapshots are
+// appended to each other (their entries carry the namespace). returns the change seq of every namespace the
+// snapshot has all changes up to
+func DB_Snapshot(path string) (map[string]int64, error) {
+	// read before the snapshot is taken so every change up to these seqs is guaranteed to be in it,
+	// replaying a few changes that already made it in is harmless
+	changeSeqs := make(map[string]int64)
+	names := g_dbNetwork.GetNamespaceNames()
+	for _, name := range names {
+		if changeLog, ok := DB_GetStorage(name).(ChangeLogReader); ok {
+			changeSeqs[name] = changeLog.LatestChangeSeq()
+		}
+	}
+
+	if err := g_storage.Snapshot(path); err != nil {
+		return nil, err
+	}
+	if GetSnapshotFormat(g_storageEngineName) == SNAPSHOT_FORMAT_SQLITE {
+		return changeSeqs, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	for _, name := range names {
+		storage := DB_GetStorage(name)
+		if name == DEFAULT_NAMESPACE || storage == nil {
+			continue
+		}
+
+		if err := AppendNamespaceSnapshot(file, storage, path+"."+name); err != nil {
+			return nil, fmt.Errorf("namespace '%s': %s", name, err.Error())
+		}
+	}
+
+	return changeSeqs, file.Sync()
+}
+
+func AppendNamespaceSnapshot(file *os.File, storage StorageEngine, path string) error {
+	defer os.Remove(path)
+	if err := storage.Snapshot(path); err != nil {
+		return err
+	}
+
+	snapshot, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	_, err = io.Copy(file, snapshot)
+	return err
+}
+
+// writes entries one JSON object per line, used as the snapshot format of engines that have no native one
+func WriteNDJSONSnapshot(path string, entries []DBEntry) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return file.Sync()
+}
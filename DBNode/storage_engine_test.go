@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+)
+
+// every engine has to behave the same for the handlers, the suite runs against each of them. the sqlite
+// engine joins in sqlite_engine_test.go when cgo is there. every test gets a namespace of its own, engines
+// that keep namespaces in one file (sqlite) start out empty that way too
+type engineFactory struct {
+	name string
+	make func(t *testing.T, namespace string) StorageEngine
+}
+
+var g_testEngines = []engineFactory{
+	{STORAGE_ENGINE_MEMORY, func(t *testing.T, namespace string) StorageEngine { return MakeMemoryEngine(namespace) }},
+	{STORAGE_ENGINE_LOG, func(t *testing.T, namespace string) StorageEngine {
+		g_dataDir = t.TempDir()
+		engine := MakeLogEngine(namespace)
+		if !engine.Open() {
+			t.Fatalf("failed to open log engine in %s", g_dataDir)
+		}
+		return engine
+	}},
+}
+
+var g_testNamespaces = 0
+
+func OpenTestLogEngine(t *testing.T, dir string) *LogEngine {
+	g_dataDir = dir
+	engine := MakeLogEngine(DEFAULT_NAMESPACE)
+	if !engine.Open() {
+		t.Fatalf("failed to open log engine in %s", dir)
+	}
+	return engine
+}
+
+func TestStorageEngines(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, engine StorageEngine, namespace string)
+	}{
+		{"PutGet", testPutGet},
+		{"Overwrite", testOverwrite},
+		{"Delete", testDelete},
+		{"Scan", testScan},
+		{"ExpiredKeys", testExpiredKeys},
+		{"EmptyKey", testEmptyKey},
+		{"Stats", testStats},
+		{"ChangeLog", testChangeLog},
+	}
+
+	for _, factory := range g_testEngines {
+		factory := factory
+		t.Run(factory.name, func(t *testing.T) {
+			for _, test := range tests {
+				test := test
+				t.Run(test.name, func(t *testing.T) {
+					g_testNamespaces++
+					namespace := fmt.Sprintf("test%d", g_testNamespaces)
+					test.run(t, factory.make(t, namespace), namespace)
+				})
+			}
+		})
+	}
+}
+
+func mustPut(t *testing.T, engine StorageEngine, entry DBEntry) {
+	t.Helper()
+	if !engine.PutDurable(entry) {
+		t.Fatalf("PutDurable(%q) failed", entry.Key)
+	}
+}
+
+func mustDelete(t *testing.T, engine StorageEngine, key string) {
+	t.Helper()
+	if !engine.DeleteDurable(key) {
+		t.Fatalf("DeleteDurable(%q) failed", key)
+	}
+}
+
+func scanKeys(engine StorageEngine, prefix string) []string {
+	keys := make([]string, 0)
+	for _, entry := range engine.Scan(prefix).Entries {
+		keys = append(keys, entry.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func equalKeys(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testPutGet(t *testing.T, engine StorageEngine, namespace string) {
+	entries := []DBEntry{
+		{Key: "plain", Value: "value"},
+		{Key: "empty", Value: ""},
+		{Key: "binary", Value: "\x00\xff\x01\n\r"},
+		{Key: "metadata", Value: "v", ExpiresAt: 1700000000000, Flags: 42, ContentType: "application/json", Parts: 3},
+		{Key: "compressible", Value: string(bytes.Repeat([]byte("abcd"), 4096))},
+	}
+	for _, entry := range entries {
+		mustPut(t, engine, entry)
+	}
+
+	for _, want := range entries {
+		got := engine.Get(want.Key)
+		if got == nil {
+			t.Fatalf("Get(%q) = nil", want.Key)
+		}
+		want.Namespace = namespace
+		if *got != want {
+			t.Errorf("Get(%q) = %+v, want %+v", want.Key, *got, want)
+		}
+	}
+
+	if got := engine.Get("missing"); got != nil {
+		t.Errorf("Get(missing) = %+v, want nil", *got)
+	}
+}
+
+func testOverwrite(t *testing.T, engine StorageEngine, namespace string) {
+	mustPut(t, engine, DBEntry{Key: "key", Value: "first", Flags: 1, ContentType: "text/plain"})
+	mustPut(t, engine, DBEntry{Key: "key", Value: "second"})
+
+	got := engine.Get("key")
+	if got == nil || got.Value != "second" || got.Flags != 0 || got.ContentType != "" {
+		t.Fatalf("Get after overwrite = %+v, want the second write without the first one's metadata", got)
+	}
+}
+
+func testDelete(t *testing.T, engine StorageEngine, namespace string) {
+	mustPut(t, engine, DBEntry{Key: "key", Value: "value"})
+	mustDelete(t, engine, "key")
+	if got := engine.Get("key"); got != nil {
+		t.Fatalf("Get after delete = %+v, want nil", *got)
+	}
+
+	// deleting a missing key isn't an error
+	mustDelete(t, engine, "missing")
+}
+
+func testScan(t *testing.T, engine StorageEngine, namespace string) {
+	for _, key := range []string{"user:1", "user:2", "users", "order:1", "über", "ü", "u", "v", "\xff\xff", "\xff\xffa"} {
+		mustPut(t, engine, DBEntry{Key: key, Value: key})
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"user:", []string{"user:1", "user:2"}},
+		{"user", []string{"user:1", "user:2", "users"}},
+		{"ü", []string{"ü", "über"}},
+		{"üb", []string{"über"}},
+		{"u", []string{"u", "user:1", "user:2", "users"}},
+		{"\xff\xff", []string{"\xff\xff", "\xff\xffa"}},
+		{"missing", []string{}},
+		{"", []string{"order:1", "u", "user:1", "user:2", "users", "v", "ü", "über", "\xff\xff", "\xff\xffa"}},
+	}
+	for _, test := range tests {
+		want := append([]string{}, test.want...)
+		sort.Strings(want)
+		if got := scanKeys(engine, test.prefix); !equalKeys(got, want) {
+			t.Errorf("Scan(%q) = %q, want %q", test.prefix, got, want)
+		}
+
+		keys := engine.ScanKeys(test.prefix)
+		sort.Strings(keys)
+		if !equalKeys(keys, want) {
+			t.Errorf("ScanKeys(%q) = %q, want %q", test.prefix, keys, want)
+		}
+	}
+}
+
+func testExpiredKeys(t *testing.T, engine StorageEngine, namespace string) {
+	if keys, nextExpiry := engine.ExpiredKeys(1000); len(keys) != 0 || nextExpiry != 0 {
+		t.Fatalf("ExpiredKeys() of an empty store = %q, %d, want nothing", keys, nextExpiry)
+	}
+
+	mustPut(t, engine, DBEntry{Key: "forever", Value: "1"})
+	mustPut(t, engine, DBEntry{Key: "expired", Value: "2", ExpiresAt: 500})
+	mustPut(t, engine, DBEntry{Key: "now", Value: "3", ExpiresAt: 1000})
+	mustPut(t, engine, DBEntry{Key: "later", Value: "4", ExpiresAt: 3000})
+	mustPut(t, engine, DBEntry{Key: "soon", Value: "5", ExpiresAt: 2000})
+
+	keys, nextExpiry := engine.ExpiredKeys(1000)
+	sort.Strings(keys)
+	if !equalKeys(keys, []string{"expired", "now"}) || nextExpiry != 2000 {
+		t.Errorf("ExpiredKeys(1000) = %q, %d, want [expired now], 2000", keys, nextExpiry)
+	}
+
+	if keys, nextExpiry := engine.ExpiredKeys(5000); len(keys) != 4 || nextExpiry != 0 {
+		t.Errorf("ExpiredKeys(5000) = %q, %d, want every key but forever and no next expiry", keys, nextExpiry)
+	}
+}
+
+func testEmptyKey(t *testing.T, engine StorageEngine, namespace string) {
+	if engine.Put(DBEntry{Key: "", Value: "value"}) {
+		t.Fatal("Put with an empty key succeeded")
+	}
+}
+
+func testStats(t *testing.T, engine StorageEngine, namespace string) {
+	mustPut(t, engine, DBEntry{Key: "a", Value: "1"})
+	mustPut(t, engine, DBEntry{Key: "b", Value: "2"})
+	mustPut(t, engine, DBEntry{Key: "a", Value: "3"})
+	mustDelete(t, engine, "b")
+
+	if stats := engine.Stats(); stats.NumKeys != 1 {
+		t.Errorf("Stats().NumKeys = %d, want 1", stats.NumKeys)
+	}
+}
+
+func testChangeLog(t *testing.T, engine StorageEngine, namespace string) {
+	reader, ok := engine.(ChangeLogReader)
+	if !ok {
+		t.Skip("engine has no change log")
+	}
+
+	since := reader.LatestChangeSeq()
+	mustPut(t, engine, DBEntry{Key: "a", Value: "1"})
+	mustPut(t, engine, DBEntry{Key: "b", Value: "2", ExpiresAt: 1700000000000, Flags: 5, ContentType: "text/plain"})
+	mustDelete(t, engine, "a")
+	if !engine.Drop("b") {
+		t.Fatal("Drop(\"b\") failed")
+	}
+	mustPut(t, engine, DBEntry{Key: "c", Value: "3"}) // queued engines apply the drop before this returns
+
+	changes := reader.ReadChanges(since, 100)
+	if len(changes) != 5 {
+		t.Fatalf("ReadChanges returned %d changes, want 5: %+v", len(changes), changes)
+	}
+	wantOps := []DBChangeOp{CHANGE_OP_WRITE, CHANGE_OP_WRITE, CHANGE_OP_DELETE, CHANGE_OP_DROP, CHANGE_OP_WRITE}
+	wantKeys := []string{"a", "b", "a", "b", "c"}
+	for i, change := range changes {
+		if change.Op != wantOps[i] || change.Key != wantKeys[i] {
+			t.Errorf("change %d = %+v, want op %d on %q", i, change, wantOps[i], wantKeys[i])
+		}
+		if i > 0 && change.Seq <= changes[i-1].Seq {
+			t.Errorf("change seqs aren't increasing: %d after %d", change.Seq, changes[i-1].Seq)
+		}
+	}
+	if write := changes[1]; write.Value != "2" || write.ExpiresAt != 1700000000000 || write.Flags != 5 || write.ContentType != "text/plain" {
+		t.Errorf("write of b = %+v, want its value and metadata", write)
+	}
+
+	if got := scanKeys(engine, ""); !equalKeys(got, []string{"c"}) {
+		t.Errorf("keys after the delete and drop = %v, want [c]", got)
+	}
+
+	if latest := reader.LatestChangeSeq(); latest != changes[4].Seq {
+		t.Errorf("LatestChangeSeq() = %d, want %d", latest, changes[4].Seq)
+	}
+	if limited := reader.ReadChanges(since, 2); len(limited) != 2 {
+		t.Errorf("ReadChanges with limit 2 returned %d changes", len(limited))
+	}
+	if oldest := reader.OldestChangeSeq(); oldest > changes[0].Seq {
+		t.Errorf("OldestChangeSeq() = %d, want at most %d", oldest, changes[0].Seq)
+	}
+}
+
+func TestLogEngineReplay(t *testing.T) {
+	dir := t.TempDir()
+	engine := OpenTestLogEngine(t, dir)
+	mustPut(t, engine, DBEntry{Key: "kept", Value: "value", Flags: 7})
+	mustPut(t, engine, DBEntry{Key: "deleted", Value: "value"})
+	mustDelete(t, engine, "deleted")
+	latest := engine.LatestChangeSeq()
+
+	reopened := OpenTestLogEngine(t, dir)
+	if got := reopened.Get("kept"); got == nil || got.Value != "value" || got.Flags != 7 {
+		t.Errorf("Get(kept) after replay = %+v", got)
+	}
+	if got := reopened.Get("deleted"); got != nil {
+		t.Errorf("Get(deleted) after replay = %+v, want nil", *got)
+	}
+	if got := reopened.LatestChangeSeq(); got != latest {
+		t.Errorf("LatestChangeSeq() after replay = %d, want %d", got, latest)
+	}
+}
+
+func TestLogEngineTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	engine := OpenTestLogEngine(t, dir)
+	mustPut(t, engine, DBEntry{Key: "key", Value: "value"})
+	size := engine.Stats().SizeBytes
+
+	// half a record, as if the node died while appending
+	record := LogRecord{seq: engine.LatestChangeSeq() + 1, op: CHANGE_OP_WRITE, key: "torn", value: "value"}
+	file, err := os.OpenFile(engine.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(record.Encode()[:LOG_RECORD_HEADER_SIZE+2])
+	file.Close()
+
+	reopened := OpenTestLogEngine(t, dir)
+	if got := reopened.Stats().SizeBytes; got != size {
+		t.Errorf("log is %d bytes after replay, want the torn record truncated to %d", got, size)
+	}
+	if got := reopened.Get("key"); got == nil || got.Value != "value" {
+		t.Errorf("Get(key) after replay = %+v", got)
+	}
+	if got := reopened.Get("torn"); got != nil {
+		t.Errorf("Get(torn) after replay = %+v, want nil", *got)
+	}
+}
+
+func TestReadLogRecordBoundsLengths(t *testing.T) {
+	record := LogRecord{seq: 1, op: CHANGE_OP_WRITE, key: "key", value: "value"}
+	encoded := record.Encode()
+
+	decoded, length, err := ReadLogRecord(bytes.NewReader(encoded))
+	if err != nil || length != int64(len(encoded)) || decoded.key != "key" || decoded.value != "value" {
+		t.Fatalf("ReadLogRecord = %+v, %d, %v", decoded, length, err)
+	}
+
+	tests := []struct {
+		name     string
+		keyLen   uint32
+		valueLen uint32
+	}{
+		{"huge key", 0xffffffff, 5},
+		{"huge value", 3, 0xffffffff},
+		{"key over the limit", LOG_RECORD_MAX_KEY_SIZE + 1, 5},
+	}
+	for _, test := range tests {
+		corrupt := append([]byte{}, encoded...)
+		binary.LittleEndian.PutUint32(corrupt[21:], test.keyLen)
+		binary.LittleEndian.PutUint32(corrupt[25:], test.valueLen)
+		if _, _, err := ReadLogRecord(bytes.NewReader(corrupt)); err != ErrCorruptLogRecord {
+			t.Errorf("%s: ReadLogRecord error = %v, want ErrCorruptLogRecord", test.name, err)
+		}
+	}
+
+	flipped := append([]byte{}, encoded...)
+	flipped[len(flipped)-1] ^= 0x01
+	if _, _, err := ReadLogRecord(bytes.NewReader(flipped)); err != ErrCorruptLogRecord {
+		t.Errorf("flipped value byte: ReadLogRecord error = %v, want ErrCorruptLogRecord", err)
+	}
+}
+
+func TestLogEngineCompaction(t *testing.T) {
+	dir := t.TempDir()
+	engine := OpenTestLogEngine(t, dir)
+	for i := 0; i < 10; i++ {
+		mustPut(t, engine, DBEntry{Key: "overwritten", Value: string(rune('a' + i))})
+	}
+	mustPut(t, engine, DBEntry{Key: "kept", Value: "value", ExpiresAt: 1700000000000, ContentType: "text/plain"})
+	mustPut(t, engine, DBEntry{Key: "deleted", Value: "value"})
+	mustDelete(t, engine, "deleted")
+	compactedThrough := engine.LatestChangeSeq()
+	size := engine.Stats().SizeBytes
+
+	engine.Compact()
+
+	if got := engine.Stats().SizeBytes; got >= size {
+		t.Errorf("log is %d bytes after compaction, was %d", got, size)
+	}
+	if got := engine.Get("overwritten"); got == nil || got.Value != "j" {
+		t.Errorf("Get(overwritten) after compaction = %+v", got)
+	}
+	if got := engine.Get("kept"); got == nil || got.ExpiresAt != 1700000000000 || got.ContentType != "text/plain" {
+		t.Errorf("Get(kept) after compaction = %+v", got)
+	}
+	if got := engine.Get("deleted"); got != nil {
+		t.Errorf("Get(deleted) after compaction = %+v, want nil", *got)
+	}
+
+	// the delete is gone from the log, readers from before it have to be told they missed changes
+	if oldest := engine.OldestChangeSeq(); oldest != compactedThrough+1 {
+		t.Errorf("OldestChangeSeq() after compaction = %d, want %d", oldest, compactedThrough+1)
+	}
+
+	mustPut(t, engine, DBEntry{Key: "after", Value: "value"})
+	mustDelete(t, engine, "kept")
+	if latest := engine.LatestChangeSeq(); latest != compactedThrough+2 {
+		t.Errorf("LatestChangeSeq() = %d, want seqs to continue at %d", latest, compactedThrough+2)
+	}
+	changes := engine.ReadChanges(compactedThrough, 100)
+	if len(changes) != 2 || changes[0].Key != "after" || changes[1].Op != CHANGE_OP_DELETE || changes[1].Key != "kept" {
+		t.Errorf("ReadChanges after compaction = %+v, want the write of after and the delete of kept", changes)
+	}
+	for _, change := range engine.ReadChanges(0, 100) {
+		if change.Op == LOG_RECORD_OP_COMPACTED {
+			t.Errorf("ReadChanges returned the compaction marker: %+v", change)
+		}
+	}
+
+	reopened := OpenTestLogEngine(t, dir)
+	if oldest := reopened.OldestChangeSeq(); oldest != compactedThrough+1 {
+		t.Errorf("OldestChangeSeq() after replay = %d, want %d", oldest, compactedThrough+1)
+	}
+	if got := scanKeys(reopened, ""); !equalKeys(got, []string{"after", "overwritten"}) {
+		t.Errorf("keys after replay = %q", got)
+	}
+}
+
+func TestGetPrefixUpperBound(t *testing.T) {
+	tests := []struct {
+		prefix string
+		bound  string
+		found  bool
+	}{
+		{"abc", "abd", true},
+		{"ü", "\xc3\xbd", true},
+		{"a\xff", "b", true},
+		{"\xff\xff", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		bound, found := GetPrefixUpperBound(test.prefix)
+		if bound != test.bound || found != test.found {
+			t.Errorf("GetPrefixUpperBound(%q) = %q, %t, want %q, %t", test.prefix, bound, found, test.bound, test.found)
+		}
+	}
+}
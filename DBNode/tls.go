@@ -0,0 +1,80 @@
+package main
+
+import (
+	"DBCommon/clustertls"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// with -tlscert/-tlskey/-tlsca (or -tlsdev) set, every listener of the node uses TLS. the node presents its
+// certificate on every call to other nodes and the controller, /internal/* and the binary protocol only
+// accept peers presenting a certificate issued by the cluster CA
+
+const INTERNAL_ROUTE_PREFIX = "/internal/"
+
+var g_tlsOptions clustertls.Options
+var g_tls *clustertls.Config // nil if TLS is off
+
+func TLS_Setup() {
+	config, err := clustertls.Load(g_tlsOptions)
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %s\n", err.Error())
+	}
+	if config == nil {
+		return
+	}
+
+	if !strings.HasPrefix(g_controllerAddr, "https://") {
+		log.Fatalf("TLS is on but the controller address %s isn't https\n", g_controllerAddr)
+	}
+
+	g_tls = config
+	g_rpc.SetTLSConfig(config.Client)
+	log.Println("TLS_Setup: serving over TLS, internal routes need a certificate issued by the cluster CA")
+}
+
+// only other processes of the cluster may call /internal/* routes when TLS is on
+func TLS_RequireClusterPeer(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if strings.HasPrefix(request.URL.Path, INTERNAL_ROUTE_PREFIX) && !clustertls.IsClusterPeer(request.TLS) {
+			log.Printf("[%s]: Rejected a request for %s without a cluster certificate\n", request.RemoteAddr, request.URL.Path)
+			http.Error(response, "Internal routes need a certificate issued by the cluster CA", http.StatusForbidden)
+			return
+		}
+
+		handler.ServeHTTP(response, request)
+	})
+}
+
+func TLS_ListenAndServe() error {
+	addr := fmt.Sprintf(":%d", g_listenPort)
+	if g_tls == nil {
+		return http.ListenAndServe(addr, nil)
+	}
+
+	server := &http.Server{Addr: addr, Handler: TLS_RequireClusterPeer(http.DefaultServeMux), TLSConfig: g_tls.Server}
+	return server.ListenAndServeTLS("", "")
+}
+
+// wraps the listener in TLS if it's on, internal listeners refuse peers without a cluster certificate
+func TLS_WrapListener(listener net.Listener, internal bool) net.Listener {
+	if g_tls == nil {
+		return listener
+	}
+	if internal {
+		return tls.NewListener(listener, g_tls.InternalServer())
+	}
+	return tls.NewListener(listener, g_tls.Server)
+}
+
+// the config binary protocol connections to other nodes are made with, nil if TLS is off
+func TLS_GetClientConfig() *tls.Config {
+	if g_tls == nil {
+		return nil
+	}
+	return g_tls.Client
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"DBCommon/placement"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"strings"
+	"sync"
+)
+
+// values larger than the part threshold are split into parts of the part size, stored as entries of their
+// own under keys derived from the key of the value. the entry of the key itself only holds a manifest
+// (with Parts set to the number of parts), which is written once all the parts are stored. parts hash
+// like their key, so they are stored on the same replicas and move with it when the network changes.
+// every write uses a new write id in the part keys, the parts of an overwritten or deleted value are left
+// behind and cleaned up by the expiry loop
+
+const VALUE_PART_SEPARATOR = placement.VALUE_PART_SEPARATOR
+
+type DBValueManifest struct {
+	WriteID  string // identifies the write the parts belong to
+	Size     int    // size of the whole value in bytes
+	Checksum uint32 // crc32 (IEEE) of the whole value
+}
+
+// parts found without a matching manifest on the last sweep, by namespace. only the expiry loop uses it
+var g_orphanPartSuspects = make(map[string]map[string]bool)
+
+func GetValuePartKey(key string, writeID string, index int) string {
+	return fmt.Sprintf("%s%s%s.%d", key, VALUE_PART_SEPARATOR, writeID, index)
+}
+
+func IsValuePartKey(key string) bool {
+	return strings.Contains(key, VALUE_PART_SEPARATOR)
+}
+
+// the key of the value a part belongs to and the write id of the part
+func ParseValuePartKey(key string) (string, string) {
+	parentKey, suffix, _ := strings.Cut(key, VALUE_PART_SEPARATOR)
+	writeID, _, _ := strings.Cut(suffix, ".")
+	return parentKey, writeID
+}
+
+func ShouldSplitValue(entry DBEntry) bool {
+	return entry.Parts == 0 && uint64(len(entry.Value)) > g_valuePartThreshold && !IsValuePartKey(entry.Key)
+}
+
+// the parts of the value of the entry and the manifest entry that replaces it
+func SplitValue(entry DBEntry) ([]DBEntry, DBEntry) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	writeID := hex.EncodeToString(id)
+
+	partSize := int(g_valuePartSize)
+	parts := make([]DBEntry, 0, (len(entry.Value)+partSize-1)/partSize)
+	for offset := 0; offset < len(entry.Value); offset += partSize {
+		end := offset + partSize
+		if end > len(entry.Value) {
+			end = len(entry.Value)
+		}
+		parts = append(parts, DBEntry{Namespace: entry.Namespace, Key: GetValuePartKey(entry.Key, writeID, len(parts)), Value: entry.Value[offset:end], ExpiresAt: entry.ExpiresAt})
+	}
+
+	manifest, _ := json.Marshal(DBValueManifest{WriteID: writeID, Size: len(entry.Value), Checksum: crc32.ChecksumIEEE([]byte(entry.Value))})
+	entry.Value = string(manifest)
+	entry.Parts = uint32(len(parts))
+	return parts, entry
+}
+
+// stores the parts of the value with requiredAcks each, then the manifest. returns the acks of the manifest,
+// or of the first part that didn't get enough of them (the manifest isn't written then)
+func DB_WriteSplit(data DBEntry, requiredAcks int) int {
+	parts, manifest := SplitValue(data)
+	log.Printf("DB_WriteSplit: storing %d bytes of key=%s as %d parts\n", len(data.Value), data.Key, len(parts))
+
+	results := make(chan int, len(parts))
+	for _, part := range parts {
+		go func(part DBEntry) { results <- DB_WriteDurable(part, requiredAcks) }(part)
+	}
+
+	for range parts {
+		if acks := <-results; acks < requiredAcks {
+			log.Printf("DB_WriteSplit: a part of key=%s was committed on %d of %d required replicas, not writing the manifest\n", data.Key, acks, requiredAcks)
+			return acks
+		}
+	}
+
+	return DB_WriteDurable(manifest, requiredAcks)
+}
+
+// reads the parts of a split value and returns the whole value
+func DB_ReadValueParts(entry *DBEntry) (string, error) {
+	var manifest DBValueManifest
+	if err := json.Unmarshal([]byte(entry.Value), &manifest); err != nil {
+		return "", fmt.Errorf("invalid manifest: %s", err.Error())
+	}
+
+	parts := make([]*DBEntry, entry.Parts)
+	var wg sync.WaitGroup
+	for i := range parts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			parts[i] = DB_ReadEntry(entry.Namespace, GetValuePartKey(entry.Key, manifest.WriteID, i))
+		}(i)
+	}
+	wg.Wait()
+
+	var builder strings.Builder
+	builder.Grow(manifest.Size)
+	for i, part := range parts {
+		if part == nil {
+			return "", fmt.Errorf("part %d of %d is missing", i, len(parts))
+		}
+		builder.WriteString(part.Value)
+	}
+
+	value := builder.String()
+	if len(value) != manifest.Size || crc32.ChecksumIEEE([]byte(value)) != manifest.Checksum {
+		return "", fmt.Errorf("parts don't match the manifest (%d of %d bytes)", len(value), manifest.Size)
+	}
+	return value, nil
+}
+
+// puts a split value back together, other entries are returned as they are. a value that can't be put
+// back together is treated as missing
+func DB_AssembleValue(entry *DBEntry) *DBEntry {
+	if entry == nil || entry.Parts == 0 {
+		return entry
+	}
+
+	value, err := DB_ReadValueParts(entry)
+	if err != nil {
+		// the key may have been overwritten since the manifest was read, the parts of the old value go away with it
+		log.Printf("DB_AssembleValue: failed to read key=%s (%s), reading the manifest again\n", entry.Key, err.Error())
+		entry = DB_ReadEntry(entry.Namespace, entry.Key)
+		if entry == nil || entry.Parts == 0 {
+			return entry
+		}
+
+		value, err = DB_ReadValueParts(entry)
+		if err != nil {
+			log.Printf("DB_AssembleValue: failed to read key=%s: %s\n", entry.Key, err.Error())
+			return nil
+		}
+	}
+
+	assembled := *entry
+	assembled.Value = value
+	assembled.Parts = 0
+	return &assembled
+}
+
+// the write id in the manifest of the entry, empty if it isn't split
+func GetManifestWriteID(entry *DBEntry) string {
+	if entry == nil || entry.Parts == 0 || entry.IsExpired() {
+		return ""
+	}
+
+	var manifest DBValueManifest
+	json.Unmarshal([]byte(entry.Value), &manifest)
+	return manifest.WriteID
+}
+
+// deletes local parts that the manifest of their key doesn't point at anymore, returns how many were
+// deleted. parts are stored before their manifest, so a part is only deleted once it was found without
+// one on two sweeps in a row
+func ValueParts_SweepOrphans(namespace string, storage StorageEngine, keys []string) int {
+	suspects := make(map[string]bool)
+	writeIDs := make(map[string]string) // key -> write id of its manifest
+	deleted := 0
+	for _, key := range keys {
+		if !IsValuePartKey(key) {
+			continue
+		}
+
+		parentKey, writeID := ParseValuePartKey(key)
+		currentID, found := writeIDs[parentKey]
+		if !found {
+			currentID = GetManifestWriteID(storage.Get(parentKey))
+			writeIDs[parentKey] = currentID
+		}
+		if currentID == writeID {
+			continue
+		}
+
+		if g_orphanPartSuspects[namespace][key] {
+			storage.Delete(key)
+			deleted++
+		} else {
+			suspects[key] = true
+		}
+	}
+
+	g_orphanPartSuspects[namespace] = suspects
+	return deleted
+}